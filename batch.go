@@ -0,0 +1,34 @@
+package kvstore
+
+// WriteBatch collects Put and Delete operations in memory so they can be
+// applied to a Store atomically with Store.Write
+//
+// A WriteBatch is not safe for concurrent use
+type WriteBatch struct {
+	entries []*Entry
+}
+
+// NewWriteBatch creates an empty batch
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// Put queues a set of key to value
+func (b *WriteBatch) Put(key string, value []byte) {
+	b.entries = append(b.entries, NewSetEntry(key, value))
+}
+
+// Delete queues a removal of key
+func (b *WriteBatch) Delete(key string) {
+	b.entries = append(b.entries, NewDeleteEntry(key))
+}
+
+// Len returns the number of queued operations
+func (b *WriteBatch) Len() int {
+	return len(b.entries)
+}
+
+// Reset discards all queued operations so the batch can be reused
+func (b *WriteBatch) Reset() {
+	b.entries = b.entries[:0]
+}
@@ -0,0 +1,210 @@
+package kvstore
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+// TestBatchWriteApplies tests that all batch operations are applied
+func TestBatchWriteApplies(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.Set("old", []byte("value")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	batch := NewWriteBatch()
+	batch.Put("key1", []byte("value1"))
+	batch.Put("key2", []byte("value2"))
+	batch.Delete("old")
+
+	if batch.Len() != 3 {
+		t.Errorf("Expected batch length 3, got %d", batch.Len())
+	}
+
+	if err := store.Write(batch); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	if value, exists := store.Get("key1"); !exists || !bytes.Equal(value, []byte("value1")) {
+		t.Errorf("key1: got %q (exists=%v), want %q", value, exists, "value1")
+	}
+	if value, exists := store.Get("key2"); !exists || !bytes.Equal(value, []byte("value2")) {
+		t.Errorf("key2: got %q (exists=%v), want %q", value, exists, "value2")
+	}
+	if _, exists := store.Get("old"); exists {
+		t.Error("old should be deleted by batch")
+	}
+}
+
+// TestBatchOrderWithinBatch tests that later operations on the same key win
+func TestBatchOrderWithinBatch(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	batch := NewWriteBatch()
+	batch.Put("key", []byte("first"))
+	batch.Delete("key")
+	batch.Put("key", []byte("last"))
+
+	if err := store.Write(batch); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	if value, _ := store.Get("key"); !bytes.Equal(value, []byte("last")) {
+		t.Errorf("Expected %q, got %q", "last", value)
+	}
+}
+
+// TestBatchEmpty tests that an empty batch writes nothing to the WAL
+func TestBatchEmpty(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.Write(NewWriteBatch()); err != nil {
+		t.Fatalf("Write of empty batch failed: %v", err)
+	}
+
+	if size := store.wal.Size(); size != 0 {
+		t.Errorf("Expected empty WAL, got size %d", size)
+	}
+}
+
+// TestBatchFuncError tests that Batch writes nothing when fn fails
+func TestBatchFuncError(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	errAbort := errors.New("abort")
+	err = store.Batch(func(b *WriteBatch) error {
+		b.Put("key", []byte("value"))
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("Expected errAbort, got %v", err)
+	}
+
+	if _, exists := store.Get("key"); exists {
+		t.Error("key should not exist after aborted batch")
+	}
+}
+
+// TestBatchRecoveryAfterCrash tests that a batch is replayed from the WAL
+func TestBatchRecoveryAfterCrash(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store1, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	if err := store1.Set("gone", []byte("x")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	err = store1.Batch(func(b *WriteBatch) error {
+		b.Put("a", []byte("1"))
+		b.Put("b", []byte("2"))
+		b.Delete("gone")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Batch failed: %v", err)
+	}
+
+	// DON'T call Close() - simulate crash
+	simulateCrash(store1)
+
+	store2, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open (after crash) failed: %v", err)
+	}
+	defer store2.Close()
+
+	if store2.Len() != 2 {
+		t.Errorf("Expected 2 keys after recovery, got %d", store2.Len())
+	}
+	if _, exists := store2.Get("gone"); exists {
+		t.Error("gone should be deleted after recovery")
+	}
+}
+
+// TestBatchTornWrite tests that a partially written batch is not applied at all
+func TestBatchTornWrite(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store1, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	if err := store1.Set("before", []byte("ok")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	batch := NewWriteBatch()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		batch.Put(key, []byte("value-"+key))
+	}
+	if err := store1.Write(batch); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	simulateCrash(store1)
+
+	// Cut the batch entry in half to simulate a crash mid-write
+	walPath := segmentPath(dir, 1)
+	data, err := os.ReadFile(walPath)
+	if err != nil {
+		t.Fatalf("Failed to read WAL: %v", err)
+	}
+	var first bytes.Buffer
+	if err := NewSetEntry("before", []byte("ok")).Encode(&first); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	cut := first.Len() + (len(data)-first.Len())/2
+	if err := os.WriteFile(walPath, data[:cut], 0644); err != nil {
+		t.Fatalf("Failed to write torn WAL: %v", err)
+	}
+
+	store2, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open (after torn write) failed: %v", err)
+	}
+	defer store2.Close()
+
+	if store2.Len() != 1 {
+		t.Errorf("Expected only the key before the batch, got %d keys: %v", store2.Len(), store2.Keys())
+	}
+	if _, exists := store2.Get("before"); !exists {
+		t.Error("before should survive recovery")
+	}
+}
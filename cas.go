@@ -0,0 +1,42 @@
+package kvstore
+
+import "bytes"
+
+// CompareAndSwap sets key to new only if it currently exists and holds old
+// Returns true if the swap happened. The comparison and the WAL append happen
+// under the same lock, so concurrent callers observe a single winner
+func (s *Store) CompareAndSwap(key string, old, new []byte) (bool, error) {
+	return s.commit(func() (*Entry, error) {
+		current, exists := s.getLocked(key)
+		if !exists || !bytes.Equal(current, old) {
+			return nil, nil
+		}
+
+		return NewSetEntry(key, new), nil
+	})
+}
+
+// SetIfAbsent sets key to value only if key does not exist
+// Returns true if the value was stored
+func (s *Store) SetIfAbsent(key string, value []byte) (bool, error) {
+	return s.commit(func() (*Entry, error) {
+		if _, exists := s.getLocked(key); exists {
+			return nil, nil
+		}
+
+		return NewSetEntry(key, value), nil
+	})
+}
+
+// DeleteIfEquals removes key only if it currently holds value
+// Returns true if the key was deleted
+func (s *Store) DeleteIfEquals(key string, value []byte) (bool, error) {
+	return s.commit(func() (*Entry, error) {
+		current, exists := s.getLocked(key)
+		if !exists || !bytes.Equal(current, value) {
+			return nil, nil
+		}
+
+		return NewDeleteEntry(key), nil
+	})
+}
@@ -0,0 +1,211 @@
+package kvstore
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestCompareAndSwap tests swapping on matching and mismatching values
+func TestCompareAndSwap(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	// Missing key never swaps
+	swapped, err := store.CompareAndSwap("key", nil, []byte("v1"))
+	if err != nil {
+		t.Fatalf("CompareAndSwap failed: %v", err)
+	}
+	if swapped {
+		t.Error("CompareAndSwap on missing key should not swap")
+	}
+
+	store.Set("key", []byte("v1"))
+
+	swapped, err = store.CompareAndSwap("key", []byte("wrong"), []byte("v2"))
+	if err != nil {
+		t.Fatalf("CompareAndSwap failed: %v", err)
+	}
+	if swapped {
+		t.Error("CompareAndSwap with wrong old value should not swap")
+	}
+
+	swapped, err = store.CompareAndSwap("key", []byte("v1"), []byte("v2"))
+	if err != nil {
+		t.Fatalf("CompareAndSwap failed: %v", err)
+	}
+	if !swapped {
+		t.Error("CompareAndSwap with matching old value should swap")
+	}
+
+	if value, _ := store.Get("key"); string(value) != "v2" {
+		t.Errorf("Expected v2, got %q", value)
+	}
+}
+
+// TestSetIfAbsent tests that only the first set succeeds
+func TestSetIfAbsent(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	ok, err := store.SetIfAbsent("leader", []byte("node-1"))
+	if err != nil || !ok {
+		t.Fatalf("First SetIfAbsent: ok=%v err=%v", ok, err)
+	}
+
+	ok, err = store.SetIfAbsent("leader", []byte("node-2"))
+	if err != nil || ok {
+		t.Fatalf("Second SetIfAbsent: ok=%v err=%v", ok, err)
+	}
+
+	if value, _ := store.Get("leader"); string(value) != "node-1" {
+		t.Errorf("Expected node-1, got %q", value)
+	}
+}
+
+// TestDeleteIfEquals tests conditional deletion
+func TestDeleteIfEquals(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	store.Set("leader", []byte("node-1"))
+
+	ok, err := store.DeleteIfEquals("leader", []byte("node-2"))
+	if err != nil || ok {
+		t.Fatalf("DeleteIfEquals with wrong value: ok=%v err=%v", ok, err)
+	}
+	if _, exists := store.Get("leader"); !exists {
+		t.Fatal("leader should still exist")
+	}
+
+	ok, err = store.DeleteIfEquals("leader", []byte("node-1"))
+	if err != nil || !ok {
+		t.Fatalf("DeleteIfEquals with matching value: ok=%v err=%v", ok, err)
+	}
+	if _, exists := store.Get("leader"); exists {
+		t.Error("leader should be deleted")
+	}
+}
+
+// TestSetIfAbsentConcurrent tests that exactly one concurrent caller wins
+func TestSetIfAbsentConcurrent(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := OpenWithConfig(Config{DataDir: dir, SyncWrites: false})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	var winners atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			ok, err := store.SetIfAbsent("leader", fmt.Appendf(nil, "node-%d", n))
+			if err != nil {
+				t.Errorf("SetIfAbsent failed: %v", err)
+			}
+			if ok {
+				winners.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if winners.Load() != 1 {
+		t.Errorf("Expected exactly 1 winner, got %d", winners.Load())
+	}
+}
+
+// TestCompareAndSwapCounter tests that CAS loops never lose increments
+func TestCompareAndSwapCounter(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := OpenWithConfig(Config{DataDir: dir, SyncWrites: false})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	store.Set("counter", []byte("0"))
+
+	const goroutines = 10
+	const increments = 20
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				for {
+					old, _ := store.Get("counter")
+					var n int
+					fmt.Sscanf(string(old), "%d", &n)
+					ok, err := store.CompareAndSwap("counter", old, fmt.Appendf(nil, "%d", n+1))
+					if err != nil {
+						t.Errorf("CompareAndSwap failed: %v", err)
+						return
+					}
+					if ok {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	want := fmt.Sprintf("%d", goroutines*increments)
+	if value, _ := store.Get("counter"); string(value) != want {
+		t.Errorf("Expected counter %s, got %q", want, value)
+	}
+}
+
+// TestCompareAndSwapWALFailure tests that a failed append leaves memory untouched
+func TestCompareAndSwapWALFailure(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	store.Set("key", []byte("v1"))
+	store.wal.Close()
+
+	swapped, err := store.CompareAndSwap("key", []byte("v1"), []byte("v2"))
+	if err == nil {
+		t.Error("Expected error when WAL is closed, got nil")
+	}
+	if swapped {
+		t.Error("CompareAndSwap should report false on error")
+	}
+	if value, _ := store.Get("key"); string(value) != "v1" {
+		t.Errorf("Expected v1 after failed swap, got %q", value)
+	}
+}
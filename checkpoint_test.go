@@ -0,0 +1,156 @@
+package kvstore
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestCheckpointTrimsWAL tests that an on-demand checkpoint empties the WAL
+func TestCheckpointTrimsWAL(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	for i := 0; i < 50; i++ {
+		store.Set(fmt.Sprintf("key-%d", i), []byte("value"))
+	}
+	if store.wal.Size() == 0 {
+		t.Fatal("Expected WAL to contain entries before checkpoint")
+	}
+
+	if err := store.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+
+	if size := store.wal.Size(); size != 0 {
+		t.Errorf("Expected empty WAL after checkpoint, got %d bytes", size)
+	}
+	if !snapshotExists(dir) {
+		t.Error("Expected snapshot file after checkpoint")
+	}
+
+	// Writes after the checkpoint land in the WAL and survive a crash
+	store.Set("after", []byte("checkpoint"))
+	store.Delete("key-0")
+	simulateCrash(store)
+
+	store2, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open (after crash) failed: %v", err)
+	}
+	defer store2.Close()
+
+	if store2.Len() != 50 {
+		t.Errorf("Expected 50 keys after recovery, got %d", store2.Len())
+	}
+	if _, ok := store2.Get("key-0"); ok {
+		t.Error("key-0 should be deleted after recovery")
+	}
+	if value, _ := store2.Get("after"); string(value) != "checkpoint" {
+		t.Errorf("Expected after=checkpoint, got %q", value)
+	}
+}
+
+// TestCheckpointConcurrentWrites tests that writes racing a checkpoint are kept
+func TestCheckpointConcurrentWrites(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := OpenWithConfig(Config{DataDir: dir, SyncWrites: false})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	const writers = 4
+	const perWriter = 200
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				if err := store.Set(fmt.Sprintf("w%d-%d", id, i), []byte("v")); err != nil {
+					t.Errorf("Set failed: %v", err)
+				}
+			}
+		}(w)
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := store.Checkpoint(); err != nil {
+			t.Errorf("Checkpoint failed: %v", err)
+		}
+	}
+	wg.Wait()
+
+	simulateCrash(store)
+
+	store2, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open (after crash) failed: %v", err)
+	}
+	defer store2.Close()
+
+	if store2.Len() != writers*perWriter {
+		t.Errorf("Expected %d keys after recovery, got %d", writers*perWriter, store2.Len())
+	}
+}
+
+// TestCheckpointBySize tests that the WAL size threshold triggers a checkpoint
+func TestCheckpointBySize(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := OpenWithConfig(Config{DataDir: dir, SyncWrites: false, CheckpointWALBytes: 4096})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	value := make([]byte, 512)
+	for i := 0; i < 20; i++ {
+		store.Set(fmt.Sprintf("key-%d", i), value)
+	}
+
+	waitFor(t, "size-triggered checkpoint", func() bool {
+		return snapshotExists(dir) && store.wal.Size() < 4096
+	})
+}
+
+// TestCheckpointByInterval tests that the timer triggers a checkpoint
+func TestCheckpointByInterval(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := OpenWithConfig(Config{DataDir: dir, SyncWrites: false, CheckpointInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	store.Set("key", []byte("value"))
+
+	waitFor(t, "interval checkpoint", func() bool {
+		return snapshotExists(dir) && store.wal.Size() == 0
+	})
+}
+
+// waitFor polls cond until it is true or fails the test after two seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,412 @@
+// Package client is a Go client for a store served by cmd/kvserver
+//
+// Client has the same methods as kvstore.Store (Set, Get, Delete, Keys, Len,
+// Close), so code can switch between an embedded and a remote store. Each of
+// them also has a Context variant that honours cancellation and deadlines
+// and reports network errors, which the Store-shaped methods cannot return
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caresle/kvstore"
+	"github.com/caresle/kvstore/resp"
+)
+
+const (
+	defaultPoolSize    = 10
+	defaultDialTimeout = 5 * time.Second
+	defaultTimeout     = 5 * time.Second
+	defaultMaxRetries  = 2
+
+	// retryBackoff is the pause before the first retry, doubled for each
+	// further one
+	retryBackoff = 10 * time.Millisecond
+)
+
+// ErrClosed is returned when using a client after Close
+var ErrClosed = errors.New("client is closed")
+
+// A Client can stand in for an embedded store
+var _ kvstore.KV = (*Client)(nil)
+
+// Config configures a Client
+type Config struct {
+	// Addr is the host:port of the server
+	Addr string
+
+	// PoolSize is the maximum number of open connections (default: 10).
+	// Requests wait for a free connection once all of them are busy
+	PoolSize int
+
+	// DialTimeout bounds establishing a connection (default: 5s)
+	DialTimeout time.Duration
+
+	// Timeout bounds requests made through the methods without a context
+	// (default: 5s)
+	Timeout time.Duration
+
+	// MaxRetries is how often a request is retried on a new connection after
+	// a network error (default: 2, negative disables retries). The commands
+	// behind the Store methods and Pipeline are idempotent, so retrying after
+	// a lost reply is safe; keep that in mind for commands sent with Do
+	MaxRetries int
+}
+
+// Client is a pool of connections to one server, safe for concurrent use
+type Client struct {
+	config Config
+	slots  chan struct{} // one token per open or opening connection
+
+	mu     sync.Mutex
+	idle   []*conn
+	closed bool
+}
+
+// conn is a pooled connection
+type conn struct {
+	nc net.Conn
+	r  *resp.Reader
+	w  *resp.Writer
+}
+
+// Dial connects to the server at addr with the default configuration
+func Dial(addr string) (*Client, error) {
+	return DialWithConfig(Config{Addr: addr})
+}
+
+// DialWithConfig creates a client and checks that the server answers
+func DialWithConfig(config Config) (*Client, error) {
+	if config.Addr == "" {
+		return nil, errors.New("server address is required")
+	}
+	if config.PoolSize <= 0 {
+		config.PoolSize = defaultPoolSize
+	}
+	if config.DialTimeout <= 0 {
+		config.DialTimeout = defaultDialTimeout
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultTimeout
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = defaultMaxRetries
+	}
+
+	c := &Client{
+		config: config,
+		slots:  make(chan struct{}, config.PoolSize),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.DialTimeout)
+	defer cancel()
+	if _, err := c.Do(ctx, "PING"); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("failed to connect to %s: %w", config.Addr, err)
+	}
+
+	return c, nil
+}
+
+// Set stores a key-value pair
+func (c *Client) Set(key string, value []byte) error {
+	ctx, cancel := c.timeout()
+	defer cancel()
+	return c.SetContext(ctx, key, value)
+}
+
+// SetContext is Set with a context
+func (c *Client) SetContext(ctx context.Context, key string, value []byte) error {
+	_, err := c.do(ctx, []byte("SET"), []byte(key), value)
+	return err
+}
+
+// SetWithTTL stores a key-value pair that expires after ttl
+func (c *Client) SetWithTTL(key string, value []byte, ttl time.Duration) error {
+	ctx, cancel := c.timeout()
+	defer cancel()
+	return c.SetWithTTLContext(ctx, key, value, ttl)
+}
+
+// SetWithTTLContext is SetWithTTL with a context
+func (c *Client) SetWithTTLContext(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return kvstore.ErrInvalidTTL
+	}
+	_, err := c.do(ctx, setWithTTLCommand(key, value, ttl)...)
+	return err
+}
+
+// setWithTTLCommand builds a SET with a PX option. The server rejects a
+// ttl <= 0, a positive one below a millisecond is rounded up
+func setWithTTLCommand(key string, value []byte, ttl time.Duration) [][]byte {
+	ms := ttl.Milliseconds()
+	if ttl > 0 && ms == 0 {
+		ms = 1
+	}
+	return [][]byte{[]byte("SET"), []byte(key), value, []byte("PX"), []byte(strconv.FormatInt(ms, 10))}
+}
+
+// Get retrieves a value. A failed request is reported as a missing key; use
+// GetContext to tell the two apart
+func (c *Client) Get(key string) ([]byte, bool) {
+	ctx, cancel := c.timeout()
+	defer cancel()
+	value, ok, _ := c.GetContext(ctx, key)
+	return value, ok
+}
+
+// GetContext retrieves a value, reporting whether the key exists
+func (c *Client) GetContext(ctx context.Context, key string) ([]byte, bool, error) {
+	v, err := c.do(ctx, []byte("GET"), []byte(key))
+	if err != nil {
+		return nil, false, err
+	}
+	return bulk(v)
+}
+
+// Delete removes a key. Deleting a missing key is not an error
+func (c *Client) Delete(key string) error {
+	ctx, cancel := c.timeout()
+	defer cancel()
+	return c.DeleteContext(ctx, key)
+}
+
+// DeleteContext is Delete with a context
+func (c *Client) DeleteContext(ctx context.Context, key string) error {
+	_, err := c.do(ctx, []byte("DEL"), []byte(key))
+	return err
+}
+
+// Keys returns every key in ascending order, or nil if the request fails
+func (c *Client) Keys() []string {
+	ctx, cancel := c.timeout()
+	defer cancel()
+	keys, _ := c.KeysContext(ctx)
+	return keys
+}
+
+// KeysContext returns every key in ascending order
+func (c *Client) KeysContext(ctx context.Context) ([]string, error) {
+	v, err := c.do(ctx, []byte("KEYS"), []byte("*"))
+	if err != nil {
+		return nil, err
+	}
+	if v.Type != resp.TypeArray {
+		return nil, fmt.Errorf("unexpected reply to KEYS: %v", v)
+	}
+
+	keys := make([]string, len(v.Elems))
+	for i, elem := range v.Elems {
+		keys[i] = string(elem.Bytes)
+	}
+	return keys, nil
+}
+
+// Len returns the number of keys, or 0 if the request fails
+func (c *Client) Len() int {
+	ctx, cancel := c.timeout()
+	defer cancel()
+	n, _ := c.LenContext(ctx)
+	return n
+}
+
+// LenContext returns the number of keys
+func (c *Client) LenContext(ctx context.Context) (int, error) {
+	v, err := c.do(ctx, []byte("DBSIZE"))
+	if err != nil {
+		return 0, err
+	}
+	if v.Type != resp.TypeInteger {
+		return 0, fmt.Errorf("unexpected reply to DBSIZE: %v", v)
+	}
+	return int(v.Int), nil
+}
+
+// Do sends an arbitrary command and returns its reply. An error reply from
+// the server is returned as a resp.Error
+func (c *Client) Do(ctx context.Context, args ...string) (resp.Value, error) {
+	raw := make([][]byte, len(args))
+	for i, arg := range args {
+		raw[i] = []byte(arg)
+	}
+	return c.do(ctx, raw...)
+}
+
+// Close closes the idle connections and makes every later request fail with
+// ErrClosed. Connections in use are closed when their request finishes
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	var err error
+	for _, cn := range c.idle {
+		if cerr := cn.nc.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	c.idle = nil
+
+	return err
+}
+
+// timeout returns the context used by the methods without one
+func (c *Client) timeout() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), c.config.Timeout)
+}
+
+// do sends one command and returns its reply
+func (c *Client) do(ctx context.Context, args ...[]byte) (resp.Value, error) {
+	replies, err := c.exec(ctx, [][][]byte{args})
+	if err != nil {
+		return resp.Value{}, err
+	}
+	if err := replies[0].Err(); err != nil {
+		return resp.Value{}, err
+	}
+	return replies[0], nil
+}
+
+// exec sends cmds in one write and reads their replies, retrying on a new
+// connection if the connection fails
+func (c *Client) exec(ctx context.Context, cmds [][][]byte) ([]resp.Value, error) {
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		replies, err := c.tryExec(ctx, cmds)
+		if err == nil {
+			return replies, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if errors.Is(err, ErrClosed) || attempt >= c.config.MaxRetries {
+			return nil, err
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// tryExec runs cmds once on a pooled connection
+func (c *Client) tryExec(ctx context.Context, cmds [][][]byte) ([]resp.Value, error) {
+	cn, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	replies, err := cn.roundTrip(ctx, cmds)
+	c.release(cn, err != nil)
+	return replies, err
+}
+
+// acquire takes an idle connection or dials a new one, waiting while
+// PoolSize connections are in use
+func (c *Client) acquire(ctx context.Context) (*conn, error) {
+	select {
+	case c.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		<-c.slots
+		return nil, ErrClosed
+	}
+	if n := len(c.idle); n > 0 {
+		cn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return cn, nil
+	}
+	c.mu.Unlock()
+
+	dialer := net.Dialer{Timeout: c.config.DialTimeout}
+	nc, err := dialer.DialContext(ctx, "tcp", c.config.Addr)
+	if err != nil {
+		<-c.slots
+		return nil, err
+	}
+
+	return &conn{nc: nc, r: resp.NewReader(nc), w: resp.NewWriter(nc)}, nil
+}
+
+// release returns a connection to the pool. A connection whose request
+// failed may have replies in flight and is closed instead
+func (c *Client) release(cn *conn, broken bool) {
+	defer func() { <-c.slots }()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if broken || c.closed {
+		cn.nc.Close()
+		return
+	}
+	c.idle = append(c.idle, cn)
+}
+
+// roundTrip writes cmds and reads one reply per command
+// The context's deadline applies to the connection, and cancelling the
+// context interrupts a blocked read or write
+func (cn *conn) roundTrip(ctx context.Context, cmds [][][]byte) ([]resp.Value, error) {
+	deadline, _ := ctx.Deadline()
+	if err := cn.nc.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		cn.nc.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	for _, args := range cmds {
+		if err := cn.w.WriteCommand(args...); err != nil {
+			return nil, err
+		}
+	}
+	if err := cn.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	replies := make([]resp.Value, len(cmds))
+	for i := range replies {
+		v, err := cn.r.ReadValue()
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = v
+	}
+
+	return replies, nil
+}
+
+// bulk converts a GET reply into a value and whether it exists
+func bulk(v resp.Value) ([]byte, bool, error) {
+	switch v.Type {
+	case resp.TypeNull:
+		return nil, false, nil
+	case resp.TypeBulkString:
+		return v.Bytes, true, nil
+	}
+	if err := v.Err(); err != nil {
+		return nil, false, err
+	}
+	return nil, false, fmt.Errorf("unexpected reply to GET: %v", v)
+}
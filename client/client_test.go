@@ -0,0 +1,298 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caresle/kvstore"
+	"github.com/caresle/kvstore/resp"
+)
+
+// startServer serves store on addr ("127.0.0.1:0" picks a free port) and
+// returns the address and a function stopping the server
+func startServer(t *testing.T, store *kvstore.Store, addr string) (string, func()) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	server := resp.NewServer(store)
+	go server.Serve(l)
+
+	var once sync.Once
+	stop := func() { once.Do(func() { server.Close() }) }
+	t.Cleanup(stop)
+
+	return l.Addr().String(), stop
+}
+
+// openStore opens a store in a temporary directory
+func openStore(t *testing.T) *kvstore.Store {
+	t.Helper()
+
+	store, err := kvstore.OpenWithConfig(kvstore.Config{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// dialTest connects a client and closes it at the end of the test
+func dialTest(t *testing.T, config Config) *Client {
+	t.Helper()
+
+	c, err := DialWithConfig(config)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// TestClientStoreMethods tests the methods shared with Store
+func TestClientStoreMethods(t *testing.T) {
+	store := openStore(t)
+	addr, _ := startServer(t, store, "127.0.0.1:0")
+	c := dialTest(t, Config{Addr: addr})
+
+	if err := c.Set("b", []byte("2")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := c.Set("a", []byte{0, 1, '\r', '\n'}); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	if value, ok := c.Get("a"); !ok || string(value) != "\x00\x01\r\n" {
+		t.Errorf("Get a: got %q, %v", value, ok)
+	}
+	if _, ok := c.Get("missing"); ok {
+		t.Error("missing should not exist")
+	}
+	if keys := c.Keys(); len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Errorf("Expected [a b], got %v", keys)
+	}
+	if n := c.Len(); n != 2 {
+		t.Errorf("Expected 2 keys, got %d", n)
+	}
+
+	if err := c.Delete("a"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := c.Delete("a"); err != nil {
+		t.Errorf("Deleting a missing key should succeed, got %v", err)
+	}
+	if _, ok := store.Get("a"); ok {
+		t.Error("a should be deleted in the store")
+	}
+
+	if err := c.SetWithTTL("temp", []byte("x"), time.Minute); err != nil {
+		t.Fatalf("SetWithTTL failed: %v", err)
+	}
+	if ttl, ok := store.TTL("temp"); !ok || ttl > time.Minute || ttl < 50*time.Second {
+		t.Errorf("Expected a TTL of about a minute, got %v, %v", ttl, ok)
+	}
+	if err := c.SetWithTTL("temp", []byte("x"), 0); !errors.Is(err, kvstore.ErrInvalidTTL) {
+		t.Errorf("Expected ErrInvalidTTL, got %v", err)
+	}
+}
+
+// TestClientServerError tests that error replies surface as resp.Error
+func TestClientServerError(t *testing.T) {
+	store := openStore(t)
+	addr, _ := startServer(t, store, "127.0.0.1:0")
+	c := dialTest(t, Config{Addr: addr})
+
+	_, err := c.Do(context.Background(), "NOSUCH")
+	var respErr resp.Error
+	if !errors.As(err, &respErr) {
+		t.Fatalf("Expected a resp.Error, got %v", err)
+	}
+
+	// The connection stays usable
+	if err := c.Set("k", []byte("v")); err != nil {
+		t.Errorf("Set after error reply failed: %v", err)
+	}
+}
+
+// TestClientPipeline tests sending many commands in one round trip
+func TestClientPipeline(t *testing.T) {
+	store := openStore(t)
+	addr, _ := startServer(t, store, "127.0.0.1:0")
+	c := dialTest(t, Config{Addr: addr})
+
+	p := c.Pipeline()
+	for i := 0; i < 50; i++ {
+		p.Set(fmt.Sprintf("k%02d", i), []byte(fmt.Sprintf("v%d", i)))
+	}
+	p.Get("k07")
+	p.Get("missing")
+	p.Delete("k00")
+	p.SetWithTTL("bad", []byte("x"), 0)
+
+	results, err := p.Exec(context.Background())
+	if err != nil {
+		t.Fatalf("Exec failed: %v", err)
+	}
+	if len(results) != 54 || p.Len() != 0 {
+		t.Fatalf("Expected 54 results and an empty pipeline, got %d and %d", len(results), p.Len())
+	}
+	if r := results[50]; !r.Found || string(r.Value) != "v7" {
+		t.Errorf("Get k07: got %+v", r)
+	}
+	if r := results[51]; r.Found || r.Err != nil {
+		t.Errorf("Get missing: got %+v", r)
+	}
+	if r := results[53]; r.Err == nil {
+		t.Error("SetWithTTL with a zero TTL should fail")
+	}
+	if store.Len() != 49 {
+		t.Errorf("Expected 49 keys, got %d", store.Len())
+	}
+}
+
+// TestClientContextDeadline tests that a request to an unresponsive server
+// fails with the context's error
+func TestClientContextDeadline(t *testing.T) {
+	store := openStore(t)
+	addr, _ := startServer(t, store, "127.0.0.1:0")
+	c := dialTest(t, Config{Addr: addr})
+
+	// A listener that accepts connections but never answers
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			nc, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			// Swallow requests until the client hangs up
+			go func() {
+				io.Copy(io.Discard, nc)
+				nc.Close()
+			}()
+		}
+	}()
+
+	slow := &Client{config: c.config, slots: make(chan struct{}, 1)}
+	slow.config.Addr = silent.Addr().String()
+	defer slow.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, _, err := slow.GetContext(ctx, "k"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Request should give up at the deadline, took %v", elapsed)
+	}
+
+	// Cancellation interrupts a blocked request as well
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if err := slow.SetContext(ctx, "k", []byte("v")); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+// TestClientReconnect tests that the client recovers when the server restarts
+func TestClientReconnect(t *testing.T) {
+	store := openStore(t)
+	addr, stop := startServer(t, store, "127.0.0.1:0")
+	c := dialTest(t, Config{Addr: addr})
+
+	if err := c.Set("before", []byte("1")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	// Restarting the server breaks the pooled connection
+	stop()
+	startServer(t, store, addr)
+
+	if err := c.Set("after", []byte("2")); err != nil {
+		t.Fatalf("Set after restart failed: %v", err)
+	}
+	if value, ok := c.Get("before"); !ok || string(value) != "1" {
+		t.Errorf("Get before: got %q, %v", value, ok)
+	}
+}
+
+// TestClientPool tests concurrent use with a small pool
+func TestClientPool(t *testing.T) {
+	store := openStore(t)
+	addr, _ := startServer(t, store, "127.0.0.1:0")
+	c := dialTest(t, Config{Addr: addr, PoolSize: 2})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if err := c.Set(fmt.Sprintf("w%d:%d", i, j), []byte("v")); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("Set failed: %v", err)
+	}
+	if n := c.Len(); n != 16*20 {
+		t.Errorf("Expected %d keys, got %d", 16*20, n)
+	}
+
+	c.mu.Lock()
+	idle := len(c.idle)
+	c.mu.Unlock()
+	if idle > 2 {
+		t.Errorf("Pool should hold at most 2 connections, has %d", idle)
+	}
+}
+
+// TestClientClosed tests that requests fail after Close
+func TestClientClosed(t *testing.T) {
+	store := openStore(t)
+	addr, _ := startServer(t, store, "127.0.0.1:0")
+	c := dialTest(t, Config{Addr: addr})
+
+	c.Close()
+	if err := c.Set("k", []byte("v")); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("Second Close should be a no-op, got %v", err)
+	}
+}
+
+// TestDialFails tests that Dial reports an unreachable server
+func TestDialFails(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	if _, err := DialWithConfig(Config{Addr: addr, MaxRetries: -1}); err == nil {
+		t.Error("Dial to a closed port should fail")
+	}
+}
@@ -0,0 +1,80 @@
+package client
+
+import (
+	"context"
+	"time"
+)
+
+// Pipeline queues commands and sends them in one round trip
+//
+// Commands are not atomic: each is executed in order on its own, and a failed
+// command does not stop the ones after it. A Pipeline is not safe for
+// concurrent use and can be reused after Exec
+type Pipeline struct {
+	client *Client
+	cmds   [][][]byte
+}
+
+// Result is the outcome of one pipelined command
+type Result struct {
+	Value []byte // value of a Get
+	Found bool   // whether the key of a Get exists
+	Err   error  // error reply from the server
+}
+
+// Pipeline returns an empty pipeline on c
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{client: c}
+}
+
+// Set queues a Set
+func (p *Pipeline) Set(key string, value []byte) {
+	p.cmds = append(p.cmds, [][]byte{[]byte("SET"), []byte(key), value})
+}
+
+// SetWithTTL queues a SetWithTTL
+func (p *Pipeline) SetWithTTL(key string, value []byte, ttl time.Duration) {
+	p.cmds = append(p.cmds, setWithTTLCommand(key, value, ttl))
+}
+
+// Get queues a Get
+func (p *Pipeline) Get(key string) {
+	p.cmds = append(p.cmds, [][]byte{[]byte("GET"), []byte(key)})
+}
+
+// Delete queues a Delete
+func (p *Pipeline) Delete(key string) {
+	p.cmds = append(p.cmds, [][]byte{[]byte("DEL"), []byte(key)})
+}
+
+// Len returns the number of queued commands
+func (p *Pipeline) Len() int {
+	return len(p.cmds)
+}
+
+// Exec sends the queued commands and returns one Result per command in the
+// order they were queued. The pipeline is empty afterwards
+// The returned error is a network or context failure, in which case it is
+// unknown which commands were executed
+func (p *Pipeline) Exec(ctx context.Context) ([]Result, error) {
+	cmds := p.cmds
+	p.cmds = nil
+	if len(cmds) == 0 {
+		return nil, nil
+	}
+
+	replies, err := p.client.exec(ctx, cmds)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]Result, len(replies))
+	for i, v := range replies {
+		if string(cmds[i][0]) == "GET" {
+			results[i].Value, results[i].Found, results[i].Err = bulk(v)
+			continue
+		}
+		results[i].Err = v.Err()
+	}
+	return results, nil
+}
@@ -0,0 +1,280 @@
+package kvstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/caresle/kvstore/raft"
+)
+
+// defaultClusterTimeout bounds the Cluster methods that take no context
+const defaultClusterTimeout = 5 * time.Second
+
+// ClusterConfig configures one member of a Cluster
+type ClusterConfig struct {
+	// Config configures the member's local store. Writes are always synced:
+	// Raft discards log entries once the store has applied them
+	Config
+
+	// Raft configures consensus. Raft.DataDir defaults to the raft
+	// directory inside DataDir and Raft.Logger to Logger
+	Raft raft.Config
+
+	// Timeout bounds Set, Delete and the reads that take no context
+	// (default: 5s)
+	Timeout time.Duration
+}
+
+// Cluster is a Store replicated with Raft: every Set and Delete is committed
+// through the Raft log of a majority of members before it is applied, and
+// reads are linearizable
+//
+// Writes and reads must go to the leader; other members return
+// raft.ErrNotLeader and Leader reports where to send them. The Raft log and
+// the store share LSNs, so a member's WAL holds exactly the committed entries
+// it has applied, and compacting the Raft log ships a store snapshot to
+// lagging members
+//
+// Keys cannot be given a TTL in a Cluster
+type Cluster struct {
+	store   *Store
+	node    *raft.Node
+	timeout time.Duration
+}
+
+// OpenCluster opens the local store and starts its Raft node
+func OpenCluster(config ClusterConfig) (*Cluster, error) {
+	if config.ReplicaOf != "" {
+		return nil, errors.New("a cluster member cannot follow a leader with ReplicaOf")
+	}
+	if config.ReadOnly {
+		return nil, errors.New("a cluster member cannot be opened read-only")
+	}
+	config.SyncWrites = true
+
+	store, err := openStore(config.Config, true)
+	if err != nil {
+		return nil, err
+	}
+
+	raftConfig := config.Raft
+	if raftConfig.DataDir == "" {
+		raftConfig.DataDir = filepath.Join(config.DataDir, "raft")
+	}
+	if raftConfig.Logger == nil {
+		raftConfig.Logger = config.Logger
+	}
+	node, err := raft.NewNode(raftConfig, &clusterFSM{store})
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to start raft: %w", err)
+	}
+
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultClusterTimeout
+	}
+
+	return &Cluster{store: store, node: node, timeout: timeout}, nil
+}
+
+// Set stores a key-value pair once a majority has committed it
+func (c *Cluster) Set(key string, value []byte) error {
+	ctx, cancel := c.context()
+	defer cancel()
+	return c.SetContext(ctx, key, value)
+}
+
+// SetContext is Set with a context
+func (c *Cluster) SetContext(ctx context.Context, key string, value []byte) error {
+	return c.propose(ctx, NewSetEntry(key, value))
+}
+
+// Delete removes a key once a majority has committed it. Deleting a missing
+// key is not an error
+func (c *Cluster) Delete(key string) error {
+	ctx, cancel := c.context()
+	defer cancel()
+	return c.DeleteContext(ctx, key)
+}
+
+// DeleteContext is Delete with a context
+func (c *Cluster) DeleteContext(ctx context.Context, key string) error {
+	return c.propose(ctx, NewDeleteEntry(key))
+}
+
+// propose commits an entry through Raft and waits until it is applied
+func (c *Cluster) propose(ctx context.Context, entry *Entry) error {
+	var buf bytes.Buffer
+	if err := entry.Encode(&buf); err != nil {
+		return fmt.Errorf("failed to encode entry: %w", err)
+	}
+
+	_, err := c.node.Propose(ctx, buf.Bytes())
+	return err
+}
+
+// Get retrieves a value, reporting whether the key exists
+// A key is reported missing when the read cannot be confirmed; use
+// GetContext to see why
+func (c *Cluster) Get(key string) ([]byte, bool) {
+	ctx, cancel := c.context()
+	defer cancel()
+	value, ok, _ := c.GetContext(ctx, key)
+	return value, ok
+}
+
+// GetContext retrieves a value, reporting whether the key exists. The read
+// sees every write committed before it started
+func (c *Cluster) GetContext(ctx context.Context, key string) ([]byte, bool, error) {
+	if err := c.node.ReadIndex(ctx); err != nil {
+		return nil, false, err
+	}
+	value, ok := c.store.Get(key)
+	return value, ok, nil
+}
+
+// Keys returns all keys in ascending order, or nil when the read cannot be
+// confirmed
+func (c *Cluster) Keys() []string {
+	ctx, cancel := c.context()
+	defer cancel()
+	keys, _ := c.KeysContext(ctx)
+	return keys
+}
+
+// KeysContext returns all keys in ascending order
+func (c *Cluster) KeysContext(ctx context.Context) ([]string, error) {
+	if err := c.node.ReadIndex(ctx); err != nil {
+		return nil, err
+	}
+	return c.store.Keys(), nil
+}
+
+// Len returns the number of keys, or 0 when the read cannot be confirmed
+func (c *Cluster) Len() int {
+	ctx, cancel := c.context()
+	defer cancel()
+	n, _ := c.LenContext(ctx)
+	return n
+}
+
+// LenContext returns the number of keys
+func (c *Cluster) LenContext(ctx context.Context) (int, error) {
+	if err := c.node.ReadIndex(ctx); err != nil {
+		return 0, err
+	}
+	return c.store.Len(), nil
+}
+
+// Leader returns the ID of the current leader, or "" if it is not known
+func (c *Cluster) Leader() string {
+	return c.node.Leader()
+}
+
+// Status returns the state of this member's Raft node
+func (c *Cluster) Status() raft.Status {
+	return c.node.Status()
+}
+
+// AddNode adds a member to the cluster. The new member must be started
+// without peers; it receives the data from the leader
+func (c *Cluster) AddNode(ctx context.Context, id string) error {
+	return c.node.AddServer(ctx, id)
+}
+
+// RemoveNode removes a member from the cluster
+func (c *Cluster) RemoveNode(ctx context.Context, id string) error {
+	return c.node.RemoveServer(ctx, id)
+}
+
+// Raft returns the member's Raft node, e.g. to serve RPCs from the other
+// members with raft.ServeTCP
+func (c *Cluster) Raft() *raft.Node {
+	return c.node
+}
+
+// Store returns the member's local store. Reading it directly is faster than
+// going through the Cluster but may miss recent writes
+func (c *Cluster) Store() *Store {
+	return c.store
+}
+
+// Close stops the Raft node, then closes the store
+func (c *Cluster) Close() error {
+	err := c.node.Close()
+	if serr := c.store.Close(); err == nil {
+		err = serr
+	}
+	return err
+}
+
+func (c *Cluster) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), c.timeout)
+}
+
+// clusterFSM applies the Raft log to a store. Raft index i is written to
+// the WAL as the entry with LSN i, so the store's sequence number is the last
+// applied index
+type clusterFSM struct {
+	s *Store
+}
+
+func (f *clusterFSM) Apply(index uint64, command []byte) error {
+	// Entries Raft uses internally still take their LSN, as empty batches
+	var entry *Entry
+	var err error
+	if command == nil {
+		entry, err = NewBatchEntry(nil)
+	} else {
+		entry, err = DecodeEntry(bytes.NewReader(command))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to decode command: %w", err)
+	}
+	entry.LSN = index
+
+	f.s.mu.Lock()
+	err = f.s.enqueueReplicatedLocked(entry)
+	f.s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return f.s.finish(entry)
+}
+
+func (f *clusterFSM) LastApplied() uint64 {
+	f.s.mu.RLock()
+	defer f.s.mu.RUnlock()
+
+	return f.s.seq
+}
+
+func (f *clusterFSM) Snapshot(w io.Writer) (uint64, error) {
+	snap := f.s.Snapshot()
+	defer snap.Close()
+
+	if err := encodeSnapshot(w, snap.Seq(), snap.Len(), snap.records("", "")); err != nil {
+		return 0, err
+	}
+	return snap.Seq(), nil
+}
+
+func (f *clusterFSM) Restore(index uint64, r io.Reader) error {
+	data, expiries, lsn, err := decodeSnapshot(bufio.NewReader(r))
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	if lsn != index {
+		return fmt.Errorf("snapshot is at LSN %d, expected %d", lsn, index)
+	}
+
+	return f.s.installSnapshot(data, expiries, lsn)
+}
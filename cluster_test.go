@@ -0,0 +1,262 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/caresle/kvstore/raft"
+)
+
+// testCluster runs members on an in-process Raft network
+type testCluster struct {
+	t         *testing.T
+	network   *raft.InmemNetwork
+	peers     []string
+	threshold uint64
+	dirs      map[string]string
+	members   map[string]*Cluster
+}
+
+func newTestCluster(t *testing.T, size int, threshold uint64) *testCluster {
+	c := &testCluster{
+		t:         t,
+		network:   raft.NewInmemNetwork(),
+		threshold: threshold,
+		dirs:      make(map[string]string),
+		members:   make(map[string]*Cluster),
+	}
+	t.Cleanup(func() {
+		for _, member := range c.members {
+			member.Close()
+		}
+	})
+
+	for i := 1; i <= size; i++ {
+		c.peers = append(c.peers, fmt.Sprintf("n%d", i))
+	}
+	for _, id := range c.peers {
+		c.start(id)
+	}
+	return c
+}
+
+// start opens (or reopens) the member id
+func (c *testCluster) start(id string) *Cluster {
+	c.t.Helper()
+
+	if _, ok := c.dirs[id]; !ok {
+		c.dirs[id] = c.t.TempDir()
+	}
+
+	member, err := OpenCluster(ClusterConfig{
+		Config: Config{DataDir: c.dirs[id]},
+		Raft: raft.Config{
+			ID:                id,
+			Peers:             c.peers,
+			Transport:         c.network.Transport(id),
+			ElectionTimeout:   100 * time.Millisecond,
+			HeartbeatInterval: 10 * time.Millisecond,
+			SnapshotThreshold: c.threshold,
+		},
+	})
+	if err != nil {
+		c.t.Fatalf("OpenCluster %s failed: %v", id, err)
+	}
+	c.network.Register(id, member.Raft())
+	c.members[id] = member
+	return member
+}
+
+// leader waits for a leader among the given members (default: all)
+func (c *testCluster) leader(ids ...string) *Cluster {
+	c.t.Helper()
+
+	if len(ids) == 0 {
+		ids = c.peers
+	}
+
+	var leader *Cluster
+	waitFor(c.t, "a leader", func() bool {
+		for _, id := range ids {
+			if c.members[id].Status().State == raft.Leader {
+				leader = c.members[id]
+				return true
+			}
+		}
+		return false
+	})
+	return leader
+}
+
+// waitApplied waits until the stores of ids hold the leader's data
+func (c *testCluster) waitApplied(leader *Cluster, ids ...string) {
+	c.t.Helper()
+
+	want := leader.Status().CommitIndex
+	for _, id := range ids {
+		store := c.members[id].Store()
+		waitFor(c.t, id+" to apply", func() bool {
+			store.mu.RLock()
+			defer store.mu.RUnlock()
+			return store.seq >= want
+		})
+		assertSameData(c.t, leader.Store(), store)
+	}
+}
+
+func TestClusterReplicates(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	leader := c.leader()
+
+	for i := 0; i < 10; i++ {
+		if err := leader.Set(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+	if err := leader.Delete("key3"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	if value, ok := leader.Get("key1"); !ok || string(value) != "value1" {
+		t.Errorf("Expected value1, got %q (exists: %v)", value, ok)
+	}
+	if _, ok := leader.Get("key3"); ok {
+		t.Error("Deleted key should not exist")
+	}
+	if n := leader.Len(); n != 9 {
+		t.Errorf("Expected 9 keys, got %d", n)
+	}
+	c.waitApplied(leader, c.peers...)
+
+	// Followers redirect to the leader
+	for _, member := range c.members {
+		if member == leader {
+			continue
+		}
+		if member.Leader() != leader.Status().ID {
+			t.Errorf("Expected leader %s, got %s", leader.Status().ID, member.Leader())
+		}
+		if err := member.Set("k", []byte("v")); !errors.Is(err, raft.ErrNotLeader) {
+			t.Errorf("Expected ErrNotLeader from Set, got %v", err)
+		}
+		if _, _, err := member.GetContext(context.Background(), "key1"); !errors.Is(err, raft.ErrNotLeader) {
+			t.Errorf("Expected ErrNotLeader from GetContext, got %v", err)
+		}
+		if err := member.Store().Set("k", []byte("v")); !errors.Is(err, ErrReadOnly) {
+			t.Errorf("Expected ErrReadOnly writing a member's store, got %v", err)
+		}
+	}
+}
+
+func TestClusterFailover(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	old := c.leader()
+	if err := old.Set("before", []byte("1")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	oldID := old.Status().ID
+	c.network.Disconnect(oldID)
+
+	var rest []string
+	for _, id := range c.peers {
+		if id != oldID {
+			rest = append(rest, id)
+		}
+	}
+	leader := c.leader(rest...)
+	if err := leader.Set("after", []byte("2")); err != nil {
+		t.Fatalf("Set on the new leader failed: %v", err)
+	}
+	if value, ok := leader.Get("before"); !ok || string(value) != "1" {
+		t.Errorf("New leader lost a committed write, got %q (exists: %v)", value, ok)
+	}
+
+	c.network.Connect(oldID)
+	c.waitApplied(leader, c.peers...)
+}
+
+func TestClusterSnapshotCatchUp(t *testing.T) {
+	c := newTestCluster(t, 3, 10)
+	leader := c.leader()
+
+	leaderID := leader.Status().ID
+	var lagging string
+	for _, id := range c.peers {
+		if id != leaderID {
+			lagging = id
+			break
+		}
+	}
+	c.network.Disconnect(lagging)
+
+	for i := 0; i < 50; i++ {
+		if err := leader.Set(fmt.Sprintf("key%02d", i), []byte("v")); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+	for i := 0; i < 50; i += 5 {
+		if err := leader.Delete(fmt.Sprintf("key%02d", i)); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+
+	c.network.Connect(lagging)
+	c.waitApplied(leader, c.peers...)
+
+	// The installed snapshot is where the member's store continues
+	store := c.members[lagging].Store()
+	_, _, lsn, err := loadSnapshot(store.config.DataDir)
+	if err != nil || lsn == 0 {
+		t.Errorf("Expected an installed snapshot, got LSN %d (%v)", lsn, err)
+	}
+}
+
+func TestClusterRestart(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	if err := c.leader().Set("durable", []byte("yes")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	for _, id := range c.peers {
+		if err := c.members[id].Close(); err != nil {
+			t.Fatalf("Close %s failed: %v", id, err)
+		}
+		delete(c.members, id)
+	}
+	for _, id := range c.peers {
+		c.start(id)
+	}
+
+	leader := c.leader()
+	if value, ok := leader.Get("durable"); !ok || string(value) != "yes" {
+		t.Errorf("Expected the write to survive a restart, got %q (exists: %v)", value, ok)
+	}
+	if err := leader.Set("more", []byte("1")); err != nil {
+		t.Fatalf("Set after restart failed: %v", err)
+	}
+	c.waitApplied(leader, c.peers...)
+}
+
+// TestClusterRejectsReadOnly tests that a member, which must apply the log
+// to its WAL, cannot be opened read-only
+func TestClusterRejectsReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	_, err := OpenCluster(ClusterConfig{
+		Config: Config{DataDir: dir, ReadOnly: true},
+		Raft:   raft.Config{ID: "a", Peers: []string{"a"}},
+	})
+	if err == nil {
+		t.Fatal("Expected OpenCluster to reject ReadOnly")
+	}
+
+	// Nothing was left locked
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open after the rejected cluster failed: %v", err)
+	}
+	store.Close()
+}
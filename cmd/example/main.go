@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"github.com/caresle/kvstore"
 )
@@ -68,7 +69,7 @@ func main() {
 		log.Fatalf("✗ Failed to open store: %v", err)
 	}
 	printSuccess("Store opened successfully")
-	printInfo(fmt.Sprintf("Files: %s/wal.log, %s/snapshot.dat", dataDir, dataDir))
+	printInfo(fmt.Sprintf("Files: %s/wal-*.log, %s/snapshot.dat", dataDir, dataDir))
 
 	// ============================================================
 	// Section 2: Basic Operations
@@ -157,10 +158,13 @@ func main() {
 	}
 
 	printInfo("Adding new session data...")
-	if err := store.Set("session:id", []byte("abc123")); err != nil {
-		log.Fatalf("✗ Set failed: %v", err)
+	// Sessions expire on their own - the deadline is persisted in the WAL
+	if err := store.SetWithTTL("session:id", []byte("abc123"), 30*time.Minute); err != nil {
+		log.Fatalf("✗ SetWithTTL failed: %v", err)
+	}
+	if ttl, ok := store.TTL("session:id"); ok {
+		printSuccess(fmt.Sprintf("Set: session:id = abc123 (expires in %s)", ttl.Round(time.Minute)))
 	}
-	printSuccess("Set: session:id = abc123")
 
 	if err := store.Set("session:active", []byte("true")); err != nil {
 		log.Fatalf("✗ Set failed: %v", err)
@@ -216,10 +220,11 @@ func main() {
 	fmt.Println("  ✓ Clean shutdown and recovery")
 	fmt.Println("  ✓ Error handling")
 	fmt.Println("  ✓ Binary data storage")
+	fmt.Println("  ✓ Key expiration (TTL)")
 
 	fmt.Printf("\nFiles created in %s/:\n", dataDir)
 	fmt.Println("  - snapshot.dat (snapshot file with all data)")
-	fmt.Println("  - wal.log (write-ahead log, empty after clean shutdown)")
+	fmt.Println("  - wal-*.log (write-ahead log segments, empty after clean shutdown)")
 
 	fmt.Println("\nRun again with: go run cmd/example/main.go")
 	fmt.Println("Keep data with: go run cmd/example/main.go -keep")
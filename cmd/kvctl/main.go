@@ -0,0 +1,362 @@
+// Command kvctl inspects and edits a kvstore data directory
+//
+// Usage:
+//
+//	kvctl [-data dir] <command> [arguments]
+//
+// Commands:
+//
+//	get <key>          print the value of a key
+//	set <key> <value>  store a value
+//	delete <key>       remove a key
+//	list [prefix]      print the keys, or only those starting with prefix
+//	wal                dump the WAL entries
+//	snapshot           print the snapshot header and statistics
+//	verify             check the snapshot and the WAL end to end
+//	repair [-dry-run]  salvage the intact records into a clean snapshot
+//
+// get and list open the store read-only and can run next to other readers;
+// set and delete open it for writing, so no server may be using the directory
+// at the same time. wal, snapshot and verify only read the files. repair
+// moves the original files to a backup directory and must not run while the
+// store is open
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/caresle/kvstore"
+)
+
+var dataDir = flag.String("data", "./data", "data directory")
+
+// errProblems makes kvctl exit with status 1 after reporting problems itself
+var errProblems = errors.New("problems found")
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	if _, err := os.Stat(*dataDir); err != nil {
+		fmt.Fprintf(os.Stderr, "kvctl: %v\n", err)
+		os.Exit(1)
+	}
+
+	command, args := flag.Arg(0), flag.Args()[1:]
+	var err error
+	switch command {
+	case "get":
+		err = withArgs(args, 1, "get <key>", get)
+	case "set":
+		err = withArgs(args, 2, "set <key> <value>", set)
+	case "delete":
+		err = withArgs(args, 1, "delete <key>", del)
+	case "list":
+		if len(args) > 1 {
+			err = usageError("list [prefix]")
+		} else {
+			err = list(append(args, "")[0])
+		}
+	case "wal":
+		err = withArgs(args, 0, "wal", func([]string) error { return dumpWAL() })
+	case "snapshot":
+		err = withArgs(args, 0, "snapshot", func([]string) error { return showSnapshot() })
+	case "verify":
+		err = withArgs(args, 0, "verify", func([]string) error { return verify() })
+	case "repair":
+		err = repair(args)
+	default:
+		fmt.Fprintf(os.Stderr, "kvctl: unknown command %q\n", command)
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		if !errors.Is(err, errProblems) {
+			fmt.Fprintf(os.Stderr, "kvctl: %v\n", err)
+		}
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: kvctl [-data dir] <command> [arguments]
+
+Commands:
+  get <key>          print the value of a key
+  set <key> <value>  store a value
+  delete <key>       remove a key
+  list [prefix]      print the keys, or only those starting with prefix
+  wal                dump the WAL entries
+  snapshot           print the snapshot header and statistics
+  verify             check the snapshot and the WAL end to end
+  repair [-dry-run]  salvage the intact records into a clean snapshot
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+func usageError(synopsis string) error {
+	return fmt.Errorf("usage: kvctl %s", synopsis)
+}
+
+// withArgs runs fn if exactly n arguments were given
+func withArgs(args []string, n int, synopsis string, fn func([]string) error) error {
+	if len(args) != n {
+		return usageError(synopsis)
+	}
+	return fn(args)
+}
+
+// withStore runs fn on the store in the data directory, opened read-only if
+// fn does not write
+func withStore(readOnly bool, fn func(*kvstore.Store) error) error {
+	store, err := kvstore.OpenWithConfig(kvstore.Config{DataDir: *dataDir, SyncWrites: true, ReadOnly: readOnly})
+	if err != nil {
+		return err
+	}
+
+	err = fn(store)
+	if cerr := store.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func get(args []string) error {
+	return withStore(true, func(store *kvstore.Store) error {
+		value, ok := store.Get(args[0])
+		if !ok {
+			return fmt.Errorf("key %q not found", args[0])
+		}
+		fmt.Printf("%s\n", value)
+		return nil
+	})
+}
+
+func set(args []string) error {
+	return withStore(false, func(store *kvstore.Store) error {
+		return store.Set(args[0], []byte(args[1]))
+	})
+}
+
+func del(args []string) error {
+	return withStore(false, func(store *kvstore.Store) error {
+		return store.Delete(args[0])
+	})
+}
+
+func list(prefix string) error {
+	return withStore(true, func(store *kvstore.Store) error {
+		for key := range store.Prefix(prefix) {
+			fmt.Println(key)
+		}
+		return nil
+	})
+}
+
+// dumpWAL prints one line per WAL entry, and one per operation of a batch
+func dumpWAL() error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SEGMENT\tOFFSET\tLSN\tOP\tTIMESTAMP\tKEY\tVALUE LEN\tCHECKSUM")
+
+	entries := 0
+	err := kvstore.InspectWAL(*dataDir, func(rec kvstore.WALRecord) error {
+		if rec.Err != nil {
+			fmt.Fprintf(tw, "%s\t%d\t-\t-\t-\t-\t-\t%v\n", rec.Segment, rec.Offset, rec.Err)
+			return nil
+		}
+
+		entries++
+		entry := rec.Entry
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%q\t%d\tok\n",
+			rec.Segment, rec.Offset, entry.LSN, opName(entry.Operation), formatTime(entry.Timestamp), entry.Key, len(entry.Value))
+
+		if entry.Operation == kvstore.OpBatch {
+			ops, err := entry.BatchEntries()
+			if err != nil {
+				fmt.Fprintf(tw, "\t\t\t  -\t-\t-\t-\t%v\n", err)
+				return nil
+			}
+			for _, op := range ops {
+				fmt.Fprintf(tw, "\t\t\t  %s\t%s\t%q\t%d\t\n",
+					opName(op.Operation), formatTime(op.Timestamp), op.Key, len(op.Value))
+			}
+		}
+		return nil
+	})
+	tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d entries\n", entries)
+	return nil
+}
+
+func showSnapshot() error {
+	info, err := kvstore.InspectSnapshot(*dataDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		fmt.Println("No snapshot")
+		return nil
+	}
+	if info.Version != 0 {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(tw, "Version:\t%d\n", info.Version)
+		fmt.Fprintf(tw, "Written:\t%s\n", formatTime(info.Timestamp))
+		fmt.Fprintf(tw, "LSN:\t%d\n", info.LSN)
+		fmt.Fprintf(tw, "Keys:\t%d\n", info.Count)
+		fmt.Fprintf(tw, "File size:\t%d bytes\n", info.Size)
+		if err == nil {
+			fmt.Fprintf(tw, "Key bytes:\t%d\n", info.KeyBytes)
+			fmt.Fprintf(tw, "Value bytes:\t%d\n", info.ValueBytes)
+			fmt.Fprintf(tw, "With TTL:\t%d (%d expired)\n", info.WithTTL, info.Expired)
+		}
+		tw.Flush()
+	}
+	return err
+}
+
+// verify reads every snapshot record and WAL entry and checks that the WAL
+// continues the snapshot without gaps
+func verify() error {
+	problems := 0
+	report := func(format string, args ...any) {
+		problems++
+		fmt.Printf("PROBLEM: "+format+"\n", args...)
+	}
+
+	// Without a snapshot the WAL must start at the first write. Snapshots
+	// from before v3 do not record where the WAL continues
+	var snapshotLSN uint64
+	checkStart := false
+	info, err := kvstore.InspectSnapshot(*dataDir)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		checkStart = true
+		fmt.Println("Snapshot: none")
+	case err != nil:
+		report("snapshot: %v", err)
+	default:
+		snapshotLSN = info.LSN
+		checkStart = info.Version >= 3
+		fmt.Printf("Snapshot: ok, v%d, %d keys at LSN %d\n", info.Version, info.Count, info.LSN)
+	}
+
+	var first, last uint64
+	entries, segments := 0, map[string]bool{}
+	err = kvstore.InspectWAL(*dataDir, func(rec kvstore.WALRecord) error {
+		segments[rec.Segment] = true
+		if rec.Err != nil {
+			report("%s at offset %d: %v", rec.Segment, rec.Offset, rec.Err)
+			return nil
+		}
+
+		entry := rec.Entry
+		if entries > 0 && entry.LSN != last+1 {
+			report("%s at offset %d: LSN %d follows %d", rec.Segment, rec.Offset, entry.LSN, last)
+		}
+		if entries == 0 {
+			first = entry.LSN
+		}
+		if entry.Operation == kvstore.OpBatch {
+			if _, err := entry.BatchEntries(); err != nil {
+				report("%s at offset %d: batch at LSN %d: %v", rec.Segment, rec.Offset, entry.LSN, err)
+			}
+		}
+		entries++
+		last = entry.LSN
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if entries == 0 {
+		fmt.Println("WAL: no entries")
+	} else {
+		fmt.Printf("WAL: %d entries in %d segments, LSN %d to %d\n", entries, len(segments), first, last)
+		if checkStart && first > snapshotLSN+1 {
+			report("WAL starts at LSN %d, entries after %d are missing", first, snapshotLSN)
+		}
+	}
+
+	if problems > 0 {
+		fmt.Printf("%d problems\n", problems)
+		return errProblems
+	}
+	fmt.Println("OK")
+	return nil
+}
+
+// repair salvages what it can from a damaged data directory and reports
+// exactly what was lost
+func repair(args []string) error {
+	flags := flag.NewFlagSet("repair", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only report what would be salvaged")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return usageError("repair [-dry-run]")
+	}
+
+	report, err := kvstore.Repair(*dataDir, kvstore.RepairOptions{DryRun: *dryRun})
+	if err != nil {
+		return err
+	}
+
+	if report.SnapshotLSN != 0 || report.SnapshotRecords != 0 || report.SnapshotLost != 0 {
+		fmt.Printf("Snapshot: %d records salvaged, %d lost, LSN %d\n", report.SnapshotRecords, report.SnapshotLost, report.SnapshotLSN)
+	}
+	fmt.Printf("WAL: %d entries salvaged\n", report.WALEntries)
+	for _, d := range report.Damaged {
+		fmt.Printf("DAMAGED: %s offset %d, %d bytes: %v\n", d.File, d.Offset, d.Length, d.Err)
+	}
+	for _, m := range report.Missing {
+		if m.First == m.Last {
+			fmt.Printf("MISSING: LSN %d\n", m.First)
+		} else {
+			fmt.Printf("MISSING: LSN %d to %d\n", m.First, m.Last)
+		}
+	}
+
+	if *dryRun {
+		fmt.Printf("Would write %d keys at LSN %d\n", report.Keys, report.LSN)
+		return nil
+	}
+	fmt.Printf("Wrote %d keys at LSN %d, originals in %s\n", report.Keys, report.LSN, report.Backup)
+	return nil
+}
+
+func opName(op byte) string {
+	switch op {
+	case kvstore.OpSet:
+		return "set"
+	case kvstore.OpDelete:
+		return "delete"
+	case kvstore.OpBatch:
+		return "batch"
+	case kvstore.OpSetTTL:
+		return "setttl"
+	case kvstore.OpExpire:
+		return "expire"
+	}
+	return fmt.Sprintf("op(0x%X)", op)
+}
+
+func formatTime(unixNano int64) string {
+	if unixNano == 0 {
+		return "-"
+	}
+	return time.Unix(0, unixNano).UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,88 @@
+// Command kvhttp serves a kvstore over HTTP as a REST/JSON API
+//
+// Store metrics are served at /metrics in the Prometheus text format and at
+// /debug/vars through expvar
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/caresle/kvstore"
+	"github.com/caresle/kvstore/httpapi"
+)
+
+var (
+	addr               = flag.String("addr", ":8080", "HTTP address to listen on")
+	dataDir            = flag.String("data", "./data", "data directory")
+	syncWrites         = flag.Bool("sync", true, "fsync the WAL before acknowledging writes")
+	checkpointInterval = flag.Duration("checkpoint-interval", time.Minute, "how often to checkpoint (0 disables)")
+	checkpointWALBytes = flag.Int64("checkpoint-wal-bytes", 64<<20, "checkpoint once the WAL grows past this size (0 disables)")
+)
+
+func main() {
+	flag.Parse()
+
+	metrics := kvstore.NewRegistry()
+	store, err := kvstore.OpenWithConfig(kvstore.Config{
+		DataDir:            *dataDir,
+		SyncWrites:         *syncWrites,
+		CheckpointInterval: *checkpointInterval,
+		CheckpointWALBytes: *checkpointWALBytes,
+		Metrics:            metrics,
+	})
+	if err != nil {
+		log.Fatalf("Failed to open store: %v", err)
+	}
+
+	expvar.Publish("kvstore", metrics.Expvar())
+	mux := http.NewServeMux()
+	mux.Handle("/", httpapi.NewHandler(store))
+	mux.Handle("GET /metrics", metrics)
+	mux.Handle("GET /debug/vars", expvar.Handler())
+
+	server := &http.Server{
+		Addr:              *addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	// Finish in-flight requests, then close the store so it writes its snapshot
+	// ListenAndServe returns as soon as the listener closes, so done tells
+	// when Shutdown has waited for the requests
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sig := <-signals
+		log.Printf("Received %v, shutting down", sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	log.Printf("Serving %s on %s", *dataDir, *addr)
+	err = server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		<-done
+	} else {
+		log.Printf("Server failed: %v", err)
+	}
+
+	if cerr := store.Close(); cerr != nil {
+		log.Fatalf("Failed to close store: %v", cerr)
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,87 @@
+// Command kvserver serves a kvstore over the Redis protocol (RESP2/RESP3), so
+// redis-cli and Redis client libraries can be used against it
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/caresle/kvstore"
+	"github.com/caresle/kvstore/resp"
+)
+
+var (
+	addr               = flag.String("addr", ":6379", "TCP address to listen on")
+	dataDir            = flag.String("data", "./data", "data directory")
+	syncWrites         = flag.Bool("sync", true, "fsync the WAL before acknowledging writes")
+	checkpointInterval = flag.Duration("checkpoint-interval", time.Minute, "how often to checkpoint (0 disables)")
+	checkpointWALBytes = flag.Int64("checkpoint-wal-bytes", 64<<20, "checkpoint once the WAL grows past this size (0 disables)")
+	replicationAddr    = flag.String("replication-addr", "", "TCP address to serve the WAL to followers on (empty disables)")
+	replicaOf          = flag.String("replicaof", "", "replication address of a leader to follow; the store becomes read-only")
+)
+
+func main() {
+	flag.Parse()
+
+	store, err := kvstore.OpenWithConfig(kvstore.Config{
+		DataDir:            *dataDir,
+		SyncWrites:         *syncWrites,
+		CheckpointInterval: *checkpointInterval,
+		CheckpointWALBytes: *checkpointWALBytes,
+		ReplicaOf:          *replicaOf,
+	})
+	if err != nil {
+		log.Fatalf("Failed to open store: %v", err)
+	}
+
+	// Closing the store stops the replication listener
+	if *replicationAddr != "" {
+		l, err := net.Listen("tcp", *replicationAddr)
+		if err != nil {
+			store.Close()
+			log.Fatalf("Failed to listen for followers: %v", err)
+		}
+		log.Printf("Serving replication on %s", *replicationAddr)
+		go func() {
+			if err := store.ServeReplication(l); err != nil {
+				log.Printf("Replication listener failed: %v", err)
+			}
+		}()
+	}
+
+	server := resp.NewServer(store)
+
+	// Shut down cleanly so the store writes its snapshot. ListenAndServe
+	// returns as soon as the listener closes, so done tells when Close has
+	// waited for the connections
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sig := <-signals
+		log.Printf("Received %v, shutting down", sig)
+		server.Close()
+	}()
+
+	log.Printf("Serving %s on %s", *dataDir, *addr)
+	err = server.ListenAndServe(*addr)
+	if errors.Is(err, resp.ErrServerClosed) {
+		<-done
+	} else {
+		log.Printf("Server failed: %v", err)
+	}
+
+	if cerr := store.Close(); cerr != nil {
+		log.Fatalf("Failed to close store: %v", cerr)
+	}
+	if !errors.Is(err, resp.ErrServerClosed) {
+		os.Exit(1)
+	}
+}
@@ -6,17 +6,33 @@ import (
 	"fmt"
 	"hash/crc32"
 	"io"
+	"slices"
 	"time"
 )
 
 const (
 	OpSet    byte = 0x01
 	OpDelete byte = 0x02
+	OpBatch  byte = 0x03
+	OpSetTTL byte = 0x04 // Value: ExpiresAt(8) | value
+	OpExpire byte = 0x05 // Value: ExpiresAt(8), 0 removes the expiry
 )
 
-const EntryMagic uint32 = 0x4B564C47 // "KVLG"
+const EntryMagic uint32 = 0x4B564C32 // "KVL2" - KV Log v2 (entries carry an LSN)
+
+// entryMagicV1 identifies entries written before log sequence numbers existed
+const entryMagicV1 uint32 = 0x4B564C47 // "KVLG"
+
+// Sizes of an entry up to and including the key length
+const (
+	entryHeaderSizeV2 = 4 + 8 + 1 + 8 + 4 // Magic | LSN | Op | Timestamp | KeyLen
+	entryHeaderSizeV1 = 4 + 1 + 8 + 4     // no LSN
+)
 
 type Entry struct {
+	// LSN is the log sequence number assigned by WAL.Append. Entries inside a
+	// batch and entries decoded from a v1 log have LSN 0
+	LSN       uint64
 	Operation byte
 	Timestamp int64
 	Key       string
@@ -41,7 +57,113 @@ func NewDeleteEntry(key string) *Entry {
 	}
 }
 
+// NewSetWithTTLEntry creates a set entry that expires at expiresAt (unix nanoseconds)
+func NewSetWithTTLEntry(key string, value []byte, expiresAt int64) *Entry {
+	payload := make([]byte, 8+len(value))
+	binary.BigEndian.PutUint64(payload, uint64(expiresAt))
+	copy(payload[8:], value)
+
+	return &Entry{
+		Operation: OpSetTTL,
+		Timestamp: time.Now().UnixNano(),
+		Key:       key,
+		Value:     payload,
+	}
+}
+
+// NewExpireEntry creates an entry that changes the expiry of an existing key
+// An expiresAt of 0 removes the expiry
+func NewExpireEntry(key string, expiresAt int64) *Entry {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, uint64(expiresAt))
+
+	return &Entry{
+		Operation: OpExpire,
+		Timestamp: time.Now().UnixNano(),
+		Key:       key,
+		Value:     payload,
+	}
+}
+
+// decodeTTLValue splits the value of an OpSetTTL or OpExpire entry into the
+// expiry deadline and the stored value
+func decodeTTLValue(payload []byte) (int64, []byte, error) {
+	if len(payload) < 8 {
+		return 0, nil, fmt.Errorf("TTL payload too short: %d bytes", len(payload))
+	}
+	return int64(binary.BigEndian.Uint64(payload)), payload[8:], nil
+}
+
+// NewBatchEntry wraps write entries into a single entry so they are
+// written, checksummed and replayed as one unit
+// Value format: Count(4) | Entry | Entry | ...
+func NewBatchEntry(entries []*Entry) (*Entry, error) {
+	var buf bytes.Buffer
+
+	if err := binary.Write(&buf, binary.BigEndian, uint32(len(entries))); err != nil {
+		return nil, fmt.Errorf("failed to write batch count: %w", err)
+	}
+
+	for i, entry := range entries {
+		if entry.Operation == OpBatch || !isKnownOperation(entry.Operation) {
+			return nil, fmt.Errorf("invalid operation 0x%X in batch entry %d", entry.Operation, i)
+		}
+		if err := entry.Encode(&buf); err != nil {
+			return nil, fmt.Errorf("failed to encode batch entry %d: %w", i, err)
+		}
+	}
+
+	return &Entry{
+		Operation: OpBatch,
+		Timestamp: time.Now().UnixNano(),
+		Value:     buf.Bytes(),
+	}, nil
+}
+
+// BatchEntries decodes the entries contained in a batch entry
+func (e *Entry) BatchEntries() ([]*Entry, error) {
+	if e.Operation != OpBatch {
+		return nil, fmt.Errorf("not a batch entry: operation 0x%X", e.Operation)
+	}
+
+	r := bytes.NewReader(e.Value)
+
+	var count uint32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, fmt.Errorf("failed to read batch count: %w", truncated(err))
+	}
+
+	entries := make([]*Entry, 0, count)
+	for i := uint32(0); i < count; i++ {
+		entry, err := DecodeEntry(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode batch entry %d: %w", i, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// isKnownOperation reports whether op is an operation code this version understands
+func isKnownOperation(op byte) bool {
+	switch op {
+	case OpSet, OpDelete, OpBatch, OpSetTTL, OpExpire:
+		return true
+	}
+	return false
+}
+
+// Encode writes the entry in the current (v2) format:
+// Magic(4) | LSN(8) | Op(1) | Timestamp(8) | KeyLen(4) | Key | ValueLen(4) | Value | CRC32(4)
 func (e *Entry) Encode(w io.Writer) error {
+	if len(e.Key) > MaxKeySize {
+		return fmt.Errorf("%w: %d bytes", ErrKeyTooLarge, len(e.Key))
+	}
+	if uint64(len(e.Value)) > maxValueSize {
+		return fmt.Errorf("%w: %d bytes", ErrValueTooLarge, len(e.Value))
+	}
+
 	// First, encode all fields to a buffer to compute CRC32
 	var dataBuffer bytes.Buffer
 
@@ -49,6 +171,10 @@ func (e *Entry) Encode(w io.Writer) error {
 		return fmt.Errorf("failed to write magic: %w", err)
 	}
 
+	if err := binary.Write(&dataBuffer, binary.BigEndian, e.LSN); err != nil {
+		return fmt.Errorf("failed to write LSN: %w", err)
+	}
+
 	if err := binary.Write(&dataBuffer, binary.BigEndian, e.Operation); err != nil {
 		return fmt.Errorf("failed to write operation: %w", err)
 	}
@@ -94,74 +220,108 @@ func (e *Entry) Encode(w io.Writer) error {
 	return nil
 }
 
+// DecodeEntry reads one entry in either the v2 format or the v1 format,
+// which has no LSN field
 func DecodeEntry(r io.Reader) (*Entry, error) {
 	// Read all data into buffer to compute CRC32
 	var dataBuffer bytes.Buffer
 
 	var magic uint32
 	if err := binary.Read(r, binary.BigEndian, &magic); err != nil {
-		return nil, fmt.Errorf("failed to read magic: %w", err)
+		return nil, fmt.Errorf("failed to read magic: %w", truncated(err))
 	}
 	binary.Write(&dataBuffer, binary.BigEndian, magic)
 
-	if magic != EntryMagic {
-		return nil, fmt.Errorf("invalid magic: expected 0x%X, got 0x%X", EntryMagic, magic)
+	if magic != EntryMagic && magic != entryMagicV1 {
+		return nil, fmt.Errorf("%w: expected 0x%X, got 0x%X", ErrInvalidMagic, EntryMagic, magic)
+	}
+
+	var lsn uint64
+	if magic != entryMagicV1 {
+		if err := binary.Read(r, binary.BigEndian, &lsn); err != nil {
+			return nil, fmt.Errorf("failed to read LSN: %w", truncated(err))
+		}
+		binary.Write(&dataBuffer, binary.BigEndian, lsn)
 	}
 
 	var operation byte
 	if err := binary.Read(r, binary.BigEndian, &operation); err != nil {
-		return nil, fmt.Errorf("failed to read operation: %w", err)
+		return nil, fmt.Errorf("failed to read operation: %w", truncated(err))
 	}
 	binary.Write(&dataBuffer, binary.BigEndian, operation)
 
 	var timestamp int64
 	if err := binary.Read(r, binary.BigEndian, &timestamp); err != nil {
-		return nil, fmt.Errorf("failed to read timestamp: %w", err)
+		return nil, fmt.Errorf("failed to read timestamp: %w", truncated(err))
 	}
 	binary.Write(&dataBuffer, binary.BigEndian, timestamp)
 
 	var keyLen uint32
 	if err := binary.Read(r, binary.BigEndian, &keyLen); err != nil {
-		return nil, fmt.Errorf("failed to read key length: %w", err)
+		return nil, fmt.Errorf("failed to read key length: %w", truncated(err))
 	}
 	binary.Write(&dataBuffer, binary.BigEndian, keyLen)
 
+	// A corrupted length must not turn into a huge allocation
+	if keyLen > MaxKeySize {
+		return nil, fmt.Errorf("%w: length %d", ErrKeyTooLarge, keyLen)
+	}
+
 	key := make([]byte, keyLen)
 	if _, err := io.ReadFull(r, key); err != nil {
-		return nil, fmt.Errorf("failed to read key: %w", err)
+		return nil, fmt.Errorf("failed to read key: %w", truncated(err))
 	}
 	dataBuffer.Write(key)
 
 	var valueLen uint32
 	if err := binary.Read(r, binary.BigEndian, &valueLen); err != nil {
-		return nil, fmt.Errorf("failed to read value length: %w", err)
+		return nil, fmt.Errorf("failed to read value length: %w", truncated(err))
 	}
 	binary.Write(&dataBuffer, binary.BigEndian, valueLen)
 
-	value := make([]byte, valueLen)
-	if valueLen > 0 {
-		if _, err := io.ReadFull(r, value); err != nil {
-			return nil, fmt.Errorf("failed to read value: %w", err)
-		}
-		dataBuffer.Write(value)
+	value, err := readValue(r, valueLen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read value: %w", err)
 	}
+	dataBuffer.Write(value)
 
 	// Read checksum
 	var storedChecksum uint32
 	if err := binary.Read(r, binary.BigEndian, &storedChecksum); err != nil {
-		return nil, fmt.Errorf("failed to read checksum: %w", err)
+		return nil, fmt.Errorf("failed to read checksum: %w", truncated(err))
 	}
 
 	// Verify checksum
 	computedChecksum := crc32.ChecksumIEEE(dataBuffer.Bytes())
 	if computedChecksum != storedChecksum {
-		return nil, fmt.Errorf("checksum mismatch: expected 0x%X, got 0x%X (data corrupted)", storedChecksum, computedChecksum)
+		return nil, fmt.Errorf("%w: expected 0x%X, got 0x%X (data corrupted)", ErrChecksumMismatch, storedChecksum, computedChecksum)
 	}
 
 	return &Entry{
+		LSN:       lsn,
 		Operation: operation,
 		Timestamp: timestamp,
 		Key:       string(key),
 		Value:     value,
 	}, nil
 }
+
+// valueChunk is the most a value length makes a decoder allocate before the
+// bytes it describes have been read
+const valueChunk = 1 << 20
+
+// readValue reads a value of n bytes. Long values are read a chunk at a time,
+// so a corrupted length fails with ErrTruncatedEntry at the end of the data
+// instead of allocating up to 4 GiB first
+func readValue(r io.Reader, n uint32) ([]byte, error) {
+	value := make([]byte, 0, min(n, valueChunk))
+	for len(value) < int(n) {
+		start := len(value)
+		chunk := min(int(n)-start, valueChunk)
+		value = slices.Grow(value, chunk)[:start+chunk]
+		if _, err := io.ReadFull(r, value[start:]); err != nil {
+			return nil, truncated(err)
+		}
+	}
+	return value, nil
+}
@@ -3,6 +3,8 @@ package kvstore
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"os"
 	"strings"
 	"testing"
 	"time"
@@ -60,8 +62,8 @@ func TestEntryInvalidMagic(t *testing.T) {
 		t.Error("Expected error for invalid magic, got nil")
 	}
 
-	if !strings.Contains(err.Error(), "magic") {
-		t.Errorf("Expected magic error, got: %v", err)
+	if !errors.Is(err, ErrInvalidMagic) {
+		t.Errorf("Expected ErrInvalidMagic, got: %v", err)
 	}
 }
 
@@ -181,7 +183,7 @@ func TestEntryLargeKey(t *testing.T) {
 }
 
 func TestEntryLargeValue(t *testing.T) {
-	largeValue := bytes.Repeat([]byte("v"), 100000)
+	largeValue := bytes.Repeat([]byte("v"), 3*valueChunk+100)
 	original := NewSetEntry("key", largeValue)
 
 	var buf bytes.Buffer
@@ -337,8 +339,8 @@ func TestEntryCRC32CorruptedValue(t *testing.T) {
 	if err == nil {
 		t.Error("Expected checksum error for corrupted data, got nil")
 	}
-	if !strings.Contains(err.Error(), "checksum mismatch") {
-		t.Errorf("Expected 'checksum mismatch' error, got: %v", err)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Expected ErrChecksumMismatch, got: %v", err)
 	}
 }
 
@@ -363,8 +365,8 @@ func TestEntryCRC32CorruptedChecksum(t *testing.T) {
 	if err == nil {
 		t.Error("Expected checksum error for corrupted checksum, got nil")
 	}
-	if !strings.Contains(err.Error(), "checksum mismatch") {
-		t.Errorf("Expected 'checksum mismatch' error, got: %v", err)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Expected ErrChecksumMismatch, got: %v", err)
 	}
 }
 
@@ -385,3 +387,116 @@ func TestEntryCRC32TruncatedEntry(t *testing.T) {
 		t.Error("Expected error for truncated entry, got nil")
 	}
 }
+
+func TestEntryBatchRoundTrip(t *testing.T) {
+	entries := []*Entry{
+		NewSetEntry("key1", []byte("value1")),
+		NewDeleteEntry("key2"),
+		NewSetEntry("key3", nil),
+	}
+
+	batch, err := NewBatchEntry(entries)
+	if err != nil {
+		t.Fatalf("NewBatchEntry failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := batch.Encode(&buf); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	decoded, err := DecodeEntry(&buf)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+
+	if decoded.Operation != OpBatch {
+		t.Fatalf("Operation mismatch: got %d, want %d", decoded.Operation, OpBatch)
+	}
+
+	inner, err := decoded.BatchEntries()
+	if err != nil {
+		t.Fatalf("BatchEntries failed: %v", err)
+	}
+
+	if len(inner) != len(entries) {
+		t.Fatalf("Expected %d entries, got %d", len(entries), len(inner))
+	}
+
+	for i := range entries {
+		if inner[i].Operation != entries[i].Operation || inner[i].Key != entries[i].Key {
+			t.Errorf("Entry %d mismatch: got %d/%q, want %d/%q", i, inner[i].Operation, inner[i].Key, entries[i].Operation, entries[i].Key)
+		}
+	}
+}
+
+func TestEntryBatchRejectsNested(t *testing.T) {
+	inner, err := NewBatchEntry([]*Entry{NewSetEntry("k", []byte("v"))})
+	if err != nil {
+		t.Fatalf("NewBatchEntry failed: %v", err)
+	}
+
+	if _, err := NewBatchEntry([]*Entry{inner}); err == nil {
+		t.Error("Expected error for nested batch, got nil")
+	}
+}
+
+func TestEntrySetWithTTL(t *testing.T) {
+	expiresAt := time.Now().Add(time.Minute).UnixNano()
+	original := NewSetWithTTLEntry("session", []byte("abc"), expiresAt)
+
+	var buf bytes.Buffer
+	if err := original.Encode(&buf); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	decoded, err := DecodeEntry(&buf)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+
+	gotExpiresAt, value, err := decodeTTLValue(decoded.Value)
+	if err != nil {
+		t.Fatalf("decodeTTLValue failed: %v", err)
+	}
+	if gotExpiresAt != expiresAt {
+		t.Errorf("ExpiresAt mismatch: got %d, want %d", gotExpiresAt, expiresAt)
+	}
+	if !bytes.Equal(value, []byte("abc")) {
+		t.Errorf("Value mismatch: got %q, want %q", value, "abc")
+	}
+}
+
+func TestEntryTTLValueTooShort(t *testing.T) {
+	if _, _, err := decodeTTLValue([]byte{1, 2, 3}); err == nil {
+		t.Error("Expected error for short TTL payload, got nil")
+	}
+}
+
+// TestEntryHugeValueLength tests that a corrupted value length is reported
+// as corruption of the segment instead of allocating the length it claims
+func TestEntryHugeValueLength(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewSetEntry("key", []byte("value")).Encode(&buf); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	data := buf.Bytes()
+	binary.BigEndian.PutUint32(data[entryHeaderSizeV2+3:], 0xFFFFFFFF)
+
+	if _, err := DecodeEntry(bytes.NewReader(data)); !errors.Is(err, ErrTruncatedEntry) {
+		t.Errorf("Expected ErrTruncatedEntry, got %v", err)
+	}
+
+	path := segmentPath(t.TempDir(), 1)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	_, corruption, err := scanSegment(segment{firstLSN: 1, path: path}, nil)
+	if err != nil {
+		t.Fatalf("scanSegment failed: %v", err)
+	}
+	var cerr *CorruptionError
+	if !errors.As(corruption, &cerr) || cerr.Offset != 0 {
+		t.Errorf("Expected a *CorruptionError at offset 0, got %v", corruption)
+	}
+}
@@ -0,0 +1,102 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// MaxKeySize is the largest key, in bytes, the store accepts. Decoding
+// rejects longer keys as corruption instead of allocating them
+const MaxKeySize = 64 << 10
+
+// maxValueSize is the largest value the 32-bit length fields can describe
+const maxValueSize = 1<<32 - 1
+
+var (
+	// ErrClosed is returned when using a store after Close
+	ErrClosed = errors.New("store is closed")
+
+	// ErrKeyTooLarge is returned when writing a key longer than MaxKeySize,
+	// and when decoding a record whose key length exceeds it
+	ErrKeyTooLarge = errors.New("key too large")
+
+	// ErrValueTooLarge is returned when writing a value whose length does not
+	// fit in the 32-bit length field
+	ErrValueTooLarge = errors.New("value too large")
+
+	// ErrChecksumMismatch means a record does not match its CRC32
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+
+	// ErrTruncatedEntry means the data ended in the middle of a record
+	ErrTruncatedEntry = errors.New("truncated entry")
+
+	// ErrInvalidMagic means a record does not start with a known magic number
+	ErrInvalidMagic = errors.New("invalid magic")
+
+	// ErrUnexpectedLSN means a WAL entry does not follow the previous one
+	ErrUnexpectedLSN = errors.New("unexpected LSN")
+)
+
+// CorruptionError reports where a record of a WAL segment or snapshot failed
+// to decode. Err wraps one of ErrChecksumMismatch, ErrTruncatedEntry,
+// ErrInvalidMagic, ErrKeyTooLarge or ErrUnexpectedLSN, so errors.Is works
+// through it
+type CorruptionError struct {
+	File   string // file name in the data directory, "" if unknown
+	Offset int64  // where the record starts in the file
+	Index  int    // position of the record in a snapshot, -1 for the header or a WAL entry
+	LSN    uint64 // LSN the WAL entry was expected to have, 0 for a snapshot
+	Err    error
+}
+
+func (e *CorruptionError) Error() string {
+	var b strings.Builder
+	if e.File != "" {
+		b.WriteString(e.File + ": ")
+	}
+	switch {
+	case e.LSN != 0:
+		fmt.Fprintf(&b, "entry %d at offset %d: ", e.LSN, e.Offset)
+	case e.Index >= 0:
+		fmt.Fprintf(&b, "entry %d at offset %d: ", e.Index, e.Offset)
+	default:
+		fmt.Fprintf(&b, "header at offset %d: ", e.Offset)
+	}
+	b.WriteString(e.Err.Error())
+	return b.String()
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return e.Err
+}
+
+// truncated marks a short read as ErrTruncatedEntry, keeping the io error
+// in the chain
+func truncated(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %w", ErrTruncatedEntry, err)
+	}
+	return err
+}
+
+// isCorruption reports whether err means the data itself is damaged, as
+// opposed to failing to read it
+func isCorruption(err error) bool {
+	for _, target := range []error{ErrChecksumMismatch, ErrTruncatedEntry, ErrInvalidMagic, ErrKeyTooLarge, ErrUnexpectedLSN} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// withFile fills in the file name of a *CorruptionError in err's chain
+func withFile(err error, file string) error {
+	var cerr *CorruptionError
+	if errors.As(err, &cerr) && cerr.File == "" {
+		cerr.File = file
+	}
+	return err
+}
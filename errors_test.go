@@ -0,0 +1,156 @@
+package kvstore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestCorruptionErrorWAL tests that a damaged WAL entry is reported with its
+// segment, offset and LSN
+func TestCorruptionErrorWAL(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	wal, err := NewWAL(dir, true)
+	if err != nil {
+		t.Fatalf("NewWAL failed: %v", err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if err := wal.Append(NewSetEntry(key, []byte("value"))); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	entrySize := wal.Size() / 3
+	seg := wal.segments[0]
+	wal.Close()
+
+	data, err := os.ReadFile(seg.path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	data[2*entrySize-6] ^= 0xFF
+	if err := os.WriteFile(seg.path, data, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	last, stop, err := scanSegment(seg, nil)
+	if err != nil || last != 1 {
+		t.Fatalf("Expected to stop after LSN 1, got %d, %v", last, err)
+	}
+	var cerr *CorruptionError
+	if !errors.As(stop, &cerr) {
+		t.Fatalf("Expected a CorruptionError, got %v", stop)
+	}
+	if cerr.File != filepath.Base(seg.path) || cerr.Offset != entrySize || cerr.LSN != 2 {
+		t.Errorf("Unexpected position: %+v", cerr)
+	}
+	if !errors.Is(stop, ErrChecksumMismatch) {
+		t.Errorf("Expected ErrChecksumMismatch, got %v", stop)
+	}
+}
+
+// TestCorruptionErrorSnapshot tests that Open reports a damaged snapshot
+// record with its index and offset
+func TestCorruptionErrorSnapshot(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		store.Set(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("value%d", i)))
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Every record is KeyLen | "keyN" | ValueLen | "valueN" | ExpiresAt | CRC
+	recordSize := int64(4 + 4 + 4 + 6 + 8 + 4)
+	path := filepath.Join(dir, snapshotFilename)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	data[snapshotHeaderV3+recordSize+14] ^= 0xFF
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	_, err = Open(dir)
+	var cerr *CorruptionError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("Expected a CorruptionError, got %v", err)
+	}
+	if cerr.File != snapshotFilename || cerr.Index != 1 || cerr.Offset != snapshotHeaderV3+recordSize {
+		t.Errorf("Unexpected position: %+v", cerr)
+	}
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Expected ErrChecksumMismatch, got %v", err)
+	}
+}
+
+// TestTruncatedEntry tests that a short read is both ErrTruncatedEntry and
+// the underlying io error
+func TestTruncatedEntry(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewSetEntry("key", []byte("value")).Encode(&buf); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	_, err := DecodeEntry(bytes.NewReader(buf.Bytes()[:buf.Len()-3]))
+	if !errors.Is(err, ErrTruncatedEntry) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected ErrTruncatedEntry, got %v", err)
+	}
+}
+
+// TestKeyTooLarge tests that oversized keys are rejected without breaking
+// the WAL
+func TestKeyTooLarge(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	key := strings.Repeat("k", MaxKeySize+1)
+	if err := store.Set(key, []byte("v")); !errors.Is(err, ErrKeyTooLarge) {
+		t.Errorf("Set: expected ErrKeyTooLarge, got %v", err)
+	}
+	err = store.Batch(func(b *WriteBatch) error {
+		b.Put("ok", []byte("v"))
+		b.Put(key, []byte("v"))
+		return nil
+	})
+	if !errors.Is(err, ErrKeyTooLarge) {
+		t.Errorf("Batch: expected ErrKeyTooLarge, got %v", err)
+	}
+
+	if err := store.Set("key", []byte("v")); err != nil {
+		t.Fatalf("Set after a rejected key failed: %v", err)
+	}
+	if _, ok := store.Get("ok"); ok {
+		t.Error("Rejected batch should not be applied")
+	}
+
+	// A corrupted length is rejected before allocating the key
+	var buf bytes.Buffer
+	if err := NewSetEntry("key", nil).Encode(&buf); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	data := buf.Bytes()
+	data[entryHeaderSizeV2-4] = 0xFF
+	if _, err := DecodeEntry(bytes.NewReader(data)); !errors.Is(err, ErrKeyTooLarge) {
+		t.Errorf("Expected ErrKeyTooLarge decoding a huge key length, got %v", err)
+	}
+}
@@ -0,0 +1,312 @@
+// Package httpapi exposes a kvstore.Store as a REST API over HTTP
+//
+//	GET    /keys/{key}   value as the response body, 404 if absent
+//	HEAD   /keys/{key}   200 or 404 without a body
+//	PUT    /keys/{key}   store the request body; 201 if created, 204 if replaced
+//	DELETE /keys/{key}   204 if removed, 404 if absent
+//	GET    /keys         list keys as JSON (?prefix=, ?after=, ?limit=)
+//
+// Keys may contain slashes and are URL-decoded, so any byte string can be used
+// as a key. Bodies are stored byte for byte, and the Content-Type sent with a
+// PUT is kept in a separate metadata key (see metaPrefix) and returned by
+// later GETs
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caresle/kvstore"
+)
+
+const (
+	// MaxValueBytes is the largest request body a PUT accepts
+	MaxValueBytes = 64 << 20
+
+	// defaultListLimit and maxListLimit bound the keys in one listing page
+	defaultListLimit = 100
+	maxListLimit     = 1000
+
+	// metaPrefix marks the keys holding the Content-Type of a value. They
+	// sort before every key the API accepts and are hidden from listings
+	metaPrefix = "\x00content-type\x00"
+)
+
+var (
+	errEmptyKey    = errors.New("key must not be empty")
+	errReservedKey = errors.New("keys starting with a NUL byte are reserved")
+	errNotFound    = errors.New("key not found")
+	errExists      = errors.New("key already exists")
+)
+
+// Handler serves the REST API for one store
+type Handler struct {
+	store *kvstore.Store
+	mux   *http.ServeMux
+}
+
+// NewHandler returns a handler serving store under /keys
+func NewHandler(store *kvstore.Store) *Handler {
+	h := &Handler{store: store, mux: http.NewServeMux()}
+
+	// GET patterns also match HEAD requests
+	h.mux.HandleFunc("GET /keys", h.list)
+	h.mux.HandleFunc("GET /keys/{$}", h.list)
+	h.mux.HandleFunc("GET /keys/{key...}", h.get)
+	h.mux.HandleFunc("PUT /keys/{key...}", h.put)
+	h.mux.HandleFunc("DELETE /keys/{key...}", h.delete)
+
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// listResponse is the body of a listing
+type listResponse struct {
+	Keys []string `json:"keys"`
+	// Next is passed as ?after= to fetch the following page; empty on the
+	// last page
+	Next string `json:"next,omitempty"`
+}
+
+// errorResponse is the body of every error reply
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// get serves GET and HEAD /keys/{key}
+func (h *Handler) get(w http.ResponseWriter, r *http.Request) {
+	key, err := keyFromRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var value, meta []byte
+	var found bool
+	err = h.store.View(func(tx *kvstore.Txn) error {
+		if value, found = tx.Get(key); found {
+			meta, _ = tx.Get(metaPrefix + key)
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, errNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType(meta, value))
+	w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+	if ttl, ok := h.store.TTL(key); ok && ttl != kvstore.NoExpiry {
+		w.Header().Set("X-TTL", strconv.FormatInt(int64((ttl+time.Second-1)/time.Second), 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(value)
+	}
+}
+
+// put serves PUT /keys/{key}
+//
+// ?ttl=<duration> (e.g. 30s) makes the key expire, and If-None-Match: * only
+// writes the key if it does not exist (412 otherwise)
+func (h *Handler) put(w http.ResponseWriter, r *http.Request) {
+	key, err := keyFromRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var ttl time.Duration
+	if raw := r.URL.Query().Get("ttl"); raw != "" {
+		if ttl, err = time.ParseDuration(raw); err != nil || ttl <= 0 {
+			writeError(w, http.StatusBadRequest, kvstore.ErrInvalidTTL)
+			return
+		}
+	}
+	ifNoneMatch := r.Header.Get("If-None-Match") == "*"
+
+	value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxValueBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var created bool
+	err = h.store.Update(func(tx *kvstore.Txn) error {
+		_, exists := tx.Get(key)
+		if exists && ifNoneMatch {
+			return errExists
+		}
+		created = !exists
+
+		// The content type expires with the value it describes
+		set := func(key string, value []byte) error {
+			if ttl > 0 {
+				return tx.SetWithTTL(key, value, ttl)
+			}
+			return tx.Set(key, value)
+		}
+
+		if err := set(key, value); err != nil {
+			return err
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "" {
+			return set(metaPrefix+key, encodeMeta(ct, value))
+		}
+		return tx.Delete(metaPrefix + key)
+	})
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+
+	if created {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// delete serves DELETE /keys/{key}
+func (h *Handler) delete(w http.ResponseWriter, r *http.Request) {
+	key, err := keyFromRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var found bool
+	err = h.store.Update(func(tx *kvstore.Txn) error {
+		if _, found = tx.Get(key); !found {
+			return nil
+		}
+		if err := tx.Delete(key); err != nil {
+			return err
+		}
+		return tx.Delete(metaPrefix + key)
+	})
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, errNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// list serves GET /keys?prefix=&after=&limit=
+// Keys are returned in ascending order, at most limit per page
+func (h *Handler) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix, after := query.Get("prefix"), query.Get("after")
+
+	limit := defaultListLimit
+	if raw := query.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxListLimit {
+			writeError(w, http.StatusBadRequest, errors.New("limit must be between 1 and "+strconv.Itoa(maxListLimit)))
+			return
+		}
+		limit = n
+	}
+
+	lo, hi := kvstore.PrefixRange(prefix)
+	if after != "" && after+"\x00" > lo {
+		lo = after + "\x00"
+	}
+
+	resp := listResponse{Keys: []string{}}
+	for key := range h.store.Range(lo, hi) {
+		if strings.HasPrefix(key, "\x00") {
+			continue
+		}
+		if len(resp.Keys) == limit {
+			resp.Next = resp.Keys[limit-1]
+			break
+		}
+		resp.Keys = append(resp.Keys, key)
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// keyFromRequest returns the decoded key of a /keys/{key} request
+func keyFromRequest(r *http.Request) (string, error) {
+	key := r.PathValue("key")
+	if key == "" {
+		return "", errEmptyKey
+	}
+	if key[0] == 0 {
+		return "", errReservedKey
+	}
+	return key, nil
+}
+
+// encodeMeta records a content type together with the checksum of the value
+// it was sent with, so a value later overwritten by another API (which does
+// not know about content types) is not served with a stale one
+func encodeMeta(contentType string, value []byte) []byte {
+	return strconv.AppendUint([]byte(contentType+"\x00"), uint64(crc32.ChecksumIEEE(value)), 10)
+}
+
+// contentType returns the Content-Type recorded for value, or one sniffed
+// from its first bytes
+func contentType(meta, value []byte) string {
+	if i := strings.LastIndexByte(string(meta), 0); i >= 0 {
+		sum, err := strconv.ParseUint(string(meta[i+1:]), 10, 32)
+		if err == nil && uint32(sum) == crc32.ChecksumIEEE(value) {
+			return string(meta[:i])
+		}
+	}
+	return http.DetectContentType(value)
+}
+
+// statusFor maps a store error to an HTTP status code
+func statusFor(err error) int {
+	switch {
+	case errors.Is(err, errExists):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, kvstore.ErrInvalidTTL), errors.Is(err, kvstore.ErrKeyTooLarge):
+		return http.StatusBadRequest
+	case errors.Is(err, kvstore.ErrValueTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, kvstore.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, kvstore.ErrReadOnly):
+		return http.StatusForbidden
+	case errors.Is(err, kvstore.ErrClosed):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,315 @@
+package httpapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caresle/kvstore"
+)
+
+// newTestServer serves a fresh store over HTTP
+func newTestServer(t *testing.T) (*kvstore.Store, *httptest.Server) {
+	t.Helper()
+
+	store, err := kvstore.OpenWithConfig(kvstore.Config{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	server := httptest.NewServer(NewHandler(store))
+	t.Cleanup(func() {
+		server.Close()
+		store.Close()
+	})
+
+	return store, server
+}
+
+// do sends a request and returns the response with its body read
+func do(t *testing.T, method, url string, body []byte, header http.Header) (*http.Response, []byte) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("NewRequest failed: %v", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Reading body failed: %v", err)
+	}
+	return resp, data
+}
+
+// TestHandlerPutGetDelete tests the lifecycle of a key
+func TestHandlerPutGetDelete(t *testing.T) {
+	store, server := newTestServer(t)
+	url := server.URL + "/keys/user:1"
+
+	resp, _ := do(t, http.MethodPut, url, []byte("alice"), nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("First PUT: expected 201, got %d", resp.StatusCode)
+	}
+	resp, _ = do(t, http.MethodPut, url, []byte("bob"), nil)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Second PUT: expected 204, got %d", resp.StatusCode)
+	}
+
+	resp, body := do(t, http.MethodGet, url, nil, nil)
+	if resp.StatusCode != http.StatusOK || string(body) != "bob" {
+		t.Errorf("GET: expected 200 bob, got %d %q", resp.StatusCode, body)
+	}
+	if value, ok := store.Get("user:1"); !ok || string(value) != "bob" {
+		t.Errorf("Store should hold bob, got %q", value)
+	}
+
+	resp, body = do(t, http.MethodHead, url, nil, nil)
+	if resp.StatusCode != http.StatusOK || len(body) != 0 || resp.ContentLength != 3 {
+		t.Errorf("HEAD: expected 200 with length 3 and no body, got %d %d %q", resp.StatusCode, resp.ContentLength, body)
+	}
+
+	resp, _ = do(t, http.MethodDelete, url, nil, nil)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE: expected 204, got %d", resp.StatusCode)
+	}
+	resp, _ = do(t, http.MethodDelete, url, nil, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Second DELETE: expected 404, got %d", resp.StatusCode)
+	}
+
+	resp, body = do(t, http.MethodGet, url, nil, nil)
+	if resp.StatusCode != http.StatusNotFound || !strings.Contains(string(body), "not found") {
+		t.Errorf("GET after DELETE: expected 404 with JSON error, got %d %q", resp.StatusCode, body)
+	}
+	resp, _ = do(t, http.MethodHead, url, nil, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("HEAD after DELETE: expected 404, got %d", resp.StatusCode)
+	}
+}
+
+// TestHandlerBinaryAndContentType tests that bodies and content types
+// survive a round trip and that odd keys work
+func TestHandlerBinaryAndContentType(t *testing.T) {
+	store, server := newTestServer(t)
+
+	value := []byte{0x00, 0xff, '\r', '\n', 0x80}
+	url := server.URL + "/keys/dir/sub%2Fname%20x"
+	resp, _ := do(t, http.MethodPut, url, value, http.Header{"Content-Type": {"image/x-custom"}})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT: expected 201, got %d", resp.StatusCode)
+	}
+
+	if _, ok := store.Get("dir/sub/name x"); !ok {
+		t.Errorf("Key should be URL-decoded, keys: %q", store.Keys())
+	}
+
+	resp, body := do(t, http.MethodGet, url, nil, nil)
+	if !bytes.Equal(body, value) {
+		t.Errorf("Expected %v, got %v", value, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "image/x-custom" {
+		t.Errorf("Expected stored content type, got %q", ct)
+	}
+	if raw, _ := store.Get("dir/sub/name x"); !bytes.Equal(raw, value) {
+		t.Errorf("Other APIs should see the body as sent, got %v", raw)
+	}
+
+	// A write that bypasses the API makes the stored content type stale
+	store.Set("dir/sub/name x", []byte("plain text"))
+	resp, _ = do(t, http.MethodGet, url, nil, nil)
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Expected sniffed content type, got %q", ct)
+	}
+
+	// Metadata keys are hidden and cannot be written through the API
+	_, body = do(t, http.MethodGet, server.URL+"/keys", nil, nil)
+	if strings.Contains(string(body), "content-type") {
+		t.Errorf("Listing should hide metadata keys, got %s", body)
+	}
+	resp, _ = do(t, http.MethodPut, server.URL+"/keys/%00content-type%00x", []byte("v"), nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("PUT of a reserved key: expected 400, got %d", resp.StatusCode)
+	}
+}
+
+// TestHandlerBodyLooksTyped tests that bodies are never parsed for a content
+// type, whatever bytes they start with
+func TestHandlerBodyLooksTyped(t *testing.T) {
+	store, server := newTestServer(t)
+	url := server.URL + "/keys/raw"
+
+	value := []byte("\x00KVCT\x03abcpayload")
+	do(t, http.MethodPut, url, value, nil)
+	resp, body := do(t, http.MethodGet, url, nil, nil)
+	if !bytes.Equal(body, value) || resp.Header.Get("Content-Type") == "abc" {
+		t.Errorf("Expected the body back unchanged, got %q as %q", body, resp.Header.Get("Content-Type"))
+	}
+
+	form := http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}
+	do(t, http.MethodPut, url, []byte("hello"), form)
+	if raw, _ := store.Get("raw"); string(raw) != "hello" {
+		t.Errorf("Store should hold hello, got %q", raw)
+	}
+}
+
+// TestHandlerTTLHeader tests that X-TTL is only sent for expiring keys and
+// rounds up to whole seconds
+func TestHandlerTTLHeader(t *testing.T) {
+	_, server := newTestServer(t)
+
+	do(t, http.MethodPut, server.URL+"/keys/plain", []byte("v"), nil)
+	resp, _ := do(t, http.MethodGet, server.URL+"/keys/plain", nil, nil)
+	if ttl, ok := resp.Header["X-Ttl"]; ok {
+		t.Errorf("Key without TTL: expected no X-TTL, got %q", ttl)
+	}
+
+	do(t, http.MethodPut, server.URL+"/keys/short?ttl=500ms", []byte("v"), nil)
+	resp, _ = do(t, http.MethodGet, server.URL+"/keys/short", nil, nil)
+	if ttl := resp.Header.Get("X-TTL"); ttl != "1" {
+		t.Errorf("Sub-second TTL: expected X-TTL 1, got %q", ttl)
+	}
+}
+
+// TestHandlerList tests prefix filtering and pagination
+func TestHandlerList(t *testing.T) {
+	store, server := newTestServer(t)
+
+	for i := 0; i < 25; i++ {
+		store.Set(fmt.Sprintf("user:%02d", i), []byte("v"))
+	}
+	store.Set("config", []byte("v"))
+	do(t, http.MethodPut, server.URL+"/keys/typed", []byte("v"), http.Header{"Content-Type": {"text/plain"}})
+
+	var all []string
+	after := ""
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("Listing did not terminate")
+		}
+		resp, body := do(t, http.MethodGet, server.URL+"/keys?prefix=user:&limit=10&after="+after, nil, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("List: expected 200, got %d %s", resp.StatusCode, body)
+		}
+
+		var page listResponse
+		if err := json.Unmarshal(body, &page); err != nil {
+			t.Fatalf("Invalid JSON %q: %v", body, err)
+		}
+		all = append(all, page.Keys...)
+		if page.Next == "" {
+			break
+		}
+		after = page.Next
+	}
+	if len(all) != 25 || all[0] != "user:00" || all[24] != "user:24" {
+		t.Errorf("Expected user:00..user:24, got %v", all)
+	}
+
+	// Typed values are one key like the others
+	_, body := do(t, http.MethodGet, server.URL+"/keys/", nil, nil)
+	var page listResponse
+	json.Unmarshal(body, &page)
+	if len(page.Keys) != 27 || page.Keys[0] != "config" {
+		t.Errorf("Expected 27 keys starting at config, got %v", page.Keys)
+	}
+
+	resp, _ := do(t, http.MethodGet, server.URL+"/keys?limit=0", nil, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Invalid limit: expected 400, got %d", resp.StatusCode)
+	}
+}
+
+// TestHandlerConditionalAndTTL tests If-None-Match and ?ttl=
+func TestHandlerConditionalAndTTL(t *testing.T) {
+	store, server := newTestServer(t)
+	url := server.URL + "/keys/lock"
+	once := http.Header{"If-None-Match": {"*"}}
+
+	resp, _ := do(t, http.MethodPut, url+"?ttl=50ms", []byte("owner-1"), once)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("First PUT: expected 201, got %d", resp.StatusCode)
+	}
+	resp, _ = do(t, http.MethodPut, url, []byte("owner-2"), once)
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("Second PUT: expected 412, got %d", resp.StatusCode)
+	}
+
+	if ttl, ok := store.TTL("lock"); !ok || ttl == kvstore.NoExpiry || ttl <= 0 || ttl > 50*time.Millisecond {
+		t.Errorf("lock should expire within 50ms, got %v", ttl)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	resp, _ = do(t, http.MethodPut, url, []byte("owner-2"), once)
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("PUT after expiry: expected 201, got %d", resp.StatusCode)
+	}
+
+	resp, _ = do(t, http.MethodPut, url+"?ttl=soon", []byte("x"), nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Invalid TTL: expected 400, got %d", resp.StatusCode)
+	}
+}
+
+// TestHandlerBadRequests tests rejected keys, bodies and methods
+func TestHandlerBadRequests(t *testing.T) {
+	_, server := newTestServer(t)
+
+	resp, _ := do(t, http.MethodPut, server.URL+"/keys/big", make([]byte, MaxValueBytes+1), nil)
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Large body: expected 413, got %d", resp.StatusCode)
+	}
+
+	resp, _ = do(t, http.MethodPost, server.URL+"/keys/x", nil, nil)
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST: expected 405, got %d", resp.StatusCode)
+	}
+}
+
+// TestHandlerUnavailable tests the status of writes to a read-only store and
+// of requests to a closed one
+func TestHandlerUnavailable(t *testing.T) {
+	dir := t.TempDir()
+	store, err := kvstore.Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	store.Set("key", []byte("value"))
+	store.Close()
+
+	readOnly, err := kvstore.OpenWithConfig(kvstore.Config{DataDir: dir, ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Read-only Open failed: %v", err)
+	}
+	server := httptest.NewServer(NewHandler(readOnly))
+	defer server.Close()
+
+	resp, body := do(t, http.MethodPut, server.URL+"/keys/key", []byte("other"), nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("PUT to a read-only store: expected 403, got %d %s", resp.StatusCode, body)
+	}
+	resp, _ = do(t, http.MethodGet, server.URL+"/keys/key", nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET from a read-only store: expected 200, got %d", resp.StatusCode)
+	}
+
+	readOnly.Close()
+	resp, body = do(t, http.MethodDelete, server.URL+"/keys/key", nil, nil)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("DELETE on a closed store: expected 503, got %d %s", resp.StatusCode, body)
+	}
+}
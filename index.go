@@ -0,0 +1,135 @@
+package kvstore
+
+import "math/rand/v2"
+
+const (
+	skiplistMaxLevel = 32
+	skiplistP        = 4 // 1/P chance of promoting a node to the next level
+)
+
+// skiplist is an ordered set of keys kept alongside Store.data so range and
+// prefix scans do not need to sort every key
+// It is not safe for concurrent use; the Store protects it with s.mu
+type skiplist struct {
+	head   *skipNode
+	tail   *skipNode
+	level  int
+	length int
+}
+
+type skipNode struct {
+	key  string
+	next []*skipNode
+	prev *skipNode // previous node on level 0, nil for the first node
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		head:  &skipNode{next: make([]*skipNode, skiplistMaxLevel)},
+		level: 1,
+	}
+}
+
+func randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && rand.IntN(skiplistP) == 0 {
+		level++
+	}
+	return level
+}
+
+// findPredecessors fills update with the last node before key on every level
+func (l *skiplist) findPredecessors(key string, update []*skipNode) *skipNode {
+	node := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].key < key {
+			node = node.next[i]
+		}
+		if update != nil {
+			update[i] = node
+		}
+	}
+	return node
+}
+
+// insert adds key to the list; inserting an existing key is a no-op
+func (l *skiplist) insert(key string) {
+	var update [skiplistMaxLevel]*skipNode
+	prev := l.findPredecessors(key, update[:])
+
+	if next := prev.next[0]; next != nil && next.key == key {
+		return
+	}
+
+	level := randomLevel()
+	if level > l.level {
+		for i := l.level; i < level; i++ {
+			update[i] = l.head
+		}
+		l.level = level
+	}
+
+	node := &skipNode{key: key, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+
+	if prev != l.head {
+		node.prev = prev
+	}
+	if node.next[0] != nil {
+		node.next[0].prev = node
+	} else {
+		l.tail = node
+	}
+	l.length++
+}
+
+// remove deletes key from the list; removing a missing key is a no-op
+func (l *skiplist) remove(key string) {
+	var update [skiplistMaxLevel]*skipNode
+	l.findPredecessors(key, update[:])
+
+	node := update[0].next[0]
+	if node == nil || node.key != key {
+		return
+	}
+
+	for i := 0; i < len(node.next); i++ {
+		update[i].next[i] = node.next[i]
+	}
+	for l.level > 1 && l.head.next[l.level-1] == nil {
+		l.level--
+	}
+
+	if node.next[0] != nil {
+		node.next[0].prev = node.prev
+	} else {
+		l.tail = node.prev
+	}
+	l.length--
+}
+
+// seekGE returns the first node with a key >= key, or nil
+func (l *skiplist) seekGE(key string) *skipNode {
+	return l.findPredecessors(key, nil).next[0]
+}
+
+// seekLT returns the last node with a key < key, or nil
+// An empty key means no upper bound and returns the last node
+func (l *skiplist) seekLT(key string) *skipNode {
+	if key == "" {
+		return l.tail
+	}
+	node := l.findPredecessors(key, nil)
+	if node == l.head {
+		return nil
+	}
+	return node
+}
+
+// first returns the smallest node, or nil if the list is empty
+func (l *skiplist) first() *skipNode {
+	return l.head.next[0]
+}
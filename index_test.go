@@ -0,0 +1,141 @@
+package kvstore
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"testing"
+)
+
+// collectForward returns every key walking level 0 forwards
+func collectForward(l *skiplist) []string {
+	var keys []string
+	for node := l.first(); node != nil; node = node.next[0] {
+		keys = append(keys, node.key)
+	}
+	return keys
+}
+
+// collectBackward returns every key walking prev pointers from the tail
+func collectBackward(l *skiplist) []string {
+	var keys []string
+	for node := l.tail; node != nil; node = node.prev {
+		keys = append(keys, node.key)
+	}
+	return keys
+}
+
+// TestSkiplistInsertOrdered tests that keys come out sorted regardless of insert order
+func TestSkiplistInsertOrdered(t *testing.T) {
+	l := newSkiplist()
+	for _, key := range []string{"m", "a", "z", "k", "b", "a"} {
+		l.insert(key)
+	}
+
+	want := []string{"a", "b", "k", "m", "z"}
+	if got := collectForward(l); !slices.Equal(got, want) {
+		t.Errorf("Forward order: got %v, want %v", got, want)
+	}
+	if l.length != len(want) {
+		t.Errorf("Length: got %d, want %d", l.length, len(want))
+	}
+
+	reversed := slices.Clone(want)
+	slices.Reverse(reversed)
+	if got := collectBackward(l); !slices.Equal(got, reversed) {
+		t.Errorf("Backward order: got %v, want %v", got, reversed)
+	}
+}
+
+// TestSkiplistRemove tests removing first, middle, last and missing keys
+func TestSkiplistRemove(t *testing.T) {
+	l := newSkiplist()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		l.insert(key)
+	}
+
+	l.remove("a")
+	l.remove("c")
+	l.remove("d")
+	l.remove("missing")
+
+	if got := collectForward(l); !slices.Equal(got, []string{"b"}) {
+		t.Errorf("Forward after remove: got %v, want [b]", got)
+	}
+	if got := collectBackward(l); !slices.Equal(got, []string{"b"}) {
+		t.Errorf("Backward after remove: got %v, want [b]", got)
+	}
+
+	l.remove("b")
+	if l.first() != nil || l.tail != nil || l.length != 0 {
+		t.Error("Expected empty list after removing every key")
+	}
+}
+
+// TestSkiplistSeek tests seekGE and seekLT boundaries
+func TestSkiplistSeek(t *testing.T) {
+	l := newSkiplist()
+	for _, key := range []string{"b", "d", "f"} {
+		l.insert(key)
+	}
+
+	tests := []struct {
+		key    string
+		wantGE string
+		wantLT string
+	}{
+		{"a", "b", ""},
+		{"b", "b", ""},
+		{"c", "d", "b"},
+		{"f", "f", "d"},
+		{"g", "", "f"},
+	}
+
+	for _, test := range tests {
+		ge := l.seekGE(test.key)
+		if (ge == nil && test.wantGE != "") || (ge != nil && ge.key != test.wantGE) {
+			t.Errorf("seekGE(%q): got %v, want %q", test.key, ge, test.wantGE)
+		}
+		lt := l.seekLT(test.key)
+		if (lt == nil && test.wantLT != "") || (lt != nil && lt.key != test.wantLT) {
+			t.Errorf("seekLT(%q): got %v, want %q", test.key, lt, test.wantLT)
+		}
+	}
+
+	if last := l.seekLT(""); last == nil || last.key != "f" {
+		t.Errorf("seekLT(\"\") should return the last node, got %v", last)
+	}
+}
+
+// TestSkiplistRandomized compares the list against a sorted reference
+func TestSkiplistRandomized(t *testing.T) {
+	l := newSkiplist()
+	reference := make(map[string]bool)
+
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("key-%04d", rand.IntN(1000))
+		if rand.IntN(3) == 0 {
+			l.remove(key)
+			delete(reference, key)
+		} else {
+			l.insert(key)
+			reference[key] = true
+		}
+	}
+
+	want := make([]string, 0, len(reference))
+	for key := range reference {
+		want = append(want, key)
+	}
+	sort.Strings(want)
+
+	if got := collectForward(l); !slices.Equal(got, want) {
+		t.Fatalf("Forward mismatch: got %d keys, want %d", len(got), len(want))
+	}
+
+	slices.Reverse(want)
+	if got := collectBackward(l); !slices.Equal(got, want) {
+		t.Fatalf("Backward mismatch: got %d keys, want %d", len(got), len(want))
+	}
+}
@@ -0,0 +1,167 @@
+package kvstore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// WALRecord is one entry of a WAL segment, as read by InspectWAL
+type WALRecord struct {
+	Segment string // file name of the segment
+	Offset  int64  // where the entry starts in the segment
+	Size    int64  // bytes read for the entry
+	Entry   *Entry // nil if the entry could not be decoded
+	Err     error  // why decoding failed; the rest of the segment is not read
+}
+
+// InspectWAL decodes the entries of every WAL segment in dataDir in order and
+// calls fn for each, without opening the store
+// A segment is read up to the first entry that fails to decode, which fn
+// receives with Err set, like replay stops at the first corruption. Entries
+// from a v1 log have no LSN and are numbered in order
+func InspectWAL(dataDir string, fn func(WALRecord) error) error {
+	segments, err := listSegments(dataDir)
+	if err != nil {
+		return err
+	}
+
+	// A log from before segmentation, not migrated yet
+	if len(segments) == 0 {
+		legacyPath := filepath.Join(dataDir, legacyWALFilename)
+		if _, err := os.Stat(legacyPath); err == nil {
+			segments = append(segments, segment{firstLSN: 1, path: legacyPath})
+		}
+	}
+
+	for _, seg := range segments {
+		if err := inspectSegment(seg, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// inspectSegment reads one segment for InspectWAL
+func inspectSegment(seg segment, fn func(WALRecord) error) error {
+	file, err := os.Open(seg.path)
+	if err != nil {
+		return fmt.Errorf("failed to open WAL segment: %w", err)
+	}
+	defer file.Close()
+
+	br := bufio.NewReader(file)
+	r := &countingReader{r: br}
+	last := seg.firstLSN - 1
+
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			return nil
+		}
+
+		start := r.n
+		entry, err := DecodeEntry(r)
+		rec := WALRecord{Segment: filepath.Base(seg.path), Offset: start, Size: r.n - start}
+		if err != nil {
+			rec.Err = err
+			return fn(rec)
+		}
+
+		if entry.LSN == 0 {
+			entry.LSN = last + 1
+		}
+		last = entry.LSN
+
+		rec.Entry = entry
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// SnapshotInfo describes a snapshot file, as read by InspectSnapshot
+type SnapshotInfo struct {
+	Version    int    // format version, 1 to 3
+	Timestamp  int64  // when the snapshot was written (unix nanoseconds)
+	LSN        uint64 // last WAL entry the snapshot reflects (0 before v3)
+	Count      int    // number of keys in the header
+	Size       int64  // file size in bytes
+	KeyBytes   int64  // total size of the keys
+	ValueBytes int64  // total size of the values
+	WithTTL    int    // keys with an expiry
+	Expired    int    // keys whose expiry has passed
+}
+
+// InspectSnapshot reads and verifies every record of the snapshot in dataDir
+// When a record is corrupted the header fields are still returned along
+// with the error. A missing snapshot is reported as os.ErrNotExist
+func InspectSnapshot(dataDir string) (SnapshotInfo, error) {
+	var info SnapshotInfo
+
+	file, err := os.Open(filepath.Join(dataDir, snapshotFilename))
+	if err != nil {
+		return info, fmt.Errorf("failed to open snapshot file: %w", err)
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return info, fmt.Errorf("failed to stat snapshot file: %w", err)
+	}
+	info.Size = stat.Size()
+
+	r := &countingReader{r: bufio.NewReader(file)}
+	header, err := decodeSnapshotHeader(r)
+	if err != nil {
+		return info, withFile(err, snapshotFilename)
+	}
+
+	switch header.magic {
+	case snapshotMagicV1:
+		info.Version = 1
+	case snapshotMagicV2:
+		info.Version = 2
+	default:
+		info.Version = 3
+	}
+	info.Timestamp = header.timestamp
+	info.LSN = header.lsn
+	info.Count = int(header.count)
+
+	now := time.Now().UnixNano()
+	err = decodeSnapshotRecords(r, header, func(rec record) {
+		info.KeyBytes += int64(len(rec.key))
+		info.ValueBytes += int64(len(rec.value))
+		if rec.expiresAt != 0 {
+			info.WithTTL++
+			if isExpired(rec.expiresAt, now) {
+				info.Expired++
+			}
+		}
+	})
+	if err != nil {
+		return info, withFile(err, snapshotFilename)
+	}
+
+	if r.n != info.Size {
+		return info, fmt.Errorf("%d unexpected bytes after the last entry", info.Size-r.n)
+	}
+
+	return info, nil
+}
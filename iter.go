@@ -0,0 +1,55 @@
+package kvstore
+
+import "iter"
+
+// iterBatchSize is how many pairs an iterator reads per lock acquisition
+const iterBatchSize = 128
+
+// All returns an iterator over every key-value pair in ascending key order
+//
+// Iterators do not materialize the dataset: they read iterBatchSize pairs at a
+// time under the read lock and release it before yielding, so the loop body
+// may freely call other Store methods, including writes. Because of that an
+// iteration is not a point-in-time view:
+//   - every key is yielded at most once, in ascending order
+//   - each pair is the committed value at the moment its batch was read
+//   - writes to keys already passed are not seen; writes to keys after the
+//     current position may or may not be, depending on whether the batch
+//     holding them was read before the write
+//   - expired keys are skipped
+func (s *Store) All() iter.Seq2[string, []byte] {
+	return s.Range("", "")
+}
+
+// Prefix returns an iterator over the pairs whose key starts with prefix
+// See All for the behavior under concurrent writes
+func (s *Store) Prefix(prefix string) iter.Seq2[string, []byte] {
+	return s.Range(PrefixRange(prefix))
+}
+
+// Range returns an iterator over the pairs with lo <= key < hi
+// An empty hi means no upper bound. See All for the behavior under concurrent
+// writes
+func (s *Store) Range(lo, hi string) iter.Seq2[string, []byte] {
+	return func(yield func(string, []byte) bool) {
+		cursor := lo
+		for {
+			s.mu.RLock()
+			pairs := s.scanLocked(cursor, hi, ScanOptions{Limit: iterBatchSize})
+			s.mu.RUnlock()
+
+			for _, pair := range pairs {
+				if !yield(pair.Key, pair.Value) {
+					return
+				}
+			}
+
+			if len(pairs) < iterBatchSize {
+				return
+			}
+
+			// Smallest key strictly greater than the last one yielded
+			cursor = pairs[len(pairs)-1].Key + "\x00"
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package kvstore
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// TestIterAll tests iterating more pairs than one batch in order
+func TestIterAll(t *testing.T) {
+	store, err := OpenWithConfig(Config{DataDir: t.TempDir(), SyncWrites: false})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	const n = iterBatchSize*2 + 7
+	for i := 0; i < n; i++ {
+		store.Set(fmt.Sprintf("key-%04d", i), fmt.Appendf(nil, "value-%d", i))
+	}
+
+	var keys []string
+	for key, value := range store.All() {
+		if want := "value-" + fmt.Sprint(len(keys)); string(value) != want {
+			t.Errorf("Value for %s: got %q, want %q", key, value, want)
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) != n {
+		t.Fatalf("Expected %d keys, got %d", n, len(keys))
+	}
+	if !slices.IsSorted(keys) {
+		t.Error("Keys not yielded in order")
+	}
+}
+
+// TestIterPrefixAndRange tests bounded iterators
+func TestIterPrefixAndRange(t *testing.T) {
+	store := openScanStore(t)
+
+	var keys []string
+	for key := range store.Prefix("user:") {
+		keys = append(keys, key)
+	}
+	if !slices.Equal(keys, []string{"user:1", "user:2", "user:3"}) {
+		t.Errorf("Prefix: got %v", keys)
+	}
+
+	keys = nil
+	for key := range store.Range("session:", "user:2") {
+		keys = append(keys, key)
+	}
+	if !slices.Equal(keys, []string{"session:id", "user:1"}) {
+		t.Errorf("Range: got %v", keys)
+	}
+}
+
+// TestIterEarlyBreak tests that breaking out of the loop stops iteration
+func TestIterEarlyBreak(t *testing.T) {
+	store := openScanStore(t)
+
+	count := 0
+	for range store.All() {
+		count++
+		if count == 2 {
+			break
+		}
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 iterations, got %d", count)
+	}
+}
+
+// TestIterWritesDuringIteration tests the documented behavior under writes
+func TestIterWritesDuringIteration(t *testing.T) {
+	store, err := OpenWithConfig(Config{DataDir: t.TempDir(), SyncWrites: false})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	const n = iterBatchSize * 3
+	for i := 0; i < n; i++ {
+		store.Set(fmt.Sprintf("key-%04d", i), []byte("v"))
+	}
+
+	seen := make(map[string]int)
+	for key := range store.All() {
+		seen[key]++
+
+		if key == "key-0000" {
+			// Writes from the loop body must not deadlock
+			if err := store.Delete(fmt.Sprintf("key-%04d", n-1)); err != nil {
+				t.Fatalf("Delete failed: %v", err)
+			}
+			if err := store.Set("zzz-added", []byte("v")); err != nil {
+				t.Fatalf("Set failed: %v", err)
+			}
+			if err := store.Set("aaa-behind", []byte("v")); err != nil {
+				t.Fatalf("Set failed: %v", err)
+			}
+		}
+	}
+
+	for key, count := range seen {
+		if count != 1 {
+			t.Errorf("Key %s yielded %d times", key, count)
+		}
+	}
+	if _, ok := seen[fmt.Sprintf("key-%04d", n-1)]; ok {
+		t.Error("Key deleted ahead of the cursor should not be yielded")
+	}
+	if _, ok := seen["zzz-added"]; !ok {
+		t.Error("Key added ahead of the cursor should be yielded")
+	}
+	if _, ok := seen["aaa-behind"]; ok {
+		t.Error("Key added behind the cursor should not be yielded")
+	}
+}
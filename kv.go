@@ -0,0 +1,33 @@
+package kvstore
+
+// KV is the key-value interface shared by every backend
+//
+// Code that only needs these operations should depend on KV rather than on a
+// concrete type, so the backend can be swapped: Store for durable data,
+// MemStore for tests and caches, or a remote store through the client package
+type KV interface {
+	// Get retrieves a value, reporting whether the key exists
+	Get(key string) ([]byte, bool)
+
+	// Set stores a key-value pair
+	Set(key string, value []byte) error
+
+	// Delete removes a key. Deleting a missing key is not an error
+	Delete(key string) error
+
+	// Keys returns all keys in ascending order
+	Keys() []string
+
+	// Len returns the number of keys
+	Len() int
+
+	// Close releases the backend's resources. Afterwards reads find nothing
+	// and writes fail. Closing twice is not an error
+	Close() error
+}
+
+var (
+	_ KV = (*Store)(nil)
+	_ KV = (*MemStore)(nil)
+	_ KV = (*Cluster)(nil)
+)
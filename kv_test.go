@@ -0,0 +1,133 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// kvBackends opens a fresh instance of every KV backend
+var kvBackends = map[string]func(t *testing.T) KV{
+	"Store": func(t *testing.T) KV {
+		store, err := OpenWithConfig(Config{DataDir: t.TempDir()})
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		return store
+	},
+	"MemStore": func(t *testing.T) KV {
+		return NewMemStore()
+	},
+}
+
+// TestKVBasicOperations tests that every backend behaves the same
+func TestKVBasicOperations(t *testing.T) {
+	for name, open := range kvBackends {
+		t.Run(name, func(t *testing.T) {
+			kv := open(t)
+			defer kv.Close()
+
+			if _, ok := kv.Get("missing"); ok {
+				t.Error("missing should not exist")
+			}
+			if err := kv.Delete("missing"); err != nil {
+				t.Errorf("Deleting a missing key should succeed, got %v", err)
+			}
+
+			for _, key := range []string{"c", "a", "b"} {
+				if err := kv.Set(key, []byte("v-"+key)); err != nil {
+					t.Fatalf("Set failed: %v", err)
+				}
+			}
+			if err := kv.Set("a", []byte("new")); err != nil {
+				t.Fatalf("Set failed: %v", err)
+			}
+
+			if value, ok := kv.Get("a"); !ok || string(value) != "new" {
+				t.Errorf("Get a: got %q (exists=%v), want new", value, ok)
+			}
+			if keys := kv.Keys(); !slices.Equal(keys, []string{"a", "b", "c"}) {
+				t.Errorf("Expected [a b c], got %v", keys)
+			}
+			if n := kv.Len(); n != 3 {
+				t.Errorf("Expected 3 keys, got %d", n)
+			}
+
+			if err := kv.Delete("b"); err != nil {
+				t.Fatalf("Delete failed: %v", err)
+			}
+			if _, ok := kv.Get("b"); ok {
+				t.Error("b should be deleted")
+			}
+			if keys := kv.Keys(); !slices.Equal(keys, []string{"a", "c"}) {
+				t.Errorf("Expected [a c], got %v", keys)
+			}
+		})
+	}
+}
+
+// TestKVClose tests that every backend rejects writes after Close and can
+// be closed twice
+func TestKVClose(t *testing.T) {
+	for name, open := range kvBackends {
+		t.Run(name, func(t *testing.T) {
+			kv := open(t)
+			kv.Set("key", []byte("value"))
+
+			if err := kv.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+			if err := kv.Close(); err != nil {
+				t.Errorf("Second Close failed: %v", err)
+			}
+
+			if err := kv.Set("key", []byte("other")); !errors.Is(err, ErrClosed) {
+				t.Errorf("Set: expected ErrClosed, got %v", err)
+			}
+			if err := kv.Delete("key"); !errors.Is(err, ErrClosed) {
+				t.Errorf("Delete: expected ErrClosed, got %v", err)
+			}
+			if _, ok := kv.Get("key"); ok {
+				t.Error("Get should find nothing after Close")
+			}
+			if kv.Len() != 0 || len(kv.Keys()) != 0 {
+				t.Errorf("Expected no keys after Close, got %v", kv.Keys())
+			}
+		})
+	}
+}
+
+// TestKVConcurrentAccess tests every backend under concurrent readers and writers
+func TestKVConcurrentAccess(t *testing.T) {
+	for name, open := range kvBackends {
+		t.Run(name, func(t *testing.T) {
+			kv := open(t)
+			defer kv.Close()
+
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(2)
+				go func(i int) {
+					defer wg.Done()
+					for j := 0; j < 50; j++ {
+						kv.Set(fmt.Sprintf("w%d:%d", i, j), []byte("v"))
+					}
+				}(i)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 50; j++ {
+						kv.Get("w0:0")
+						kv.Keys()
+					}
+				}()
+			}
+			wg.Wait()
+
+			if n := kv.Len(); n != 200 {
+				t.Errorf("Expected 200 keys, got %d", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrLocked is returned when opening a data directory that another store,
+// in this process or another one, holds
+var ErrLocked = errors.New("data directory is locked by another store")
+
+// dirLock is a lock held on a data directory
+type dirLock struct {
+	dir    *os.File
+	shared bool
+}
+
+// lockDir locks the data directory itself, so the lock needs no file inside
+// it. An exclusive lock creates the directory if needed; a shared lock (for a
+// read-only store) creates nothing and only excludes writers
+func lockDir(dataDir string, shared bool) (*dirLock, error) {
+	if !shared {
+		if err := os.MkdirAll(dataDir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create data directory: %w", err)
+		}
+	}
+	dir, err := os.Open(dataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open data directory: %w", err)
+	}
+
+	if err := lockFile(dir, shared); err != nil {
+		dir.Close()
+		if errors.Is(err, ErrLocked) {
+			return nil, fmt.Errorf("%w: %s", ErrLocked, dataDir)
+		}
+		return nil, fmt.Errorf("failed to lock data directory: %w", err)
+	}
+
+	return &dirLock{dir: dir, shared: shared}, nil
+}
+
+// release unlocks the directory
+func (l *dirLock) release() error {
+	unlockFile(l.dir, l.shared)
+	return l.dir.Close()
+}
@@ -0,0 +1,55 @@
+//go:build !unix
+
+package kvstore
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Without flock, directories are only locked against other stores in this
+// process
+var (
+	lockedMu   sync.Mutex
+	lockedDirs = make(map[string]int) // -1 for an exclusive lock, else the number of shared locks
+)
+
+// lockFile records a lock on the directory open as file until unlockFile
+func lockFile(file *os.File, shared bool) error {
+	dir, err := filepath.Abs(file.Name())
+	if err != nil {
+		return err
+	}
+
+	lockedMu.Lock()
+	defer lockedMu.Unlock()
+
+	n := lockedDirs[dir]
+	if n < 0 || (n > 0 && !shared) {
+		return ErrLocked
+	}
+	if shared {
+		lockedDirs[dir] = n + 1
+	} else {
+		lockedDirs[dir] = -1
+	}
+	return nil
+}
+
+// unlockFile releases a lock taken by lockFile
+func unlockFile(file *os.File, shared bool) {
+	dir, err := filepath.Abs(file.Name())
+	if err != nil {
+		return
+	}
+
+	lockedMu.Lock()
+	defer lockedMu.Unlock()
+
+	if shared && lockedDirs[dir] > 1 {
+		lockedDirs[dir]--
+	} else {
+		delete(lockedDirs, dir)
+	}
+}
@@ -0,0 +1,118 @@
+package kvstore
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+// TestLockExclusive tests that a data directory can only be opened once
+// until the store holding it is closed
+func TestLockExclusive(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	store.Set("key", []byte("value"))
+
+	if _, err := Open(dir); !errors.Is(err, ErrLocked) {
+		t.Fatalf("Second Open: expected ErrLocked, got %v", err)
+	}
+	if _, err := OpenWithConfig(Config{DataDir: dir, ReadOnly: true}); !errors.Is(err, ErrLocked) {
+		t.Fatalf("Read-only Open: expected ErrLocked, got %v", err)
+	}
+	if _, err := Repair(dir, RepairOptions{}); !errors.Is(err, ErrLocked) {
+		t.Fatalf("Repair: expected ErrLocked, got %v", err)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	store, err = Open(dir)
+	if err != nil {
+		t.Fatalf("Open after Close failed: %v", err)
+	}
+	defer store.Close()
+	if value, ok := store.Get("key"); !ok || string(value) != "value" {
+		t.Errorf("Expected the value written before reopening, got %q", value)
+	}
+}
+
+// TestLockShared tests that read-only stores share a directory with each
+// other but not with a writer
+func TestLockShared(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	store.Set("key", []byte("value"))
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	reader1, err := OpenWithConfig(Config{DataDir: dir, ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Read-only Open failed: %v", err)
+	}
+	reader2, err := OpenWithConfig(Config{DataDir: dir, ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Second read-only Open failed: %v", err)
+	}
+
+	if value, ok := reader2.Get("key"); !ok || string(value) != "value" {
+		t.Errorf("Expected value, got %q", value)
+	}
+	if err := reader1.Set("key", []byte("other")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Set: expected ErrReadOnly, got %v", err)
+	}
+	if _, err := Open(dir); !errors.Is(err, ErrLocked) {
+		t.Fatalf("Open while read: expected ErrLocked, got %v", err)
+	}
+	if _, err := Repair(dir, RepairOptions{DryRun: true}); err != nil {
+		t.Errorf("Dry run while read failed: %v", err)
+	}
+
+	reader1.Close()
+	if _, err := Open(dir); !errors.Is(err, ErrLocked) {
+		t.Fatalf("Open with one reader left: expected ErrLocked, got %v", err)
+	}
+	reader2.Close()
+
+	store, err = Open(dir)
+	if err != nil {
+		t.Fatalf("Open after the readers closed failed: %v", err)
+	}
+	defer store.Close()
+}
+
+// TestLockSharedFirst tests that a read-only store excludes writers even on a
+// directory no writer has opened yet
+func TestLockSharedFirst(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	reader, err := OpenWithConfig(Config{DataDir: dir, ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Read-only Open failed: %v", err)
+	}
+	if _, err := Open(dir); !errors.Is(err, ErrLocked) {
+		t.Fatalf("Open while read: expected ErrLocked, got %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Read-only Open created files: %v", entries)
+	}
+	reader.Close()
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open after the reader closed failed: %v", err)
+	}
+	defer store.Close()
+}
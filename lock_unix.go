@@ -0,0 +1,26 @@
+//go:build unix
+
+package kvstore
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an flock on the data directory itself without waiting
+func lockFile(file *os.File, shared bool) error {
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+
+	err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return ErrLocked
+	}
+	return err
+}
+
+// unlockFile does nothing: closing the file releases the flock
+func unlockFile(*os.File, bool) {}
@@ -0,0 +1,91 @@
+package kvstore
+
+import (
+	"sort"
+	"sync"
+)
+
+// MemStore is a KV backend that keeps everything in memory
+//
+// It has no data directory, WAL or snapshot, so nothing survives Close or a
+// restart. Values are copied on Set, so callers may reuse their buffers
+type MemStore struct {
+	mu   sync.RWMutex
+	data map[string][]byte // nil once closed
+}
+
+// NewMemStore creates an empty in-memory store
+func NewMemStore() *MemStore {
+	return &MemStore{data: make(map[string][]byte)}
+}
+
+// Get retrieves a value, reporting whether the key exists
+func (m *MemStore) Get(key string) ([]byte, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	value, exists := m.data[key]
+	return value, exists
+}
+
+// Set stores a copy of value under key
+func (m *MemStore) Set(key string, value []byte) error {
+	stored := append([]byte{}, value...)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.data == nil {
+		return ErrClosed
+	}
+	m.data[key] = stored
+	return nil
+}
+
+// Delete removes a key
+func (m *MemStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.data == nil {
+		return ErrClosed
+	}
+	delete(m.data, key)
+	return nil
+}
+
+// Keys returns all keys in ascending order
+func (m *MemStore) Keys() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.data == nil {
+		return nil
+	}
+
+	keys := make([]string, 0, len(m.data))
+	for key := range m.data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Len returns the number of keys
+func (m *MemStore) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return len(m.data)
+}
+
+// Close drops every key. Afterwards reads find nothing and writes fail with
+// ErrClosed, as with Store. Closing twice is not an error
+func (m *MemStore) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.data = nil
+	return nil
+}
@@ -0,0 +1,16 @@
+package kvstore
+
+import "testing"
+
+// TestMemStoreCopiesValues tests that callers may reuse their buffers
+func TestMemStoreCopiesValues(t *testing.T) {
+	m := NewMemStore()
+
+	buf := []byte("original")
+	m.Set("key", buf)
+	copy(buf, "mutated!")
+
+	if value, _ := m.Get("key"); string(value) != "original" {
+		t.Errorf("Expected original, got %q", value)
+	}
+}
@@ -0,0 +1,248 @@
+package kvstore
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Metrics receives measurements from a store, see Config.Metrics
+// Implementations must be safe for concurrent use and cheap: they are called
+// on every operation
+type Metrics interface {
+	// Count adds delta to a counter
+	Count(name string, delta int64)
+	// Observe records one sample of a histogram, a duration in seconds or a
+	// size in bytes
+	Observe(name string, value float64)
+	// Gauge sets the current value of a gauge
+	Gauge(name string, value float64)
+}
+
+// Names of the metrics a store reports. Counters end in _total, histograms
+// and gauges in their unit
+const (
+	MetricGets      = "kvstore_gets_total"
+	MetricGetHits   = "kvstore_get_hits_total"
+	MetricGetMisses = "kvstore_get_misses_total"
+	MetricSets      = "kvstore_sets_total"    // applied set operations, batches count each one
+	MetricDeletes   = "kvstore_deletes_total" // applied deletes, including expired keys
+
+	MetricWriteSeconds    = "kvstore_write_duration_seconds"     // histogram, from the call to the write being visible
+	MetricWALWrittenBytes = "kvstore_wal_written_bytes_total"    // bytes appended to the WAL
+	MetricFsyncSeconds    = "kvstore_wal_fsync_duration_seconds" // histogram
+	MetricWALBytes        = "kvstore_wal_size_bytes"             // gauge, bytes in every segment
+
+	MetricReplaySeconds   = "kvstore_replay_duration_seconds"   // gauge, time spent recovering on open
+	MetricSnapshotSeconds = "kvstore_snapshot_duration_seconds" // histogram, checkpoints and Close
+	MetricSnapshotBytes   = "kvstore_snapshot_size_bytes"       // gauge, size of the last snapshot written
+
+	MetricKeys        = "kvstore_keys"         // gauge, keys in memory including expired ones not deleted yet
+	MetricMemoryBytes = "kvstore_memory_bytes" // gauge, estimate of the memory held by keys and values
+)
+
+// keyOverhead is a rough estimate of the memory used per key besides the
+// key and value bytes: map entries, version and skiplist node
+const keyOverhead = 128
+
+// sizeOf estimates the memory held for a key and its value
+func sizeOf(key string, value []byte) int64 {
+	return int64(len(key)+len(value)) + keyOverhead
+}
+
+// nopMetrics discards every measurement
+type nopMetrics struct{}
+
+func (nopMetrics) Count(string, int64)     {}
+func (nopMetrics) Observe(string, float64) {}
+func (nopMetrics) Gauge(string, float64)   {}
+
+// Histogram bucket upper bounds, chosen by the unit at the end of the name
+var (
+	secondsBuckets = []float64{0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	bytesBuckets   = []float64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20, 256 << 20, 1 << 30}
+)
+
+// Registry is a Metrics implementation that keeps every value in memory
+// and exports them in the Prometheus text format or through expvar
+type Registry struct {
+	mu         sync.RWMutex
+	counters   map[string]*atomic.Int64
+	gauges     map[string]*atomic.Uint64 // math.Float64bits of the value
+	histograms map[string]*histogram
+}
+
+// NewRegistry returns an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{
+		counters:   make(map[string]*atomic.Int64),
+		gauges:     make(map[string]*atomic.Uint64),
+		histograms: make(map[string]*histogram),
+	}
+}
+
+// lookup returns the metric called name in m, creating it with create if
+// it does not exist yet
+func lookup[T any](r *Registry, m map[string]T, name string, create func() T) T {
+	r.mu.RLock()
+	v, ok := m[name]
+	r.mu.RUnlock()
+	if ok {
+		return v
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if v, ok := m[name]; ok {
+		return v
+	}
+	v = create()
+	m[name] = v
+	return v
+}
+
+func (r *Registry) Count(name string, delta int64) {
+	lookup(r, r.counters, name, func() *atomic.Int64 { return new(atomic.Int64) }).Add(delta)
+}
+
+func (r *Registry) Gauge(name string, value float64) {
+	lookup(r, r.gauges, name, func() *atomic.Uint64 { return new(atomic.Uint64) }).Store(math.Float64bits(value))
+}
+
+func (r *Registry) Observe(name string, value float64) {
+	lookup(r, r.histograms, name, func() *histogram { return newHistogram(name) }).observe(value)
+}
+
+// WritePrometheus writes every metric in the Prometheus text exposition
+// format, sorted by name
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	var b strings.Builder
+	r.each(func(name string, counter *atomic.Int64) {
+		fmt.Fprintf(&b, "# TYPE %s counter\n%s %d\n", name, name, counter.Load())
+	}, func(name string, gauge *atomic.Uint64) {
+		fmt.Fprintf(&b, "# TYPE %s gauge\n%s %s\n", name, name, formatFloat(math.Float64frombits(gauge.Load())))
+	}, func(name string, h histogramValue) {
+		fmt.Fprintf(&b, "# TYPE %s histogram\n", name)
+		var cumulative uint64
+		for i, bound := range h.bounds {
+			cumulative += h.counts[i]
+			fmt.Fprintf(&b, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(&b, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+		fmt.Fprintf(&b, "%s_sum %s\n%s_count %d\n", name, formatFloat(h.sum), name, h.count)
+	})
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WritePrometheus(w)
+}
+
+// Expvar returns the metrics as an expvar.Var, for expvar.Publish. Counters
+// and gauges are numbers, histograms objects with count, sum and the
+// cumulative count of each bucket
+func (r *Registry) Expvar() expvar.Var {
+	return expvar.Func(func() any {
+		vars := make(map[string]any)
+		r.each(func(name string, counter *atomic.Int64) {
+			vars[name] = counter.Load()
+		}, func(name string, gauge *atomic.Uint64) {
+			vars[name] = math.Float64frombits(gauge.Load())
+		}, func(name string, h histogramValue) {
+			buckets := make(map[string]uint64, len(h.bounds))
+			var cumulative uint64
+			for i, bound := range h.bounds {
+				cumulative += h.counts[i]
+				buckets[formatFloat(bound)] = cumulative
+			}
+			vars[name] = map[string]any{"count": h.count, "sum": h.sum, "buckets": buckets}
+		})
+		return vars
+	})
+}
+
+// each calls the function for the kind of every metric, in name order.
+// Histograms are passed as a consistent copy
+func (r *Registry) each(counter func(string, *atomic.Int64), gauge func(string, *atomic.Uint64), hist func(string, histogramValue)) {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.counters)+len(r.gauges)+len(r.histograms))
+	for name := range r.counters {
+		names = append(names, name)
+	}
+	for name := range r.gauges {
+		names = append(names, name)
+	}
+	for name := range r.histograms {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		if c, ok := r.counters[name]; ok {
+			counter(name, c)
+		} else if g, ok := r.gauges[name]; ok {
+			gauge(name, g)
+		} else {
+			hist(name, r.histograms[name].snapshot())
+		}
+	}
+	r.mu.RUnlock()
+}
+
+// histogram counts samples into buckets
+type histogram struct {
+	mu sync.Mutex
+	histogramValue
+}
+
+// histogramValue is the state of a histogram
+type histogramValue struct {
+	bounds []float64
+	counts []uint64 // samples per bucket (not cumulative), len(bounds)
+	sum    float64
+	count  uint64 // every sample, including those above the last bound
+}
+
+func newHistogram(name string) *histogram {
+	bounds := secondsBuckets
+	if strings.HasSuffix(name, "_bytes") {
+		bounds = bytesBuckets
+	}
+	return &histogram{histogramValue: histogramValue{bounds: bounds, counts: make([]uint64, len(bounds))}}
+}
+
+func (h *histogram) observe(value float64) {
+	i, _ := slices.BinarySearch(h.bounds, value)
+
+	h.mu.Lock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += value
+	h.count++
+	h.mu.Unlock()
+}
+
+// snapshot returns a copy that can be read without the lock
+func (h *histogram) snapshot() histogramValue {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	v := h.histogramValue
+	v.counts = slices.Clone(v.counts)
+	return v
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,151 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestRegistryPrometheus tests the Prometheus text format
+func TestRegistryPrometheus(t *testing.T) {
+	r := NewRegistry()
+	r.Count("test_total", 2)
+	r.Count("test_total", 3)
+	r.Gauge("test_bytes", 1.5)
+	r.Observe("test_seconds", 0.0001)
+	r.Observe("test_seconds", 0.003)
+	r.Observe("test_seconds", 60)
+
+	var b strings.Builder
+	if err := r.WritePrometheus(&b); err != nil {
+		t.Fatalf("WritePrometheus failed: %v", err)
+	}
+	out := b.String()
+
+	for _, want := range []string{
+		"# TYPE test_bytes gauge\ntest_bytes 1.5\n",
+		"# TYPE test_seconds histogram\n",
+		"test_seconds_bucket{le=\"5e-05\"} 0\n",
+		"test_seconds_bucket{le=\"0.0001\"} 1\n",
+		"test_seconds_bucket{le=\"0.005\"} 2\n",
+		"test_seconds_bucket{le=\"10\"} 2\n",
+		"test_seconds_bucket{le=\"+Inf\"} 3\n",
+		"test_seconds_sum 60.0031\ntest_seconds_count 3\n",
+		"# TYPE test_total counter\ntest_total 5\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Missing %q in:\n%s", want, out)
+		}
+	}
+	if strings.Index(out, "test_bytes") > strings.Index(out, "test_total") {
+		t.Errorf("Metrics should be sorted by name:\n%s", out)
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Body.String() != out || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("ServeHTTP should serve the text format, got %q", rec.Header().Get("Content-Type"))
+	}
+}
+
+// TestRegistryExpvar tests the JSON published through expvar
+func TestRegistryExpvar(t *testing.T) {
+	r := NewRegistry()
+	r.Count("test_total", 4)
+	r.Observe("test_bytes", 2048)
+
+	var vars struct {
+		Total int64 `json:"test_total"`
+		Bytes struct {
+			Count   uint64            `json:"count"`
+			Sum     float64           `json:"sum"`
+			Buckets map[string]uint64 `json:"buckets"`
+		} `json:"test_bytes"`
+	}
+	if err := json.Unmarshal([]byte(r.Expvar().String()), &vars); err != nil {
+		t.Fatalf("Invalid expvar JSON: %v", err)
+	}
+	if vars.Total != 4 || vars.Bytes.Count != 1 || vars.Bytes.Sum != 2048 {
+		t.Errorf("Unexpected values: %+v", vars)
+	}
+	if vars.Bytes.Buckets["1024"] != 0 || vars.Bytes.Buckets["4096"] != 1 {
+		t.Errorf("Unexpected buckets: %v", vars.Bytes.Buckets)
+	}
+}
+
+// TestStoreMetrics tests what a store reports
+func TestStoreMetrics(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	store.Set("replayed", []byte("v"))
+	simulateCrash(store)
+
+	r := NewRegistry()
+	store, err = OpenWithConfig(Config{DataDir: dir, SyncWrites: true, Metrics: r})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	store.Set("a", []byte("12345"))
+	store.Batch(func(b *WriteBatch) error {
+		b.Put("b", []byte("v"))
+		b.Delete("replayed")
+		return nil
+	})
+	store.Get("a")
+	store.Get("missing")
+	if err := store.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+
+	counters := map[string]int64{
+		MetricGets:      2,
+		MetricGetHits:   1,
+		MetricGetMisses: 1,
+		MetricSets:      2, // the replayed set is not counted
+		MetricDeletes:   1,
+	}
+	for name, want := range counters {
+		if got := r.counters[name].Load(); got != want {
+			t.Errorf("%s: got %d, want %d", name, got, want)
+		}
+	}
+
+	gauge := func(name string) float64 {
+		var out strings.Builder
+		r.WritePrometheus(&out)
+		for _, line := range strings.Split(out.String(), "\n") {
+			if value, ok := strings.CutPrefix(line, name+" "); ok {
+				var v float64
+				json.Unmarshal([]byte(value), &v)
+				return v
+			}
+		}
+		t.Fatalf("%s not reported", name)
+		return 0
+	}
+	if keys := gauge(MetricKeys); keys != 2 {
+		t.Errorf("Expected 2 keys, got %v", keys)
+	}
+	if memory := gauge(MetricMemoryBytes); memory != float64(sizeOf("a", []byte("12345"))+sizeOf("b", []byte("v"))) {
+		t.Errorf("Unexpected memory estimate %v", memory)
+	}
+	if gauge(MetricSnapshotBytes) == 0 {
+		t.Error("Expected the snapshot size")
+	}
+	for _, name := range []string{MetricWriteSeconds, MetricFsyncSeconds, MetricSnapshotSeconds} {
+		if h := r.histograms[name]; h == nil || h.count == 0 {
+			t.Errorf("%s: no samples", name)
+		}
+	}
+	if r.counters[MetricWALWrittenBytes].Load() == 0 {
+		t.Error("Expected WAL bytes written")
+	}
+}
@@ -0,0 +1,489 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+const (
+	logFilename   = "raft.log"
+	stateFilename = "raft.state"
+
+	// StateMagic identifies the file holding a node's term, vote and the
+	// position of the last compaction
+	StateMagic uint32 = 0x52465431 // "RFT1"
+
+	// maxEntryData bounds the payload of a decoded entry, so a corrupted
+	// length cannot allocate unbounded memory
+	maxEntryData = 64 << 20
+)
+
+// EntryType distinguishes client commands from entries used by Raft itself
+type EntryType uint8
+
+const (
+	// EntryCommand carries a command for the state machine
+	EntryCommand EntryType = iota + 1
+
+	// EntryNoop is appended by a new leader so entries from earlier terms
+	// can be committed
+	EntryNoop
+
+	// EntryConfig changes the cluster membership; Data holds the new
+	// member list
+	EntryConfig
+)
+
+// Entry is one record of the replicated log
+type Entry struct {
+	Index uint64
+	Term  uint64
+	Type  EntryType
+	Data  []byte
+}
+
+// logStore keeps the log and the state a node must remember across restarts
+//
+// Entries live in memory and in an append-only file; the hard state (term,
+// vote) and the compaction point are kept in a small file that is replaced
+// atomically. Entries up to snapIndex have been applied to the state machine
+// and discarded
+type logStore struct {
+	dir     string
+	file    *os.File
+	entries []Entry // entries[i].Index == snapIndex+1+i
+	offsets []int64 // file offset of each entry
+	size    int64   // bytes in the log file
+
+	term      uint64   // current term
+	vote      string   // candidate voted for in term, "" if none
+	snapIndex uint64   // last compacted entry
+	snapTerm  uint64   // term of snapIndex (0 if unknown)
+	members   []string // membership as of snapIndex
+
+	logger *slog.Logger
+}
+
+// openLog loads the log in dir, creating an empty one if there is none
+// A torn record at the end of the file (a crash during an append) is dropped
+func openLog(dir string, logger *slog.Logger) (*logStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create raft directory: %w", err)
+	}
+
+	l := &logStore{dir: dir, logger: logger}
+	if err := l.loadState(); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, logFilename), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open raft log: %w", err)
+	}
+	l.file = file
+
+	if err := l.loadEntries(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// loadEntries reads the log file and truncates it after the last valid record
+func (l *logStore) loadEntries() error {
+	r := bufio.NewReader(l.file)
+	var offset int64
+
+	for {
+		if _, err := r.Peek(1); err == io.EOF {
+			break
+		}
+
+		entry, n, err := decodeEntry(r)
+		if err != nil {
+			l.logger.Warn("dropping raft log tail", "offset", offset, "err", err)
+			break
+		}
+
+		// Records before the compaction point survive a crash between
+		// saving the state and rewriting the file
+		if entry.Index > l.snapIndex {
+			if entry.Index != l.lastIndex()+1 {
+				return fmt.Errorf("raft log is not contiguous: expected index %d, got %d", l.lastIndex()+1, entry.Index)
+			}
+			l.entries = append(l.entries, entry)
+			l.offsets = append(l.offsets, offset)
+		}
+		offset += int64(n)
+	}
+
+	l.size = offset
+	if err := l.file.Truncate(offset); err != nil {
+		return fmt.Errorf("failed to truncate raft log: %w", err)
+	}
+	if _, err := l.file.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek raft log: %w", err)
+	}
+
+	return nil
+}
+
+// encodeEntry writes an entry record:
+// Index(8) | Term(8) | Type(1) | DataLen(4) | Data | CRC32(4)
+func encodeEntry(w *bytes.Buffer, entry Entry) {
+	start := w.Len()
+
+	var header [21]byte
+	binary.BigEndian.PutUint64(header[0:], entry.Index)
+	binary.BigEndian.PutUint64(header[8:], entry.Term)
+	header[16] = byte(entry.Type)
+	binary.BigEndian.PutUint32(header[17:], uint32(len(entry.Data)))
+	w.Write(header[:])
+	w.Write(entry.Data)
+
+	checksum := crc32.ChecksumIEEE(w.Bytes()[start:])
+	binary.Write(w, binary.BigEndian, checksum)
+}
+
+// decodeEntry reads one record written by encodeEntry and returns its size
+func decodeEntry(r io.Reader) (Entry, int, error) {
+	var header [21]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return Entry{}, 0, fmt.Errorf("failed to read entry header: %w", err)
+	}
+
+	dataLen := binary.BigEndian.Uint32(header[17:])
+	if dataLen > maxEntryData {
+		return Entry{}, 0, fmt.Errorf("entry data too large: %d bytes", dataLen)
+	}
+
+	data := make([]byte, dataLen)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return Entry{}, 0, fmt.Errorf("failed to read entry data: %w", err)
+	}
+
+	var checksum uint32
+	if err := binary.Read(r, binary.BigEndian, &checksum); err != nil {
+		return Entry{}, 0, fmt.Errorf("failed to read entry checksum: %w", err)
+	}
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[:])
+	crc.Write(data)
+	if crc.Sum32() != checksum {
+		return Entry{}, 0, fmt.Errorf("entry checksum mismatch: expected 0x%X, got 0x%X", checksum, crc.Sum32())
+	}
+
+	entry := Entry{
+		Index: binary.BigEndian.Uint64(header[0:]),
+		Term:  binary.BigEndian.Uint64(header[8:]),
+		Type:  EntryType(header[16]),
+		Data:  data,
+	}
+	return entry, len(header) + len(data) + 4, nil
+}
+
+// lastIndex returns the index of the last entry, or snapIndex if the log
+// holds none
+func (l *logStore) lastIndex() uint64 {
+	return l.snapIndex + uint64(len(l.entries))
+}
+
+// lastTerm returns the term of the last entry
+func (l *logStore) lastTerm() uint64 {
+	if len(l.entries) == 0 {
+		return l.snapTerm
+	}
+	return l.entries[len(l.entries)-1].Term
+}
+
+// termAt returns the term of the entry at index, which must be between
+// snapIndex and lastIndex. Returns false for a compacted or missing entry
+func (l *logStore) termAt(index uint64) (uint64, bool) {
+	if index == l.snapIndex {
+		return l.snapTerm, true
+	}
+	if index < l.snapIndex || index > l.lastIndex() {
+		return 0, false
+	}
+	return l.entries[index-l.snapIndex-1].Term, true
+}
+
+// entry returns the entry at index, which must be in the log
+func (l *logStore) entry(index uint64) Entry {
+	return l.entries[index-l.snapIndex-1]
+}
+
+// slice returns up to max entries from index lo (inclusive) to hi
+// (exclusive). The result shares memory with the log and must not be modified
+func (l *logStore) slice(lo, hi uint64, max int) []Entry {
+	if hi-lo > uint64(max) {
+		hi = lo + uint64(max)
+	}
+	return l.entries[lo-l.snapIndex-1 : hi-l.snapIndex-1]
+}
+
+// append adds entries after the last one and syncs them to disk
+func (l *logStore) append(entries ...Entry) error {
+	var buf bytes.Buffer
+	offsets := make([]int64, len(entries))
+	for i, entry := range entries {
+		if entry.Index != l.lastIndex()+1+uint64(i) {
+			return fmt.Errorf("appending index %d after %d", entry.Index, l.lastIndex()+uint64(i))
+		}
+		offsets[i] = l.size + int64(buf.Len())
+		encodeEntry(&buf, entry)
+	}
+
+	n, err := l.file.Write(buf.Bytes())
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write raft log: %w", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync raft log: %w", err)
+	}
+
+	l.entries = append(l.entries, entries...)
+	l.offsets = append(l.offsets, offsets...)
+	return nil
+}
+
+// truncateAfter removes every entry after index, which must not be below
+// snapIndex
+func (l *logStore) truncateAfter(index uint64) error {
+	if index >= l.lastIndex() {
+		return nil
+	}
+
+	keep := index - l.snapIndex
+	offset := l.offsets[keep]
+	if err := l.file.Truncate(offset); err != nil {
+		return fmt.Errorf("failed to truncate raft log: %w", err)
+	}
+	if _, err := l.file.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek raft log: %w", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync raft log: %w", err)
+	}
+
+	l.entries = l.entries[:keep]
+	l.offsets = l.offsets[:keep]
+	l.size = offset
+	return nil
+}
+
+// compact discards the entries up to index, which the state machine has
+// applied durably. members is the membership as of index
+func (l *logStore) compact(index uint64, members []string) error {
+	if index <= l.snapIndex {
+		return nil
+	}
+	term, ok := l.termAt(index)
+	if !ok {
+		return fmt.Errorf("cannot compact past the last entry %d", l.lastIndex())
+	}
+
+	return l.rebase(index, term, members, l.entries[index-l.snapIndex:])
+}
+
+// reset discards the whole log and continues it after a snapshot at index
+func (l *logStore) reset(index, term uint64, members []string) error {
+	return l.rebase(index, term, members, nil)
+}
+
+// rebase records a new compaction point and rewrites the log file with only
+// the entries that follow it
+// The state is saved first: a crash before the file is replaced leaves
+// records at or below the new snapIndex, which loadEntries skips
+func (l *logStore) rebase(index, term uint64, members []string, keep []Entry) error {
+	prev := *l
+	l.snapIndex, l.snapTerm, l.members = index, term, members
+	if err := l.saveState(); err != nil {
+		l.snapIndex, l.snapTerm, l.members = prev.snapIndex, prev.snapTerm, prev.members
+		return err
+	}
+
+	var buf bytes.Buffer
+	offsets := make([]int64, len(keep))
+	for i, entry := range keep {
+		offsets[i] = int64(buf.Len())
+		encodeEntry(&buf, entry)
+	}
+
+	path := filepath.Join(l.dir, logFilename)
+	if err := writeFileAtomic(path, buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to rewrite raft log: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open raft log: %w", err)
+	}
+	if _, err := file.Seek(int64(buf.Len()), io.SeekStart); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to seek raft log: %w", err)
+	}
+
+	l.file.Close()
+	l.file = file
+	l.entries = append([]Entry(nil), keep...)
+	l.offsets = offsets
+	l.size = int64(buf.Len())
+	return nil
+}
+
+// setHardState records the current term and vote durably
+func (l *logStore) setHardState(term uint64, vote string) error {
+	if term == l.term && vote == l.vote {
+		return nil
+	}
+
+	prevTerm, prevVote := l.term, l.vote
+	l.term, l.vote = term, vote
+	if err := l.saveState(); err != nil {
+		l.term, l.vote = prevTerm, prevVote
+		return err
+	}
+	return nil
+}
+
+// saveState writes the state file:
+// Magic(4) | Term(8) | SnapIndex(8) | SnapTerm(8) | Vote | MemberCount(4) |
+// Members | CRC32(4), where strings are a 4-byte length and the bytes
+func (l *logStore) saveState() error {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, StateMagic)
+	binary.Write(&buf, binary.BigEndian, l.term)
+	binary.Write(&buf, binary.BigEndian, l.snapIndex)
+	binary.Write(&buf, binary.BigEndian, l.snapTerm)
+	writeString(&buf, l.vote)
+	binary.Write(&buf, binary.BigEndian, uint32(len(l.members)))
+	for _, member := range l.members {
+		writeString(&buf, member)
+	}
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()))
+
+	if err := writeFileAtomic(filepath.Join(l.dir, stateFilename), buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to save raft state: %w", err)
+	}
+	return nil
+}
+
+// loadState reads the state file, if there is one
+func (l *logStore) loadState() error {
+	data, err := os.ReadFile(filepath.Join(l.dir, stateFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read raft state: %w", err)
+	}
+
+	if len(data) < 4 {
+		return fmt.Errorf("raft state too short: %d bytes", len(data))
+	}
+	body, sum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return fmt.Errorf("raft state checksum mismatch")
+	}
+
+	r := bytes.NewReader(body)
+	var header struct {
+		Magic     uint32
+		Term      uint64
+		SnapIndex uint64
+		SnapTerm  uint64
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return fmt.Errorf("failed to read raft state: %w", err)
+	}
+	if header.Magic != StateMagic {
+		return fmt.Errorf("invalid raft state magic: expected 0x%X, got 0x%X", StateMagic, header.Magic)
+	}
+
+	vote, err := readString(r)
+	if err != nil {
+		return fmt.Errorf("failed to read raft vote: %w", err)
+	}
+	var count uint32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return fmt.Errorf("failed to read raft members: %w", err)
+	}
+	members := make([]string, 0, min(count, 1024))
+	for i := uint32(0); i < count; i++ {
+		member, err := readString(r)
+		if err != nil {
+			return fmt.Errorf("failed to read raft members: %w", err)
+		}
+		members = append(members, member)
+	}
+
+	l.term, l.vote = header.Term, vote
+	l.snapIndex, l.snapTerm, l.members = header.SnapIndex, header.SnapTerm, members
+	return nil
+}
+
+// hasState reports whether the node has ever stored anything, i.e. it is
+// not starting for the first time
+func (l *logStore) hasState() bool {
+	return l.term > 0 || l.lastIndex() > 0
+}
+
+// close closes the log file
+func (l *logStore) close() error {
+	return l.file.Close()
+}
+
+// writeString writes a length-prefixed string
+func writeString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, uint32(len(s)))
+	buf.WriteString(s)
+}
+
+// readString reads a string written by writeString
+func readString(r *bytes.Reader) (string, error) {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return "", err
+	}
+	if int64(n) > int64(r.Len()) {
+		return "", io.ErrUnexpectedEOF
+	}
+	b := make([]byte, n)
+	io.ReadFull(r, b)
+	return string(b), nil
+}
+
+// writeFileAtomic replaces path with data through a synced temporary file
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,111 @@
+package raft
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func openTestLog(t *testing.T, dir string) *logStore {
+	t.Helper()
+
+	l, err := openLog(dir, slog.Default())
+	if err != nil {
+		t.Fatalf("openLog failed: %v", err)
+	}
+	t.Cleanup(func() { l.close() })
+	return l
+}
+
+func appendTestEntries(t *testing.T, l *logStore, term uint64, n int) {
+	t.Helper()
+
+	for range n {
+		entry := Entry{Index: l.lastIndex() + 1, Term: term, Type: EntryCommand, Data: []byte("data")}
+		if err := l.append(entry); err != nil {
+			t.Fatalf("append failed: %v", err)
+		}
+	}
+}
+
+// TestLogPersistence tests that entries, truncation and the hard state
+// survive reopening
+func TestLogPersistence(t *testing.T) {
+	dir := t.TempDir()
+	l := openTestLog(t, dir)
+
+	appendTestEntries(t, l, 1, 5)
+	if err := l.truncateAfter(3); err != nil {
+		t.Fatalf("truncateAfter failed: %v", err)
+	}
+	appendTestEntries(t, l, 2, 2)
+	if err := l.setHardState(2, "n2"); err != nil {
+		t.Fatalf("setHardState failed: %v", err)
+	}
+	l.close()
+
+	l = openTestLog(t, dir)
+	if l.lastIndex() != 5 || l.lastTerm() != 2 {
+		t.Errorf("Expected last entry 5 at term 2, got %d at %d", l.lastIndex(), l.lastTerm())
+	}
+	if term, _ := l.termAt(3); term != 1 {
+		t.Errorf("Expected entry 3 at term 1, got %d", term)
+	}
+	if l.term != 2 || l.vote != "n2" {
+		t.Errorf("Expected term 2 vote n2, got %d %q", l.term, l.vote)
+	}
+}
+
+// TestLogCompact tests that compaction keeps later entries and the position
+// of the snapshot
+func TestLogCompact(t *testing.T) {
+	dir := t.TempDir()
+	l := openTestLog(t, dir)
+
+	appendTestEntries(t, l, 1, 10)
+	members := []string{"n1", "n2"}
+	if err := l.compact(6, members); err != nil {
+		t.Fatalf("compact failed: %v", err)
+	}
+	appendTestEntries(t, l, 1, 1)
+	l.close()
+
+	l = openTestLog(t, dir)
+	if l.snapIndex != 6 || l.snapTerm != 1 || !slices.Equal(l.members, members) {
+		t.Errorf("Expected snapshot at 6 with %v, got %d/%d with %v", members, l.snapIndex, l.snapTerm, l.members)
+	}
+	if l.lastIndex() != 11 || len(l.entries) != 5 {
+		t.Errorf("Expected entries 7..11, got last %d with %d entries", l.lastIndex(), len(l.entries))
+	}
+	if _, ok := l.termAt(5); ok {
+		t.Error("Compacted entries should be gone")
+	}
+}
+
+// TestLogTornTail tests that a partially written record is dropped on open
+func TestLogTornTail(t *testing.T) {
+	dir := t.TempDir()
+	l := openTestLog(t, dir)
+	appendTestEntries(t, l, 1, 3)
+	size := l.size
+	l.close()
+
+	path := filepath.Join(dir, logFilename)
+	if err := os.Truncate(path, size-3); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+
+	l = openTestLog(t, dir)
+	if l.lastIndex() != 2 {
+		t.Errorf("Expected 2 entries after the torn one, got %d", l.lastIndex())
+	}
+	appendTestEntries(t, l, 1, 1)
+	l.close()
+
+	l = openTestLog(t, dir)
+	if l.lastIndex() != 3 {
+		t.Errorf("Expected appends to continue after the torn tail, got %d", l.lastIndex())
+	}
+}
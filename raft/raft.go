@@ -0,0 +1,1274 @@
+// Package raft replicates a state machine across a cluster with the Raft
+// consensus algorithm
+//
+// A Node elects a leader, replicates the leader's log to the other members
+// and applies every committed entry to its StateMachine in order. Membership
+// changes add or remove one server at a time. Applied entries are discarded
+// from the log once enough of them accumulate; a follower that needs
+// discarded entries receives a snapshot of the state machine instead. Reads
+// can be made linearizable with ReadIndex
+//
+// Nodes talk through a Transport: InmemNetwork runs a whole cluster inside
+// one process (for tests), TCPTransport across machines
+package raft
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	defaultElectionTimeout   = time.Second
+	defaultMaxAppendEntries  = 256
+	defaultSnapshotThreshold = 8192
+)
+
+var (
+	// ErrNotLeader is returned by operations that only the leader can
+	// perform. Leader reports where to send them instead
+	ErrNotLeader = errors.New("raft: not the leader")
+
+	// ErrLeadershipLost is returned when the node stopped being leader
+	// before a proposed entry was applied. The entry may or may not have
+	// been committed by the next leader
+	ErrLeadershipLost = errors.New("raft: leadership lost")
+
+	// ErrClosed is returned when using a node after Close
+	ErrClosed = errors.New("raft: node is closed")
+)
+
+// State is the role of a node in the current term
+type State int
+
+const (
+	Follower State = iota
+	Candidate
+	Leader
+)
+
+func (s State) String() string {
+	switch s {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// StateMachine is the replicated state, e.g. a key-value store
+type StateMachine interface {
+	// Apply applies the committed entry at index. It is called for every
+	// index in order, with a nil command for the entries Raft uses
+	// internally, and the result must be durable when it returns: Raft
+	// discards applied entries from its log
+	Apply(index uint64, command []byte) error
+
+	// LastApplied returns the index of the last applied entry. After a
+	// restart Raft resumes applying after it
+	LastApplied() uint64
+
+	// Snapshot writes the current state to w and returns the index of the
+	// last entry it reflects. It may be called concurrently with Apply
+	Snapshot(w io.Writer) (uint64, error)
+
+	// Restore replaces the state with a snapshot taken at index
+	Restore(index uint64, r io.Reader) error
+}
+
+// Config configures a Node
+type Config struct {
+	// ID identifies the node; the Transport uses it as the address
+	ID string
+
+	// DataDir holds the log and the node's term and vote
+	DataDir string
+
+	// Peers is the initial membership (including ID) when starting a new
+	// cluster. It is ignored once DataDir holds state. A node started
+	// without peers waits until a leader adds it with AddServer
+	Peers []string
+
+	// Transport sends RPCs to the other nodes
+	Transport Transport
+
+	// ElectionTimeout is how long a follower waits to hear from a leader
+	// before starting an election (default: 1s). The actual timeout is
+	// randomized between ElectionTimeout and twice that
+	ElectionTimeout time.Duration
+
+	// HeartbeatInterval is how often the leader contacts idle followers
+	// (default: ElectionTimeout/10)
+	HeartbeatInterval time.Duration
+
+	// MaxAppendEntries bounds the entries sent in one AppendEntries
+	// request (default: 256)
+	MaxAppendEntries int
+
+	// SnapshotThreshold is the number of applied entries after which the
+	// log is compacted (default: 8192)
+	SnapshotThreshold uint64
+
+	// Logger receives errors the node recovers from by itself
+	// (default: slog.Default())
+	Logger *slog.Logger
+}
+
+// Status is a point-in-time summary of a node
+type Status struct {
+	ID           string
+	State        State
+	Term         uint64
+	Leader       string // "" if unknown
+	Members      []string
+	LastIndex    uint64 // last entry in the log
+	CommitIndex  uint64 // last entry known to be committed
+	AppliedIndex uint64 // last entry applied to the state machine
+}
+
+// Node is one member of a Raft cluster
+type Node struct {
+	id        string
+	config    Config
+	sm        StateMachine
+	transport Transport
+	log       *logStore
+	logger    *slog.Logger
+
+	mu               sync.Mutex
+	state            State
+	leader           string
+	lastContact      time.Time // last message from the leader
+	members          []string  // latest membership in the log, sorted
+	configIndex      uint64    // index of the entry that set members
+	commitIndex      uint64
+	lastApplied      uint64
+	electionDeadline time.Time
+	rand             *rand.Rand
+	err              error // state machine failure, stops the node
+
+	// Leader state
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	peers      map[string]*replicator
+
+	waiters     map[uint64]waiter // proposals waiting to be applied
+	applyMu     sync.Mutex        // held while the state machine changes
+	commitCond  *sync.Cond        // commitIndex advanced or node closed, uses mu
+	appliedCond *sync.Cond        // lastApplied or state changed, uses mu
+
+	ctx    context.Context // cancelled by Close, bounds RPCs
+	cancel context.CancelFunc
+	closed bool
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// replicator sends the log to one follower while this node leads
+type replicator struct {
+	trigger chan struct{} // buffered, wakes the replicator
+	stop    chan struct{} // closed when the follower is removed or leadership ends
+}
+
+// waiter is a proposal waiting for its entry to be applied
+type waiter struct {
+	term uint64
+	done chan error
+}
+
+// NewNode starts a node. The state machine must already hold the state it
+// had when the node last stopped
+func NewNode(config Config, sm StateMachine) (*Node, error) {
+	if config.ID == "" {
+		return nil, errors.New("raft: node ID is required")
+	}
+	if config.Transport == nil {
+		return nil, errors.New("raft: transport is required")
+	}
+	if config.ElectionTimeout <= 0 {
+		config.ElectionTimeout = defaultElectionTimeout
+	}
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = config.ElectionTimeout / 10
+	}
+	if config.MaxAppendEntries <= 0 {
+		config.MaxAppendEntries = defaultMaxAppendEntries
+	}
+	if config.SnapshotThreshold == 0 {
+		config.SnapshotThreshold = defaultSnapshotThreshold
+	}
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+	logger := config.Logger.With("raft_node", config.ID)
+
+	log, err := openLog(config.DataDir, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	// Record the initial membership the first time the node starts
+	if len(log.members) == 0 && log.lastIndex() == 0 && len(config.Peers) > 0 {
+		if !slices.Contains(config.Peers, config.ID) {
+			log.close()
+			return nil, fmt.Errorf("raft: peers %v do not include %s", config.Peers, config.ID)
+		}
+		if err := log.reset(0, 0, sortedMembers(config.Peers)); err != nil {
+			log.close()
+			return nil, err
+		}
+	}
+
+	n := &Node{
+		id:          config.ID,
+		config:      config,
+		sm:          sm,
+		transport:   config.Transport,
+		log:         log,
+		logger:      logger,
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+		waiters:     make(map[uint64]waiter),
+		lastApplied: sm.LastApplied(),
+		stop:        make(chan struct{}),
+	}
+	n.commitCond = sync.NewCond(&n.mu)
+	n.appliedCond = sync.NewCond(&n.mu)
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+
+	// Everything the state machine applied was committed. A state machine
+	// ahead of the log (a crash while installing a snapshot) continues the
+	// log after its state; the leader fills in the rest
+	if n.lastApplied < log.snapIndex {
+		log.close()
+		return nil, fmt.Errorf("raft: state machine at index %d is behind the compacted log at %d", n.lastApplied, log.snapIndex)
+	}
+	if n.lastApplied > log.lastIndex() {
+		n.recomputeMembersLocked()
+		if err := log.reset(n.lastApplied, 0, n.members); err != nil {
+			log.close()
+			return nil, err
+		}
+	}
+	n.commitIndex = n.lastApplied
+	n.recomputeMembersLocked()
+	n.resetElectionTimerLocked()
+
+	n.wg.Add(2)
+	go n.run()
+	go n.runApplier()
+
+	return n, nil
+}
+
+// Propose appends a command to the log and waits until it has been
+// committed and applied to the local state machine. Returns the entry's index
+// Only the leader accepts proposals
+func (n *Node) Propose(ctx context.Context, command []byte) (uint64, error) {
+	n.mu.Lock()
+	index, done, err := n.appendLocked(EntryCommand, command)
+	n.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	return index, n.wait(ctx, index, done)
+}
+
+// appendLocked appends an entry as leader and registers a waiter for it
+// Caller must hold n.mu
+func (n *Node) appendLocked(typ EntryType, data []byte) (uint64, chan error, error) {
+	if err := n.usableLocked(); err != nil {
+		return 0, nil, err
+	}
+	if n.state != Leader {
+		return 0, nil, ErrNotLeader
+	}
+
+	entry := Entry{Index: n.log.lastIndex() + 1, Term: n.log.term, Type: typ, Data: data}
+	if err := n.log.append(entry); err != nil {
+		n.stepDownLocked(n.log.term)
+		return 0, nil, err
+	}
+	if typ == EntryConfig {
+		n.recomputeMembersLocked()
+		n.syncReplicatorsLocked()
+	}
+
+	done := make(chan error, 1)
+	n.waiters[entry.Index] = waiter{term: entry.Term, done: done}
+
+	n.advanceCommitLocked()
+	n.triggerAllLocked()
+
+	return entry.Index, done, nil
+}
+
+// wait waits for the result of an appended entry
+func (n *Node) wait(ctx context.Context, index uint64, done chan error) error {
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		n.mu.Lock()
+		delete(n.waiters, index)
+		n.mu.Unlock()
+		return ctx.Err()
+	case <-n.stop:
+		return ErrClosed
+	}
+}
+
+// ReadIndex waits until the local state machine reflects every entry
+// committed before the call, after confirming with a majority that this node
+// is still the leader. Reading the state machine afterwards is linearizable
+func (n *Node) ReadIndex(ctx context.Context) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.state != Leader {
+		return ErrNotLeader
+	}
+	term := n.log.term
+
+	// The commit index is only known once an entry of this term committed
+	err := n.waitLocked(ctx, term, func() bool {
+		t, _ := n.log.termAt(n.commitIndex)
+		return t == term
+	})
+	if err != nil {
+		return err
+	}
+	readIndex := n.commitIndex
+
+	n.mu.Unlock()
+	err = n.confirmLeadership(ctx, term)
+	n.mu.Lock()
+	if err != nil {
+		return err
+	}
+
+	return n.waitLocked(ctx, term, func() bool {
+		return n.lastApplied >= readIndex
+	})
+}
+
+// waitLocked waits on appliedCond until cond holds, failing if ctx is done
+// or the node stops leading in term
+// Caller must hold n.mu
+func (n *Node) waitLocked(ctx context.Context, term uint64, cond func() bool) error {
+	stop := context.AfterFunc(ctx, func() {
+		n.mu.Lock()
+		n.appliedCond.Broadcast()
+		n.mu.Unlock()
+	})
+	defer stop()
+
+	for !cond() {
+		if err := n.usableLocked(); err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if n.state != Leader || n.log.term != term {
+			return ErrLeadershipLost
+		}
+		n.appliedCond.Wait()
+	}
+	return nil
+}
+
+// confirmLeadership checks that a majority still accepts this node as the
+// leader of term, so no newer leader can have committed anything yet
+func (n *Node) confirmLeadership(ctx context.Context, term uint64) error {
+	n.mu.Lock()
+	if n.state != Leader || n.log.term != term {
+		n.mu.Unlock()
+		return ErrLeadershipLost
+	}
+	peers := n.otherMembersLocked()
+	need := quorum(len(n.members))
+	if n.isMemberLocked(n.id) {
+		need--
+	}
+	args := AppendEntriesArgs{Term: term, LeaderID: n.id}
+	if need <= 0 {
+		n.mu.Unlock()
+		return nil
+	}
+
+	acks := make(chan bool, len(peers))
+	for _, peer := range peers {
+		n.goLocked(func() {
+			ctx, cancel := context.WithTimeout(ctx, n.config.ElectionTimeout)
+			defer cancel()
+
+			reply, err := n.transport.AppendEntries(ctx, peer, &args)
+			if err == nil && reply.Term > term {
+				n.mu.Lock()
+				n.stepDownLocked(reply.Term)
+				n.mu.Unlock()
+			}
+			acks <- err == nil && reply.Term == term
+		})
+	}
+	n.mu.Unlock()
+
+	for range peers {
+		select {
+		case ok := <-acks:
+			if ok {
+				need--
+			}
+			if need == 0 {
+				return nil
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-n.stop:
+			return ErrClosed
+		}
+	}
+	return ErrLeadershipLost
+}
+
+// AddServer adds a server to the cluster and waits until the change is
+// applied. The new server should be started without peers; it receives the
+// log (or a snapshot) from the leader
+func (n *Node) AddServer(ctx context.Context, id string) error {
+	return n.changeMembers(ctx, func(members []string) []string {
+		if slices.Contains(members, id) {
+			return nil
+		}
+		return sortedMembers(append(slices.Clone(members), id))
+	})
+}
+
+// RemoveServer removes a server from the cluster and waits until the change
+// is applied. A leader that removes itself steps down once the change commits
+func (n *Node) RemoveServer(ctx context.Context, id string) error {
+	return n.changeMembers(ctx, func(members []string) []string {
+		if !slices.Contains(members, id) {
+			return nil
+		}
+		return slices.DeleteFunc(slices.Clone(members), func(m string) bool { return m == id })
+	})
+}
+
+// changeMembers appends a configuration entry with the membership returned
+// by change (nil for no change). Changes are made one at a time: the previous
+// one, and the leader's first entry, must be committed first
+func (n *Node) changeMembers(ctx context.Context, change func([]string) []string) error {
+	n.mu.Lock()
+	if n.state != Leader {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	term := n.log.term
+	err := n.waitLocked(ctx, term, func() bool {
+		t, _ := n.log.termAt(n.commitIndex)
+		return t == term && n.configIndex <= n.commitIndex
+	})
+	if err != nil {
+		n.mu.Unlock()
+		return err
+	}
+
+	members := change(n.members)
+	if members == nil {
+		n.mu.Unlock()
+		return nil
+	}
+	index, done, err := n.appendLocked(EntryConfig, encodeMembers(members))
+	n.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return n.wait(ctx, index, done)
+}
+
+// Leader returns the ID of the current leader, or "" if unknown
+func (n *Node) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.leader
+}
+
+// Status returns a summary of the node's state
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return Status{
+		ID:           n.id,
+		State:        n.state,
+		Term:         n.log.term,
+		Leader:       n.leader,
+		Members:      slices.Clone(n.members),
+		LastIndex:    n.log.lastIndex(),
+		CommitIndex:  n.commitIndex,
+		AppliedIndex: n.lastApplied,
+	}
+}
+
+// Close stops the node. Proposals waiting for their entry fail with ErrClosed
+func (n *Node) Close() error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil
+	}
+	n.closed = true
+	if n.state == Leader {
+		n.stopReplicatorsLocked()
+	}
+	n.cancel()
+	close(n.stop)
+	n.commitCond.Broadcast()
+	n.appliedCond.Broadcast()
+	n.mu.Unlock()
+
+	n.wg.Wait()
+
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	return n.log.close()
+}
+
+// usableLocked returns why the node cannot serve requests, if it cannot
+// Caller must hold n.mu
+func (n *Node) usableLocked() error {
+	if n.closed {
+		return ErrClosed
+	}
+	return n.err
+}
+
+// goLocked runs fn in a goroutine that Close waits for, unless the node is
+// closed
+// Caller must hold n.mu
+func (n *Node) goLocked(fn func()) {
+	if n.closed {
+		return
+	}
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		fn()
+	}()
+}
+
+// run drives elections and heartbeats until the node is closed
+func (n *Node) run() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.config.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		}
+
+		n.mu.Lock()
+		switch {
+		case n.usableLocked() != nil:
+		case n.state == Leader:
+			n.triggerAllLocked()
+		case time.Now().After(n.electionDeadline):
+			n.startElectionLocked()
+		}
+		n.mu.Unlock()
+	}
+}
+
+// resetElectionTimerLocked picks a new random election deadline
+// Caller must hold n.mu
+func (n *Node) resetElectionTimerLocked() {
+	timeout := n.config.ElectionTimeout
+	n.electionDeadline = time.Now().Add(timeout + time.Duration(n.rand.Int63n(int64(timeout))))
+}
+
+// startElectionLocked becomes a candidate in the next term and asks the
+// other members for their votes. Servers outside the membership (not added
+// yet, or removed) never start elections
+// Caller must hold n.mu
+func (n *Node) startElectionLocked() {
+	n.resetElectionTimerLocked()
+	if !n.isMemberLocked(n.id) {
+		return
+	}
+
+	term := n.log.term + 1
+	if err := n.log.setHardState(term, n.id); err != nil {
+		n.logger.Error("failed to start election", "err", err)
+		return
+	}
+	n.state = Candidate
+	n.leader = ""
+
+	votes := 1
+	if votes >= quorum(len(n.members)) {
+		n.becomeLeaderLocked()
+		return
+	}
+
+	args := RequestVoteArgs{
+		Term:         term,
+		CandidateID:  n.id,
+		LastLogIndex: n.log.lastIndex(),
+		LastLogTerm:  n.log.lastTerm(),
+	}
+	for _, peer := range n.otherMembersLocked() {
+		n.goLocked(func() {
+			ctx, cancel := context.WithTimeout(n.ctx, n.config.ElectionTimeout)
+			defer cancel()
+
+			reply, err := n.transport.RequestVote(ctx, peer, &args)
+			if err != nil {
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+
+			if reply.Term > n.log.term {
+				n.stepDownLocked(reply.Term)
+				return
+			}
+			if n.state != Candidate || n.log.term != term || !reply.VoteGranted {
+				return
+			}
+			votes++
+			if votes >= quorum(len(n.members)) {
+				n.becomeLeaderLocked()
+			}
+		})
+	}
+}
+
+// becomeLeaderLocked takes over as leader of the current term
+// Caller must hold n.mu
+func (n *Node) becomeLeaderLocked() {
+	n.state = Leader
+	n.leader = n.id
+	n.nextIndex = make(map[string]uint64)
+	n.matchIndex = make(map[string]uint64)
+	n.peers = make(map[string]*replicator)
+
+	// Committing an entry of its own term also commits everything the
+	// previous leaders left behind
+	entry := Entry{Index: n.log.lastIndex() + 1, Term: n.log.term, Type: EntryNoop}
+	if err := n.log.append(entry); err != nil {
+		n.logger.Error("failed to append as leader", "err", err)
+		n.stepDownLocked(n.log.term)
+		return
+	}
+
+	n.syncReplicatorsLocked()
+	n.advanceCommitLocked()
+	n.triggerAllLocked()
+	n.appliedCond.Broadcast()
+}
+
+// stepDownLocked becomes a follower, moving to term if it is newer
+// Caller must hold n.mu
+func (n *Node) stepDownLocked(term uint64) {
+	if term > n.log.term {
+		if err := n.log.setHardState(term, ""); err != nil {
+			n.logger.Error("failed to save term", "term", term, "err", err)
+		}
+		n.leader = ""
+	}
+	if n.state == Leader {
+		n.stopReplicatorsLocked()
+		n.leader = ""
+	}
+	n.state = Follower
+	n.resetElectionTimerLocked()
+	n.appliedCond.Broadcast()
+}
+
+// stopReplicatorsLocked stops sending the log to followers
+// Caller must hold n.mu
+func (n *Node) stopReplicatorsLocked() {
+	for _, r := range n.peers {
+		close(r.stop)
+	}
+	n.peers = nil
+}
+
+// syncReplicatorsLocked starts a replicator for every member that has none.
+// Removed members keep theirs until the change commits, so they learn that
+// they were removed
+// Caller must hold n.mu
+func (n *Node) syncReplicatorsLocked() {
+	if n.state != Leader {
+		return
+	}
+
+	for _, peer := range n.otherMembersLocked() {
+		if _, ok := n.peers[peer]; ok {
+			continue
+		}
+		r := &replicator{trigger: make(chan struct{}, 1), stop: make(chan struct{})}
+		n.peers[peer] = r
+		n.nextIndex[peer] = n.log.lastIndex() + 1
+		n.matchIndex[peer] = 0
+		n.goLocked(func() { n.replicate(peer, r) })
+	}
+
+	if n.configIndex > n.commitIndex {
+		return
+	}
+	for peer, r := range n.peers {
+		if !n.isMemberLocked(peer) {
+			close(r.stop)
+			delete(n.peers, peer)
+			delete(n.nextIndex, peer)
+			delete(n.matchIndex, peer)
+		}
+	}
+}
+
+// triggerAllLocked wakes every replicator
+// Caller must hold n.mu
+func (n *Node) triggerAllLocked() {
+	for _, r := range n.peers {
+		select {
+		case r.trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// replicate sends entries (or a snapshot) to peer whenever triggered
+func (n *Node) replicate(peer string, r *replicator) {
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-r.trigger:
+		}
+
+		for n.replicateOnce(peer, r) {
+		}
+	}
+}
+
+// replicateOnce sends one AppendEntries or InstallSnapshot request to peer
+// Returns whether there is more to send right away
+func (n *Node) replicateOnce(peer string, r *replicator) bool {
+	n.mu.Lock()
+	if n.state != Leader || isClosed(r.stop) {
+		n.mu.Unlock()
+		return false
+	}
+	term := n.log.term
+	next := n.nextIndex[peer]
+	if next <= n.log.snapIndex {
+		n.mu.Unlock()
+		return n.sendSnapshot(peer, r, term)
+	}
+
+	prev := next - 1
+	prevTerm, _ := n.log.termAt(prev)
+	args := AppendEntriesArgs{
+		Term:         term,
+		LeaderID:     n.id,
+		PrevLogIndex: prev,
+		PrevLogTerm:  prevTerm,
+		Entries:      slices.Clone(n.log.slice(next, n.log.lastIndex()+1, n.config.MaxAppendEntries)),
+		LeaderCommit: n.commitIndex,
+	}
+	n.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(n.ctx, n.config.ElectionTimeout)
+	reply, err := n.transport.AppendEntries(ctx, peer, &args)
+	cancel()
+	if err != nil {
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if reply.Term > n.log.term {
+		n.stepDownLocked(reply.Term)
+		return false
+	}
+	if n.state != Leader || n.log.term != term || isClosed(r.stop) {
+		return false
+	}
+
+	if !reply.Success {
+		// Back up to where the follower's log may match
+		n.nextIndex[peer] = max(1, min(reply.ConflictIndex, prev))
+		return true
+	}
+
+	match := prev + uint64(len(args.Entries))
+	n.matchIndex[peer] = max(n.matchIndex[peer], match)
+	n.nextIndex[peer] = max(n.nextIndex[peer], match+1)
+	n.advanceCommitLocked()
+
+	return n.nextIndex[peer] <= n.log.lastIndex()
+}
+
+// sendSnapshot sends the state machine's current state to peer
+// Returns whether there is more to send right away
+func (n *Node) sendSnapshot(peer string, r *replicator, term uint64) bool {
+	var buf bytes.Buffer
+	index, err := n.sm.Snapshot(&buf)
+	if err != nil {
+		n.logger.Error("failed to snapshot for peer", "peer", peer, "err", err)
+		return false
+	}
+
+	n.mu.Lock()
+	if n.state != Leader || n.log.term != term || isClosed(r.stop) {
+		n.mu.Unlock()
+		return false
+	}
+	lastTerm, ok := n.log.termAt(index)
+	if !ok {
+		// The log was compacted past the snapshot meanwhile, take another
+		n.mu.Unlock()
+		return true
+	}
+	args := InstallSnapshotArgs{
+		Term:      term,
+		LeaderID:  n.id,
+		LastIndex: index,
+		LastTerm:  lastTerm,
+		Members:   n.membersAtLocked(index),
+		Data:      buf.Bytes(),
+	}
+	n.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(n.ctx, 10*n.config.ElectionTimeout)
+	reply, err := n.transport.InstallSnapshot(ctx, peer, &args)
+	cancel()
+	if err != nil {
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if reply.Term > n.log.term {
+		n.stepDownLocked(reply.Term)
+		return false
+	}
+	if n.state != Leader || n.log.term != term || isClosed(r.stop) {
+		return false
+	}
+
+	n.matchIndex[peer] = max(n.matchIndex[peer], index)
+	n.nextIndex[peer] = max(n.nextIndex[peer], index+1)
+	n.advanceCommitLocked()
+
+	return n.nextIndex[peer] <= n.log.lastIndex()
+}
+
+// advanceCommitLocked commits the newest entry of the current term that a
+// majority of the members has stored
+// Caller must hold n.mu
+func (n *Node) advanceCommitLocked() {
+	if n.state != Leader {
+		return
+	}
+
+	for index := n.log.lastIndex(); index > n.commitIndex; index-- {
+		// Entries from earlier terms are committed only indirectly
+		if term, _ := n.log.termAt(index); term != n.log.term {
+			return
+		}
+
+		count := 0
+		for _, member := range n.members {
+			if member == n.id || n.matchIndex[member] >= index {
+				count++
+			}
+		}
+		if count < quorum(len(n.members)) {
+			continue
+		}
+
+		n.commitIndex = index
+		n.commitCond.Broadcast()
+		n.triggerAllLocked()
+
+		// A committed membership change is final: stop replicating to
+		// removed servers, and step down if this one was removed
+		if n.configIndex <= n.commitIndex {
+			n.syncReplicatorsLocked()
+			if !n.isMemberLocked(n.id) {
+				n.stepDownLocked(n.log.term)
+			}
+		}
+		return
+	}
+}
+
+// runApplier applies committed entries to the state machine in order
+func (n *Node) runApplier() {
+	defer n.wg.Done()
+
+	for {
+		n.mu.Lock()
+		for n.commitIndex <= n.lastApplied && !n.closed {
+			n.commitCond.Wait()
+		}
+		if n.closed {
+			n.mu.Unlock()
+			return
+		}
+		n.mu.Unlock()
+
+		if err := n.applyCommitted(); err != nil {
+			n.logger.Error("state machine failed, node stopped", "err", err)
+			return
+		}
+	}
+}
+
+// applyCommitted applies a group of committed entries and compacts the log
+// once enough have been applied
+func (n *Node) applyCommitted() error {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+
+	n.mu.Lock()
+	if n.commitIndex <= n.lastApplied {
+		n.mu.Unlock()
+		return nil
+	}
+	entries := slices.Clone(n.log.slice(n.lastApplied+1, n.commitIndex+1, n.config.MaxAppendEntries))
+	n.mu.Unlock()
+
+	for _, entry := range entries {
+		var command []byte
+		if entry.Type == EntryCommand {
+			command = entry.Data
+		}
+		err := n.sm.Apply(entry.Index, command)
+
+		n.mu.Lock()
+		if err != nil {
+			n.err = fmt.Errorf("raft: failed to apply entry %d: %w", entry.Index, err)
+			n.stepDownLocked(n.log.term)
+			n.mu.Unlock()
+			return err
+		}
+		n.lastApplied = entry.Index
+		if w, ok := n.waiters[entry.Index]; ok {
+			delete(n.waiters, entry.Index)
+			if w.term == entry.Term {
+				w.done <- nil
+			} else {
+				w.done <- ErrLeadershipLost
+			}
+		}
+		n.appliedCond.Broadcast()
+		n.mu.Unlock()
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.lastApplied-n.log.snapIndex >= n.config.SnapshotThreshold {
+		if err := n.log.compact(n.lastApplied, n.membersAtLocked(n.lastApplied)); err != nil {
+			n.logger.Error("failed to compact log", "index", n.lastApplied, "err", err)
+		}
+	}
+	return nil
+}
+
+// HandleRequestVote processes a vote request from a candidate
+func (n *Node) HandleRequestVote(args *RequestVoteArgs) (*RequestVoteReply, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if err := n.usableLocked(); err != nil {
+		return nil, err
+	}
+
+	// While a leader is active, a server that stopped hearing from it (e.g.
+	// one that was removed) must not force a new election
+	if args.Term > n.log.term && n.leader != "" && n.leader != args.CandidateID &&
+		(n.state == Leader || time.Since(n.lastContact) < n.config.ElectionTimeout) {
+		return &RequestVoteReply{Term: n.log.term}, nil
+	}
+
+	if args.Term > n.log.term {
+		n.stepDownLocked(args.Term)
+	}
+	reply := &RequestVoteReply{Term: n.log.term}
+	if args.Term < n.log.term {
+		return reply, nil
+	}
+
+	upToDate := args.LastLogTerm > n.log.lastTerm() ||
+		(args.LastLogTerm == n.log.lastTerm() && args.LastLogIndex >= n.log.lastIndex())
+	if (n.log.vote == "" || n.log.vote == args.CandidateID) && upToDate {
+		if err := n.log.setHardState(n.log.term, args.CandidateID); err != nil {
+			return nil, err
+		}
+		reply.VoteGranted = true
+		n.resetElectionTimerLocked()
+	}
+
+	return reply, nil
+}
+
+// HandleAppendEntries processes entries or a heartbeat from the leader
+func (n *Node) HandleAppendEntries(args *AppendEntriesArgs) (*AppendEntriesReply, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if err := n.usableLocked(); err != nil {
+		return nil, err
+	}
+	if args.Term < n.log.term {
+		return &AppendEntriesReply{Term: n.log.term}, nil
+	}
+	if args.Term > n.log.term || n.state != Follower {
+		n.stepDownLocked(args.Term)
+	}
+	n.leader = args.LeaderID
+	n.lastContact = time.Now()
+	n.resetElectionTimerLocked()
+
+	reply := &AppendEntriesReply{Term: n.log.term}
+	prev, entries := args.PrevLogIndex, args.Entries
+
+	switch {
+	case prev < n.log.snapIndex:
+		// Entries up to snapIndex are committed and already applied here
+		skip := n.log.snapIndex - prev
+		if skip >= uint64(len(entries)) {
+			entries = nil
+		} else {
+			entries = entries[skip:]
+		}
+		prev = n.log.snapIndex
+	case prev > n.log.lastIndex():
+		reply.ConflictIndex = n.log.lastIndex() + 1
+		return reply, nil
+	case prev > n.log.snapIndex:
+		if term, _ := n.log.termAt(prev); term != args.PrevLogTerm {
+			// Skip the whole conflicting term in one round trip
+			index := prev
+			for index-1 > n.log.snapIndex {
+				if t, _ := n.log.termAt(index - 1); t != term {
+					break
+				}
+				index--
+			}
+			reply.ConflictIndex = index
+			return reply, nil
+		}
+	}
+
+	membersChanged := false
+	for i, entry := range entries {
+		if entry.Index <= n.log.lastIndex() {
+			if term, _ := n.log.termAt(entry.Index); term == entry.Term {
+				continue
+			}
+			if entry.Index <= n.commitIndex {
+				return nil, fmt.Errorf("raft: leader %s conflicts with committed entry %d", args.LeaderID, entry.Index)
+			}
+			if err := n.log.truncateAfter(entry.Index - 1); err != nil {
+				return nil, err
+			}
+			membersChanged = true
+		}
+
+		rest := entries[i:]
+		if err := n.log.append(rest...); err != nil {
+			return nil, err
+		}
+		for _, e := range rest {
+			if e.Type == EntryConfig {
+				membersChanged = true
+			}
+		}
+		break
+	}
+	if membersChanged {
+		n.recomputeMembersLocked()
+	}
+
+	if lastNew := prev + uint64(len(entries)); args.LeaderCommit > n.commitIndex && lastNew > n.commitIndex {
+		n.commitIndex = min(args.LeaderCommit, lastNew)
+		n.commitCond.Broadcast()
+	}
+
+	reply.Success = true
+	return reply, nil
+}
+
+// HandleInstallSnapshot replaces the state machine with the leader's
+// snapshot and discards the log it covers
+func (n *Node) HandleInstallSnapshot(args *InstallSnapshotArgs) (*InstallSnapshotReply, error) {
+	// Keep the applier out while the state machine is replaced
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if err := n.usableLocked(); err != nil {
+		return nil, err
+	}
+	if args.Term < n.log.term {
+		return &InstallSnapshotReply{Term: n.log.term}, nil
+	}
+	if args.Term > n.log.term || n.state != Follower {
+		n.stepDownLocked(args.Term)
+	}
+	n.leader = args.LeaderID
+	n.lastContact = time.Now()
+	n.resetElectionTimerLocked()
+
+	reply := &InstallSnapshotReply{Term: n.log.term}
+	if args.LastIndex <= n.lastApplied {
+		return reply, nil
+	}
+
+	n.mu.Unlock()
+	err := n.sm.Restore(args.LastIndex, bytes.NewReader(args.Data))
+	n.mu.Lock()
+	if err != nil {
+		return nil, fmt.Errorf("raft: failed to restore snapshot: %w", err)
+	}
+
+	// Entries following the snapshot stay if the log agrees with it
+	if term, ok := n.log.termAt(args.LastIndex); ok && term == args.LastTerm {
+		err = n.log.compact(args.LastIndex, args.Members)
+	} else {
+		err = n.log.reset(args.LastIndex, args.LastTerm, args.Members)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	n.lastApplied = args.LastIndex
+	n.commitIndex = max(n.commitIndex, args.LastIndex)
+	n.recomputeMembersLocked()
+	for index, w := range n.waiters {
+		if index <= args.LastIndex {
+			delete(n.waiters, index)
+			w.done <- ErrLeadershipLost
+		}
+	}
+	n.appliedCond.Broadcast()
+
+	return reply, nil
+}
+
+// recomputeMembersLocked sets members from the newest configuration entry in
+// the log, or the membership recorded at the compaction point
+// Caller must hold n.mu
+func (n *Node) recomputeMembersLocked() {
+	for index := n.log.lastIndex(); index > n.log.snapIndex; index-- {
+		if entry := n.log.entry(index); entry.Type == EntryConfig {
+			n.members = decodeMembers(entry.Data)
+			n.configIndex = index
+			return
+		}
+	}
+	n.members = n.log.members
+	n.configIndex = n.log.snapIndex
+}
+
+// membersAtLocked returns the membership as of index, which must not be
+// below the compaction point
+// Caller must hold n.mu
+func (n *Node) membersAtLocked(index uint64) []string {
+	for i := index; i > n.log.snapIndex; i-- {
+		if entry := n.log.entry(i); entry.Type == EntryConfig {
+			return decodeMembers(entry.Data)
+		}
+	}
+	return n.log.members
+}
+
+// isMemberLocked reports whether id is in the current membership
+// Caller must hold n.mu
+func (n *Node) isMemberLocked(id string) bool {
+	return slices.Contains(n.members, id)
+}
+
+// otherMembersLocked returns the members other than this node
+// Caller must hold n.mu
+func (n *Node) otherMembersLocked() []string {
+	others := make([]string, 0, len(n.members))
+	for _, member := range n.members {
+		if member != n.id {
+			others = append(others, member)
+		}
+	}
+	return others
+}
+
+// quorum returns the number of votes that make a majority of size members
+func quorum(size int) int {
+	return size/2 + 1
+}
+
+// isClosed reports whether ch is closed
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// sortedMembers returns members sorted and without duplicates
+func sortedMembers(members []string) []string {
+	sorted := slices.Clone(members)
+	slices.Sort(sorted)
+	return slices.Compact(sorted)
+}
+
+// encodeMembers encodes a member list for a configuration entry
+func encodeMembers(members []string) []byte {
+	var buf bytes.Buffer
+	for _, member := range members {
+		writeString(&buf, member)
+	}
+	return buf.Bytes()
+}
+
+// decodeMembers decodes a member list written by encodeMembers
+func decodeMembers(data []byte) []string {
+	var members []string
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		member, err := readString(r)
+		if err != nil {
+			break
+		}
+		members = append(members, member)
+	}
+	return members
+}
@@ -0,0 +1,552 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testMachine records the commands applied to it. It stands in for a
+// durable state machine: tests keep it across restarts of its node
+type testMachine struct {
+	mu       sync.Mutex
+	applied  uint64
+	commands []string
+	restores int
+}
+
+func (m *testMachine) Apply(index uint64, command []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if index != m.applied+1 {
+		return fmt.Errorf("applying index %d after %d", index, m.applied)
+	}
+	m.applied = index
+	if command != nil {
+		m.commands = append(m.commands, string(command))
+	}
+	return nil
+}
+
+func (m *testMachine) LastApplied() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.applied
+}
+
+func (m *testMachine) Snapshot(w io.Writer) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(len(m.commands)))
+	for _, command := range m.commands {
+		writeString(&buf, command)
+	}
+	_, err := w.Write(buf.Bytes())
+	return m.applied, err
+}
+
+func (m *testMachine) Restore(index uint64, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	br := bytes.NewReader(data)
+	var count uint32
+	if err := binary.Read(br, binary.BigEndian, &count); err != nil {
+		return err
+	}
+	commands := make([]string, count)
+	for i := range commands {
+		if commands[i], err = readString(br); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.applied = index
+	m.commands = commands
+	m.restores++
+	return nil
+}
+
+// state returns the applied index and commands
+func (m *testMachine) state() (uint64, []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.applied, slices.Clone(m.commands)
+}
+
+// testCluster runs nodes on an InmemNetwork with short timeouts
+type testCluster struct {
+	t         *testing.T
+	network   *InmemNetwork
+	threshold uint64
+	dirs      map[string]string
+	machines  map[string]*testMachine
+	nodes     map[string]*Node
+}
+
+// newTestCluster bootstraps a cluster of size nodes named n1, n2, ...
+func newTestCluster(t *testing.T, size int) *testCluster {
+	c := &testCluster{
+		t:        t,
+		network:  NewInmemNetwork(),
+		dirs:     make(map[string]string),
+		machines: make(map[string]*testMachine),
+		nodes:    make(map[string]*Node),
+	}
+	t.Cleanup(func() {
+		for _, node := range c.nodes {
+			node.Close()
+		}
+	})
+
+	var peers []string
+	for i := 1; i <= size; i++ {
+		peers = append(peers, fmt.Sprintf("n%d", i))
+	}
+	for _, id := range peers {
+		c.start(id, peers)
+	}
+	return c
+}
+
+// start starts (or restarts) the node id with its data directory and state
+// machine
+func (c *testCluster) start(id string, peers []string) *Node {
+	c.t.Helper()
+
+	if _, ok := c.dirs[id]; !ok {
+		c.dirs[id] = c.t.TempDir()
+		c.machines[id] = &testMachine{}
+	}
+
+	node, err := NewNode(Config{
+		ID:                id,
+		DataDir:           c.dirs[id],
+		Peers:             peers,
+		Transport:         c.network.Transport(id),
+		ElectionTimeout:   100 * time.Millisecond,
+		HeartbeatInterval: 10 * time.Millisecond,
+		SnapshotThreshold: c.threshold,
+	}, c.machines[id])
+	if err != nil {
+		c.t.Fatalf("NewNode %s failed: %v", id, err)
+	}
+	c.network.Register(id, node)
+	c.nodes[id] = node
+	return node
+}
+
+// stop closes the node id
+func (c *testCluster) stop(id string) {
+	c.nodes[id].Close()
+	delete(c.nodes, id)
+}
+
+// leader waits until exactly one running node among ids leads and every
+// other one of them follows it, and returns it
+func (c *testCluster) leader(ids ...string) *Node {
+	c.t.Helper()
+
+	if len(ids) == 0 {
+		for id := range c.nodes {
+			ids = append(ids, id)
+		}
+	}
+
+	var leader *Node
+	waitFor(c.t, "a leader", func() bool {
+		leader = nil
+		for _, id := range ids {
+			status := c.nodes[id].Status()
+			if status.State == Leader {
+				if leader != nil {
+					return false
+				}
+				leader = c.nodes[id]
+			}
+		}
+		if leader == nil {
+			return false
+		}
+		for _, id := range ids {
+			if c.nodes[id].Leader() != leader.id {
+				return false
+			}
+		}
+		return true
+	})
+	return leader
+}
+
+// propose proposes a command through the current leader, retrying while
+// leadership changes
+func (c *testCluster) propose(command string) {
+	c.t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		leader := c.leader()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err := leader.Propose(ctx, []byte(command))
+		cancel()
+		if err == nil {
+			return
+		}
+	}
+	c.t.Fatalf("Proposing %q did not succeed", command)
+}
+
+// waitCommands waits until the machines of ids applied exactly want
+func (c *testCluster) waitCommands(want []string, ids ...string) {
+	c.t.Helper()
+
+	waitFor(c.t, fmt.Sprintf("%v to apply %d commands", ids, len(want)), func() bool {
+		for _, id := range ids {
+			if _, got := c.machines[id].state(); !slices.Equal(got, want) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// waitFor polls cond until it holds or a few seconds pass
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// commands returns cmd-0 .. cmd-(n-1)
+func commands(n int) []string {
+	out := make([]string, n)
+	for i := range out {
+		out[i] = fmt.Sprintf("cmd-%d", i)
+	}
+	return out
+}
+
+// TestElection tests that a cluster elects one leader that everyone follows
+func TestElection(t *testing.T) {
+	c := newTestCluster(t, 3)
+	leader := c.leader()
+
+	term := leader.Status().Term
+	for id, node := range c.nodes {
+		if status := node.Status(); status.Term != term || len(status.Members) != 3 {
+			t.Errorf("%s: expected term %d with 3 members, got %+v", id, term, status)
+		}
+	}
+
+	// A stable leader keeps its term
+	time.Sleep(300 * time.Millisecond)
+	if status := leader.Status(); status.State != Leader || status.Term != term {
+		t.Errorf("Leader should be stable, got %+v", status)
+	}
+}
+
+// TestReplication tests that proposals are applied on every node in order
+func TestReplication(t *testing.T) {
+	c := newTestCluster(t, 3)
+	want := commands(20)
+	for _, command := range want {
+		c.propose(command)
+	}
+	c.waitCommands(want, "n1", "n2", "n3")
+
+	// Followers reject proposals
+	for _, node := range c.nodes {
+		if node == c.leader() {
+			continue
+		}
+		if _, err := node.Propose(context.Background(), []byte("x")); !errors.Is(err, ErrNotLeader) {
+			t.Errorf("Expected ErrNotLeader from a follower, got %v", err)
+		}
+	}
+}
+
+// TestLeaderFailover tests that a new leader takes over when the leader is
+// cut off, and that the old leader's uncommitted entries are discarded
+func TestLeaderFailover(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.propose("before")
+
+	old := c.leader()
+	c.network.Disconnect(old.id)
+
+	// Without a majority the old leader cannot commit
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	_, err := old.Propose(ctx, []byte("lost"))
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected a timeout from the isolated leader, got %v", err)
+	}
+
+	var rest []string
+	for id := range c.nodes {
+		if id != old.id {
+			rest = append(rest, id)
+		}
+	}
+	leader := c.leader(rest...)
+	if leader == old {
+		t.Fatal("The isolated node cannot stay leader")
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := leader.Propose(ctx, []byte("after")); err != nil {
+		t.Fatalf("Propose on the new leader failed: %v", err)
+	}
+
+	// The old leader rejoins as a follower and drops "lost"
+	c.network.Connect(old.id)
+	c.waitCommands([]string{"before", "after"}, "n1", "n2", "n3")
+	if status := old.Status(); status.State != Follower {
+		t.Errorf("Old leader should follow, got %v", status.State)
+	}
+}
+
+// TestSnapshotInstall tests that a follower that fell behind a compaction
+// receives a snapshot
+func TestSnapshotInstall(t *testing.T) {
+	c := &testCluster{
+		t:         t,
+		network:   NewInmemNetwork(),
+		threshold: 5,
+		dirs:      make(map[string]string),
+		machines:  make(map[string]*testMachine),
+		nodes:     make(map[string]*Node),
+	}
+	t.Cleanup(func() {
+		for _, node := range c.nodes {
+			node.Close()
+		}
+	})
+	peers := []string{"n1", "n2", "n3"}
+	for _, id := range peers {
+		c.start(id, peers)
+	}
+
+	leader := c.leader()
+	var lagging string
+	for _, id := range peers {
+		if id != leader.id {
+			lagging = id
+			break
+		}
+	}
+	c.network.Disconnect(lagging)
+
+	want := commands(30)
+	for _, command := range want {
+		c.propose(command)
+	}
+	waitFor(t, "the leader to compact", func() bool {
+		leader.mu.Lock()
+		defer leader.mu.Unlock()
+		return leader.log.snapIndex > 5
+	})
+
+	c.network.Connect(lagging)
+	c.waitCommands(want, peers...)
+	machine := c.machines[lagging]
+	machine.mu.Lock()
+	restores := machine.restores
+	machine.mu.Unlock()
+	if restores == 0 {
+		t.Error("Lagging follower should have restored a snapshot")
+	}
+
+	// It keeps up with new entries afterwards
+	c.propose("next")
+	c.waitCommands(append(want, "next"), peers...)
+}
+
+// TestMembershipChanges tests growing a cluster from one node and removing
+// the leader
+func TestMembershipChanges(t *testing.T) {
+	c := newTestCluster(t, 1)
+	c.propose("solo")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, id := range []string{"n2", "n3"} {
+		c.start(id, nil)
+		if err := c.leader("n1").AddServer(ctx, id); err != nil {
+			t.Fatalf("AddServer %s failed: %v", id, err)
+		}
+	}
+	c.propose("trio")
+	c.waitCommands([]string{"solo", "trio"}, "n1", "n2", "n3")
+	if members := c.leader().Status().Members; len(members) != 3 {
+		t.Errorf("Expected 3 members, got %v", members)
+	}
+
+	// The leader removes itself and the others carry on
+	old := c.leader()
+	if err := old.RemoveServer(ctx, old.id); err != nil {
+		t.Fatalf("RemoveServer failed: %v", err)
+	}
+	waitFor(t, "the removed leader to step down", func() bool {
+		return old.Status().State == Follower
+	})
+
+	var rest []string
+	for id := range c.nodes {
+		if id != old.id {
+			rest = append(rest, id)
+		}
+	}
+	leader := c.leader(rest...)
+	if members := leader.Status().Members; slices.Contains(members, old.id) || len(members) != 2 {
+		t.Errorf("Expected the two remaining members, got %v", members)
+	}
+	if _, err := leader.Propose(ctx, []byte("duo")); err != nil {
+		t.Fatalf("Propose after removal failed: %v", err)
+	}
+	c.waitCommands([]string{"solo", "trio", "duo"}, rest...)
+}
+
+// TestRestart tests that terms, votes and the log survive a restart
+func TestRestart(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.propose("one")
+	c.waitCommands([]string{"one"}, "n1", "n2", "n3")
+	term := c.leader().Status().Term
+
+	for _, id := range []string{"n1", "n2", "n3"} {
+		c.stop(id)
+	}
+	for _, id := range []string{"n1", "n2", "n3"} {
+		c.start(id, nil)
+	}
+
+	leader := c.leader()
+	if status := leader.Status(); status.Term <= term || len(status.Members) != 3 {
+		t.Errorf("Expected a later term with 3 members, got %+v", status)
+	}
+	c.propose("two")
+	c.waitCommands([]string{"one", "two"}, "n1", "n2", "n3")
+}
+
+// TestReadIndex tests linearizable reads
+func TestReadIndex(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.propose("x")
+	leader := c.leader()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := leader.ReadIndex(ctx); err != nil {
+		t.Fatalf("ReadIndex failed: %v", err)
+	}
+	if applied, _ := c.machines[leader.id].state(); applied < leader.Status().CommitIndex {
+		t.Errorf("Leader should have applied up to the commit index after ReadIndex")
+	}
+
+	for _, node := range c.nodes {
+		if node != leader {
+			if err := node.ReadIndex(ctx); !errors.Is(err, ErrNotLeader) {
+				t.Errorf("Expected ErrNotLeader from a follower, got %v", err)
+			}
+		}
+	}
+
+	// A leader cut off from the majority cannot serve reads
+	c.network.Disconnect(leader.id)
+	short, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := leader.ReadIndex(short); err == nil {
+		t.Error("An isolated leader should not serve linearizable reads")
+	}
+}
+
+// TestTCPTransport tests a cluster talking over loopback TCP
+func TestTCPTransport(t *testing.T) {
+	var listeners []net.Listener
+	var peers []string
+	for i := 0; i < 3; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen failed: %v", err)
+		}
+		defer l.Close()
+		listeners = append(listeners, l)
+		peers = append(peers, l.Addr().String())
+	}
+
+	var nodes []*Node
+	machines := make(map[*Node]*testMachine)
+	for i, id := range peers {
+		transport := NewTCPTransport()
+		defer transport.Close()
+
+		machine := &testMachine{}
+		node, err := NewNode(Config{
+			ID:                id,
+			DataDir:           t.TempDir(),
+			Peers:             peers,
+			Transport:         transport,
+			ElectionTimeout:   100 * time.Millisecond,
+			HeartbeatInterval: 10 * time.Millisecond,
+		}, machine)
+		if err != nil {
+			t.Fatalf("NewNode failed: %v", err)
+		}
+		defer node.Close()
+		go ServeTCP(listeners[i], node)
+
+		nodes = append(nodes, node)
+		machines[node] = machine
+	}
+
+	var leader *Node
+	waitFor(t, "a leader", func() bool {
+		for _, node := range nodes {
+			if node.Status().State == Leader {
+				leader = node
+				return true
+			}
+		}
+		return false
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := leader.Propose(ctx, []byte("over tcp")); err != nil {
+		t.Fatalf("Propose failed: %v", err)
+	}
+	waitFor(t, "every node to apply", func() bool {
+		for _, machine := range machines {
+			if _, got := machine.state(); !slices.Equal(got, []string{"over tcp"}) {
+				return false
+			}
+		}
+		return true
+	})
+}
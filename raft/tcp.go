@@ -0,0 +1,167 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+const defaultDialTimeout = 5 * time.Second
+
+// TCPTransport sends RPCs over TCP with net/rpc, to servers whose IDs are
+// their host:port. Connections are kept open and reused
+type TCPTransport struct {
+	// DialTimeout bounds connecting to a server (default: 5s)
+	DialTimeout time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*rpc.Client
+}
+
+// NewTCPTransport returns a transport with no open connections
+func NewTCPTransport() *TCPTransport {
+	return &TCPTransport{clients: make(map[string]*rpc.Client)}
+}
+
+// ServeTCP accepts RPCs for h on l until l is closed
+func ServeTCP(l net.Listener, h Handler) error {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Raft", &rpcService{h}); err != nil {
+		return err
+	}
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go server.ServeConn(conn)
+	}
+}
+
+// rpcService adapts a Handler to the method signatures net/rpc expects
+type rpcService struct {
+	h Handler
+}
+
+func (s *rpcService) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	r, err := s.h.HandleRequestVote(args)
+	if err != nil {
+		return err
+	}
+	*reply = *r
+	return nil
+}
+
+func (s *rpcService) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	r, err := s.h.HandleAppendEntries(args)
+	if err != nil {
+		return err
+	}
+	*reply = *r
+	return nil
+}
+
+func (s *rpcService) InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	r, err := s.h.HandleInstallSnapshot(args)
+	if err != nil {
+		return err
+	}
+	*reply = *r
+	return nil
+}
+
+func (t *TCPTransport) RequestVote(ctx context.Context, target string, args *RequestVoteArgs) (*RequestVoteReply, error) {
+	reply := new(RequestVoteReply)
+	return reply, t.call(ctx, target, "Raft.RequestVote", args, reply)
+}
+
+func (t *TCPTransport) AppendEntries(ctx context.Context, target string, args *AppendEntriesArgs) (*AppendEntriesReply, error) {
+	reply := new(AppendEntriesReply)
+	return reply, t.call(ctx, target, "Raft.AppendEntries", args, reply)
+}
+
+func (t *TCPTransport) InstallSnapshot(ctx context.Context, target string, args *InstallSnapshotArgs) (*InstallSnapshotReply, error) {
+	reply := new(InstallSnapshotReply)
+	return reply, t.call(ctx, target, "Raft.InstallSnapshot", args, reply)
+}
+
+// Close closes every open connection
+func (t *TCPTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for target, client := range t.clients {
+		client.Close()
+		delete(t.clients, target)
+	}
+	return nil
+}
+
+// call makes one RPC, dropping the connection if it fails so the next call
+// reconnects
+func (t *TCPTransport) call(ctx context.Context, target, method string, args, reply any) error {
+	client, err := t.client(ctx, target)
+	if err != nil {
+		return err
+	}
+
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		var serverErr rpc.ServerError
+		if call.Error != nil && !errors.As(call.Error, &serverErr) {
+			t.drop(target, client)
+		}
+		return call.Error
+	case <-ctx.Done():
+		// The reply may still arrive later; a connection that stays
+		// stuck is dropped so the next call starts afresh
+		t.drop(target, client)
+		return ctx.Err()
+	}
+}
+
+// client returns the connection to target, dialing it if needed
+func (t *TCPTransport) client(ctx context.Context, target string) (*rpc.Client, error) {
+	t.mu.Lock()
+	client, ok := t.clients[target]
+	t.mu.Unlock()
+	if ok {
+		return client, nil
+	}
+
+	timeout := t.DialTimeout
+	if timeout <= 0 {
+		timeout = defaultDialTimeout
+	}
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		return nil, err
+	}
+	client = rpc.NewClient(conn)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if existing, ok := t.clients[target]; ok {
+		client.Close()
+		return existing, nil
+	}
+	t.clients[target] = client
+	return client, nil
+}
+
+// drop closes client and forgets it if it is still the connection to target
+func (t *TCPTransport) drop(target string, client *rpc.Client) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.clients[target] == client {
+		delete(t.clients, target)
+	}
+	client.Close()
+}
@@ -0,0 +1,199 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// RequestVoteArgs is sent by candidates to gather votes
+type RequestVoteArgs struct {
+	Term         uint64
+	CandidateID  string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+// RequestVoteReply answers RequestVoteArgs
+type RequestVoteReply struct {
+	Term        uint64
+	VoteGranted bool
+}
+
+// AppendEntriesArgs is sent by the leader to replicate entries; without
+// entries it is a heartbeat
+type AppendEntriesArgs struct {
+	Term         uint64
+	LeaderID     string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []Entry
+	LeaderCommit uint64
+}
+
+// AppendEntriesReply answers AppendEntriesArgs
+// On failure ConflictIndex is where the leader should retry from
+type AppendEntriesReply struct {
+	Term          uint64
+	Success       bool
+	ConflictIndex uint64
+}
+
+// InstallSnapshotArgs is sent by the leader to a follower that needs entries
+// the leader has already discarded. Data is the state machine's snapshot
+// as of LastIndex
+type InstallSnapshotArgs struct {
+	Term      uint64
+	LeaderID  string
+	LastIndex uint64
+	LastTerm  uint64
+	Members   []string
+	Data      []byte
+}
+
+// InstallSnapshotReply answers InstallSnapshotArgs
+type InstallSnapshotReply struct {
+	Term uint64
+}
+
+// Transport delivers RPCs to other servers, which are identified by their ID
+type Transport interface {
+	RequestVote(ctx context.Context, target string, args *RequestVoteArgs) (*RequestVoteReply, error)
+	AppendEntries(ctx context.Context, target string, args *AppendEntriesArgs) (*AppendEntriesReply, error)
+	InstallSnapshot(ctx context.Context, target string, args *InstallSnapshotArgs) (*InstallSnapshotReply, error)
+}
+
+// Handler processes incoming RPCs. *Node implements it; transports deliver
+// the requests they receive to it
+type Handler interface {
+	HandleRequestVote(args *RequestVoteArgs) (*RequestVoteReply, error)
+	HandleAppendEntries(args *AppendEntriesArgs) (*AppendEntriesReply, error)
+	HandleInstallSnapshot(args *InstallSnapshotArgs) (*InstallSnapshotReply, error)
+}
+
+// ErrUnreachable is returned by InmemNetwork for a server that is not
+// registered or is disconnected
+var ErrUnreachable = errors.New("raft: server unreachable")
+
+// InmemNetwork connects nodes in the same process, so a whole cluster can
+// run in a test. Servers can be disconnected to simulate crashes and
+// network partitions
+type InmemNetwork struct {
+	mu       sync.Mutex
+	handlers map[string]Handler
+	down     map[string]bool
+}
+
+// NewInmemNetwork returns an empty network
+func NewInmemNetwork() *InmemNetwork {
+	return &InmemNetwork{
+		handlers: make(map[string]Handler),
+		down:     make(map[string]bool),
+	}
+}
+
+// Register makes h receive the RPCs sent to id, replacing any previous
+// handler (e.g. of a node that was restarted)
+func (n *InmemNetwork) Register(id string, h Handler) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.handlers[id] = h
+}
+
+// Disconnect cuts id off: RPCs to and from it fail until Connect
+func (n *InmemNetwork) Disconnect(id string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.down[id] = true
+}
+
+// Connect undoes Disconnect
+func (n *InmemNetwork) Connect(id string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.down, id)
+}
+
+// Transport returns the transport used by the server id to send RPCs
+func (n *InmemNetwork) Transport(id string) Transport {
+	return &inmemTransport{network: n, from: id}
+}
+
+// handler returns the handler for an RPC from one server to another
+func (n *InmemNetwork) handler(from, to string) (Handler, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	h, ok := n.handlers[to]
+	if !ok || n.down[from] || n.down[to] {
+		return nil, fmt.Errorf("%w: %s", ErrUnreachable, to)
+	}
+	return h, nil
+}
+
+// inmemTransport sends RPCs on an InmemNetwork
+type inmemTransport struct {
+	network *InmemNetwork
+	from    string
+}
+
+func (t *inmemTransport) RequestVote(ctx context.Context, target string, args *RequestVoteArgs) (*RequestVoteReply, error) {
+	h, err := t.network.handler(t.from, target)
+	if err != nil {
+		return nil, err
+	}
+	copied := *args
+	return deliver(ctx, func() (*RequestVoteReply, error) { return h.HandleRequestVote(&copied) })
+}
+
+func (t *inmemTransport) AppendEntries(ctx context.Context, target string, args *AppendEntriesArgs) (*AppendEntriesReply, error) {
+	h, err := t.network.handler(t.from, target)
+	if err != nil {
+		return nil, err
+	}
+
+	// Receivers keep the entries, so they must not share memory with the
+	// sender's log
+	copied := *args
+	copied.Entries = make([]Entry, len(args.Entries))
+	for i, entry := range args.Entries {
+		entry.Data = append([]byte(nil), entry.Data...)
+		copied.Entries[i] = entry
+	}
+	return deliver(ctx, func() (*AppendEntriesReply, error) { return h.HandleAppendEntries(&copied) })
+}
+
+func (t *inmemTransport) InstallSnapshot(ctx context.Context, target string, args *InstallSnapshotArgs) (*InstallSnapshotReply, error) {
+	h, err := t.network.handler(t.from, target)
+	if err != nil {
+		return nil, err
+	}
+	copied := *args
+	copied.Members = append([]string(nil), args.Members...)
+	return deliver(ctx, func() (*InstallSnapshotReply, error) { return h.HandleInstallSnapshot(&copied) })
+}
+
+// deliver runs an RPC handler, giving up when ctx is done. The handler keeps
+// running in that case, like a request already on the wire
+func deliver[R any](ctx context.Context, call func() (*R, error)) (*R, error) {
+	type result struct {
+		reply *R
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		reply, err := call()
+		done <- result{reply, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.reply, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,486 @@
+package kvstore
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+)
+
+// RepairOptions controls Repair
+type RepairOptions struct {
+	// DryRun only reports what would be salvaged and lost; no file is
+	// changed
+	DryRun bool
+}
+
+// RepairReport describes what Repair salvaged and what was lost
+type RepairReport struct {
+	SnapshotRecords int    // records salvaged from the snapshot
+	SnapshotLost    int    // records the snapshot header counts that could not be read
+	SnapshotLSN     uint64 // LSN in the snapshot header, 0 if unknown
+	WALEntries      int    // entries salvaged from the WAL
+
+	Damaged []DamagedRange // bytes that could not be decoded
+	Missing []LSNRange     // WAL entries that are neither in the WAL nor covered by the snapshot
+
+	LSN    uint64 // LSN of the repaired snapshot; the WAL continues after it
+	Keys   int    // keys in the repaired snapshot
+	Backup string // directory the original files were moved to, "" for a dry run
+}
+
+// Clean reports whether nothing was lost
+func (r *RepairReport) Clean() bool {
+	return len(r.Damaged) == 0 && len(r.Missing) == 0 && r.SnapshotLost == 0
+}
+
+// DamagedRange is a run of bytes in a file that held no decodable record
+type DamagedRange struct {
+	File   string // file name in the data directory
+	Offset int64
+	Length int64
+	Err    error // why the first record in the range failed to decode
+}
+
+// LSNRange is an inclusive range of LSNs
+type LSNRange struct {
+	First, Last uint64
+}
+
+// Repair salvages every intact record of a damaged data directory and
+// rewrites it as a clean snapshot and an empty WAL
+//
+// Unlike recovery, which stops at the first corruption, Repair skips damaged
+// bytes: in the WAL it resynchronizes on the next entry magic number, in the
+// snapshot on the next record whose checksum matches. The salvaged WAL
+// entries are applied over the salvaged snapshot in LSN order. Segments that
+// recovery set aside (*.corrupt) are reported as damaged but not salvaged:
+// the log continued without them, so their LSNs may have been reused. The
+// original files are moved to a backup directory inside dataDir
+//
+// The repaired files are written and synced before any original is touched,
+// and the new snapshot replaces the old one atomically, so a failure or a
+// crash never leaves the directory without a snapshot or a WAL
+//
+// The store must not be open while Repair runs: Repair fails with ErrLocked
+// if it is, and a dry run only while it is open for writing
+func Repair(dataDir string, opts RepairOptions) (*RepairReport, error) {
+	lock, err := lockDir(dataDir, opts.DryRun)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.release()
+
+	report := &RepairReport{}
+
+	store := &Store{
+		data:      make(map[string][]byte),
+		versions:  make(map[string]uint64),
+		expiries:  make(map[string]int64),
+		index:     newSkiplist(),
+		snapshots: make(map[*Snapshot]struct{}),
+		metrics:   nopMetrics{},
+	}
+
+	var originals []string
+	snapshotPath := filepath.Join(dataDir, snapshotFilename)
+	if data, err := os.ReadFile(snapshotPath); err == nil {
+		originals = append(originals, snapshotPath)
+		salvageSnapshot(data, store, report)
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	store.seq = report.SnapshotLSN
+
+	segments, err := listSegments(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	legacyPath := filepath.Join(dataDir, legacyWALFilename)
+	if _, err := os.Stat(legacyPath); err == nil {
+		segments = append([]segment{{firstLSN: 1, path: legacyPath}}, segments...)
+	}
+
+	var entries []*Entry
+	for _, seg := range segments {
+		data, err := os.ReadFile(seg.path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read WAL segment: %w", err)
+		}
+		originals = append(originals, seg.path)
+		entries = append(entries, salvageSegment(data, seg, report)...)
+	}
+
+	setAside, err := listSetAside(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, seg := range setAside {
+		originals = append(originals, seg.path)
+		report.Damaged = append(report.Damaged, DamagedRange{File: filepath.Base(seg.path), Length: seg.size, Err: errSetAside})
+	}
+
+	// Apply the entries the snapshot does not cover, noting the gaps
+	slices.SortStableFunc(entries, func(a, b *Entry) int {
+		return cmp.Compare(a.LSN, b.LSN)
+	})
+	for _, entry := range entries {
+		if entry.LSN <= store.seq {
+			continue
+		}
+		if entry.LSN > store.seq+1 {
+			report.Missing = append(report.Missing, LSNRange{First: store.seq + 1, Last: entry.LSN - 1})
+		}
+		if !isKnownOperation(entry.Operation) {
+			store.seq = entry.LSN
+			continue
+		}
+		if err := store.apply(entry); err != nil {
+			return nil, fmt.Errorf("failed to apply entry %d: %w", entry.LSN, err)
+		}
+		report.WALEntries++
+	}
+
+	report.LSN = store.seq
+	report.Keys = len(store.data)
+	now := time.Now().UnixNano()
+	for _, expiresAt := range store.expiries {
+		if isExpired(expiresAt, now) {
+			report.Keys--
+		}
+	}
+
+	if opts.DryRun {
+		return report, nil
+	}
+
+	// Write the repaired files next to the originals first, so a failure
+	// leaves the directory as it was
+	count, records := mapRecords(store.data, store.expiries)
+	snapshotTemp, err := writeSnapshotTemp(dataDir, store.seq, count, records)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write repaired snapshot: %w", err)
+	}
+	defer os.Remove(snapshotTemp)
+
+	newSegment := segmentPath(dataDir, store.seq+1)
+	segmentTemp := newSegment + ".tmp"
+	if err := createSynced(segmentTemp); err != nil {
+		return nil, fmt.Errorf("failed to create WAL segment: %w", err)
+	}
+	defer os.Remove(segmentTemp)
+
+	// Keep the originals. They stay in place until the repaired snapshot,
+	// which covers every entry they hold, has replaced the old one
+	backup := filepath.Join(dataDir, fmt.Sprintf("repair-backup-%d", now))
+	if err := os.Mkdir(backup, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	for _, path := range originals {
+		if err := backupFile(path, backup); err != nil {
+			return nil, fmt.Errorf("failed to back up %s: %w", filepath.Base(path), err)
+		}
+	}
+	if err := syncDir(backup); err != nil {
+		return nil, err
+	}
+	report.Backup = backup
+
+	if err := os.Rename(snapshotTemp, snapshotPath); err != nil {
+		return nil, fmt.Errorf("failed to install repaired snapshot: %w", err)
+	}
+	for _, path := range originals {
+		if path == snapshotPath || path == newSegment {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove %s: %w", filepath.Base(path), err)
+		}
+	}
+	if err := os.Rename(segmentTemp, newSegment); err != nil {
+		return nil, fmt.Errorf("failed to create WAL segment: %w", err)
+	}
+	if err := syncDir(dataDir); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// errSetAside is the reason reported for a segment recovery set aside
+var errSetAside = errors.New("segment set aside by recovery after missing entries, not salvaged")
+
+// listSetAside returns the segments recovery set aside in dataDir
+func listSetAside(dataDir string) ([]segment, error) {
+	entries, err := os.ReadDir(dataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list WAL segments: %w", err)
+	}
+
+	var segments []segment
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), segmentPrefix) || !strings.HasSuffix(entry.Name(), segmentSuffix+".corrupt") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat WAL segment %s: %w", entry.Name(), err)
+		}
+		segments = append(segments, segment{path: filepath.Join(dataDir, entry.Name()), size: info.Size()})
+	}
+	return segments, nil
+}
+
+// createSynced creates an empty file and syncs it
+func createSynced(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// backupFile links path into the backup directory, or copies it where hard
+// links are not supported
+func backupFile(path, backup string) error {
+	target := filepath.Join(backup, filepath.Base(path))
+	if err := os.Link(path, target); err == nil {
+		return nil
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// syncDir syncs a directory so the renames and removals in it are durable
+// Windows cannot sync directories and does not need to
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %w", err)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	return nil
+}
+
+// salvageSnapshot decodes the records of a snapshot into store, skipping
+// damaged bytes. A damaged header is assumed to be in the current format
+func salvageSnapshot(data []byte, store *Store, report *RepairReport) {
+	header, err := decodeSnapshotHeader(bytes.NewReader(data))
+	count := -1
+	if err == nil {
+		count = int(header.count)
+		report.SnapshotLSN = header.lsn
+	} else {
+		report.Damaged = append(report.Damaged, DamagedRange{File: snapshotFilename, Length: snapshotHeaderV3, Err: err})
+		if header.magic != snapshotMagicV1 && header.magic != snapshotMagicV2 {
+			header.magic = SnapshotMagic
+		}
+	}
+
+	pos := snapshotHeaderV3
+	if header.magic != SnapshotMagic {
+		pos = snapshotHeaderV2
+	}
+	pos = min(pos, len(data))
+
+	salvage(data, pos, snapshotFilename, report, func(at int) (int, error) {
+		rec, size, err := decodeSnapshotRecordAt(data[at:], header)
+		if err != nil {
+			return 0, err
+		}
+		store.data[rec.key] = rec.value
+		store.index.insert(rec.key)
+		if rec.expiresAt != 0 {
+			store.expiries[rec.key] = rec.expiresAt
+		}
+		report.SnapshotRecords++
+		return size, nil
+	}, nil)
+
+	if count > report.SnapshotRecords {
+		report.SnapshotLost = count - report.SnapshotRecords
+	}
+}
+
+// decodeSnapshotRecordAt decodes the snapshot record at the start of data,
+// returning its size. The lengths are checked before anything is allocated
+func decodeSnapshotRecordAt(data []byte, header snapshotHeader) (record, int, error) {
+	trailer := 8 + 4 // ExpiresAt | CRC
+	if header.magic == snapshotMagicV1 {
+		trailer = 4
+	}
+
+	if len(data) < 4 {
+		return record{}, 0, ErrTruncatedEntry
+	}
+	keyLen := int64(binary.BigEndian.Uint32(data))
+	if 4+keyLen+4 > int64(len(data)) {
+		return record{}, 0, fmt.Errorf("%w: key length %d past the end of the file", ErrTruncatedEntry, keyLen)
+	}
+	valueLen := int64(binary.BigEndian.Uint32(data[4+keyLen:]))
+	size := 4 + keyLen + 4 + valueLen + int64(trailer)
+	if size > int64(len(data)) {
+		return record{}, 0, fmt.Errorf("%w: value length %d past the end of the file", ErrTruncatedEntry, valueLen)
+	}
+
+	// The position in the CorruptionError is relative to data, the caller
+	// reports its own
+	var rec record
+	header.count = 1
+	err := decodeSnapshotRecords(bytes.NewReader(data[:size]), header, func(r record) { rec = r })
+	var cerr *CorruptionError
+	if errors.As(err, &cerr) {
+		err = cerr.Err
+	}
+	return rec, int(size), err
+}
+
+// salvageSegment decodes the entries of a WAL segment, skipping damaged
+// bytes. Entries without an LSN (v1) are numbered after the previous one
+func salvageSegment(data []byte, seg segment, report *RepairReport) []*Entry {
+	var entries []*Entry
+	last := seg.firstLSN - 1
+
+	salvage(data, 0, filepath.Base(seg.path), report, func(at int) (int, error) {
+		size, err := entrySizeAt(data[at:])
+		if err != nil {
+			return 0, err
+		}
+		entry, err := DecodeEntry(bytes.NewReader(data[at : at+size]))
+		if err != nil {
+			return 0, err
+		}
+
+		if entry.LSN == 0 {
+			entry.LSN = last + 1
+		}
+		last = entry.LSN
+		entries = append(entries, entry)
+		return size, nil
+	}, func(from int) int {
+		return nextEntryMagic(data, from)
+	})
+
+	return entries
+}
+
+// salvage decodes the records of data starting at pos with decode, which
+// returns the size of the record at an offset. After a failure the next
+// record is looked for at each offset returned by next (every following byte
+// if next is nil), and the skipped bytes are reported as damaged
+func salvage(data []byte, pos int, file string, report *RepairReport, decode func(at int) (int, error), next func(from int) int) {
+	if next == nil {
+		next = func(from int) int { return from }
+	}
+
+	for pos < len(data) {
+		size, err := decode(pos)
+		if err == nil {
+			pos += size
+			continue
+		}
+
+		damaged := DamagedRange{File: file, Offset: int64(pos), Err: err}
+		for pos = next(pos + 1); pos < len(data); pos = next(pos + 1) {
+			if size, err := decode(pos); err == nil {
+				damaged.Length = int64(pos) - damaged.Offset
+				pos += size
+				break
+			}
+		}
+		if pos >= len(data) {
+			damaged.Length = int64(len(data)) - damaged.Offset
+		}
+		report.Damaged = append(report.Damaged, damaged)
+	}
+}
+
+// entrySizeAt returns the size of the entry at the start of data, checking
+// that its lengths fit in data before anything is allocated
+func entrySizeAt(data []byte) (int, error) {
+	if len(data) < 4 {
+		return 0, ErrTruncatedEntry
+	}
+
+	headerSize := entryHeaderSizeV2
+	switch binary.BigEndian.Uint32(data) {
+	case EntryMagic:
+	case entryMagicV1:
+		headerSize = entryHeaderSizeV1
+	default:
+		return 0, fmt.Errorf("%w: 0x%X", ErrInvalidMagic, binary.BigEndian.Uint32(data))
+	}
+
+	if len(data) < headerSize {
+		return 0, ErrTruncatedEntry
+	}
+	keyLen := int64(binary.BigEndian.Uint32(data[headerSize-4:]))
+	if int64(headerSize)+keyLen+4 > int64(len(data)) {
+		return 0, fmt.Errorf("%w: key length %d past the end of the file", ErrTruncatedEntry, keyLen)
+	}
+	valueLen := int64(binary.BigEndian.Uint32(data[int64(headerSize)+keyLen:]))
+	size := int64(headerSize) + keyLen + 4 + valueLen + 4
+	if size > int64(len(data)) {
+		return 0, fmt.Errorf("%w: value length %d past the end of the file", ErrTruncatedEntry, valueLen)
+	}
+
+	return int(size), nil
+}
+
+// nextEntryMagic returns the offset of the next entry magic number at or
+// after from, or len(data) if there is none
+func nextEntryMagic(data []byte, from int) int {
+	if from >= len(data) {
+		return len(data)
+	}
+
+	var v2, v1 [4]byte
+	binary.BigEndian.PutUint32(v2[:], EntryMagic)
+	binary.BigEndian.PutUint32(v1[:], entryMagicV1)
+
+	next := len(data)
+	for _, magic := range [][]byte{v2[:], v1[:]} {
+		if i := bytes.Index(data[from:], magic); i >= 0 {
+			next = min(next, from+i)
+		}
+	}
+	return next
+}
@@ -0,0 +1,219 @@
+package kvstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestRepairWAL tests that entries after a corrupted one are salvaged
+func TestRepairWAL(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	wal, err := NewWAL(dir, true)
+	if err != nil {
+		t.Fatalf("NewWAL failed: %v", err)
+	}
+	var offsets []int64
+	for i := 0; i < 10; i++ {
+		offsets = append(offsets, wal.Size())
+		if err := wal.Append(NewSetEntry(fmt.Sprintf("key%d", i), []byte("value"))); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	wal.Close()
+
+	// Damage the value of the entry with LSN 4
+	path := segmentPath(dir, 1)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	data[offsets[4]-6] ^= 0xFF
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	report, err := Repair(dir, RepairOptions{})
+	if err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	if report.WALEntries != 9 || report.LSN != 10 || report.Keys != 9 {
+		t.Errorf("Expected 9 entries up to LSN 10, got %+v", report)
+	}
+	if len(report.Missing) != 1 || report.Missing[0] != (LSNRange{First: 4, Last: 4}) {
+		t.Errorf("Expected LSN 4 missing, got %v", report.Missing)
+	}
+	if len(report.Damaged) != 1 || report.Damaged[0].Offset != offsets[3] || report.Damaged[0].Length != offsets[4]-offsets[3] {
+		t.Errorf("Expected the bytes of LSN 4 damaged, got %+v", report.Damaged)
+	}
+	if report.Clean() {
+		t.Error("Report should not be clean")
+	}
+	if _, err := os.Stat(filepath.Join(report.Backup, filepath.Base(path))); err != nil {
+		t.Errorf("Original segment should be in the backup: %v", err)
+	}
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open after repair failed: %v", err)
+	}
+	defer store.Close()
+
+	for i := 0; i < 10; i++ {
+		_, ok := store.Get(fmt.Sprintf("key%d", i))
+		if ok != (i != 3) {
+			t.Errorf("key%d: expected exists=%v", i, i != 3)
+		}
+	}
+
+	// The WAL continues after the repaired snapshot
+	store.Set("next", []byte("v"))
+	if store.wal.LastLSN() != 11 {
+		t.Errorf("Expected the next write at LSN 11, got %d", store.wal.LastLSN())
+	}
+}
+
+// TestRepairSnapshot tests that records after a corrupted one are salvaged
+func TestRepairSnapshot(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		store.Set(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("value%d", i)))
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Damage the value of the third record: KeyLen | "keyN" | ValueLen |
+	// "valueN" | ExpiresAt | CRC
+	recordSize := 4 + 4 + 4 + 6 + 8 + 4
+	path := filepath.Join(dir, snapshotFilename)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	data[snapshotHeaderV3+2*recordSize+14] ^= 0xFF
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if _, err := Open(dir); err == nil {
+		t.Fatal("Open should fail on the damaged snapshot")
+	}
+
+	report, err := Repair(dir, RepairOptions{})
+	if err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	if report.SnapshotRecords != 4 || report.SnapshotLost != 1 || report.SnapshotLSN != 5 || report.LSN != 5 {
+		t.Errorf("Expected 4 of 5 records at LSN 5, got %+v", report)
+	}
+
+	store, err = Open(dir)
+	if err != nil {
+		t.Fatalf("Open after repair failed: %v", err)
+	}
+	defer store.Close()
+	if store.Len() != 4 {
+		t.Errorf("Expected 4 keys, got %d", store.Len())
+	}
+}
+
+// TestRepairDryRun tests that a dry run reports without changing files
+func TestRepairDryRun(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	store.Set("a", []byte("1"))
+	store.Close()
+
+	before, _ := os.ReadDir(dir)
+	report, err := Repair(dir, RepairOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	if !report.Clean() || report.Keys != 1 || report.Backup != "" {
+		t.Errorf("Expected a clean report with 1 key, got %+v", report)
+	}
+
+	after, _ := os.ReadDir(dir)
+	if len(before) != len(after) {
+		t.Errorf("Dry run changed the directory: %v -> %v", before, after)
+	}
+}
+
+// TestRepairSetAside tests that segments set aside by recovery are reported
+// and moved to the backup
+func TestRepairSetAside(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	store.Set("a", []byte("1"))
+	store.Close()
+
+	setAside := segmentPath(dir, 7) + ".corrupt"
+	if err := os.WriteFile(setAside, []byte("lost entries"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	report, err := Repair(dir, RepairOptions{})
+	if err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	if len(report.Damaged) != 1 || report.Damaged[0].File != filepath.Base(setAside) || report.Damaged[0].Length != 12 {
+		t.Errorf("Expected the set aside segment reported, got %+v", report.Damaged)
+	}
+	if _, err := os.Stat(setAside); !os.IsNotExist(err) {
+		t.Errorf("Set aside segment should be moved to the backup: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(report.Backup, filepath.Base(setAside))); err != nil {
+		t.Errorf("Set aside segment missing from the backup: %v", err)
+	}
+}
+
+// TestRepairFailureKeepsOriginals tests that a failed repair leaves the
+// directory as it was
+func TestRepairFailureKeepsOriginals(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	store.Set("a", []byte("1"))
+	store.Close()
+
+	// The repaired snapshot cannot be written
+	if err := os.Mkdir(filepath.Join(dir, snapshotTempFilename), 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	if _, err := Repair(dir, RepairOptions{}); err == nil {
+		t.Fatal("Expected Repair to fail")
+	}
+	os.Remove(filepath.Join(dir, snapshotTempFilename))
+
+	store, err = Open(dir)
+	if err != nil {
+		t.Fatalf("Open after a failed repair failed: %v", err)
+	}
+	defer store.Close()
+	if value, ok := store.Get("a"); !ok || string(value) != "1" {
+		t.Errorf("Expected the original data, got %q", value)
+	}
+}
@@ -0,0 +1,495 @@
+package kvstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Replication protocol
+//
+// A follower connects to the leader and sends a handshake:
+// Magic (4 bytes) | From (8 bytes, LSN of the first entry it needs)
+//
+// The leader answers with a stream of frames, each a type byte followed by
+// its payload:
+//
+//	'S' a snapshot in the format of writeSnapshot, sent first when the WAL
+//	    no longer holds From. Entries continue after the snapshot's LSN
+//	'E' a WAL entry in the format of Entry.Encode, in LSN order
+//	'H' the leader's durable LSN (8 bytes), sent after each group of
+//	    entries and every heartbeatInterval while idle
+//
+// Entries are shipped once they are durable on the leader and applied by the
+// follower exactly like WAL replay during recovery, so a follower's data
+// directory is a valid store at every point and picks up where it left off
+// after a restart
+const ReplicationMagic uint32 = 0x4B565231 // "KVR1" - KV Replication v1
+
+const (
+	frameSnapshot  byte = 'S'
+	frameEntry     byte = 'E'
+	frameHeartbeat byte = 'H'
+
+	// heartbeatInterval is how often an idle leader reports its position
+	heartbeatInterval = time.Second
+
+	// replicationTimeout is how long a read or write may stall before the
+	// connection is considered dead
+	replicationTimeout = 5 * heartbeatInterval
+
+	// maxShipBatch bounds the entries sent between two position reports
+	maxShipBatch = 1024
+
+	// Delay before reconnecting to the leader, doubled after each failure
+	minReconnectDelay = 100 * time.Millisecond
+	maxReconnectDelay = 5 * time.Second
+)
+
+// ErrReadOnly is returned by writes to a store that follows a leader or was
+// opened with Config.ReadOnly
+var ErrReadOnly = errors.New("store is read-only")
+
+// ReplicationStatus describes a follower's position relative to its leader
+type ReplicationStatus struct {
+	Leader      string    // address of the leader (Config.ReplicaOf)
+	Connected   bool      // whether the follower is streaming from the leader
+	AppliedLSN  uint64    // LSN of the last entry applied locally
+	LeaderLSN   uint64    // last durable LSN reported by the leader
+	Lag         uint64    // entries applied by the leader but not yet here
+	LastContact time.Time // when the leader was last heard from
+	LastError   error     // why the last connection ended, if it failed
+}
+
+// follower holds the replication state of a store following a leader
+type follower struct {
+	leader string
+
+	mu          sync.Mutex
+	connected   bool
+	leaderLSN   uint64
+	lastContact time.Time
+	err         error
+}
+
+// ReplicationStatus reports how far the store lags behind its leader
+// Returns false if the store is not a follower
+func (s *Store) ReplicationStatus() (ReplicationStatus, bool) {
+	if s.follower == nil {
+		return ReplicationStatus{}, false
+	}
+
+	s.mu.RLock()
+	applied := s.seq
+	s.mu.RUnlock()
+
+	f := s.follower
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	status := ReplicationStatus{
+		Leader:      f.leader,
+		Connected:   f.connected,
+		AppliedLSN:  applied,
+		LeaderLSN:   f.leaderLSN,
+		LastContact: f.lastContact,
+		LastError:   f.err,
+	}
+	if status.LeaderLSN > applied {
+		status.Lag = status.LeaderLSN - applied
+	}
+
+	return status, true
+}
+
+// ServeReplication accepts followers on l and streams the store's WAL to
+// them. It blocks until l fails or the store is closed, in which case it
+// closes l and returns nil
+func (s *Store) ServeReplication(l net.Listener) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-s.stop:
+			l.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.stopped() {
+				return nil
+			}
+			return err
+		}
+
+		started := s.goTask(func() {
+			// Errors caused by closing the store are not worth reporting
+			if err := s.serveFollower(conn); err != nil && !s.stopped() {
+				s.logger.Warn("replication to follower stopped", "follower", conn.RemoteAddr().String(), "err", err)
+			}
+		})
+		if !started {
+			conn.Close()
+		}
+	}
+}
+
+// goTask runs fn in the background unless the store is closing, so Close
+// waits for it. Returns whether fn was started
+func (s *Store) goTask(fn func()) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped() {
+		return false
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		fn()
+	}()
+	return true
+}
+
+// stopped reports whether the store is closing
+func (s *Store) stopped() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// timeoutConn refreshes the deadline before every read and write, so a
+// stalled peer is detected without bounding long transfers
+type timeoutConn struct {
+	net.Conn
+}
+
+func (c timeoutConn) Read(p []byte) (int, error) {
+	c.SetReadDeadline(time.Now().Add(replicationTimeout))
+	return c.Conn.Read(p)
+}
+
+func (c timeoutConn) Write(p []byte) (int, error) {
+	c.SetWriteDeadline(time.Now().Add(replicationTimeout))
+	return c.Conn.Write(p)
+}
+
+// closeOnStop closes conn when the store is closed, until the returned
+// function is called
+func (s *Store) closeOnStop(conn net.Conn) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-s.stop:
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// serveFollower streams the WAL to one follower until it disconnects or the
+// store is closed
+func (s *Store) serveFollower(nc net.Conn) error {
+	defer nc.Close()
+	defer s.closeOnStop(nc)()
+	conn := timeoutConn{nc}
+
+	var handshake struct {
+		Magic uint32
+		From  uint64
+	}
+	if err := binary.Read(conn, binary.BigEndian, &handshake); err != nil {
+		return fmt.Errorf("failed to read handshake: %w", err)
+	}
+	if handshake.Magic != ReplicationMagic {
+		return fmt.Errorf("invalid replication magic: 0x%X", handshake.Magic)
+	}
+
+	w := bufio.NewWriter(conn)
+
+	tail, err := s.wal.tail(handshake.From)
+	if errors.Is(err, errEntriesRemoved) {
+		// The follower is too far behind (or ahead) for the WAL: start it
+		// over from a snapshot and ship the entries after it
+		tail, err = s.sendSnapshot(w)
+	}
+	if err != nil {
+		return err
+	}
+	defer tail.close()
+
+	// Let the follower know how far behind it is right away
+	durable, _ := s.wal.durableLSN()
+	if err := sendPosition(w, durable); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		durable, advanced := s.wal.durableLSN()
+		if tail.next <= durable {
+			upto := min(durable, tail.next+maxShipBatch-1)
+			err := tail.read(upto, func(entry *Entry) error {
+				if err := w.WriteByte(frameEntry); err != nil {
+					return err
+				}
+				return entry.Encode(w)
+			})
+			if err != nil {
+				return err
+			}
+			if err := sendPosition(w, durable); err != nil {
+				return err
+			}
+			continue
+		}
+
+		select {
+		case <-s.stop:
+			return nil
+		case <-advanced:
+		case <-ticker.C:
+			if err := sendPosition(w, durable); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// sendSnapshot writes a snapshot frame of the current state and returns a
+// tail positioned right after it
+func (s *Store) sendSnapshot(w *bufio.Writer) (*walTail, error) {
+	snap := s.Snapshot()
+	defer snap.Close()
+
+	// Open the tail before the dump so a checkpoint cannot remove the
+	// entries following the snapshot meanwhile
+	tail, err := s.wal.tail(snap.Seq() + 1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to tail WAL after snapshot: %w", err)
+	}
+
+	if err := w.WriteByte(frameSnapshot); err != nil {
+		tail.close()
+		return nil, err
+	}
+	if err := encodeSnapshot(w, snap.Seq(), snap.Len(), snap.records("", "")); err != nil {
+		tail.close()
+		return nil, fmt.Errorf("failed to send snapshot: %w", err)
+	}
+
+	return tail, nil
+}
+
+// sendPosition writes a heartbeat frame carrying lsn and flushes w
+func sendPosition(w *bufio.Writer, lsn uint64) error {
+	var frame [9]byte
+	frame[0] = frameHeartbeat
+	binary.BigEndian.PutUint64(frame[1:], lsn)
+
+	if _, err := w.Write(frame[:]); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// runFollower replicates from the leader, reconnecting after failures, until
+// the store is closed
+func (s *Store) runFollower() {
+	defer s.wg.Done()
+
+	delay := minReconnectDelay
+	for {
+		progressed, err := s.follow()
+
+		f := s.follower
+		f.mu.Lock()
+		f.connected = false
+		if err != nil {
+			f.err = err
+		}
+		f.mu.Unlock()
+
+		if progressed {
+			delay = minReconnectDelay
+		}
+		if err != nil && !s.stopped() {
+			s.logger.Warn("replication from leader interrupted", "leader", f.leader, "err", err, "retry_in", delay)
+		}
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, maxReconnectDelay)
+	}
+}
+
+// follow runs one replication session. Returns whether anything was received
+// from the leader and why the session ended
+func (s *Store) follow() (bool, error) {
+	nc, err := net.DialTimeout("tcp", s.follower.leader, replicationTimeout)
+	if err != nil {
+		return false, err
+	}
+	defer nc.Close()
+	defer s.closeOnStop(nc)()
+	conn := timeoutConn{nc}
+
+	// Every received entry has been applied when a session starts, so the
+	// applied LSN is where the WAL ends
+	s.mu.RLock()
+	from := s.seq + 1
+	s.mu.RUnlock()
+
+	var handshake bytes.Buffer
+	binary.Write(&handshake, binary.BigEndian, ReplicationMagic)
+	binary.Write(&handshake, binary.BigEndian, from)
+	if _, err := conn.Write(handshake.Bytes()); err != nil {
+		return false, err
+	}
+
+	r := bufio.NewReader(conn)
+	var pending []*Entry
+	progressed := false
+
+	// apply makes the entries received so far durable and visible. They
+	// are queued as they arrive, so one fsync covers all of them
+	apply := func() error {
+		var err error
+		for _, entry := range pending {
+			if ferr := s.finish(entry); ferr != nil && err == nil {
+				err = ferr
+			}
+		}
+		pending = pending[:0]
+		return err
+	}
+	defer apply()
+
+	for {
+		if len(pending) > 0 && (r.Buffered() == 0 || len(pending) >= maxShipBatch) {
+			if err := apply(); err != nil {
+				return progressed, err
+			}
+		}
+
+		kind, err := r.ReadByte()
+		if err != nil {
+			return progressed, err
+		}
+
+		if !progressed {
+			progressed = true
+			s.follower.mu.Lock()
+			s.follower.connected = true
+			s.follower.err = nil
+			s.follower.mu.Unlock()
+		}
+
+		switch kind {
+		case frameEntry:
+			entry, err := DecodeEntry(r)
+			if err != nil {
+				return progressed, fmt.Errorf("failed to read replicated entry: %w", err)
+			}
+
+			s.mu.Lock()
+			err = s.enqueueReplicatedLocked(entry)
+			s.mu.Unlock()
+			if err != nil {
+				return progressed, err
+			}
+			pending = append(pending, entry)
+
+		case frameSnapshot:
+			if err := apply(); err != nil {
+				return progressed, err
+			}
+			data, expiries, lsn, err := decodeSnapshot(r)
+			if err != nil {
+				return progressed, fmt.Errorf("failed to read replicated snapshot: %w", err)
+			}
+			if err := s.installSnapshot(data, expiries, lsn); err != nil {
+				return progressed, err
+			}
+
+		case frameHeartbeat:
+			var lsn uint64
+			if err := binary.Read(r, binary.BigEndian, &lsn); err != nil {
+				return progressed, err
+			}
+			s.follower.mu.Lock()
+			s.follower.leaderLSN = lsn
+			s.follower.mu.Unlock()
+
+		default:
+			return progressed, fmt.Errorf("unknown replication frame 0x%X", kind)
+		}
+
+		s.follower.mu.Lock()
+		s.follower.lastContact = time.Now()
+		s.follower.mu.Unlock()
+	}
+}
+
+// installSnapshot replaces the follower's state with a snapshot received
+// from the leader. The WAL is restarted after the snapshot's LSN before the
+// snapshot replaces the old one on disk: a crash in between recovers the old
+// snapshot, and the log no longer continuing it is discarded by ReplayFrom
+func (s *Store) installSnapshot(data map[string][]byte, expiries map[string]int64, lsn uint64) error {
+	s.checkpointMu.Lock()
+	defer s.checkpointMu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.wal.reset(lsn); err != nil {
+		return fmt.Errorf("failed to install snapshot: %w", err)
+	}
+	if err := writeSnapshot(s.config.DataDir, data, expiries, lsn); err != nil {
+		return fmt.Errorf("failed to install snapshot: %w", err)
+	}
+
+	// Open snapshots keep seeing the state before the install
+	for key := range s.data {
+		s.preserve(key)
+	}
+	for key := range data {
+		s.preserve(key)
+	}
+
+	s.data = data
+	s.expiries = expiries
+	s.versions = make(map[string]uint64, len(data))
+	s.index = newSkiplist()
+	s.bytes = 0
+	for key, value := range data {
+		s.versions[key] = lsn
+		s.index.insert(key)
+		s.bytes += sizeOf(key, value)
+	}
+	s.seq = lsn
+	s.resetWatchersLocked()
+	s.applied.Broadcast()
+	s.metrics.Gauge(MetricKeys, float64(len(data)))
+	s.metrics.Gauge(MetricMemoryBytes, float64(s.bytes))
+	s.logger.Info("installed snapshot", "lsn", lsn, "keys", len(data))
+
+	return nil
+}
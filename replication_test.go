@@ -0,0 +1,253 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveReplication serves the store's WAL on addr ("127.0.0.1:0" picks a
+// free port) and returns the address
+func serveReplication(t *testing.T, store *Store, addr string) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	go store.ServeReplication(l)
+
+	return l.Addr().String()
+}
+
+// openFollower opens a store in dir following the leader at addr
+func openFollower(t *testing.T, dir, addr string) *Store {
+	t.Helper()
+
+	store, err := OpenWithConfig(Config{DataDir: dir, ReplicaOf: addr})
+	if err != nil {
+		t.Fatalf("Open follower failed: %v", err)
+	}
+	return store
+}
+
+// waitCaughtUp waits until follower has applied every entry of leader
+func waitCaughtUp(t *testing.T, leader, follower *Store) {
+	t.Helper()
+
+	waitFor(t, "follower to catch up", func() bool {
+		leader.mu.RLock()
+		seq := leader.seq
+		leader.mu.RUnlock()
+
+		status, _ := follower.ReplicationStatus()
+		return status.AppliedLSN == seq && status.LeaderLSN == seq
+	})
+}
+
+// assertSameData fails unless both stores hold the same pairs
+func assertSameData(t *testing.T, leader, follower *Store) {
+	t.Helper()
+
+	want, got := leader.Keys(), follower.Keys()
+	if fmt.Sprint(want) != fmt.Sprint(got) {
+		t.Fatalf("Expected keys %v, got %v", want, got)
+	}
+	for _, key := range want {
+		a, _ := leader.Get(key)
+		b, _ := follower.Get(key)
+		if string(a) != string(b) {
+			t.Errorf("Key %s: expected %q, got %q", key, a, b)
+		}
+	}
+}
+
+// TestReplicationStreamsWAL tests that a new follower receives the existing
+// log and then every write as it happens
+func TestReplicationStreamsWAL(t *testing.T) {
+	leader, err := OpenWithConfig(Config{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Open leader failed: %v", err)
+	}
+	defer leader.Close()
+
+	leader.Set("a", []byte("1"))
+	leader.Set("b", []byte("2"))
+	leader.Delete("a")
+
+	addr := serveReplication(t, leader, "127.0.0.1:0")
+	follower := openFollower(t, t.TempDir(), addr)
+	defer follower.Close()
+
+	waitCaughtUp(t, leader, follower)
+	assertSameData(t, leader, follower)
+
+	// Live writes, including batches and TTLs
+	leader.Batch(func(b *WriteBatch) error {
+		b.Put("c", []byte("3"))
+		b.Put("d", []byte("4"))
+		return nil
+	})
+	leader.SetWithTTL("temp", []byte("x"), time.Hour)
+	for i := 0; i < 100; i++ {
+		leader.Set(fmt.Sprintf("k%03d", i), []byte("v"))
+	}
+
+	waitCaughtUp(t, leader, follower)
+	assertSameData(t, leader, follower)
+	if ttl, ok := follower.TTL("temp"); !ok || ttl < 59*time.Minute {
+		t.Errorf("Expected temp to expire in about an hour, got %v, %v", ttl, ok)
+	}
+
+	status, ok := follower.ReplicationStatus()
+	if !ok || !status.Connected || status.Lag != 0 || status.Leader != addr {
+		t.Errorf("Unexpected status %+v", status)
+	}
+	if _, ok := leader.ReplicationStatus(); ok {
+		t.Error("Leader should not report follower status")
+	}
+}
+
+// TestReplicationReadOnly tests that a follower rejects writes
+func TestReplicationReadOnly(t *testing.T) {
+	leader, err := OpenWithConfig(Config{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Open leader failed: %v", err)
+	}
+	defer leader.Close()
+
+	follower := openFollower(t, t.TempDir(), serveReplication(t, leader, "127.0.0.1:0"))
+	defer follower.Close()
+
+	if err := follower.Set("k", []byte("v")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Set: expected ErrReadOnly, got %v", err)
+	}
+	if err := follower.Delete("k"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Delete: expected ErrReadOnly, got %v", err)
+	}
+	if _, err := follower.SetIfAbsent("k", []byte("v")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("SetIfAbsent: expected ErrReadOnly, got %v", err)
+	}
+	err = follower.Update(func(tx *Txn) error {
+		return tx.Set("k", []byte("v"))
+	})
+	if !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Update: expected ErrReadOnly, got %v", err)
+	}
+}
+
+// TestReplicationSnapshotBootstrap tests that a follower whose position is
+// no longer in the leader's WAL starts from a snapshot
+func TestReplicationSnapshotBootstrap(t *testing.T) {
+	leader, err := OpenWithConfig(Config{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Open leader failed: %v", err)
+	}
+	defer leader.Close()
+
+	for i := 0; i < 50; i++ {
+		leader.Set(fmt.Sprintf("k%02d", i), []byte(fmt.Sprintf("v%d", i)))
+	}
+	leader.SetWithTTL("temp", []byte("x"), time.Hour)
+	if err := leader.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	leader.Set("after", []byte("checkpoint"))
+
+	followerDir := t.TempDir()
+	follower := openFollower(t, followerDir, serveReplication(t, leader, "127.0.0.1:0"))
+	defer follower.Close()
+
+	waitCaughtUp(t, leader, follower)
+	assertSameData(t, leader, follower)
+	if _, ok := follower.TTL("temp"); !ok {
+		t.Error("temp should keep its TTL")
+	}
+
+	// The snapshot was installed on disk
+	_, _, lsn, err := loadSnapshot(followerDir)
+	if err != nil || lsn != 52 {
+		t.Errorf("Expected an installed snapshot at LSN 52, got %d, %v", lsn, err)
+	}
+}
+
+// TestReplicationResume tests that a restarted follower continues from its
+// own data and catches up with what it missed
+func TestReplicationResume(t *testing.T) {
+	leader, err := OpenWithConfig(Config{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Open leader failed: %v", err)
+	}
+	defer leader.Close()
+
+	addr := serveReplication(t, leader, "127.0.0.1:0")
+	followerDir := t.TempDir()
+	follower := openFollower(t, followerDir, addr)
+
+	leader.Set("first", []byte("1"))
+	waitCaughtUp(t, leader, follower)
+	if err := follower.Close(); err != nil {
+		t.Fatalf("Close follower failed: %v", err)
+	}
+
+	leader.Set("second", []byte("2"))
+	leader.Delete("first")
+
+	// Before it reconnects the follower serves what it had
+	follower, err = OpenWithConfig(Config{DataDir: followerDir, ReplicaOf: "127.0.0.1:1"})
+	if err != nil {
+		t.Fatalf("Reopen follower failed: %v", err)
+	}
+	if value, ok := follower.Get("first"); !ok || string(value) != "1" {
+		t.Errorf("Expected first=1 after restart, got %q, %v", value, ok)
+	}
+	status, _ := follower.ReplicationStatus()
+	if status.Connected || status.AppliedLSN != 1 {
+		t.Errorf("Expected a disconnected follower at LSN 1, got %+v", status)
+	}
+	follower.Close()
+
+	follower = openFollower(t, followerDir, addr)
+	defer follower.Close()
+	waitCaughtUp(t, leader, follower)
+	assertSameData(t, leader, follower)
+}
+
+// TestReplicationLeaderRestart tests that a follower reconnects when the
+// leader comes back
+func TestReplicationLeaderRestart(t *testing.T) {
+	leaderDir := t.TempDir()
+	leader, err := OpenWithConfig(Config{DataDir: leaderDir})
+	if err != nil {
+		t.Fatalf("Open leader failed: %v", err)
+	}
+
+	addr := serveReplication(t, leader, "127.0.0.1:0")
+	follower := openFollower(t, t.TempDir(), addr)
+	defer follower.Close()
+
+	leader.Set("before", []byte("1"))
+	waitCaughtUp(t, leader, follower)
+
+	// Closing the leader also closes its listener and replication streams
+	if err := leader.Close(); err != nil {
+		t.Fatalf("Close leader failed: %v", err)
+	}
+	waitFor(t, "follower to notice", func() bool {
+		status, _ := follower.ReplicationStatus()
+		return !status.Connected
+	})
+
+	leader, err = OpenWithConfig(Config{DataDir: leaderDir})
+	if err != nil {
+		t.Fatalf("Reopen leader failed: %v", err)
+	}
+	defer leader.Close()
+	serveReplication(t, leader, addr)
+
+	leader.Set("after", []byte("2"))
+	waitCaughtUp(t, leader, follower)
+	assertSameData(t, leader, follower)
+}
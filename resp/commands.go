@@ -0,0 +1,510 @@
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caresle/kvstore"
+)
+
+// redisVersion is the Redis version reported to clients, some of which probe
+// it to decide which commands and protocol features to use
+const redisVersion = "7.0.0"
+
+const (
+	// defaultScanCount is the number of keys SCAN visits when COUNT is omitted
+	defaultScanCount = 10
+
+	// maxCursors bounds the SCAN cursors remembered by the server; the
+	// oldest ones are forgotten first
+	maxCursors = 4096
+)
+
+var (
+	errSyntax  = errors.New("syntax error")
+	errNotInt  = errors.New("value is not an integer or out of range")
+	errCursor  = errors.New("invalid cursor")
+	errExpire  = errors.New("invalid expire time in 'set' command")
+	errDBIndex = errors.New("DB index is out of range")
+)
+
+// command is a handler and its arity in the Redis sense: a positive arity is
+// the exact number of arguments including the command name, a negative one
+// the minimum
+//
+// An error returned by run is sent as an ERR reply. Write failures are sticky
+// in the Writer and end the connection at the next Flush
+type command struct {
+	run   func(s *Server, c *conn, args [][]byte) error
+	arity int
+}
+
+var commands = map[string]command{
+	"ping":    {(*Server).ping, -1},
+	"echo":    {(*Server).echo, 2},
+	"quit":    {(*Server).quit, 1},
+	"hello":   {(*Server).hello, -1},
+	"client":  {(*Server).client, -2},
+	"command": {(*Server).command, -1},
+	"select":  {(*Server).selectDB, 2},
+	"info":    {(*Server).info, -1},
+	"dbsize":  {(*Server).dbsize, 1},
+	"get":     {(*Server).get, 2},
+	"set":     {(*Server).set, -3},
+	"del":     {(*Server).del, -2},
+	"exists":  {(*Server).exists, -2},
+	"mget":    {(*Server).mget, -2},
+	"mset":    {(*Server).mset, -3},
+	"keys":    {(*Server).keys, 2},
+	"scan":    {(*Server).scan, -2},
+}
+
+func (s *Server) ping(c *conn, args [][]byte) error {
+	switch len(args) {
+	case 1:
+		return c.w.WriteSimpleString("PONG")
+	case 2:
+		return c.w.WriteBulk(args[1])
+	}
+	return c.w.WriteError("ERR wrong number of arguments for 'ping' command")
+}
+
+func (s *Server) echo(c *conn, args [][]byte) error {
+	return c.w.WriteBulk(args[1])
+}
+
+func (s *Server) quit(c *conn, args [][]byte) error {
+	c.quit = true
+	return c.w.WriteSimpleString("OK")
+}
+
+// hello negotiates the protocol version: HELLO [protover [AUTH user pass] [SETNAME name]]
+func (s *Server) hello(c *conn, args [][]byte) error {
+	proto := c.w.Protocol()
+	if len(args) > 1 {
+		v, err := strconv.Atoi(string(args[1]))
+		if err != nil {
+			return errors.New("Protocol version is not an integer or out of range")
+		}
+		if v != 2 && v != 3 {
+			return c.w.WriteError("NOPROTO sorry, this protocol version is not supported")
+		}
+		proto = v
+	}
+
+	name := c.name
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "AUTH":
+			return errors.New("AUTH is not supported, no password is set")
+		case "SETNAME":
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			name = string(args[i+1])
+			i++
+		default:
+			return errSyntax
+		}
+	}
+
+	c.name = name
+	c.w.SetProtocol(proto)
+
+	c.w.WriteMap(7)
+	c.w.WriteBulkString("server")
+	c.w.WriteBulkString("kvstore")
+	c.w.WriteBulkString("version")
+	c.w.WriteBulkString(redisVersion)
+	c.w.WriteBulkString("proto")
+	c.w.WriteInteger(int64(proto))
+	c.w.WriteBulkString("id")
+	c.w.WriteInteger(c.id)
+	c.w.WriteBulkString("mode")
+	c.w.WriteBulkString("standalone")
+	c.w.WriteBulkString("role")
+	c.w.WriteBulkString("master")
+	c.w.WriteBulkString("modules")
+	return c.w.WriteArray(0)
+}
+
+// client implements the CLIENT subcommands that client libraries send when
+// connecting
+func (s *Server) client(c *conn, args [][]byte) error {
+	sub := strings.ToUpper(string(args[1]))
+	switch {
+	case sub == "SETNAME" && len(args) == 3:
+		c.name = string(args[2])
+		return c.w.WriteSimpleString("OK")
+	case sub == "GETNAME" && len(args) == 2:
+		if c.name == "" {
+			return c.w.WriteNull()
+		}
+		return c.w.WriteBulkString(c.name)
+	case sub == "ID" && len(args) == 2:
+		return c.w.WriteInteger(c.id)
+	case sub == "SETINFO" && len(args) == 4:
+		return c.w.WriteSimpleString("OK")
+	}
+	return fmt.Errorf("unknown subcommand or wrong number of arguments for '%s'. Try CLIENT HELP.", args[1])
+}
+
+// command answers COMMAND and its subcommands with an empty list; clients
+// such as redis-cli use it for hints only
+func (s *Server) command(c *conn, args [][]byte) error {
+	return c.w.WriteArray(0)
+}
+
+// selectDB accepts SELECT 0, the only database there is
+func (s *Server) selectDB(c *conn, args [][]byte) error {
+	index, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return errNotInt
+	}
+	if index != 0 {
+		return errDBIndex
+	}
+	return c.w.WriteSimpleString("OK")
+}
+
+// info reports server, client, stats and keyspace sections: INFO [section ...]
+func (s *Server) info(c *conn, args [][]byte) error {
+	want := make(map[string]bool)
+	for _, arg := range args[1:] {
+		want[strings.ToLower(string(arg))] = true
+	}
+	all := len(want) == 0 || want["all"] || want["default"] || want["everything"]
+
+	var b strings.Builder
+	section := func(name string) bool {
+		if !all && !want[strings.ToLower(name)] {
+			return false
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# %s\r\n", name)
+		return true
+	}
+
+	if section("Server") {
+		fmt.Fprintf(&b, "redis_version:%s\r\n", redisVersion)
+		fmt.Fprintf(&b, "server_name:kvstore\r\n")
+		fmt.Fprintf(&b, "redis_mode:standalone\r\n")
+		fmt.Fprintf(&b, "process_id:%d\r\n", os.Getpid())
+		fmt.Fprintf(&b, "uptime_in_seconds:%d\r\n", int64(time.Since(s.started).Seconds()))
+	}
+	if section("Clients") {
+		fmt.Fprintf(&b, "connected_clients:%d\r\n", s.clientCount())
+	}
+	if section("Stats") {
+		fmt.Fprintf(&b, "total_connections_received:%d\r\n", s.connections.Load())
+		fmt.Fprintf(&b, "total_commands_processed:%d\r\n", s.commands.Load())
+	}
+	if section("Keyspace") {
+		if n := s.store.Len(); n > 0 {
+			fmt.Fprintf(&b, "db0:keys=%d\r\n", n)
+		}
+	}
+
+	return c.w.WriteBulkString(b.String())
+}
+
+func (s *Server) dbsize(c *conn, args [][]byte) error {
+	return c.w.WriteInteger(int64(s.store.Len()))
+}
+
+func (s *Server) get(c *conn, args [][]byte) error {
+	value, ok := s.store.Get(string(args[1]))
+	if !ok {
+		return c.w.WriteNull()
+	}
+	return c.w.WriteBulk(value)
+}
+
+// set implements SET key value [NX|XX] [EX seconds|PX milliseconds]
+// A SET skipped because of NX or XX replies with null
+func (s *Server) set(c *conn, args [][]byte) error {
+	key, value := string(args[1]), args[2]
+
+	var nx, xx bool
+	var ttl time.Duration
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); opt {
+		case "NX", "XX":
+			if nx || xx {
+				return errSyntax
+			}
+			nx, xx = opt == "NX", opt == "XX"
+		case "EX", "PX":
+			if ttl != 0 || i+1 >= len(args) {
+				return errSyntax
+			}
+			n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return errNotInt
+			}
+			unit := time.Second
+			if opt == "PX" {
+				unit = time.Millisecond
+			}
+			if n <= 0 || n > math.MaxInt64/int64(unit) {
+				return errExpire
+			}
+			ttl = time.Duration(n) * unit
+			i++
+		default:
+			return errSyntax
+		}
+	}
+
+	if !nx && !xx {
+		var err error
+		if ttl > 0 {
+			err = s.store.SetWithTTL(key, value, ttl)
+		} else {
+			err = s.store.Set(key, value)
+		}
+		if err != nil {
+			return err
+		}
+		return c.w.WriteSimpleString("OK")
+	}
+
+	// Check and write in one transaction so a concurrent writer cannot slip
+	// in between
+	var stored bool
+	err := s.store.Update(func(tx *kvstore.Txn) error {
+		_, exists := tx.Get(key)
+		stored = exists == xx
+		if !stored {
+			return nil
+		}
+		if ttl > 0 {
+			return tx.SetWithTTL(key, value, ttl)
+		}
+		return tx.Set(key, value)
+	})
+	if err != nil {
+		return err
+	}
+	if !stored {
+		return c.w.WriteNull()
+	}
+	return c.w.WriteSimpleString("OK")
+}
+
+// del removes the given keys and replies with how many existed
+func (s *Server) del(c *conn, args [][]byte) error {
+	var removed int64
+	err := s.store.Update(func(tx *kvstore.Txn) error {
+		removed = 0
+		for _, arg := range args[1:] {
+			key := string(arg)
+			if _, ok := tx.Get(key); ok {
+				removed++
+				if err := tx.Delete(key); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return c.w.WriteInteger(removed)
+}
+
+// exists replies with how many of the given keys exist; a key named twice
+// counts twice
+func (s *Server) exists(c *conn, args [][]byte) error {
+	var n int64
+	for _, arg := range args[1:] {
+		if _, ok := s.store.Get(string(arg)); ok {
+			n++
+		}
+	}
+	return c.w.WriteInteger(n)
+}
+
+// mget reads the given keys from one consistent view
+func (s *Server) mget(c *conn, args [][]byte) error {
+	values := make([][]byte, len(args)-1)
+	found := make([]bool, len(args)-1)
+	err := s.store.View(func(tx *kvstore.Txn) error {
+		for i, arg := range args[1:] {
+			values[i], found[i] = tx.Get(string(arg))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	c.w.WriteArray(len(values))
+	for i, value := range values {
+		if !found[i] {
+			c.w.WriteNull()
+			continue
+		}
+		c.w.WriteBulk(value)
+	}
+	return nil
+}
+
+// mset writes every pair atomically: MSET key value [key value ...]
+func (s *Server) mset(c *conn, args [][]byte) error {
+	if len(args)%2 != 1 {
+		return errors.New("wrong number of arguments for 'mset' command")
+	}
+
+	err := s.store.Batch(func(b *kvstore.WriteBatch) error {
+		for i := 1; i < len(args); i += 2 {
+			b.Put(string(args[i]), args[i+1])
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return c.w.WriteSimpleString("OK")
+}
+
+// keys replies with every key matching the glob pattern in ascending order
+func (s *Server) keys(c *conn, args [][]byte) error {
+	pattern := string(args[1])
+	prefix := globPrefix(pattern)
+
+	var matched []string
+	for key := range s.store.Range(kvstore.PrefixRange(prefix)) {
+		if matchGlob(pattern, key) {
+			matched = append(matched, key)
+		}
+	}
+
+	c.w.WriteArray(len(matched))
+	for _, key := range matched {
+		c.w.WriteBulkString(key)
+	}
+	return nil
+}
+
+// scan implements SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+//
+// Keys are visited in ascending order, COUNT at a time. The cursor handed
+// back names the key to resume from; keys added or removed meanwhile are
+// picked up or skipped as the order dictates, and no key present for the
+// whole iteration is missed or returned twice
+func (s *Server) scan(c *conn, args [][]byte) error {
+	id, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		return errCursor
+	}
+	start := ""
+	if id != 0 {
+		var ok bool
+		if start, ok = s.cursors.get(id); !ok {
+			return errCursor
+		}
+	}
+
+	pattern, count, onlyStrings := "*", defaultScanCount, true
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return errSyntax
+		}
+		value := string(args[i+1])
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = value
+		case "COUNT":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return errNotInt
+			}
+			if n < 1 {
+				return errSyntax
+			}
+			count = n
+		case "TYPE":
+			// Every value is a string
+			onlyStrings = strings.EqualFold(value, "string")
+		default:
+			return errSyntax
+		}
+	}
+
+	prefix := globPrefix(pattern)
+	lo, hi := kvstore.PrefixRange(prefix)
+	lo = max(lo, start)
+
+	var matched []string
+	next, visited := uint64(0), 0
+	if onlyStrings {
+		for key := range s.store.Range(lo, hi) {
+			if visited == count {
+				next = s.cursors.put(key)
+				break
+			}
+			visited++
+			if matchGlob(pattern, key) {
+				matched = append(matched, key)
+			}
+		}
+	}
+
+	c.w.WriteArray(2)
+	c.w.WriteBulkString(strconv.FormatUint(next, 10))
+	c.w.WriteArray(len(matched))
+	for _, key := range matched {
+		c.w.WriteBulkString(key)
+	}
+	return nil
+}
+
+// cursorTable maps the numeric SCAN cursors handed to clients to the key the
+// scan resumes from. Cursors are shared by all connections, as in Redis a
+// client may continue a scan on another connection
+type cursorTable struct {
+	mu    sync.Mutex
+	last  uint64
+	keys  map[uint64]string
+	order []uint64 // oldest first
+}
+
+func newCursorTable() *cursorTable {
+	return &cursorTable{keys: make(map[uint64]string)}
+}
+
+// put remembers key and returns its cursor, forgetting the oldest cursor if
+// the table is full
+func (t *cursorTable) put(key string) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.last++
+	t.keys[t.last] = key
+	t.order = append(t.order, t.last)
+	if len(t.order) > maxCursors {
+		delete(t.keys, t.order[0])
+		t.order = t.order[1:]
+	}
+
+	return t.last
+}
+
+// get returns the key cursor id resumes from
+func (t *cursorTable) get(id uint64) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key, ok := t.keys[id]
+	return key, ok
+}
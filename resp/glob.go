@@ -0,0 +1,118 @@
+package resp
+
+// matchGlob reports whether s matches the Redis style glob pattern: '*'
+// matches any sequence of bytes, '?' any single byte, [abc] one of the listed
+// bytes, [^abc] any other byte, [a-z] a range, and a backslash escapes the
+// byte after it
+//
+// Matching is byte-wise. Only the last '*' is backtracked to, so the cost is
+// O(len(pattern) * len(s)) even for patterns like "*a*a*a*b"
+func matchGlob(pattern, s string) bool {
+	px, sx := 0, 0
+	starPx, starSx := -1, 0
+
+	for px < len(pattern) || sx < len(s) {
+		if px < len(pattern) {
+			switch c := pattern[px]; c {
+			case '*':
+				// Try the empty match first, remember where to retry
+				starPx, starSx = px, sx
+				px++
+				continue
+			case '?':
+				if sx < len(s) {
+					px++
+					sx++
+					continue
+				}
+			case '[':
+				if sx < len(s) {
+					if ok, width := matchClass(pattern[px:], s[sx]); ok {
+						px += width
+						sx++
+						continue
+					}
+				}
+			case '\\':
+				if px+1 < len(pattern) {
+					if sx < len(s) && s[sx] == pattern[px+1] {
+						px += 2
+						sx++
+						continue
+					}
+					break
+				}
+				fallthrough
+			default:
+				if sx < len(s) && s[sx] == c {
+					px++
+					sx++
+					continue
+				}
+			}
+		}
+
+		// Mismatch: let the last '*' swallow one more byte
+		if starPx >= 0 && starSx < len(s) {
+			starSx++
+			px, sx = starPx+1, starSx
+			continue
+		}
+		return false
+	}
+
+	return true
+}
+
+// matchClass matches c against the character class at the start of pattern
+// and returns whether it matched and the length of the class. A class that is
+// not closed extends to the end of the pattern, as in Redis
+func matchClass(pattern string, c byte) (bool, int) {
+	i := 1
+	negate := i < len(pattern) && pattern[i] == '^'
+	if negate {
+		i++
+	}
+
+	matched := false
+	for i < len(pattern) && pattern[i] != ']' {
+		switch {
+		case pattern[i] == '\\' && i+1 < len(pattern):
+			if pattern[i+1] == c {
+				matched = true
+			}
+			i += 2
+		case i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']':
+			lo, hi := pattern[i], pattern[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			if c >= lo && c <= hi {
+				matched = true
+			}
+			i += 3
+		default:
+			if pattern[i] == c {
+				matched = true
+			}
+			i++
+		}
+	}
+	if i < len(pattern) {
+		i++ // closing ']'
+	}
+
+	return matched != negate, i
+}
+
+// globPrefix returns the literal prefix every key matching pattern starts
+// with, so only that part of the key space has to be visited
+func globPrefix(pattern string) string {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*', '?', '[', '\\':
+			return pattern[:i]
+		}
+	}
+	return pattern
+}
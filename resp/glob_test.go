@@ -0,0 +1,73 @@
+package resp
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestMatchGlob tests the Redis glob syntax
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "users", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[b-a]llo", "hallo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"*a*b", "xaybzb", true},
+		{"*a*b", "xaybzc", false},
+		{"a*", "", false},
+		{"[abc", "b", true},
+		{"", "", true},
+		{"", "a", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchGlob(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+// TestMatchGlobPathological tests that many stars do not backtrack exponentially
+func TestMatchGlobPathological(t *testing.T) {
+	pattern := strings.Repeat("*a", 30) + "b"
+	s := strings.Repeat("a", 5000)
+
+	if matchGlob(pattern, s) {
+		t.Error("Pattern should not match")
+	}
+}
+
+// TestGlobPrefix tests the literal prefix used to narrow key scans
+func TestGlobPrefix(t *testing.T) {
+	tests := map[string]string{
+		"user:*":    "user:",
+		"user:?":    "user:",
+		"exact":     "exact",
+		"*":         "",
+		"a[bc]":     "a",
+		`a\*`:       "a",
+		"":          "",
+		"x:[0-9]*y": "x:",
+	}
+
+	for pattern, want := range tests {
+		if got := globPrefix(pattern); got != want {
+			t.Errorf("globPrefix(%q) = %q, want %q", pattern, got, want)
+		}
+	}
+}
@@ -0,0 +1,533 @@
+// Package resp implements the Redis serialization protocol (RESP2 and RESP3)
+// and a server exposing a kvstore.Store to Redis clients
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Type identifies a RESP value by its leading byte
+type Type byte
+
+const (
+	TypeSimpleString Type = '+'
+	TypeError        Type = '-'
+	TypeInteger      Type = ':'
+	TypeBulkString   Type = '$'
+	TypeArray        Type = '*'
+
+	// RESP3 only
+	TypeNull           Type = '_'
+	TypeBoolean        Type = '#'
+	TypeDouble         Type = ','
+	TypeBigNumber      Type = '('
+	TypeBulkError      Type = '!'
+	TypeVerbatimString Type = '='
+	TypeMap            Type = '%'
+	TypeSet            Type = '~'
+	TypePush           Type = '>'
+	TypeAttribute      Type = '|'
+)
+
+const (
+	// maxBulkLen is the largest bulk string accepted, as in Redis
+	maxBulkLen = 512 << 20
+
+	// maxArrayLen is the largest number of elements accepted in an aggregate
+	maxArrayLen = 1 << 20
+
+	// maxLineLen bounds simple strings, headers and inline commands
+	maxLineLen = 64 << 10
+)
+
+// ErrProtocol is returned when the peer sends malformed RESP
+var ErrProtocol = errors.New("protocol error")
+
+// Error is an error reply sent by the server, e.g. "ERR syntax error"
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// Value is a decoded RESP value
+//
+// Null bulk strings and null arrays from RESP2 are decoded as TypeNull, so
+// callers can treat both protocol versions alike
+type Value struct {
+	Type  Type
+	Bytes []byte  // SimpleString, Error, BulkString, BulkError, VerbatimString, Double, BigNumber
+	Int   int64   // Integer; Boolean is 0 or 1
+	Elems []Value // Array, Set, Push; for Map keys and values alternate
+}
+
+// IsNull reports whether v is a null reply
+func (v Value) IsNull() bool {
+	return v.Type == TypeNull
+}
+
+// Err returns v as an Error if it is an error reply and nil otherwise
+func (v Value) Err() error {
+	if v.Type == TypeError || v.Type == TypeBulkError {
+		return Error(v.Bytes)
+	}
+	return nil
+}
+
+// String returns a human readable form of v
+func (v Value) String() string {
+	switch v.Type {
+	case TypeInteger:
+		return strconv.FormatInt(v.Int, 10)
+	case TypeBoolean:
+		return strconv.FormatBool(v.Int != 0)
+	case TypeNull:
+		return "(nil)"
+	case TypeArray, TypeSet, TypePush, TypeMap:
+		return fmt.Sprint(v.Elems)
+	}
+	return string(v.Bytes)
+}
+
+// Reader decodes RESP values from a stream
+type Reader struct {
+	rd *bufio.Reader
+}
+
+// NewReader returns a Reader reading from r
+func NewReader(r io.Reader) *Reader {
+	return &Reader{rd: bufio.NewReaderSize(r, maxLineLen)}
+}
+
+// Buffered returns the number of bytes already read from the stream but not
+// decoded yet. Zero means no further request of a pipeline is pending
+func (r *Reader) Buffered() int {
+	return r.rd.Buffered()
+}
+
+// ReadCommand reads one request and returns its arguments
+// Requests are either arrays of bulk strings, as sent by clients, or inline
+// commands (space separated words on one line), as typed into telnet. Empty
+// inline lines are skipped
+func (r *Reader) ReadCommand() ([][]byte, error) {
+	for {
+		b, err := r.rd.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+
+		if Type(b[0]) != TypeArray {
+			// Inline commands may end in a bare LF, as sent by netcat
+			line, err := r.rd.ReadSlice('\n')
+			if err == bufio.ErrBufferFull {
+				return nil, fmt.Errorf("%w: too big inline request", ErrProtocol)
+			}
+			if err != nil {
+				return nil, err
+			}
+			line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+			args, err := splitInline(line)
+			if err != nil {
+				return nil, err
+			}
+			if len(args) == 0 {
+				continue
+			}
+			return args, nil
+		}
+
+		r.rd.ReadByte()
+		n, err := r.readLength(maxArrayLen)
+		if err != nil {
+			return nil, err
+		}
+		if n <= 0 {
+			continue
+		}
+
+		args := make([][]byte, n)
+		for i := range args {
+			prefix, err := r.rd.ReadByte()
+			if err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			if Type(prefix) != TypeBulkString {
+				return nil, fmt.Errorf("%w: expected '$', got '%c'", ErrProtocol, prefix)
+			}
+			args[i], err = r.readBulk()
+			if err != nil {
+				return nil, err
+			}
+			if args[i] == nil {
+				return nil, fmt.Errorf("%w: null bulk string in request", ErrProtocol)
+			}
+		}
+		return args, nil
+	}
+}
+
+// ReadValue reads one reply
+// Attributes (RESP3 out-of-band metadata) are skipped
+func (r *Reader) ReadValue() (Value, error) {
+	prefix, err := r.rd.ReadByte()
+	if err != nil {
+		return Value{}, err
+	}
+
+	v := Value{Type: Type(prefix)}
+	switch v.Type {
+	case TypeSimpleString, TypeError, TypeDouble, TypeBigNumber:
+		line, err := r.readLine()
+		if err != nil {
+			return Value{}, unexpectedEOF(err)
+		}
+		v.Bytes = append([]byte(nil), line...)
+
+	case TypeInteger:
+		line, err := r.readLine()
+		if err != nil {
+			return Value{}, unexpectedEOF(err)
+		}
+		if v.Int, err = strconv.ParseInt(string(line), 10, 64); err != nil {
+			return Value{}, fmt.Errorf("%w: invalid integer %q", ErrProtocol, line)
+		}
+
+	case TypeBulkString, TypeBulkError, TypeVerbatimString:
+		if v.Bytes, err = r.readBulk(); err != nil {
+			return Value{}, err
+		}
+		if v.Bytes == nil {
+			v.Type = TypeNull
+		}
+
+	case TypeNull:
+		if _, err := r.readLine(); err != nil {
+			return Value{}, unexpectedEOF(err)
+		}
+
+	case TypeBoolean:
+		line, err := r.readLine()
+		if err != nil {
+			return Value{}, unexpectedEOF(err)
+		}
+		switch string(line) {
+		case "t":
+			v.Int = 1
+		case "f":
+		default:
+			return Value{}, fmt.Errorf("%w: invalid boolean %q", ErrProtocol, line)
+		}
+
+	case TypeArray, TypeSet, TypePush, TypeMap, TypeAttribute:
+		n, err := r.readLength(maxArrayLen)
+		if err != nil {
+			return Value{}, err
+		}
+		if n < 0 {
+			v.Type = TypeNull
+			break
+		}
+		if v.Type == TypeMap || v.Type == TypeAttribute {
+			n *= 2
+		}
+		v.Elems = make([]Value, n)
+		for i := range v.Elems {
+			if v.Elems[i], err = r.ReadValue(); err != nil {
+				return Value{}, unexpectedEOF(err)
+			}
+		}
+		if v.Type == TypeAttribute {
+			return r.ReadValue()
+		}
+
+	default:
+		return Value{}, fmt.Errorf("%w: unknown type '%c'", ErrProtocol, prefix)
+	}
+
+	return v, nil
+}
+
+// readLine reads up to the next CRLF and returns the line without it
+// The returned slice is only valid until the next read
+func (r *Reader) readLine() ([]byte, error) {
+	line, err := r.rd.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, fmt.Errorf("%w: line too long", ErrProtocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("%w: line not terminated by CRLF", ErrProtocol)
+	}
+	return line[:len(line)-2], nil
+}
+
+// readLength reads the length header of a bulk string or aggregate
+// -1 is the RESP2 null marker
+func (r *Reader) readLength(max int) (int, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+
+	n, err := strconv.Atoi(string(line))
+	if err != nil || n < -1 {
+		return 0, fmt.Errorf("%w: invalid length %q", ErrProtocol, line)
+	}
+	if n > max {
+		return 0, fmt.Errorf("%w: length %d exceeds limit", ErrProtocol, n)
+	}
+	return n, nil
+}
+
+// readBulk reads the length and payload of a bulk string
+// A null bulk string is returned as nil
+func (r *Reader) readBulk() ([]byte, error) {
+	n, err := r.readLength(maxBulkLen)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, n+2)
+	if _, err := io.ReadFull(r.rd, buf); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if buf[n] != '\r' || buf[n+1] != '\n' {
+		return nil, fmt.Errorf("%w: bulk string not terminated by CRLF", ErrProtocol)
+	}
+	return buf[:n], nil
+}
+
+// splitInline splits an inline command into arguments. Double and single
+// quotes group words, and double quoted strings understand the usual escapes
+func splitInline(line []byte) ([][]byte, error) {
+	var args [][]byte
+	i := 0
+	for {
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		var arg []byte
+		switch line[i] {
+		case '"':
+			i++
+			for ; i < len(line) && line[i] != '"'; i++ {
+				c := line[i]
+				if c == '\\' && i+1 < len(line) {
+					i++
+					switch c = line[i]; c {
+					case 'n':
+						c = '\n'
+					case 'r':
+						c = '\r'
+					case 't':
+						c = '\t'
+					case 'x':
+						if i+2 < len(line) {
+							if b, err := strconv.ParseUint(string(line[i+1:i+3]), 16, 8); err == nil {
+								c = byte(b)
+								i += 2
+							}
+						}
+					}
+				}
+				arg = append(arg, c)
+			}
+			if i == len(line) {
+				return nil, fmt.Errorf("%w: unbalanced quotes in request", ErrProtocol)
+			}
+			i++
+		case '\'':
+			i++
+			for ; i < len(line) && line[i] != '\''; i++ {
+				arg = append(arg, line[i])
+			}
+			if i == len(line) {
+				return nil, fmt.Errorf("%w: unbalanced quotes in request", ErrProtocol)
+			}
+			i++
+		default:
+			for ; i < len(line) && line[i] != ' ' && line[i] != '\t'; i++ {
+				arg = append(arg, line[i])
+			}
+		}
+		if arg == nil {
+			arg = []byte{}
+		}
+		args = append(args, arg)
+	}
+}
+
+// unexpectedEOF turns an EOF in the middle of a value into io.ErrUnexpectedEOF
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Writer encodes RESP values to a buffered stream
+//
+// Replies are written in RESP2 unless the protocol is switched to 3 with
+// SetProtocol; the null and map helpers pick the encoding the peer expects.
+// Nothing is sent until Flush is called
+type Writer struct {
+	wr    *bufio.Writer
+	proto int
+	num   []byte
+}
+
+// NewWriter returns a RESP2 Writer writing to w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{wr: bufio.NewWriter(w), proto: 2}
+}
+
+// SetProtocol selects RESP2 or RESP3 encoding
+func (w *Writer) SetProtocol(proto int) {
+	w.proto = proto
+}
+
+// Protocol returns the protocol version in use
+func (w *Writer) Protocol() int {
+	return w.proto
+}
+
+// Flush sends everything written so far
+func (w *Writer) Flush() error {
+	return w.wr.Flush()
+}
+
+// header writes a type byte followed by a number and CRLF
+func (w *Writer) header(t Type, n int64) error {
+	w.wr.WriteByte(byte(t))
+	w.num = strconv.AppendInt(w.num[:0], n, 10)
+	w.wr.Write(w.num)
+	_, err := w.wr.WriteString("\r\n")
+	return err
+}
+
+// line writes a type byte followed by s and CRLF
+func (w *Writer) line(t Type, s string) error {
+	w.wr.WriteByte(byte(t))
+	w.wr.WriteString(s)
+	_, err := w.wr.WriteString("\r\n")
+	return err
+}
+
+// WriteSimpleString writes a status reply such as "OK"
+func (w *Writer) WriteSimpleString(s string) error {
+	return w.line(TypeSimpleString, s)
+}
+
+// WriteError writes an error reply. msg starts with the error code, e.g.
+// "ERR syntax error". Line breaks are replaced, they would end the reply
+func (w *Writer) WriteError(msg string) error {
+	b := []byte(msg)
+	for i, c := range b {
+		if c == '\r' || c == '\n' {
+			b[i] = ' '
+		}
+	}
+	return w.line(TypeError, string(b))
+}
+
+// WriteInteger writes an integer reply
+func (w *Writer) WriteInteger(n int64) error {
+	return w.header(TypeInteger, n)
+}
+
+// WriteBulk writes a bulk string reply
+func (w *Writer) WriteBulk(b []byte) error {
+	w.header(TypeBulkString, int64(len(b)))
+	w.wr.Write(b)
+	_, err := w.wr.WriteString("\r\n")
+	return err
+}
+
+// WriteBulkString writes a bulk string reply
+func (w *Writer) WriteBulkString(s string) error {
+	return w.WriteBulk([]byte(s))
+}
+
+// WriteNull writes a null reply: "_" in RESP3, a null bulk string in RESP2
+func (w *Writer) WriteNull() error {
+	if w.proto >= 3 {
+		return w.line(TypeNull, "")
+	}
+	return w.header(TypeBulkString, -1)
+}
+
+// WriteArray writes the header of an array of n elements, which must follow
+func (w *Writer) WriteArray(n int) error {
+	return w.header(TypeArray, int64(n))
+}
+
+// WriteMap writes the header of a map of n pairs, which must follow as
+// alternating keys and values. RESP2 has no maps, there it is a flat array
+func (w *Writer) WriteMap(n int) error {
+	if w.proto >= 3 {
+		return w.header(TypeMap, int64(n))
+	}
+	return w.header(TypeArray, int64(2*n))
+}
+
+// WriteCommand writes a request as an array of bulk strings
+func (w *Writer) WriteCommand(args ...[]byte) error {
+	err := w.WriteArray(len(args))
+	for _, arg := range args {
+		err = w.WriteBulk(arg)
+	}
+	return err
+}
+
+// WriteValue writes an arbitrary value as is
+func (w *Writer) WriteValue(v Value) error {
+	switch v.Type {
+	case TypeSimpleString, TypeError, TypeDouble, TypeBigNumber:
+		return w.line(v.Type, string(v.Bytes))
+	case TypeInteger:
+		return w.header(TypeInteger, v.Int)
+	case TypeBulkString, TypeBulkError, TypeVerbatimString:
+		w.header(v.Type, int64(len(v.Bytes)))
+		w.wr.Write(v.Bytes)
+		_, err := w.wr.WriteString("\r\n")
+		return err
+	case TypeNull:
+		return w.WriteNull()
+	case TypeBoolean:
+		if v.Int != 0 {
+			return w.line(TypeBoolean, "t")
+		}
+		return w.line(TypeBoolean, "f")
+	case TypeArray, TypeSet, TypePush:
+		t := v.Type
+		if w.proto < 3 {
+			t = TypeArray
+		}
+		w.header(t, int64(len(v.Elems)))
+	case TypeMap:
+		w.WriteMap(len(v.Elems) / 2)
+	default:
+		return fmt.Errorf("cannot encode RESP type '%c'", v.Type)
+	}
+
+	for _, elem := range v.Elems {
+		if err := w.WriteValue(elem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
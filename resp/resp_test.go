@@ -0,0 +1,195 @@
+package resp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// TestReadCommandArray tests the array of bulk strings clients send
+func TestReadCommandArray(t *testing.T) {
+	r := NewReader(strings.NewReader("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$0\r\n\r\n"))
+
+	args, err := r.ReadCommand()
+	if err != nil {
+		t.Fatalf("ReadCommand failed: %v", err)
+	}
+	if len(args) != 3 || string(args[0]) != "SET" || string(args[1]) != "key" || len(args[2]) != 0 {
+		t.Errorf("Unexpected args: %q", args)
+	}
+
+	if _, err := r.ReadCommand(); err != io.EOF {
+		t.Errorf("Expected io.EOF at end of stream, got %v", err)
+	}
+}
+
+// TestReadCommandInline tests inline commands with quoting and bare LF
+func TestReadCommandInline(t *testing.T) {
+	r := NewReader(strings.NewReader("\r\nPING\nSET \"a b\" 'c d' \"\\x41\\n\"\r\n"))
+
+	args, err := r.ReadCommand()
+	if err != nil {
+		t.Fatalf("ReadCommand failed: %v", err)
+	}
+	if len(args) != 1 || string(args[0]) != "PING" {
+		t.Errorf("Unexpected args: %q", args)
+	}
+
+	args, err = r.ReadCommand()
+	if err != nil {
+		t.Fatalf("ReadCommand failed: %v", err)
+	}
+	want := []string{"SET", "a b", "c d", "A\n"}
+	if len(args) != len(want) {
+		t.Fatalf("Expected %d args, got %q", len(want), args)
+	}
+	for i := range want {
+		if string(args[i]) != want[i] {
+			t.Errorf("Arg %d: expected %q, got %q", i, want[i], args[i])
+		}
+	}
+}
+
+// TestReadCommandMalformed tests that malformed requests are protocol errors
+func TestReadCommandMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"bad array length", "*x\r\n"},
+		{"not a bulk string", "*1\r\n:1\r\n"},
+		{"bad bulk length", "*1\r\n$-5\r\n"},
+		{"missing CRLF", "*1\r\n$3\r\nGETX\r\n"},
+		{"array too long", "*99999999\r\n"},
+		{"unbalanced quotes", "SET \"a\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewReader(strings.NewReader(tt.input)).ReadCommand()
+			if !errors.Is(err, ErrProtocol) {
+				t.Errorf("Expected ErrProtocol, got %v", err)
+			}
+		})
+	}
+
+	// A request cut short is an unexpected EOF, not a clean end of stream
+	_, err := NewReader(strings.NewReader("*2\r\n$3\r\nGET\r\n")).ReadCommand()
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+// TestReadValue tests decoding of every reply type
+func TestReadValue(t *testing.T) {
+	input := "+OK\r\n" +
+		"-ERR bad\r\n" +
+		":-42\r\n" +
+		"$5\r\nhello\r\n" +
+		"$-1\r\n" +
+		"*-1\r\n" +
+		"_\r\n" +
+		"#t\r\n" +
+		",3.14\r\n" +
+		"*2\r\n:1\r\n$1\r\na\r\n" +
+		"%1\r\n+k\r\n+v\r\n" +
+		"|1\r\n+ttl\r\n:3\r\n+after-attribute\r\n"
+	r := NewReader(strings.NewReader(input))
+
+	read := func() Value {
+		t.Helper()
+		v, err := r.ReadValue()
+		if err != nil {
+			t.Fatalf("ReadValue failed: %v", err)
+		}
+		return v
+	}
+
+	if v := read(); v.Type != TypeSimpleString || v.String() != "OK" {
+		t.Errorf("Unexpected simple string: %+v", v)
+	}
+	if v := read(); v.Err() == nil || v.Err().Error() != "ERR bad" {
+		t.Errorf("Unexpected error reply: %+v", v)
+	}
+	if v := read(); v.Type != TypeInteger || v.Int != -42 {
+		t.Errorf("Unexpected integer: %+v", v)
+	}
+	if v := read(); v.Type != TypeBulkString || string(v.Bytes) != "hello" {
+		t.Errorf("Unexpected bulk string: %+v", v)
+	}
+	for i := 0; i < 3; i++ {
+		if v := read(); !v.IsNull() {
+			t.Errorf("Expected null, got %+v", v)
+		}
+	}
+	if v := read(); v.Type != TypeBoolean || v.Int != 1 {
+		t.Errorf("Unexpected boolean: %+v", v)
+	}
+	if v := read(); v.Type != TypeDouble || v.String() != "3.14" {
+		t.Errorf("Unexpected double: %+v", v)
+	}
+	if v := read(); v.Type != TypeArray || len(v.Elems) != 2 || v.Elems[0].Int != 1 || v.Elems[1].String() != "a" {
+		t.Errorf("Unexpected array: %+v", v)
+	}
+	if v := read(); v.Type != TypeMap || len(v.Elems) != 2 || v.Elems[0].String() != "k" || v.Elems[1].String() != "v" {
+		t.Errorf("Unexpected map: %+v", v)
+	}
+	if v := read(); v.String() != "after-attribute" {
+		t.Errorf("Expected the attribute to be skipped, got %+v", v)
+	}
+}
+
+// TestWriterProtocols tests that nulls and maps follow the protocol version
+func TestWriterProtocols(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+
+	w.WriteNull()
+	w.WriteMap(1)
+	w.WriteBulkString("k")
+	w.WriteInteger(7)
+	w.SetProtocol(3)
+	w.WriteNull()
+	w.WriteMap(0)
+	w.WriteError("ERR multi\r\nline")
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	want := "$-1\r\n*2\r\n$1\r\nk\r\n:7\r\n_\r\n%0\r\n-ERR multi  line\r\n"
+	if buf.String() != want {
+		t.Errorf("Expected %q, got %q", want, buf.String())
+	}
+}
+
+// TestWriterRoundTrip tests that commands and values read back unchanged
+func TestWriterRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+
+	w.WriteCommand([]byte("MSET"), []byte("k"), []byte("v\r\n"))
+	w.SetProtocol(3)
+	w.WriteValue(Value{Type: TypeSet, Elems: []Value{{Type: TypeBoolean}, {Type: TypeNull}}})
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	r := NewReader(&buf)
+	args, err := r.ReadCommand()
+	if err != nil {
+		t.Fatalf("ReadCommand failed: %v", err)
+	}
+	if len(args) != 3 || string(args[2]) != "v\r\n" {
+		t.Errorf("Unexpected args: %q", args)
+	}
+
+	v, err := r.ReadValue()
+	if err != nil {
+		t.Fatalf("ReadValue failed: %v", err)
+	}
+	if v.Type != TypeSet || len(v.Elems) != 2 || v.Elems[0].Type != TypeBoolean || !v.Elems[1].IsNull() {
+		t.Errorf("Unexpected value: %+v", v)
+	}
+}
@@ -0,0 +1,212 @@
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caresle/kvstore"
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Close
+var ErrServerClosed = errors.New("resp: server closed")
+
+// Server serves a Store to Redis clients over RESP
+//
+// Every connection is handled by its own goroutine. Commands are executed in
+// the order they arrive and replies to pipelined commands are sent together
+// once the pipeline has been drained
+type Server struct {
+	store   *kvstore.Store
+	started time.Time
+	cursors *cursorTable
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+
+	nextID      atomic.Int64
+	connections atomic.Int64 // total accepted
+	commands    atomic.Int64 // total processed
+}
+
+// conn is the state of one client connection
+type conn struct {
+	id   int64
+	nc   net.Conn
+	r    *Reader
+	w    *Writer
+	name string
+	quit bool // close after the pending replies are sent
+}
+
+// NewServer returns a server for store. The store is not closed by the server
+func NewServer(store *kvstore.Store) *Server {
+	return &Server{
+		store:     store,
+		started:   time.Now(),
+		cursors:   newCursorTable(),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[*conn]struct{}),
+	}
+}
+
+// ListenAndServe listens on the TCP address addr and serves connections
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until Close is called, then returns
+// ErrServerClosed. l is closed when Serve returns
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+		l.Close()
+	}()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		c := &conn{
+			id: s.nextID.Add(1),
+			nc: nc,
+			r:  NewReader(nc),
+			w:  NewWriter(nc),
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			nc.Close()
+			return ErrServerClosed
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		s.connections.Add(1)
+		go s.serveConn(c)
+	}
+}
+
+// Close stops the listeners, disconnects every client and waits for the
+// commands in flight to finish
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	for c := range s.conns {
+		c.nc.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// clientCount returns the number of connected clients
+func (s *Server) clientCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// serveConn reads and executes commands from one client until it quits or
+// the connection fails
+func (s *Server) serveConn(c *conn) {
+	defer s.wg.Done()
+	defer func() {
+		c.nc.Close()
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+	}()
+
+	for !c.quit {
+		args, err := c.r.ReadCommand()
+		if err != nil {
+			if errors.Is(err, ErrProtocol) {
+				c.w.WriteError("ERR Protocol error: " + strings.TrimPrefix(err.Error(), ErrProtocol.Error()+": "))
+				c.w.Flush()
+			}
+			return
+		}
+
+		s.commands.Add(1)
+		s.dispatch(c, args)
+
+		// Reply to a whole pipeline at once
+		if c.r.Buffered() == 0 || c.quit {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// dispatch runs one command and writes its reply
+func (s *Server) dispatch(c *conn, args [][]byte) {
+	name := strings.ToLower(string(args[0]))
+	cmd, ok := commands[name]
+	if !ok {
+		var b strings.Builder
+		fmt.Fprintf(&b, "ERR unknown command '%s', with args beginning with:", args[0])
+		for _, arg := range args[1:] {
+			fmt.Fprintf(&b, " '%s'", arg)
+		}
+		c.w.WriteError(b.String())
+		return
+	}
+
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		c.w.WriteError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+		return
+	}
+
+	if err := cmd.run(s, c, args); err != nil {
+		c.w.WriteError("ERR " + err.Error())
+	}
+}
@@ -0,0 +1,366 @@
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caresle/kvstore"
+)
+
+// testClient is a minimal synchronous client for exercising the server
+type testClient struct {
+	t  *testing.T
+	nc net.Conn
+	r  *Reader
+	w  *Writer
+}
+
+// startServer serves a fresh store on a local port
+func startServer(t *testing.T) (*kvstore.Store, string) {
+	t.Helper()
+
+	store, err := kvstore.OpenWithConfig(kvstore.Config{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	server := NewServer(store)
+	done := make(chan error, 1)
+	go func() { done <- server.Serve(l) }()
+
+	t.Cleanup(func() {
+		server.Close()
+		if err := <-done; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("Serve returned %v, expected ErrServerClosed", err)
+		}
+		store.Close()
+	})
+
+	return store, l.Addr().String()
+}
+
+// dial connects a test client to addr
+func dial(t *testing.T, addr string) *testClient {
+	t.Helper()
+
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { nc.Close() })
+	nc.SetDeadline(time.Now().Add(10 * time.Second))
+
+	return &testClient{t: t, nc: nc, r: NewReader(nc), w: NewWriter(nc)}
+}
+
+// do sends a command and returns its reply
+func (c *testClient) do(args ...string) Value {
+	c.t.Helper()
+
+	if err := c.send(args...); err != nil {
+		c.t.Fatalf("Send failed: %v", err)
+	}
+	return c.read()
+}
+
+func (c *testClient) send(args ...string) error {
+	raw := make([][]byte, len(args))
+	for i, arg := range args {
+		raw[i] = []byte(arg)
+	}
+	if err := c.w.WriteCommand(raw...); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+func (c *testClient) read() Value {
+	c.t.Helper()
+
+	v, err := c.r.ReadValue()
+	if err != nil {
+		c.t.Fatalf("ReadValue failed: %v", err)
+	}
+	return v
+}
+
+// expect checks that a reply prints as want
+func expect(t *testing.T, v Value, want string) {
+	t.Helper()
+	if got := v.String(); got != want {
+		t.Errorf("Expected %q, got %q (type %c)", want, got, v.Type)
+	}
+}
+
+// elems returns the elements of an array reply as strings
+func elems(v Value) []string {
+	out := make([]string, len(v.Elems))
+	for i, elem := range v.Elems {
+		out[i] = elem.String()
+	}
+	return out
+}
+
+// TestServerGetSetDel tests the basic commands
+func TestServerGetSetDel(t *testing.T) {
+	store, addr := startServer(t)
+	c := dial(t, addr)
+
+	expect(t, c.do("PING"), "PONG")
+	expect(t, c.do("PING", "hi"), "hi")
+	expect(t, c.do("SET", "k1", "v1"), "OK")
+	expect(t, c.do("GET", "k1"), "v1")
+	expect(t, c.do("GET", "missing"), "(nil)")
+	expect(t, c.do("MSET", "k2", "v2", "k3", "v3"), "OK")
+	expect(t, c.do("EXISTS", "k1", "k2", "missing", "k1"), "3")
+	expect(t, c.do("DEL", "k1", "k2", "missing", "k1"), "2")
+	expect(t, c.do("EXISTS", "k1"), "0")
+
+	if value, ok := store.Get("k3"); !ok || string(value) != "v3" {
+		t.Errorf("Store should hold k3=v3, got %q, %v", value, ok)
+	}
+
+	v := c.do("MGET", "k1", "k3")
+	if len(v.Elems) != 2 || !v.Elems[0].IsNull() || v.Elems[1].String() != "v3" {
+		t.Errorf("Unexpected MGET reply: %v", v)
+	}
+}
+
+// TestServerSetOptions tests SET with NX, XX, EX and PX
+func TestServerSetOptions(t *testing.T) {
+	store, addr := startServer(t)
+	c := dial(t, addr)
+
+	expect(t, c.do("SET", "k", "v1", "XX"), "(nil)")
+	expect(t, c.do("SET", "k", "v1", "NX"), "OK")
+	expect(t, c.do("SET", "k", "v2", "NX"), "(nil)")
+	expect(t, c.do("SET", "k", "v3", "XX", "EX", "100"), "OK")
+	expect(t, c.do("GET", "k"), "v3")
+
+	if ttl, ok := store.TTL("k"); !ok || ttl <= 90*time.Second || ttl > 100*time.Second {
+		t.Errorf("Expected a TTL of about 100s, got %v, %v", ttl, ok)
+	}
+
+	expect(t, c.do("SET", "short", "v", "px", "50"), "OK")
+	time.Sleep(100 * time.Millisecond)
+	expect(t, c.do("GET", "short"), "(nil)")
+
+	expect(t, c.do("SET", "k", "v", "NX", "XX"), "ERR syntax error")
+	expect(t, c.do("SET", "k", "v", "EX"), "ERR syntax error")
+	expect(t, c.do("SET", "k", "v", "EX", "abc"), "ERR value is not an integer or out of range")
+	expect(t, c.do("SET", "k", "v", "EX", "0"), "ERR invalid expire time in 'set' command")
+	expect(t, c.do("GET", "k"), "v3")
+}
+
+// TestServerErrors tests error replies for bad commands
+func TestServerErrors(t *testing.T) {
+	_, addr := startServer(t)
+	c := dial(t, addr)
+
+	expect(t, c.do("GET"), "ERR wrong number of arguments for 'get' command")
+	expect(t, c.do("MSET", "a", "1", "b"), "ERR wrong number of arguments for 'mset' command")
+	expect(t, c.do("NOSUCH", "x"), "ERR unknown command 'NOSUCH', with args beginning with: 'x'")
+	expect(t, c.do("SELECT", "1"), "ERR DB index is out of range")
+	expect(t, c.do("SELECT", "0"), "OK")
+
+	// The connection survives error replies
+	expect(t, c.do("PING"), "PONG")
+}
+
+// TestServerKeysAndScan tests pattern matching and cursor iteration
+func TestServerKeysAndScan(t *testing.T) {
+	store, addr := startServer(t)
+	c := dial(t, addr)
+
+	for i := 0; i < 25; i++ {
+		store.Set(fmt.Sprintf("user:%02d", i), []byte("v"))
+	}
+	store.Set("config", []byte("v"))
+
+	v := c.do("KEYS", "user:1?")
+	if got := strings.Join(elems(v), ","); got != "user:10,user:11,user:12,user:13,user:14,user:15,user:16,user:17,user:18,user:19" {
+		t.Errorf("Unexpected KEYS reply: %s", got)
+	}
+	if v := c.do("KEYS", "*"); len(v.Elems) != 26 {
+		t.Errorf("Expected 26 keys, got %d", len(v.Elems))
+	}
+
+	var seen []string
+	cursor, rounds := "0", 0
+	for {
+		v := c.do("SCAN", cursor, "MATCH", "user:*", "COUNT", "10")
+		if len(v.Elems) != 2 {
+			t.Fatalf("Unexpected SCAN reply: %v", v)
+		}
+		cursor = v.Elems[0].String()
+		seen = append(seen, elems(v.Elems[1])...)
+		rounds++
+		if cursor == "0" {
+			break
+		}
+		if rounds > 10 {
+			t.Fatal("SCAN did not terminate")
+		}
+	}
+	if len(seen) != 25 || rounds != 3 {
+		t.Errorf("Expected 25 keys in 3 rounds, got %d in %d", len(seen), rounds)
+	}
+
+	expect(t, c.do("SCAN", "12345"), "ERR invalid cursor")
+	if v := c.do("SCAN", "0", "TYPE", "hash"); v.Elems[0].String() != "0" || len(v.Elems[1].Elems) != 0 {
+		t.Errorf("Expected no keys of type hash, got %v", v)
+	}
+}
+
+// TestServerPipeline tests that pipelined commands are answered in order
+func TestServerPipeline(t *testing.T) {
+	_, addr := startServer(t)
+	c := dial(t, addr)
+
+	const n = 100
+	for i := 0; i < n; i++ {
+		c.w.WriteCommand([]byte("SET"), []byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprintf("v%d", i)))
+		c.w.WriteCommand([]byte("GET"), []byte(fmt.Sprintf("k%d", i)))
+	}
+	if err := c.w.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	for i := 0; i < n; i++ {
+		expect(t, c.read(), "OK")
+		expect(t, c.read(), fmt.Sprintf("v%d", i))
+	}
+}
+
+// TestServerInlineAndQuit tests inline commands and QUIT
+func TestServerInlineAndQuit(t *testing.T) {
+	_, addr := startServer(t)
+	c := dial(t, addr)
+
+	if _, err := c.nc.Write([]byte("SET greeting \"hello world\"\r\nGET greeting\r\nQUIT\r\n")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	expect(t, c.read(), "OK")
+	expect(t, c.read(), "hello world")
+	expect(t, c.read(), "OK")
+
+	if _, err := c.r.ReadValue(); err == nil {
+		t.Error("Expected the connection to be closed after QUIT")
+	}
+}
+
+// TestServerHello tests switching to RESP3
+func TestServerHello(t *testing.T) {
+	_, addr := startServer(t)
+	c := dial(t, addr)
+
+	expect(t, c.do("HELLO", "4"), "NOPROTO sorry, this protocol version is not supported")
+
+	v := c.do("HELLO", "3", "SETNAME", "tester")
+	if v.Type != TypeMap {
+		t.Fatalf("Expected a map, got %c", v.Type)
+	}
+	fields := make(map[string]string)
+	for i := 0; i+1 < len(v.Elems); i += 2 {
+		fields[v.Elems[i].String()] = v.Elems[i+1].String()
+	}
+	if fields["proto"] != "3" || fields["server"] != "kvstore" {
+		t.Errorf("Unexpected HELLO fields: %v", fields)
+	}
+
+	// RESP3 null
+	if v := c.do("GET", "missing"); v.Type != TypeNull {
+		t.Errorf("Expected RESP3 null, got %c", v.Type)
+	}
+	expect(t, c.do("CLIENT", "GETNAME"), "tester")
+}
+
+// TestServerInfo tests the INFO sections
+func TestServerInfo(t *testing.T) {
+	store, addr := startServer(t)
+	c := dial(t, addr)
+	store.Set("a", []byte("1"))
+	store.Set("b", []byte("2"))
+
+	info := c.do("INFO").String()
+	for _, want := range []string{"# Server", "redis_version:", "connected_clients:1", "total_commands_processed:", "db0:keys=2"} {
+		if !strings.Contains(info, want) {
+			t.Errorf("INFO should contain %q:\n%s", want, info)
+		}
+	}
+
+	keyspace := c.do("INFO", "keyspace").String()
+	if strings.Contains(keyspace, "# Server") || !strings.Contains(keyspace, "db0:keys=2") {
+		t.Errorf("Unexpected INFO keyspace reply:\n%s", keyspace)
+	}
+}
+
+// TestServerConcurrentClients tests many clients writing at once
+func TestServerConcurrentClients(t *testing.T) {
+	store, addr := startServer(t)
+
+	const clients, writes = 8, 50
+	errs := make(chan error, clients)
+	for i := 0; i < clients; i++ {
+		nc, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		defer nc.Close()
+
+		go func(i int, nc net.Conn) {
+			r, w := NewReader(nc), NewWriter(nc)
+			for j := 0; j < writes; j++ {
+				w.WriteCommand([]byte("SET"), []byte(fmt.Sprintf("c%d:%d", i, j)), []byte("v"))
+				if err := w.Flush(); err != nil {
+					errs <- err
+					return
+				}
+				v, err := r.ReadValue()
+				if err != nil {
+					errs <- err
+					return
+				}
+				if v.String() != "OK" {
+					errs <- fmt.Errorf("unexpected reply %v", v)
+					return
+				}
+			}
+			errs <- nil
+		}(i, nc)
+	}
+
+	for i := 0; i < clients; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("Client failed: %v", err)
+		}
+	}
+	if store.Len() != clients*writes {
+		t.Errorf("Expected %d keys, got %d", clients*writes, store.Len())
+	}
+}
+
+// TestServerProtocolError tests that malformed input closes the connection
+// with an error reply
+func TestServerProtocolError(t *testing.T) {
+	_, addr := startServer(t)
+	c := dial(t, addr)
+
+	c.nc.Write([]byte("*1\r\n:5\r\n"))
+	v := c.read()
+	if v.Err() == nil || !strings.HasPrefix(v.String(), "ERR Protocol error") {
+		t.Errorf("Expected a protocol error reply, got %v", v)
+	}
+	if _, err := c.r.ReadValue(); err == nil {
+		t.Error("Expected the connection to be closed")
+	}
+}
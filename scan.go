@@ -0,0 +1,83 @@
+package kvstore
+
+import "time"
+
+// KeyValue is a key and its value returned by scans
+type KeyValue struct {
+	Key   string
+	Value []byte
+}
+
+// ScanOptions controls the order and size of a scan
+type ScanOptions struct {
+	// Limit is the maximum number of pairs returned, 0 means no limit
+	Limit int
+
+	// Reverse returns keys in descending order
+	Reverse bool
+}
+
+// Scan returns the pairs with start <= key < end in key order
+// An empty end means no upper bound. Expired keys are skipped
+func (s *Store) Scan(start, end string, opts ScanOptions) []KeyValue {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.scanLocked(start, end, opts)
+}
+
+// ScanPrefix returns the pairs whose key starts with prefix in key order
+func (s *Store) ScanPrefix(prefix string, opts ScanOptions) []KeyValue {
+	start, end := PrefixRange(prefix)
+	return s.Scan(start, end, opts)
+}
+
+// scanLocked walks the index between start and end, finding nothing once the
+// store is closing
+// Caller must hold s.mu
+func (s *Store) scanLocked(start, end string, opts ScanOptions) []KeyValue {
+	if s.state != stateOpen {
+		return nil
+	}
+
+	var result []KeyValue
+	now := time.Now().UnixNano()
+
+	emit := func(node *skipNode) bool {
+		if isExpired(s.expiries[node.key], now) {
+			return true
+		}
+		result = append(result, KeyValue{Key: node.key, Value: s.data[node.key]})
+		return opts.Limit <= 0 || len(result) < opts.Limit
+	}
+
+	if opts.Reverse {
+		for node := s.index.seekLT(end); node != nil && node.key >= start; node = node.prev {
+			if !emit(node) {
+				break
+			}
+		}
+		return result
+	}
+
+	for node := s.index.seekGE(start); node != nil && (end == "" || node.key < end); node = node.next[0] {
+		if !emit(node) {
+			break
+		}
+	}
+	return result
+}
+
+// PrefixRange returns the [start, end) range covering every key with prefix,
+// for Range
+// end is empty when no upper bound exists (empty prefix or all 0xFF bytes)
+func PrefixRange(prefix string) (string, string) {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return prefix, string(end[:i+1])
+		}
+	}
+	return prefix, ""
+}
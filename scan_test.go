@@ -0,0 +1,162 @@
+package kvstore
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// scanKeys extracts the keys of a scan result
+func scanKeys(pairs []KeyValue) []string {
+	keys := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		keys = append(keys, pair.Key)
+	}
+	return keys
+}
+
+// openScanStore opens a store filled with a few namespaced keys
+func openScanStore(t *testing.T) *Store {
+	t.Helper()
+
+	store, err := OpenWithConfig(Config{DataDir: t.TempDir(), SyncWrites: false})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	for _, key := range []string{"user:3", "config:theme", "user:1", "session:id", "user:2", "users"} {
+		if err := store.Set(key, []byte("v-"+key)); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+	return store
+}
+
+// TestScanRange tests half-open ranges and values
+func TestScanRange(t *testing.T) {
+	store := openScanStore(t)
+
+	pairs := store.Scan("session:", "user:3", ScanOptions{})
+	want := []string{"session:id", "user:1", "user:2"}
+	if got := scanKeys(pairs); !slices.Equal(got, want) {
+		t.Errorf("Scan: got %v, want %v", got, want)
+	}
+	if string(pairs[0].Value) != "v-session:id" {
+		t.Errorf("Value mismatch: got %q", pairs[0].Value)
+	}
+
+	// Empty end means no upper bound
+	if got := scanKeys(store.Scan("user:2", "", ScanOptions{})); !slices.Equal(got, []string{"user:2", "user:3", "users"}) {
+		t.Errorf("Unbounded scan: got %v", got)
+	}
+}
+
+// TestScanPrefix tests prefix scans, reverse order and limits
+func TestScanPrefix(t *testing.T) {
+	store := openScanStore(t)
+
+	if got := scanKeys(store.ScanPrefix("user:", ScanOptions{})); !slices.Equal(got, []string{"user:1", "user:2", "user:3"}) {
+		t.Errorf("ScanPrefix: got %v", got)
+	}
+
+	if got := scanKeys(store.ScanPrefix("user:", ScanOptions{Reverse: true})); !slices.Equal(got, []string{"user:3", "user:2", "user:1"}) {
+		t.Errorf("Reverse ScanPrefix: got %v", got)
+	}
+
+	if got := scanKeys(store.ScanPrefix("user:", ScanOptions{Limit: 2})); !slices.Equal(got, []string{"user:1", "user:2"}) {
+		t.Errorf("Limited ScanPrefix: got %v", got)
+	}
+
+	if got := scanKeys(store.ScanPrefix("user:", ScanOptions{Limit: 1, Reverse: true})); !slices.Equal(got, []string{"user:3"}) {
+		t.Errorf("Limited reverse ScanPrefix: got %v", got)
+	}
+
+	if got := store.ScanPrefix("nothing:", ScanOptions{}); len(got) != 0 {
+		t.Errorf("Expected no results, got %v", scanKeys(got))
+	}
+
+	if got := store.ScanPrefix("", ScanOptions{}); len(got) != 6 {
+		t.Errorf("Empty prefix should return every key, got %d", len(got))
+	}
+}
+
+// TestScanSkipsDeletedAndExpired tests that scans only see live keys
+func TestScanSkipsDeletedAndExpired(t *testing.T) {
+	store := openScanStore(t)
+
+	store.Delete("user:2")
+	store.SetWithTTL("user:4", []byte("v"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	if got := scanKeys(store.ScanPrefix("user:", ScanOptions{})); !slices.Equal(got, []string{"user:1", "user:3"}) {
+		t.Errorf("ScanPrefix: got %v", got)
+	}
+}
+
+// TestKeysSorted tests that Keys returns keys in order
+func TestKeysSorted(t *testing.T) {
+	store := openScanStore(t)
+
+	keys := store.Keys()
+	if !slices.IsSorted(keys) {
+		t.Errorf("Keys not sorted: %v", keys)
+	}
+}
+
+// TestScanAfterRestart tests that the index is rebuilt from snapshot and WAL
+func TestScanAfterRestart(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store1, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	store1.Set("user:1", []byte("a"))
+	store1.Set("user:2", []byte("b"))
+	if err := store1.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	store2, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open (second) failed: %v", err)
+	}
+	store2.Set("user:0", []byte("c"))
+	store2.Delete("user:2")
+
+	// DON'T call Close() - simulate crash
+	simulateCrash(store2)
+
+	store3, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open (third) failed: %v", err)
+	}
+	defer store3.Close()
+
+	if got := scanKeys(store3.ScanPrefix("user:", ScanOptions{})); !slices.Equal(got, []string{"user:0", "user:1"}) {
+		t.Errorf("ScanPrefix after restart: got %v", got)
+	}
+}
+
+// TestPrefixRange tests the computed upper bound of a prefix
+func TestPrefixRange(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		wantEnd string
+	}{
+		{"user:", "user;"},
+		{"a", "b"},
+		{"a\xff", "b"},
+		{"\xff\xff", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		start, end := PrefixRange(test.prefix)
+		if start != test.prefix || end != test.wantEnd {
+			t.Errorf("PrefixRange(%q): got (%q, %q), want (%q, %q)", test.prefix, start, end, test.prefix, test.wantEnd)
+		}
+	}
+}
@@ -1,17 +1,31 @@
 package kvstore
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"fmt"
 	"hash/crc32"
 	"io"
+	"iter"
 	"os"
 	"path/filepath"
 	"time"
 )
 
-const SnapshotMagic uint32 = 0x4B565350 // "KVSP" - KV SnaPshot
+const SnapshotMagic uint32 = 0x4B565333 // "KVS3" - KV Snapshot v3 (header carries the WAL LSN)
+
+// snapshotMagicV2 identifies snapshots written before the header had an LSN
+const snapshotMagicV2 uint32 = 0x4B565332 // "KVS2" - entries carry an expiry
+
+// snapshotMagicV1 identifies snapshots written before per-key expiry existed
+const snapshotMagicV1 uint32 = 0x4B565350 // "KVSP" - KV SnaPshot
+
+// Header sizes, which give the offset of the first record
+const (
+	snapshotHeaderV3 = 4 + 8 + 8 + 4 + 4 // Magic | Timestamp | LSN | Count | CRC
+	snapshotHeaderV2 = 4 + 8 + 4 + 4     // v1 and v2 have no LSN
+)
 
 const snapshotFilename = "snapshot.dat"
 const snapshotTempFilename = "snapshot.dat.tmp"
@@ -19,17 +33,72 @@ const snapshotTempFilename = "snapshot.dat.tmp"
 // writeSnapshot serializes the entire map to a snapshot file
 // Format:
 //
-//	Header: Magic(4) | Timestamp(8) | Count(4) | HeaderCRC32(4)
-//	Each Entry: KeyLen(4) | Key(var) | ValueLen(4) | Value(var) | EntryCRC32(4)
+//	Header: Magic(4) | Timestamp(8) | LSN(8) | Count(4) | HeaderCRC32(4)
+//	Each Entry: KeyLen(4) | Key(var) | ValueLen(4) | Value(var) | ExpiresAt(8) | EntryCRC32(4)
 //
+// LSN is the last WAL entry reflected in the snapshot (v1 and v2 snapshots have
+// no LSN field). ExpiresAt is unix nanoseconds, 0 for keys without expiry (v1
+// snapshots have no ExpiresAt field). expiries may be nil; keys already
+// expired are not written
 // Uses atomic write (temp file + rename) to prevent corruption
 // Returns error if write fails (caller should preserve WAL)
-func writeSnapshot(dataDir string, data map[string][]byte) error {
+func writeSnapshot(dataDir string, data map[string][]byte, expiries map[string]int64, lsn uint64) error {
+	count, records := mapRecords(data, expiries)
+	return writeSnapshotFile(dataDir, lsn, count, records)
+}
+
+// mapRecords returns the keys of data that have not expired as snapshot
+// records, and how many there are
+func mapRecords(data map[string][]byte, expiries map[string]int64) (int, iter.Seq[record]) {
+	now := time.Now().UnixNano()
+
+	count := len(data)
+	for _, expiresAt := range expiries {
+		if isExpired(expiresAt, now) {
+			count--
+		}
+	}
+
+	return count, func(yield func(record) bool) {
+		for key, value := range data {
+			expiresAt := expiries[key]
+			if isExpired(expiresAt, now) {
+				continue
+			}
+			if !yield(record{key: key, value: value, expiresAt: expiresAt}) {
+				return
+			}
+		}
+	}
+}
+
+// writeSnapshotFile streams count records to a snapshot file using the format
+// described on writeSnapshot
+// Returns error if records does not yield exactly count records
+func writeSnapshotFile(dataDir string, lsn uint64, count int, records iter.Seq[record]) error {
+	tempPath, err := writeSnapshotTemp(dataDir, lsn, count, records)
+	if err != nil {
+		return err
+	}
+
+	// Atomic rename
+	snapshotPath := filepath.Join(dataDir, snapshotFilename)
+	if err := os.Rename(tempPath, snapshotPath); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to rename snapshot file: %w", err)
+	}
+
+	return nil
+}
+
+// writeSnapshotTemp writes a snapshot to the temp file and syncs it, leaving
+// the rename to the caller. Returns the temp file's path
+func writeSnapshotTemp(dataDir string, lsn uint64, count int, records iter.Seq[record]) (string, error) {
 	// Create temp file for atomic write
 	tempPath := filepath.Join(dataDir, snapshotTempFilename)
 	file, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
-		return fmt.Errorf("failed to create snapshot temp file: %w", err)
+		return "", fmt.Errorf("failed to create snapshot temp file: %w", err)
 	}
 
 	// Ensure cleanup on error
@@ -40,9 +109,35 @@ func writeSnapshot(dataDir string, data map[string][]byte) error {
 		}
 	}()
 
+	w := bufio.NewWriter(file)
+	if err := encodeSnapshot(w, lsn, count, records); err != nil {
+		return "", err
+	}
+
+	if err := w.Flush(); err != nil {
+		return "", fmt.Errorf("failed to flush snapshot: %w", err)
+	}
+
+	// Sync to disk
+	if err := file.Sync(); err != nil {
+		return "", fmt.Errorf("failed to sync snapshot: %w", err)
+	}
+
+	// Close file before rename
+	if err := file.Close(); err != nil {
+		return "", fmt.Errorf("failed to close snapshot temp file: %w", err)
+	}
+	file = nil // Prevent defer cleanup
+
+	return tempPath, nil
+}
+
+// encodeSnapshot writes a snapshot of count records to w using the format
+// described on writeSnapshot. It is also used to ship a snapshot to followers
+// Returns error if records does not yield exactly count records
+func encodeSnapshot(w io.Writer, lsn uint64, count int, records iter.Seq[record]) error {
 	// Write header
 	timestamp := time.Now().UnixNano()
-	count := uint32(len(data))
 
 	var headerBuf bytes.Buffer
 	if err := binary.Write(&headerBuf, binary.BigEndian, SnapshotMagic); err != nil {
@@ -51,7 +146,10 @@ func writeSnapshot(dataDir string, data map[string][]byte) error {
 	if err := binary.Write(&headerBuf, binary.BigEndian, timestamp); err != nil {
 		return fmt.Errorf("failed to write timestamp: %w", err)
 	}
-	if err := binary.Write(&headerBuf, binary.BigEndian, count); err != nil {
+	if err := binary.Write(&headerBuf, binary.BigEndian, lsn); err != nil {
+		return fmt.Errorf("failed to write LSN: %w", err)
+	}
+	if err := binary.Write(&headerBuf, binary.BigEndian, uint32(count)); err != nil {
 		return fmt.Errorf("failed to write count: %w", err)
 	}
 
@@ -59,18 +157,20 @@ func writeSnapshot(dataDir string, data map[string][]byte) error {
 	headerChecksum := crc32.ChecksumIEEE(headerBuf.Bytes())
 
 	// Write header + checksum to file
-	if _, err := file.Write(headerBuf.Bytes()); err != nil {
+	if _, err := w.Write(headerBuf.Bytes()); err != nil {
 		return fmt.Errorf("failed to write header: %w", err)
 	}
-	if err := binary.Write(file, binary.BigEndian, headerChecksum); err != nil {
+	if err := binary.Write(w, binary.BigEndian, headerChecksum); err != nil {
 		return fmt.Errorf("failed to write header checksum: %w", err)
 	}
 
 	// Write each entry
-	for key, value := range data {
-		var entryBuf bytes.Buffer
+	written := 0
+	var entryBuf bytes.Buffer
+	for rec := range records {
+		entryBuf.Reset()
 
-		keyBytes := []byte(key)
+		keyBytes := []byte(rec.key)
 		keyLen := uint32(len(keyBytes))
 		if err := binary.Write(&entryBuf, binary.BigEndian, keyLen); err != nil {
 			return fmt.Errorf("failed to write key length: %w", err)
@@ -79,148 +179,219 @@ func writeSnapshot(dataDir string, data map[string][]byte) error {
 			return fmt.Errorf("failed to write key: %w", err)
 		}
 
-		valueLen := uint32(len(value))
+		valueLen := uint32(len(rec.value))
 		if err := binary.Write(&entryBuf, binary.BigEndian, valueLen); err != nil {
 			return fmt.Errorf("failed to write value length: %w", err)
 		}
 		if valueLen > 0 {
-			if _, err := entryBuf.Write(value); err != nil {
+			if _, err := entryBuf.Write(rec.value); err != nil {
 				return fmt.Errorf("failed to write value: %w", err)
 			}
 		}
+		if err := binary.Write(&entryBuf, binary.BigEndian, rec.expiresAt); err != nil {
+			return fmt.Errorf("failed to write expiry: %w", err)
+		}
 
 		// Compute entry checksum
 		entryChecksum := crc32.ChecksumIEEE(entryBuf.Bytes())
 
 		// Write entry + checksum to file
-		if _, err := file.Write(entryBuf.Bytes()); err != nil {
+		if _, err := w.Write(entryBuf.Bytes()); err != nil {
 			return fmt.Errorf("failed to write entry: %w", err)
 		}
-		if err := binary.Write(file, binary.BigEndian, entryChecksum); err != nil {
+		if err := binary.Write(w, binary.BigEndian, entryChecksum); err != nil {
 			return fmt.Errorf("failed to write entry checksum: %w", err)
 		}
+		written++
 	}
 
-	// Sync to disk
-	if err := file.Sync(); err != nil {
-		return fmt.Errorf("failed to sync snapshot: %w", err)
-	}
-
-	// Close file before rename
-	if err := file.Close(); err != nil {
-		return fmt.Errorf("failed to close snapshot temp file: %w", err)
-	}
-	file = nil // Prevent defer cleanup
-
-	// Atomic rename
-	snapshotPath := filepath.Join(dataDir, snapshotFilename)
-	if err := os.Rename(tempPath, snapshotPath); err != nil {
-		return fmt.Errorf("failed to rename snapshot file: %w", err)
+	if written != count {
+		return fmt.Errorf("snapshot entry count mismatch: header says %d, wrote %d", count, written)
 	}
 
 	return nil
 }
 
-// loadSnapshot reads a snapshot file and returns the deserialized map
-// Returns empty map + nil if snapshot doesn't exist (not an error)
+// loadSnapshot reads a snapshot file and returns the deserialized map, the
+// expiry deadline of every key that has one and the LSN it was taken at
+// Returns empty maps + nil if snapshot doesn't exist (not an error)
 // Returns error if snapshot exists but is corrupted
-func loadSnapshot(dataDir string) (map[string][]byte, error) {
+func loadSnapshot(dataDir string) (map[string][]byte, map[string]int64, uint64, error) {
 	snapshotPath := filepath.Join(dataDir, snapshotFilename)
 
 	// Check if snapshot exists
 	if _, err := os.Stat(snapshotPath); os.IsNotExist(err) {
 		// No snapshot = empty map (not an error)
-		return make(map[string][]byte), nil
+		return make(map[string][]byte), make(map[string]int64), 0, nil
 	}
 
 	// Open snapshot file
 	file, err := os.Open(snapshotPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open snapshot file: %w", err)
+		return nil, nil, 0, fmt.Errorf("failed to open snapshot file: %w", err)
 	}
 	defer file.Close()
 
-	// Read header
+	data, expiries, lsn, err := decodeSnapshot(file)
+	return data, expiries, lsn, withFile(err, snapshotFilename)
+}
+
+// decodeSnapshot reads a snapshot (v1, v2 or v3) from r
+// Snapshots older than v3 report LSN 0
+func decodeSnapshot(r io.Reader) (map[string][]byte, map[string]int64, uint64, error) {
+	header, err := decodeSnapshotHeader(r)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	data := make(map[string][]byte, header.count)
+	expiries := make(map[string]int64)
+	err = decodeSnapshotRecords(r, header, func(rec record) {
+		data[rec.key] = rec.value
+		if rec.expiresAt != 0 {
+			expiries[rec.key] = rec.expiresAt
+		}
+	})
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	return data, expiries, header.lsn, nil
+}
+
+// snapshotHeader is the header of a snapshot file
+type snapshotHeader struct {
+	magic     uint32
+	timestamp int64
+	lsn       uint64 // 0 before v3
+	count     uint32
+}
+
+// decodeSnapshotHeader reads and verifies the header of a snapshot
+// Damaged data is reported as a *CorruptionError
+func decodeSnapshotHeader(r io.Reader) (header snapshotHeader, err error) {
+	defer func() {
+		if isCorruption(err) {
+			err = &CorruptionError{Index: -1, Err: err}
+		}
+	}()
+
 	var headerBuf bytes.Buffer
-	var magic uint32
-	if err := binary.Read(file, binary.BigEndian, &magic); err != nil {
-		return nil, fmt.Errorf("failed to read magic: %w", err)
+
+	if err := binary.Read(r, binary.BigEndian, &header.magic); err != nil {
+		return header, fmt.Errorf("failed to read magic: %w", truncated(err))
+	}
+	binary.Write(&headerBuf, binary.BigEndian, header.magic)
+
+	if header.magic != SnapshotMagic && header.magic != snapshotMagicV2 && header.magic != snapshotMagicV1 {
+		return header, fmt.Errorf("%w: expected 0x%X, got 0x%X", ErrInvalidMagic, SnapshotMagic, header.magic)
 	}
-	binary.Write(&headerBuf, binary.BigEndian, magic)
 
-	if magic != SnapshotMagic {
-		return nil, fmt.Errorf("invalid magic: expected 0x%X, got 0x%X", SnapshotMagic, magic)
+	if err := binary.Read(r, binary.BigEndian, &header.timestamp); err != nil {
+		return header, fmt.Errorf("failed to read timestamp: %w", truncated(err))
 	}
+	binary.Write(&headerBuf, binary.BigEndian, header.timestamp)
 
-	var timestamp int64
-	if err := binary.Read(file, binary.BigEndian, &timestamp); err != nil {
-		return nil, fmt.Errorf("failed to read timestamp: %w", err)
+	if header.magic == SnapshotMagic {
+		if err := binary.Read(r, binary.BigEndian, &header.lsn); err != nil {
+			return header, fmt.Errorf("failed to read LSN: %w", truncated(err))
+		}
+		binary.Write(&headerBuf, binary.BigEndian, header.lsn)
 	}
-	binary.Write(&headerBuf, binary.BigEndian, timestamp)
 
-	var count uint32
-	if err := binary.Read(file, binary.BigEndian, &count); err != nil {
-		return nil, fmt.Errorf("failed to read count: %w", err)
+	if err := binary.Read(r, binary.BigEndian, &header.count); err != nil {
+		return header, fmt.Errorf("failed to read count: %w", truncated(err))
 	}
-	binary.Write(&headerBuf, binary.BigEndian, count)
+	binary.Write(&headerBuf, binary.BigEndian, header.count)
 
 	// Verify header checksum
 	var storedHeaderChecksum uint32
-	if err := binary.Read(file, binary.BigEndian, &storedHeaderChecksum); err != nil {
-		return nil, fmt.Errorf("failed to read header checksum: %w", err)
+	if err := binary.Read(r, binary.BigEndian, &storedHeaderChecksum); err != nil {
+		return header, fmt.Errorf("failed to read header checksum: %w", truncated(err))
 	}
 	computedHeaderChecksum := crc32.ChecksumIEEE(headerBuf.Bytes())
 	if computedHeaderChecksum != storedHeaderChecksum {
-		return nil, fmt.Errorf("header checksum mismatch: expected 0x%X, got 0x%X (snapshot corrupted)", storedHeaderChecksum, computedHeaderChecksum)
+		return header, fmt.Errorf("%w: expected 0x%X, got 0x%X (snapshot corrupted)", ErrChecksumMismatch, storedHeaderChecksum, computedHeaderChecksum)
 	}
 
-	// Read entries
-	data := make(map[string][]byte, count)
-	for i := uint32(0); i < count; i++ {
+	return header, nil
+}
+
+// decodeSnapshotRecords reads the header.count records following a header
+// and calls fn for each. Damaged data is reported as a *CorruptionError
+// giving the record index and its offset in the file
+func decodeSnapshotRecords(r io.Reader, header snapshotHeader, fn func(record)) (err error) {
+	offset := int64(snapshotHeaderV3)
+	if header.magic != SnapshotMagic {
+		offset = snapshotHeaderV2
+	}
+	var i uint32
+	defer func() {
+		if isCorruption(err) {
+			err = &CorruptionError{Offset: offset, Index: int(i), Err: err}
+		}
+	}()
+
+	for ; i < header.count; i++ {
 		var entryBuf bytes.Buffer
 
 		var keyLen uint32
-		if err := binary.Read(file, binary.BigEndian, &keyLen); err != nil {
-			return nil, fmt.Errorf("failed to read key length for entry %d: %w", i, err)
+		if err := binary.Read(r, binary.BigEndian, &keyLen); err != nil {
+			return fmt.Errorf("failed to read key length: %w", truncated(err))
 		}
 		binary.Write(&entryBuf, binary.BigEndian, keyLen)
 
+		if keyLen > MaxKeySize {
+			return fmt.Errorf("%w: length %d", ErrKeyTooLarge, keyLen)
+		}
+
 		keyBytes := make([]byte, keyLen)
-		if _, err := io.ReadFull(file, keyBytes); err != nil {
-			return nil, fmt.Errorf("failed to read key for entry %d: %w", i, err)
+		if _, err := io.ReadFull(r, keyBytes); err != nil {
+			return fmt.Errorf("failed to read key: %w", truncated(err))
 		}
 		entryBuf.Write(keyBytes)
 
 		var valueLen uint32
-		if err := binary.Read(file, binary.BigEndian, &valueLen); err != nil {
-			return nil, fmt.Errorf("failed to read value length for entry %d: %w", i, err)
+		if err := binary.Read(r, binary.BigEndian, &valueLen); err != nil {
+			return fmt.Errorf("failed to read value length: %w", truncated(err))
 		}
 		binary.Write(&entryBuf, binary.BigEndian, valueLen)
 
-		value := make([]byte, valueLen)
-		if valueLen > 0 {
-			if _, err := io.ReadFull(file, value); err != nil {
-				return nil, fmt.Errorf("failed to read value for entry %d: %w", i, err)
+		value, err := readValue(r, valueLen)
+		if err != nil {
+			return fmt.Errorf("failed to read value: %w", err)
+		}
+		entryBuf.Write(value)
+
+		var expiresAt int64
+		if header.magic != snapshotMagicV1 {
+			if err := binary.Read(r, binary.BigEndian, &expiresAt); err != nil {
+				return fmt.Errorf("failed to read expiry: %w", truncated(err))
 			}
-			entryBuf.Write(value)
+			binary.Write(&entryBuf, binary.BigEndian, expiresAt)
 		}
 
 		// Verify entry checksum
 		var storedEntryChecksum uint32
-		if err := binary.Read(file, binary.BigEndian, &storedEntryChecksum); err != nil {
-			return nil, fmt.Errorf("failed to read entry checksum for entry %d: %w", i, err)
+		if err := binary.Read(r, binary.BigEndian, &storedEntryChecksum); err != nil {
+			return fmt.Errorf("failed to read entry checksum: %w", truncated(err))
 		}
 		computedEntryChecksum := crc32.ChecksumIEEE(entryBuf.Bytes())
 		if computedEntryChecksum != storedEntryChecksum {
-			return nil, fmt.Errorf("entry %d checksum mismatch: expected 0x%X, got 0x%X (snapshot corrupted)", i, storedEntryChecksum, computedEntryChecksum)
+			return fmt.Errorf("%w: expected 0x%X, got 0x%X (snapshot corrupted)", ErrChecksumMismatch, storedEntryChecksum, computedEntryChecksum)
 		}
 
-		// Add to map
-		key := string(keyBytes)
-		data[key] = value
+		fn(record{key: string(keyBytes), value: value, expiresAt: expiresAt})
+		offset += int64(entryBuf.Len()) + 4
 	}
 
-	return data, nil
+	return nil
+}
+
+// isExpired reports whether an expiry deadline has passed at now
+// A deadline of 0 means the key never expires
+func isExpired(expiresAt, now int64) bool {
+	return expiresAt != 0 && now >= expiresAt
 }
 
 // snapshotExists checks if a snapshot file exists
@@ -3,10 +3,12 @@ package kvstore
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"hash/crc32"
 	"os"
 	"path/filepath"
-	"strings"
 	"testing"
+	"time"
 )
 
 func TestSnapshotWriteAndLoad(t *testing.T) {
@@ -20,12 +22,12 @@ func TestSnapshotWriteAndLoad(t *testing.T) {
 	}
 
 	// Write snapshot
-	if err := writeSnapshot(tempDir, data); err != nil {
+	if err := writeSnapshot(tempDir, data, nil, 0); err != nil {
 		t.Fatalf("writeSnapshot failed: %v", err)
 	}
 
 	// Load snapshot
-	loaded, err := loadSnapshot(tempDir)
+	loaded, _, _, err := loadSnapshot(tempDir)
 	if err != nil {
 		t.Fatalf("loadSnapshot failed: %v", err)
 	}
@@ -52,12 +54,12 @@ func TestSnapshotEmptyMap(t *testing.T) {
 
 	// Write empty snapshot
 	data := make(map[string][]byte)
-	if err := writeSnapshot(tempDir, data); err != nil {
+	if err := writeSnapshot(tempDir, data, nil, 0); err != nil {
 		t.Fatalf("writeSnapshot failed: %v", err)
 	}
 
 	// Load snapshot
-	loaded, err := loadSnapshot(tempDir)
+	loaded, _, _, err := loadSnapshot(tempDir)
 	if err != nil {
 		t.Fatalf("loadSnapshot failed: %v", err)
 	}
@@ -75,11 +77,11 @@ func TestSnapshotSingleEntry(t *testing.T) {
 		"only-key": []byte("only-value"),
 	}
 
-	if err := writeSnapshot(tempDir, data); err != nil {
+	if err := writeSnapshot(tempDir, data, nil, 0); err != nil {
 		t.Fatalf("writeSnapshot failed: %v", err)
 	}
 
-	loaded, err := loadSnapshot(tempDir)
+	loaded, _, _, err := loadSnapshot(tempDir)
 	if err != nil {
 		t.Fatalf("loadSnapshot failed: %v", err)
 	}
@@ -101,7 +103,7 @@ func TestSnapshotNoFile(t *testing.T) {
 	tempDir := t.TempDir()
 
 	// Load from directory with no snapshot
-	loaded, err := loadSnapshot(tempDir)
+	loaded, _, _, err := loadSnapshot(tempDir)
 	if err != nil {
 		t.Fatalf("loadSnapshot should not error on missing file: %v", err)
 	}
@@ -119,7 +121,7 @@ func TestSnapshotBinaryFormat(t *testing.T) {
 		"test": []byte("value"),
 	}
 
-	if err := writeSnapshot(tempDir, data); err != nil {
+	if err := writeSnapshot(tempDir, data, nil, 42); err != nil {
 		t.Fatalf("writeSnapshot failed: %v", err)
 	}
 
@@ -150,6 +152,15 @@ func TestSnapshotBinaryFormat(t *testing.T) {
 		t.Errorf("Invalid timestamp: %d", timestamp)
 	}
 
+	// Verify LSN
+	var lsn uint64
+	if err := binary.Read(buf, binary.BigEndian, &lsn); err != nil {
+		t.Fatalf("Failed to read LSN: %v", err)
+	}
+	if lsn != 42 {
+		t.Errorf("LSN mismatch: got %d, want 42", lsn)
+	}
+
 	// Verify count
 	var count uint32
 	if err := binary.Read(buf, binary.BigEndian, &count); err != nil {
@@ -184,12 +195,12 @@ func TestSnapshotCorruptedMagic(t *testing.T) {
 	file.Close()
 
 	// Try to load
-	_, err = loadSnapshot(tempDir)
+	_, _, _, err = loadSnapshot(tempDir)
 	if err == nil {
 		t.Fatal("Expected error for corrupted magic, got nil")
 	}
-	if !strings.Contains(err.Error(), "magic") {
-		t.Errorf("Expected magic error, got: %v", err)
+	if !errors.Is(err, ErrInvalidMagic) {
+		t.Errorf("Expected ErrInvalidMagic, got: %v", err)
 	}
 }
 
@@ -201,7 +212,7 @@ func TestSnapshotCorruptedChecksum(t *testing.T) {
 	}
 
 	// Write valid snapshot
-	if err := writeSnapshot(tempDir, data); err != nil {
+	if err := writeSnapshot(tempDir, data, nil, 0); err != nil {
 		t.Fatalf("writeSnapshot failed: %v", err)
 	}
 
@@ -223,12 +234,12 @@ func TestSnapshotCorruptedChecksum(t *testing.T) {
 	}
 
 	// Try to load
-	_, err = loadSnapshot(tempDir)
+	_, _, _, err = loadSnapshot(tempDir)
 	if err == nil {
 		t.Fatal("Expected error for corrupted checksum, got nil")
 	}
-	if !strings.Contains(err.Error(), "checksum") {
-		t.Errorf("Expected checksum error, got: %v", err)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Expected ErrChecksumMismatch, got: %v", err)
 	}
 }
 
@@ -240,7 +251,7 @@ func TestSnapshotTruncatedFile(t *testing.T) {
 	}
 
 	// Write valid snapshot
-	if err := writeSnapshot(tempDir, data); err != nil {
+	if err := writeSnapshot(tempDir, data, nil, 0); err != nil {
 		t.Fatalf("writeSnapshot failed: %v", err)
 	}
 
@@ -257,7 +268,7 @@ func TestSnapshotTruncatedFile(t *testing.T) {
 	}
 
 	// Try to load
-	_, err = loadSnapshot(tempDir)
+	_, _, _, err = loadSnapshot(tempDir)
 	if err == nil {
 		t.Fatal("Expected error for truncated file, got nil")
 	}
@@ -271,7 +282,7 @@ func TestSnapshotAtomicity(t *testing.T) {
 	}
 
 	// Write snapshot
-	if err := writeSnapshot(tempDir, data); err != nil {
+	if err := writeSnapshot(tempDir, data, nil, 0); err != nil {
 		t.Fatalf("writeSnapshot failed: %v", err)
 	}
 
@@ -295,7 +306,7 @@ func TestSnapshotOverwrite(t *testing.T) {
 	data1 := map[string][]byte{
 		"old": []byte("data"),
 	}
-	if err := writeSnapshot(tempDir, data1); err != nil {
+	if err := writeSnapshot(tempDir, data1, nil, 0); err != nil {
 		t.Fatalf("First writeSnapshot failed: %v", err)
 	}
 
@@ -303,12 +314,12 @@ func TestSnapshotOverwrite(t *testing.T) {
 	data2 := map[string][]byte{
 		"new": []byte("data"),
 	}
-	if err := writeSnapshot(tempDir, data2); err != nil {
+	if err := writeSnapshot(tempDir, data2, nil, 0); err != nil {
 		t.Fatalf("Second writeSnapshot failed: %v", err)
 	}
 
 	// Load and verify only new data exists
-	loaded, err := loadSnapshot(tempDir)
+	loaded, _, _, err := loadSnapshot(tempDir)
 	if err != nil {
 		t.Fatalf("loadSnapshot failed: %v", err)
 	}
@@ -338,12 +349,12 @@ func TestSnapshotLargeDataset(t *testing.T) {
 	}
 
 	// Write snapshot
-	if err := writeSnapshot(tempDir, data); err != nil {
+	if err := writeSnapshot(tempDir, data, nil, 0); err != nil {
 		t.Fatalf("writeSnapshot failed: %v", err)
 	}
 
 	// Load snapshot
-	loaded, err := loadSnapshot(tempDir)
+	loaded, _, _, err := loadSnapshot(tempDir)
 	if err != nil {
 		t.Fatalf("loadSnapshot failed: %v", err)
 	}
@@ -378,11 +389,11 @@ func TestSnapshotUnicode(t *testing.T) {
 		"mixed-日本語-en": []byte("mixed languages"),
 	}
 
-	if err := writeSnapshot(tempDir, data); err != nil {
+	if err := writeSnapshot(tempDir, data, nil, 0); err != nil {
 		t.Fatalf("writeSnapshot failed: %v", err)
 	}
 
-	loaded, err := loadSnapshot(tempDir)
+	loaded, _, _, err := loadSnapshot(tempDir)
 	if err != nil {
 		t.Fatalf("loadSnapshot failed: %v", err)
 	}
@@ -412,11 +423,11 @@ func TestSnapshotBinaryValues(t *testing.T) {
 		"mixed":  {0x00, 0x41, 0x00, 0x42}, // null + ASCII
 	}
 
-	if err := writeSnapshot(tempDir, data); err != nil {
+	if err := writeSnapshot(tempDir, data, nil, 0); err != nil {
 		t.Fatalf("writeSnapshot failed: %v", err)
 	}
 
-	loaded, err := loadSnapshot(tempDir)
+	loaded, _, _, err := loadSnapshot(tempDir)
 	if err != nil {
 		t.Fatalf("loadSnapshot failed: %v", err)
 	}
@@ -441,11 +452,11 @@ func TestSnapshotEmptyValue(t *testing.T) {
 		"nonempty": []byte("value"),
 	}
 
-	if err := writeSnapshot(tempDir, data); err != nil {
+	if err := writeSnapshot(tempDir, data, nil, 0); err != nil {
 		t.Fatalf("writeSnapshot failed: %v", err)
 	}
 
-	loaded, err := loadSnapshot(tempDir)
+	loaded, _, _, err := loadSnapshot(tempDir)
 	if err != nil {
 		t.Fatalf("loadSnapshot failed: %v", err)
 	}
@@ -477,7 +488,7 @@ func TestSnapshotExists(t *testing.T) {
 
 	// Write snapshot
 	data := map[string][]byte{"key": []byte("value")}
-	if err := writeSnapshot(tempDir, data); err != nil {
+	if err := writeSnapshot(tempDir, data, nil, 0); err != nil {
 		t.Fatalf("writeSnapshot failed: %v", err)
 	}
 
@@ -486,3 +497,96 @@ func TestSnapshotExists(t *testing.T) {
 		t.Error("snapshotExists should return true after writing snapshot")
 	}
 }
+
+func TestSnapshotExpiries(t *testing.T) {
+	tempDir := t.TempDir()
+
+	future := time.Now().Add(time.Hour).UnixNano()
+	past := time.Now().Add(-time.Hour).UnixNano()
+
+	data := map[string][]byte{
+		"plain":   []byte("a"),
+		"live":    []byte("b"),
+		"expired": []byte("c"),
+	}
+	expiries := map[string]int64{
+		"live":    future,
+		"expired": past,
+	}
+
+	if err := writeSnapshot(tempDir, data, expiries, 0); err != nil {
+		t.Fatalf("writeSnapshot failed: %v", err)
+	}
+
+	loaded, loadedExpiries, _, err := loadSnapshot(tempDir)
+	if err != nil {
+		t.Fatalf("loadSnapshot failed: %v", err)
+	}
+
+	if len(loaded) != 2 {
+		t.Errorf("Expected expired key to be skipped, got %d entries", len(loaded))
+	}
+	if _, exists := loaded["expired"]; exists {
+		t.Error("expired key should not be written")
+	}
+	if loadedExpiries["live"] != future {
+		t.Errorf("Expiry mismatch: got %d, want %d", loadedExpiries["live"], future)
+	}
+	if _, exists := loadedExpiries["plain"]; exists {
+		t.Error("plain key should have no expiry")
+	}
+}
+
+func TestSnapshotLoadV1(t *testing.T) {
+	tempDir := t.TempDir()
+
+	// Build a v1 snapshot by hand (no ExpiresAt field)
+	var header bytes.Buffer
+	binary.Write(&header, binary.BigEndian, snapshotMagicV1)
+	binary.Write(&header, binary.BigEndian, time.Now().UnixNano())
+	binary.Write(&header, binary.BigEndian, uint32(1))
+
+	var entry bytes.Buffer
+	binary.Write(&entry, binary.BigEndian, uint32(3))
+	entry.WriteString("key")
+	binary.Write(&entry, binary.BigEndian, uint32(5))
+	entry.WriteString("value")
+
+	var file bytes.Buffer
+	file.Write(header.Bytes())
+	binary.Write(&file, binary.BigEndian, crc32.ChecksumIEEE(header.Bytes()))
+	file.Write(entry.Bytes())
+	binary.Write(&file, binary.BigEndian, crc32.ChecksumIEEE(entry.Bytes()))
+
+	if err := os.WriteFile(filepath.Join(tempDir, snapshotFilename), file.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write v1 snapshot: %v", err)
+	}
+
+	loaded, expiries, _, err := loadSnapshot(tempDir)
+	if err != nil {
+		t.Fatalf("loadSnapshot failed on v1 snapshot: %v", err)
+	}
+	if !bytes.Equal(loaded["key"], []byte("value")) {
+		t.Errorf("Value mismatch: got %q, want 'value'", loaded["key"])
+	}
+	if len(expiries) != 0 {
+		t.Errorf("Expected no expiries from v1 snapshot, got %d", len(expiries))
+	}
+}
+
+func TestSnapshotLSN(t *testing.T) {
+	tempDir := t.TempDir()
+
+	data := map[string][]byte{"key": []byte("value")}
+	if err := writeSnapshot(tempDir, data, nil, 1234); err != nil {
+		t.Fatalf("writeSnapshot failed: %v", err)
+	}
+
+	_, _, lsn, err := loadSnapshot(tempDir)
+	if err != nil {
+		t.Fatalf("loadSnapshot failed: %v", err)
+	}
+	if lsn != 1234 {
+		t.Errorf("LSN mismatch: got %d, want 1234", lsn)
+	}
+}
@@ -1,20 +1,130 @@
 package kvstore
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"sync"
+	"time"
 )
 
+// defaultExpireInterval is how often the reaper looks for expired keys when
+// Config.ExpireInterval is not set
+const defaultExpireInterval = time.Second
+
 type Store struct {
-	mu     sync.RWMutex
-	data   map[string][]byte
-	wal    *WAL
-	config Config
+	mu       sync.RWMutex
+	data     map[string][]byte
+	versions map[string]uint64 // key -> seq of the commit that last set it
+	expiries map[string]int64  // key -> expiry deadline (unix nanoseconds), only keys with a TTL
+	index    *skiplist         // every key in data, in order
+	seq      uint64            // LSN of the last applied entry
+	wal      *WAL
+	config   Config
+	logger   *slog.Logger
+	metrics  Metrics
+	bytes    int64 // estimated memory held by keys and values, see sizeOf
+	recovery RecoveryReport
+
+	snapshots map[*Snapshot]struct{} // open read snapshots, see preserve
+	watchers  map[*Watcher]struct{}  // open watches, see publishLocked
+	applied   *sync.Cond             // broadcast after each write is applied, uses mu
+
+	checkpointMu sync.Mutex    // serializes checkpoints
+	checkpointCh chan struct{} // wakes the checkpointer when the WAL is too big
+
+	follower   *follower // set when replicating from a leader (Config.ReplicaOf)
+	replicated bool      // writes only arrive through replication (ReplicaOf or a Cluster)
+	lock       *dirLock  // held on DataDir until Close
+
+	// Background tasks
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+
+	// Lifecycle, see Close
+	state  storeState    // guarded by mu
+	closed chan struct{} // closed once Close has finished
 }
 
+// storeState is where a store is in its lifecycle. It only moves forward
+type storeState int
+
+const (
+	stateOpen    storeState = iota
+	stateClosing            // Close is waiting for writes and background tasks
+	stateClosed             // the WAL is closed, every method fails with ErrClosed
+)
+
 type Config struct {
 	DataDir    string
 	SyncWrites bool
+
+	// ExpireInterval is how often expired keys are deleted in the background
+	// (default: 1s). Expired keys are hidden from reads immediately either way
+	ExpireInterval time.Duration
+
+	// CheckpointInterval writes a snapshot and trims the WAL periodically
+	// (default: 0, disabled)
+	CheckpointInterval time.Duration
+
+	// CheckpointWALBytes writes a snapshot and trims the WAL once it grows
+	// past this many bytes (default: 0, disabled)
+	CheckpointWALBytes int64
+
+	// MaxSegmentBytes is the size at which a WAL segment is sealed and a new
+	// one started (default: 16 MiB)
+	MaxSegmentBytes int64
+
+	// ReplicaOf is the address of a leader serving ServeReplication. When set
+	// the store follows that leader: it applies the leader's WAL as it is
+	// written, rejects writes with ErrReadOnly and leaves deleting expired
+	// keys to the leader
+	ReplicaOf string
+
+	// Logger receives recovery, snapshot, WAL and background task events
+	// (default: slog.Default())
+	Logger *slog.Logger
+
+	// Metrics receives counters, gauges and latency histograms, see the
+	// Metric constants. Registry is a ready-made implementation (default:
+	// none)
+	Metrics Metrics
+
+	// ReadOnly opens the store for reading only: the snapshot and WAL are
+	// loaded without creating, truncating or removing any file, writes and
+	// Checkpoint fail with ErrReadOnly and Close writes no snapshot. Any
+	// number of read-only stores can share a data directory, but not with a
+	// writer
+	ReadOnly bool
+}
+
+// RecoveryReport describes what opening a store recovered from its data
+// directory, see Store.Recovery
+type RecoveryReport struct {
+	SnapshotLSN  uint64 // last WAL entry the snapshot covers
+	SnapshotKeys int    // keys loaded from the snapshot
+
+	Replayed int    // WAL entries applied after the snapshot
+	Skipped  int    // WAL entries with an unknown operation, ignored
+	LastLSN  uint64 // LSN of the last entry recovered
+
+	// Corruption holds why each damaged segment was not read to the end,
+	// usually a *CorruptionError
+	Corruption []error
+	// SetAside lists the segments renamed to *.corrupt because entries
+	// before them are missing
+	SetAside []string
+	// DiscardedBytes counts the WAL bytes not replayed because of damage
+	DiscardedBytes int64
+
+	Duration time.Duration
+}
+
+// Clean reports whether every WAL entry was recovered
+func (r RecoveryReport) Clean() bool {
+	return len(r.Corruption) == 0 && len(r.SetAside) == 0
 }
 
 func Open(dataDir string) (*Store, error) {
@@ -24,70 +134,399 @@ func Open(dataDir string) (*Store, error) {
 	})
 }
 
+// OpenWithConfig opens a store. The data directory is locked until Close;
+// opening it again, in this process or another, fails with ErrLocked
 func OpenWithConfig(config Config) (*Store, error) {
+	if config.ReadOnly && config.ReplicaOf != "" {
+		return nil, errors.New("a read-only store cannot follow a leader")
+	}
+	return openStore(config, config.ReplicaOf != "" || config.ReadOnly)
+}
+
+// openStore locks the data directory and opens a store. A replicated store
+// rejects writes and does not delete expired keys itself: its entries come
+// from elsewhere (a leader with Config.ReplicaOf, the Raft log for a
+// Cluster) or nowhere (Config.ReadOnly)
+func openStore(config Config, replicated bool) (*Store, error) {
+	lock, err := lockDir(config.DataDir, config.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := openLocked(config, replicated)
+	if err != nil {
+		lock.release()
+		return nil, err
+	}
+	store.lock = lock
+	return store, nil
+}
+
+// openLocked opens a store once the data directory is locked
+func openLocked(config Config, replicated bool) (*Store, error) {
+	started := time.Now()
+	logger := config.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	metrics := config.Metrics
+	if metrics == nil {
+		metrics = nopMetrics{}
+	}
+
 	// Create WAL
-	wal, err := NewWAL(config.DataDir, config.SyncWrites)
+	wal, err := openWAL(config.DataDir, config.SyncWrites, config.ReadOnly)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open WAL: %w", err)
 	}
+	if config.MaxSegmentBytes > 0 {
+		wal.maxSegmentBytes = config.MaxSegmentBytes
+	}
+	wal.logger = logger
 
 	// Load snapshot if exists
-	data, err := loadSnapshot(config.DataDir)
+	data, expiries, lsn, err := loadSnapshot(config.DataDir)
 	if err != nil {
 		wal.Close()
+		logger.Error("failed to load snapshot", "err", err)
 		return nil, fmt.Errorf("failed to load snapshot: %w", err)
 	}
 
 	// Create store with snapshot data
 	store := &Store{
-		data:   data,
-		wal:    wal,
-		config: config,
+		data:     data,
+		versions: make(map[string]uint64),
+		expiries: expiries,
+		index:    newSkiplist(),
+		seq:      lsn,
+		wal:      wal,
+		config:   config,
+		logger:   logger,
+		metrics:  nopMetrics{}, // replayed entries are not counted
+		stop:     make(chan struct{}),
+		closed:   make(chan struct{}),
+
+		replicated: replicated,
+
+		snapshots:    make(map[*Snapshot]struct{}),
+		watchers:     make(map[*Watcher]struct{}),
+		checkpointCh: make(chan struct{}, 1),
+	}
+
+	store.applied = sync.NewCond(&store.mu)
+
+	for key, value := range data {
+		store.index.insert(key)
+		store.bytes += sizeOf(key, value)
 	}
 
 	// Replay WAL to recover state (applies operations after snapshot)
-	err = wal.Replay(func(entry *Entry) error {
+	report := &store.recovery
+	report.SnapshotLSN = lsn
+	report.SnapshotKeys = len(data)
+	err = wal.replay(lsn+1, func(entry *Entry) error {
 		// No lock needed - single-threaded during recovery
-		switch entry.Operation {
-		case OpSet:
-			store.data[entry.Key] = entry.Value
-		case OpDelete:
-			delete(store.data, entry.Key)
-		}
-		return nil
-	})
+		return store.apply(entry)
+	}, report)
 
 	if err != nil {
 		wal.Close()
+		logger.Error("failed to replay WAL", "err", err)
 		return nil, fmt.Errorf("failed to replay WAL: %w", err)
 	}
 
+	report.LastLSN = store.seq
+	report.Duration = time.Since(started)
+
+	store.metrics = metrics
+	wal.metrics = metrics
+	metrics.Gauge(MetricReplaySeconds, report.Duration.Seconds())
+	metrics.Gauge(MetricKeys, float64(len(store.data)))
+	metrics.Gauge(MetricMemoryBytes, float64(store.bytes))
+	metrics.Gauge(MetricWALBytes, float64(wal.Size()))
+	// Routine recoveries are only logged at debug level
+	level := slog.LevelDebug
+	if !report.Clean() || report.Skipped > 0 {
+		level = slog.LevelWarn
+	}
+	logger.Log(context.Background(), level, "recovered store", "dir", config.DataDir,
+		"snapshot_lsn", report.SnapshotLSN, "snapshot_keys", report.SnapshotKeys,
+		"replayed", report.Replayed, "skipped", report.Skipped, "last_lsn", report.LastLSN,
+		"discarded_bytes", report.DiscardedBytes, "duration", report.Duration)
+
+	if config.ReplicaOf != "" {
+		store.follower = &follower{leader: config.ReplicaOf}
+		store.wg.Add(1)
+		go store.runFollower()
+	} else if !replicated {
+		interval := config.ExpireInterval
+		if interval <= 0 {
+			interval = defaultExpireInterval
+		}
+		store.wg.Add(1)
+		go store.runReaper(interval)
+	}
+
+	if !config.ReadOnly && (config.CheckpointInterval > 0 || config.CheckpointWALBytes > 0) {
+		store.wg.Add(1)
+		go store.runCheckpointer(config.CheckpointInterval)
+	}
+
 	return store, nil
 }
 
 // Store methods
 func (s *Store) Set(key string, value []byte) error {
-	// Write to WAL FIRST (before modifying memory)
-	entry := NewSetEntry(key, value)
-	if err := s.wal.Append(entry); err != nil {
-		return fmt.Errorf("WAL append failed: %w", err)
+	return s.write(NewSetEntry(key, value))
+}
+
+// Write applies every operation in the batch atomically: the batch is
+// appended to the WAL as a single checksummed entry and applied to memory
+// under one lock, so after a crash either all or none of it is recovered
+func (s *Store) Write(batch *WriteBatch) error {
+	if batch == nil || batch.Len() == 0 {
+		return nil
+	}
+
+	entry, err := NewBatchEntry(batch.entries)
+	if err != nil {
+		return fmt.Errorf("failed to build batch: %w", err)
 	}
 
-	// Then update in-memory (this can't fail)
+	return s.write(entry)
+}
+
+// Batch builds a WriteBatch with fn and writes it atomically
+// Nothing is written if fn returns an error
+func (s *Store) Batch(fn func(b *WriteBatch) error) error {
+	batch := NewWriteBatch()
+	if err := fn(batch); err != nil {
+		return err
+	}
+	return s.Write(batch)
+}
+
+// write appends an entry to the WAL and applies it to memory
+func (s *Store) write(entry *Entry) error {
+	started := time.Now()
+
 	s.mu.Lock()
-	s.data[key] = value
+	err := s.enqueueLocked(entry)
 	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := s.finish(entry); err != nil {
+		return err
+	}
+	s.metrics.Observe(MetricWriteSeconds, time.Since(started).Seconds())
+	return nil
+}
+
+// commit runs prepare under the write lock and commits the entry it returns,
+// if any. Returns whether an entry was committed
+// prepare sees every entry queued before it applied, so it can validate
+// conditions against the current state
+func (s *Store) commit(prepare func() (*Entry, error)) (bool, error) {
+	started := time.Now()
+
+	s.mu.Lock()
+	if err := s.checkOpenLocked(); err != nil {
+		s.mu.Unlock()
+		return false, err
+	}
+	s.waitAppliedLocked()
+	entry, err := prepare()
+	if err == nil && entry != nil {
+		err = s.enqueueLocked(entry)
+	}
+	s.mu.Unlock()
+
+	if err != nil || entry == nil {
+		return false, err
+	}
+
+	if err := s.finish(entry); err != nil {
+		return false, err
+	}
+	s.metrics.Observe(MetricWriteSeconds, time.Since(started).Seconds())
+	return true, nil
+}
+
+// enqueueLocked queues an entry in the WAL, assigning its LSN
+// Entries are queued under the lock so LSN order is the order in which
+// writers validated their conditions
+// Caller must hold s.mu
+func (s *Store) enqueueLocked(entry *Entry) error {
+	if err := s.checkOpenLocked(); err != nil {
+		return err
+	}
+	if s.replicated {
+		return ErrReadOnly
+	}
+	if err := s.wal.enqueue(entry); err != nil {
+		return fmt.Errorf("WAL append failed: %w", err)
+	}
+	s.maybeTriggerCheckpoint()
 
 	return nil
 }
 
+// enqueueReplicatedLocked queues an entry received through replication. It
+// already carries its LSN, which must follow the last one in the WAL
+// Caller must hold s.mu
+func (s *Store) enqueueReplicatedLocked(entry *Entry) error {
+	if err := s.wal.enqueue(entry); err != nil {
+		return fmt.Errorf("WAL append failed: %w", err)
+	}
+	s.maybeTriggerCheckpoint()
+
+	return nil
+}
+
+// finish waits until a queued entry is durable, then updates memory
+// The wait happens without holding s.mu, so concurrent writers share one
+// write and fsync (group commit). Entries are applied in LSN order, so the
+// order in which writes become visible always matches the WAL
+func (s *Store) finish(entry *Entry) error {
+	// WAL FIRST: nothing becomes visible before it is durable
+	if err := s.wal.WaitDurable(entry.LSN); err != nil {
+		return fmt.Errorf("WAL append failed: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Earlier entries are durable too, wait for their writers to apply them
+	for s.seq+1 < entry.LSN {
+		s.applied.Wait()
+	}
+	defer s.applied.Broadcast()
+
+	return s.apply(entry)
+}
+
+// waitAppliedLocked waits until every entry queued in the WAL has been
+// applied to memory, or the WAL has failed
+// Caller must hold s.mu
+func (s *Store) waitAppliedLocked() {
+	for s.seq < s.wal.LastLSN() && s.wal.failure() == nil {
+		s.applied.Wait()
+	}
+}
+
+// apply updates the in-memory map with a WAL entry
+// The entry's LSN becomes the sequence number of every operation inside it
+// Caller must hold s.mu (or be the only goroutine, as during recovery)
+func (s *Store) apply(entry *Entry) error {
+	s.seq = entry.LSN
+
+	ops := []*Entry{entry}
+	if entry.Operation == OpBatch {
+		var err error
+		if ops, err = entry.BatchEntries(); err != nil {
+			return fmt.Errorf("failed to decode batch: %w", err)
+		}
+	}
+	for _, op := range ops {
+		if err := s.applyOp(op); err != nil {
+			return err
+		}
+	}
+
+	if len(s.watchers) > 0 {
+		s.publishLocked(entry, ops)
+	}
+	s.metrics.Gauge(MetricKeys, float64(len(s.data)))
+	s.metrics.Gauge(MetricMemoryBytes, float64(s.bytes))
+	return nil
+}
+
+// applyOp applies a single non-batch operation at the current sequence number
+func (s *Store) applyOp(entry *Entry) error {
+	// Open snapshots must keep seeing the state before this write
+	s.preserve(entry.Key)
+
+	switch entry.Operation {
+	case OpSet:
+		s.resize(entry.Key, entry.Value)
+		s.data[entry.Key] = entry.Value
+		s.versions[entry.Key] = s.seq
+		s.index.insert(entry.Key)
+		delete(s.expiries, entry.Key)
+	case OpSetTTL:
+		expiresAt, value, err := decodeTTLValue(entry.Value)
+		if err != nil {
+			return fmt.Errorf("invalid TTL entry for key %q: %w", entry.Key, err)
+		}
+		s.resize(entry.Key, value)
+		s.data[entry.Key] = value
+		s.versions[entry.Key] = s.seq
+		s.index.insert(entry.Key)
+		s.expiries[entry.Key] = expiresAt
+	case OpExpire:
+		expiresAt, _, err := decodeTTLValue(entry.Value)
+		if err != nil {
+			return fmt.Errorf("invalid expire entry for key %q: %w", entry.Key, err)
+		}
+		if _, exists := s.data[entry.Key]; !exists {
+			return nil
+		}
+		s.versions[entry.Key] = s.seq
+		if expiresAt == 0 {
+			delete(s.expiries, entry.Key)
+		} else {
+			s.expiries[entry.Key] = expiresAt
+		}
+	case OpDelete:
+		if old, exists := s.data[entry.Key]; exists {
+			s.bytes -= sizeOf(entry.Key, old)
+		}
+		s.metrics.Count(MetricDeletes, 1)
+		delete(s.data, entry.Key)
+		delete(s.versions, entry.Key)
+		delete(s.expiries, entry.Key)
+		s.index.remove(entry.Key)
+	}
+	return nil
+}
+
+// resize updates the memory estimate and the set counter for a key about to
+// be set to value
+func (s *Store) resize(key string, value []byte) {
+	if old, exists := s.data[key]; exists {
+		s.bytes -= sizeOf(key, old)
+	}
+	s.bytes += sizeOf(key, value)
+	s.metrics.Count(MetricSets, 1)
+}
+
 func (s *Store) Get(key string) ([]byte, bool) {
 	s.mu.RLock()
-	defer s.mu.RUnlock()
+	value, ok := s.getLocked(key)
+	s.mu.RUnlock()
+
+	s.metrics.Count(MetricGets, 1)
+	if ok {
+		s.metrics.Count(MetricGetHits, 1)
+	} else {
+		s.metrics.Count(MetricGetMisses, 1)
+	}
+	return value, ok
+}
+
+// getLocked returns the value of key, treating expired keys as missing and
+// every key as missing once the store is closing
+// Caller must hold s.mu
+func (s *Store) getLocked(key string) ([]byte, bool) {
+	if s.state != stateOpen {
+		return nil, false
+	}
 
 	value, exists := s.data[key]
 
-	if !exists {
+	if !exists || isExpired(s.expiries[key], time.Now().UnixNano()) {
 		return nil, false
 	}
 
@@ -95,29 +534,92 @@ func (s *Store) Get(key string) ([]byte, bool) {
 }
 
 func (s *Store) Delete(key string) error {
-	// Write to WAL FIRST
-	entry := NewDeleteEntry(key)
-	if err := s.wal.Append(entry); err != nil {
-		return fmt.Errorf("WAL append failed: %w", err)
-	}
+	return s.write(NewDeleteEntry(key))
+}
 
-	// Then update in-memory
-	s.mu.Lock()
-	delete(s.data, key)
-	s.mu.Unlock()
+// Recovery returns what opening the store recovered from its data directory
+func (s *Store) Recovery() RecoveryReport {
+	return s.recovery
+}
 
+// checkOpenLocked returns ErrClosed once Close has been called
+// Caller must hold s.mu
+func (s *Store) checkOpenLocked() error {
+	if s.state != stateOpen {
+		return ErrClosed
+	}
 	return nil
 }
 
+// checkOpen is checkOpenLocked for callers that do not hold s.mu
+func (s *Store) checkOpen() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.checkOpenLocked()
+}
+
+// Close writes a snapshot, truncates the WAL (unless the store is read-only)
+// and releases the data directory
+//
+// From the moment Close is called new operations fail with ErrClosed and
+// reads find nothing. Close waits for writes already queued in the WAL,
+// background tasks, watches, replication and a checkpoint in progress, and
+// releases the open snapshots. Calling Close again, even concurrently, waits
+// for the first call to finish and returns nil
 func (s *Store) Close() error {
+	// Stop background tasks before taking the lock they also need. Stopping
+	// under the lock orders it with goTask starting new ones
+	s.mu.Lock()
+	if s.state != stateOpen {
+		s.mu.Unlock()
+		<-s.closed
+		return nil
+	}
+	s.state = stateClosing
+	s.stopOnce.Do(func() { close(s.stop) })
+	s.mu.Unlock()
+	defer close(s.closed)
+	s.wg.Wait()
+
+	// Wait for an on-demand checkpoint still in progress
+	s.checkpointMu.Lock()
+	defer s.checkpointMu.Unlock()
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	// Whatever happens below the store cannot be used any more
+	defer func() { s.state = stateClosed }()
+	for snap := range s.snapshots {
+		snap.closed = true
+		snap.preserved = nil
+	}
+	clear(s.snapshots)
+
+	// Unlock the directory last, once the WAL is closed whatever happens
+	if lock := s.lock; lock != nil {
+		s.lock = nil
+		defer lock.release()
+	}
+
+	// A read-only store leaves the directory as it found it
+	if s.config.ReadOnly {
+		return s.wal.Close()
+	}
+
+	// Let writes already in the WAL reach memory so the snapshot has them
+	s.waitAppliedLocked()
+
 	// Write snapshot (fail-safe: if snapshot fails, preserve WAL)
-	if err := writeSnapshot(s.config.DataDir, s.data); err != nil {
+	started := time.Now()
+	if err := writeSnapshot(s.config.DataDir, s.data, s.expiries, s.seq); err != nil {
 		s.wal.Close() // Try to close WAL anyway
 		return fmt.Errorf("snapshot write failed (WAL preserved): %w", err)
 	}
+	s.observeSnapshot(started)
+
+	s.logger.Debug("wrote snapshot on close", "lsn", s.seq, "keys", len(s.data))
 
 	// Truncate WAL only after successful snapshot
 	if err := s.wal.Truncate(); err != nil {
@@ -133,15 +635,43 @@ func (s *Store) Close() error {
 	return nil
 }
 
+// Len returns the number of keys, 0 once the store is closed
 func (s *Store) Len() int {
-	return len(s.data)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.state != stateOpen {
+		return 0
+	}
+
+	n := len(s.data)
+	now := time.Now().UnixNano()
+	for _, expiresAt := range s.expiries {
+		if isExpired(expiresAt, now) {
+			n--
+		}
+	}
+
+	return n
 }
 
+// Keys returns all keys in ascending order, none once the store is closed
 func (s *Store) Keys() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.state != stateOpen {
+		return nil
+	}
+
 	keys := make([]string, 0, len(s.data))
+	now := time.Now().UnixNano()
 
-	for key := range s.data {
-		keys = append(keys, key)
+	for node := s.index.first(); node != nil; node = node.next[0] {
+		if isExpired(s.expiries[node.key], now) {
+			continue
+		}
+		keys = append(keys, node.key)
 	}
 
 	return keys
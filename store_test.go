@@ -2,13 +2,21 @@ package kvstore
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestOpenStore(t *testing.T) {
-	store, err := Open("./testing-data")
+	store, err := Open(t.TempDir())
 
 	if err != nil {
 		t.Fatalf("Error opening the store path")
@@ -34,7 +42,7 @@ func TestSetGetValues(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			store, err := Open("./testing-data")
+			store, err := Open(t.TempDir())
 
 			if err != nil {
 				t.Fatalf("Error opening the store path")
@@ -62,7 +70,7 @@ func TestSetGetValues(t *testing.T) {
 }
 
 func TestStoreConcurrentReadWrite(t *testing.T) {
-	store, err := Open("./test-data")
+	store, err := Open(t.TempDir())
 
 	if err != nil {
 		t.Fatalf("failed to open store: %v", err)
@@ -101,7 +109,7 @@ func TestStoreConcurrentReadWrite(t *testing.T) {
 }
 
 func TestStoreConcurrrentWritesSameKey(t *testing.T) {
-	store, err := Open("./test-data")
+	store, err := Open(t.TempDir())
 
 	if err != nil {
 		t.Fatalf("failed to open store: %v", err)
@@ -209,7 +217,7 @@ func TestStoreRecoveryAfterCrash(t *testing.T) {
 	}
 
 	// DON'T call Close() - simulate crash
-	// store1.Close()
+	simulateCrash(store1)
 
 	// Second session: recover from crash
 	store2, err := Open(dir)
@@ -267,7 +275,7 @@ func TestStoreMultipleOperations(t *testing.T) {
 	}
 
 	// Crash (no Close)
-	// store1.Close()
+	simulateCrash(store1)
 
 	// Second session: verify final state
 	store2, err := Open(dir)
@@ -376,7 +384,7 @@ func TestStoreConcurrentWritesWithRecovery(t *testing.T) {
 	}
 
 	// Crash (no Close)
-	// store1.Close()
+	simulateCrash(store1)
 
 	// Second session: verify all keys recovered
 	store2, err := Open(dir)
@@ -397,3 +405,400 @@ func TestStoreConcurrentWritesWithRecovery(t *testing.T) {
 		}
 	}
 }
+
+// TestStoreLSNAcrossRestarts tests that sequence numbers keep counting after
+// a clean shutdown and after a crash
+func TestStoreLSNAcrossRestarts(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store1, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		store1.Set(key, []byte("value"))
+	}
+	if err := store1.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	store2, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if seq := store2.seq; seq != 3 {
+		t.Errorf("Expected seq 3 after clean shutdown, got %d", seq)
+	}
+	store2.Set("d", []byte("value"))
+	simulateCrash(store2)
+
+	store3, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open (after crash) failed: %v", err)
+	}
+	defer store3.Close()
+
+	if seq := store3.seq; seq != 4 {
+		t.Errorf("Expected seq 4 after crash, got %d", seq)
+	}
+	if store3.Len() != 4 {
+		t.Errorf("Expected 4 keys, got %d", store3.Len())
+	}
+}
+
+// TestStoreReplaySkipsSnapshotEntries tests that WAL entries already in the
+// snapshot are not replayed
+func TestStoreReplaySkipsSnapshotEntries(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store1, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	store1.Set("a", []byte("wal"))
+	store1.Set("b", []byte("wal"))
+	store1.Set("c", []byte("wal"))
+	simulateCrash(store1)
+
+	// Snapshot taken at LSN 2 whose values differ from the WAL, as if the WAL
+	// had not been trimmed yet when the process died
+	data := map[string][]byte{"a": []byte("snap"), "b": []byte("snap")}
+	if err := writeSnapshot(dir, data, nil, 2); err != nil {
+		t.Fatalf("writeSnapshot failed: %v", err)
+	}
+
+	store2, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store2.Close()
+
+	for key, want := range map[string]string{"a": "snap", "b": "snap", "c": "wal"} {
+		if value, _ := store2.Get(key); string(value) != want {
+			t.Errorf("%s: got %q, want %q", key, value, want)
+		}
+	}
+}
+
+// TestStoreRecoveryReport tests that recovery is reported through
+// Store.Recovery and the configured logger
+func TestStoreRecoveryReport(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	wal, err := NewWAL(dir, true)
+	if err != nil {
+		t.Fatalf("NewWAL failed: %v", err)
+	}
+	unknown := NewSetEntry("x", []byte("value"))
+	unknown.Operation = 0x7F
+	for _, entry := range []*Entry{NewSetEntry("a", []byte("value")), unknown, NewSetEntry("b", []byte("value")), NewSetEntry("c", []byte("value"))} {
+		if err := wal.Append(entry); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	entrySize := wal.Size() / 4
+	path := wal.segments[0].path
+	wal.Close()
+
+	// Damage the last entry
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	data[len(data)-6] ^= 0xFF
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+	store, err := OpenWithConfig(Config{DataDir: dir, SyncWrites: true, Logger: logger})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	report := store.Recovery()
+	if report.Replayed != 2 || report.Skipped != 1 || report.LastLSN != 3 {
+		t.Errorf("Unexpected counts: %+v", report)
+	}
+	if report.Clean() || len(report.Corruption) != 1 || !errors.Is(report.Corruption[0], ErrChecksumMismatch) {
+		t.Errorf("Expected one checksum mismatch, got %v", report.Corruption)
+	}
+	if report.DiscardedBytes != entrySize {
+		t.Errorf("Expected %d bytes discarded, got %d", entrySize, report.DiscardedBytes)
+	}
+
+	// One JSON object per line
+	found := false
+	for _, line := range bytes.Split(bytes.TrimSpace(logs.Bytes()), []byte("\n")) {
+		var record map[string]any
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatalf("Invalid log line %q: %v", line, err)
+		}
+		if record["level"] == "WARN" && record["offset"] == float64(3*entrySize) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected a warning with the corruption offset, got:\n%s", logs.String())
+	}
+}
+
+// TestStoreReadOnly tests that a read-only store recovers the data without
+// changing a single file
+func TestStoreReadOnly(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	store.Set("a", []byte("1"))
+	store.Set("b", []byte("2"))
+	store.Close()
+
+	store, err = Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	store.Set("c", []byte("3"))
+	store.Delete("a")
+	path := store.wal.active().path
+	simulateCrash(store)
+
+	// A torn tail would be set aside by a writable store
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	file.Write([]byte("torn"))
+	file.Close()
+
+	files := func() map[string]string {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("ReadDir failed: %v", err)
+		}
+		contents := make(map[string]string)
+		for _, entry := range entries {
+			data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				t.Fatalf("ReadFile failed: %v", err)
+			}
+			contents[entry.Name()] = string(data)
+		}
+		return contents
+	}
+	before := files()
+
+	store, err = OpenWithConfig(Config{DataDir: dir, ReadOnly: true, CheckpointInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Read-only Open failed: %v", err)
+	}
+	if _, ok := store.Get("a"); ok {
+		t.Error("Deleted key should not be recovered")
+	}
+	for key, want := range map[string]string{"b": "2", "c": "3"} {
+		if value, ok := store.Get(key); !ok || string(value) != want {
+			t.Errorf("%s: expected %q, got %q", key, want, value)
+		}
+	}
+	if len(store.Recovery().Corruption) != 1 || len(store.Recovery().SetAside) != 0 {
+		t.Errorf("Expected the torn tail to be skipped in memory: %+v", store.Recovery())
+	}
+
+	if err := store.Set("d", []byte("4")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Set: expected ErrReadOnly, got %v", err)
+	}
+	if err := store.Delete("b"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Delete: expected ErrReadOnly, got %v", err)
+	}
+	if err := store.Checkpoint(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Checkpoint: expected ErrReadOnly, got %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	after := files()
+	if len(after) != len(before) {
+		t.Errorf("Files changed from %d to %d", len(before), len(after))
+	}
+	for name, data := range before {
+		if after[name] != data {
+			t.Errorf("%s changed", name)
+		}
+	}
+
+	// Nothing is created either
+	missing := filepath.Join(dir, "missing")
+	if _, err := OpenWithConfig(Config{DataDir: missing, ReadOnly: true}); err == nil {
+		t.Error("Expected an error opening a missing directory read-only")
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("Read-only Open created the directory: %v", err)
+	}
+}
+
+// TestStoreClosed tests that every method fails or finds nothing once the
+// store is closed, and that Close can be called again
+func TestStoreClosed(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	store.Set("key", []byte("value"))
+	snap := store.Snapshot()
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Errorf("Second Close failed: %v", err)
+	}
+
+	errs := map[string]error{
+		"Set":    store.Set("key", []byte("other")),
+		"Delete": store.Delete("key"),
+		"Batch": store.Batch(func(b *WriteBatch) error {
+			b.Put("key", []byte("other"))
+			return nil
+		}),
+		"SetWithTTL": store.SetWithTTL("key", []byte("other"), time.Hour),
+		"Update":     store.Update(func(tx *Txn) error { return tx.Set("key", []byte("other")) }),
+		"View":       store.View(func(tx *Txn) error { return nil }),
+		"Checkpoint": store.Checkpoint(),
+	}
+	_, errs["CompareAndSwap"] = store.CompareAndSwap("key", []byte("value"), []byte("other"))
+	_, errs["Persist"] = store.Persist("key")
+	_, errs["Watch"] = store.Watch(context.Background(), "", WatchOptions{})
+	for name, err := range errs {
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("%s: expected ErrClosed, got %v", name, err)
+		}
+	}
+
+	if _, ok := store.Get("key"); ok {
+		t.Error("Get should find nothing after Close")
+	}
+	if _, ok := store.TTL("key"); ok {
+		t.Error("TTL should find nothing after Close")
+	}
+	if store.Len() != 0 || len(store.Keys()) != 0 || len(store.Scan("", "", ScanOptions{})) != 0 {
+		t.Error("Len, Keys and Scan should be empty after Close")
+	}
+	for key := range store.All() {
+		t.Errorf("All yielded %q after Close", key)
+	}
+	if _, ok := snap.Get("key"); ok {
+		t.Error("Snapshots should be released by Close")
+	}
+	if _, ok := store.Snapshot().Get("key"); ok {
+		t.Error("Snapshot should find nothing after Close")
+	}
+}
+
+// TestStoreCloseConcurrent tests that Close lets writes already in progress
+// finish and rejects the others, whichever goroutine calls it
+func TestStoreCloseConcurrent(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	var written sync.Map
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				key := fmt.Sprintf("g%d-%d", g, i)
+				err := store.Set(key, []byte("value"))
+				if errors.Is(err, ErrClosed) {
+					return
+				}
+				if err != nil {
+					t.Errorf("Set failed: %v", err)
+					return
+				}
+				written.Store(key, true)
+			}
+		}(g)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	closeErrs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() { closeErrs <- store.Close() }()
+	}
+	for i := 0; i < 3; i++ {
+		if err := <-closeErrs; err != nil {
+			t.Errorf("Close failed: %v", err)
+		}
+	}
+	wg.Wait()
+
+	// Every acknowledged write made it into the snapshot
+	store, err = Open(dir)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer store.Close()
+	written.Range(func(key, _ any) bool {
+		if _, ok := store.Get(key.(string)); !ok {
+			t.Errorf("Acknowledged write %s was lost", key)
+		}
+		return true
+	})
+}
+
+// simulateCrash stops background tasks and closes the WAL without writing a
+// snapshot, leaving the data directory as a killed process would
+func simulateCrash(store *Store) {
+	store.stopOnce.Do(func() { close(store.stop) })
+	store.wg.Wait()
+	store.wal.Close()
+	store.lock.release()
+}
+
+// BenchmarkStoreSet measures synchronous Set throughput with one writer and
+// with many concurrent writers sharing fsyncs
+func BenchmarkStoreSet(b *testing.B) {
+	value := bytes.Repeat([]byte("v"), 100)
+
+	for _, writers := range []int{1, 8, 64} {
+		b.Run(fmt.Sprintf("writers=%d", writers), func(b *testing.B) {
+			store, err := Open(b.TempDir())
+			if err != nil {
+				b.Fatalf("Open failed: %v", err)
+			}
+			defer store.Close()
+
+			var n atomic.Int64
+			b.SetParallelism(writers)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					key := fmt.Sprintf("key-%d", n.Add(1))
+					if err := store.Set(key, value); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
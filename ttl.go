@@ -0,0 +1,134 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// NoExpiry is returned by TTL for keys that never expire
+const NoExpiry time.Duration = -1
+
+// ErrInvalidTTL is returned when a TTL is zero or negative
+var ErrInvalidTTL = errors.New("TTL must be positive")
+
+// SetWithTTL stores a key-value pair that disappears after ttl
+// The absolute deadline is written to the WAL, so the key expires at the same
+// moment even if the store is restarted in between
+func (s *Store) SetWithTTL(key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+
+	expiresAt := time.Now().Add(ttl).UnixNano()
+	return s.write(NewSetWithTTLEntry(key, value, expiresAt))
+}
+
+// Expire sets a TTL on an existing key
+// Returns false if the key does not exist
+func (s *Store) Expire(key string, ttl time.Duration) (bool, error) {
+	if ttl <= 0 {
+		return false, ErrInvalidTTL
+	}
+
+	return s.commit(func() (*Entry, error) {
+		if _, exists := s.getLocked(key); !exists {
+			return nil, nil
+		}
+
+		expiresAt := time.Now().Add(ttl).UnixNano()
+		return NewExpireEntry(key, expiresAt), nil
+	})
+}
+
+// Persist removes the TTL of a key so it never expires
+// Returns false if the key does not exist or has no TTL
+func (s *Store) Persist(key string) (bool, error) {
+	return s.commit(func() (*Entry, error) {
+		if _, exists := s.getLocked(key); !exists {
+			return nil, nil
+		}
+		if _, hasTTL := s.expiries[key]; !hasTTL {
+			return nil, nil
+		}
+
+		return NewExpireEntry(key, 0), nil
+	})
+}
+
+// TTL returns the time left before key expires
+// Returns (NoExpiry, true) for keys without a TTL and (0, false) for missing keys
+func (s *Store) TTL(key string) (time.Duration, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, exists := s.getLocked(key); !exists {
+		return 0, false
+	}
+
+	expiresAt, hasTTL := s.expiries[key]
+	if !hasTTL {
+		return NoExpiry, true
+	}
+
+	return time.Duration(expiresAt - time.Now().UnixNano()), true
+}
+
+// runReaper periodically deletes expired keys until the store is closed
+func (s *Store) runReaper(interval time.Duration) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			// Close may have started since the tick
+			if _, err := s.reapExpired(); err != nil && !errors.Is(err, ErrClosed) {
+				s.logger.Error("failed to delete expired keys", "err", err)
+			}
+		}
+	}
+}
+
+// reapExpired writes delete records for every expired key, so expirations
+// survive a restart, and removes them from memory
+// Returns the number of keys deleted
+func (s *Store) reapExpired() (int, error) {
+	var expired []string
+
+	committed, err := s.commit(func() (*Entry, error) {
+		now := time.Now().UnixNano()
+		for key, expiresAt := range s.expiries {
+			if isExpired(expiresAt, now) {
+				expired = append(expired, key)
+			}
+		}
+
+		if len(expired) == 0 {
+			return nil, nil
+		}
+
+		// Sort keys so the WAL record is deterministic
+		sort.Strings(expired)
+
+		entries := make([]*Entry, 0, len(expired))
+		for _, key := range expired {
+			entries = append(entries, NewDeleteEntry(key))
+		}
+
+		entry, err := NewBatchEntry(entries)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build expiration batch: %w", err)
+		}
+		return entry, nil
+	})
+	if !committed {
+		return 0, err
+	}
+	return len(expired), nil
+}
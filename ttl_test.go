@@ -0,0 +1,268 @@
+package kvstore
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestTTLExpiresKey tests that a key disappears from reads once its TTL passes
+func TestTTLExpiresKey(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := OpenWithConfig(Config{DataDir: dir, SyncWrites: true, ExpireInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.SetWithTTL("session:id", []byte("abc123"), 50*time.Millisecond); err != nil {
+		t.Fatalf("SetWithTTL failed: %v", err)
+	}
+	store.Set("user:1", []byte("alice"))
+
+	if value, ok := store.Get("session:id"); !ok || string(value) != "abc123" {
+		t.Fatalf("Expected session before expiry, got %q (exists=%v)", value, ok)
+	}
+	if store.Len() != 2 {
+		t.Errorf("Expected 2 keys before expiry, got %d", store.Len())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	// Hidden immediately even though the reaper has not run
+	if _, ok := store.Get("session:id"); ok {
+		t.Error("session:id should be expired")
+	}
+	if store.Len() != 1 {
+		t.Errorf("Expected 1 key after expiry, got %d", store.Len())
+	}
+	if keys := store.Keys(); len(keys) != 1 || keys[0] != "user:1" {
+		t.Errorf("Expected only user:1, got %v", keys)
+	}
+}
+
+// TestTTLRemaining tests the TTL accessor
+func TestTTLRemaining(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	if _, ok := store.TTL("missing"); ok {
+		t.Error("TTL of missing key should report false")
+	}
+
+	store.Set("plain", []byte("v"))
+	if ttl, ok := store.TTL("plain"); !ok || ttl != NoExpiry {
+		t.Errorf("Expected NoExpiry for plain key, got %v (exists=%v)", ttl, ok)
+	}
+
+	store.SetWithTTL("temp", []byte("v"), time.Minute)
+	ttl, ok := store.TTL("temp")
+	if !ok || ttl <= 0 || ttl > time.Minute {
+		t.Errorf("Expected TTL in (0, 1m], got %v (exists=%v)", ttl, ok)
+	}
+
+	// Plain Set clears the TTL
+	store.Set("temp", []byte("v2"))
+	if ttl, _ := store.TTL("temp"); ttl != NoExpiry {
+		t.Errorf("Expected NoExpiry after Set, got %v", ttl)
+	}
+}
+
+// TestTTLExpireAndPersist tests changing the TTL of an existing key
+func TestTTLExpireAndPersist(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	ok, err := store.Expire("missing", time.Minute)
+	if err != nil || ok {
+		t.Errorf("Expire on missing key: ok=%v err=%v", ok, err)
+	}
+
+	if _, err := store.Expire("key", 0); !errors.Is(err, ErrInvalidTTL) {
+		t.Errorf("Expected ErrInvalidTTL, got %v", err)
+	}
+	if err := store.SetWithTTL("key", nil, -time.Second); !errors.Is(err, ErrInvalidTTL) {
+		t.Errorf("Expected ErrInvalidTTL, got %v", err)
+	}
+
+	store.Set("key", []byte("v"))
+	ok, err = store.Expire("key", time.Minute)
+	if err != nil || !ok {
+		t.Fatalf("Expire: ok=%v err=%v", ok, err)
+	}
+	if ttl, _ := store.TTL("key"); ttl == NoExpiry {
+		t.Error("Expected key to have a TTL after Expire")
+	}
+
+	ok, err = store.Persist("key")
+	if err != nil || !ok {
+		t.Fatalf("Persist: ok=%v err=%v", ok, err)
+	}
+	if ttl, _ := store.TTL("key"); ttl != NoExpiry {
+		t.Errorf("Expected NoExpiry after Persist, got %v", ttl)
+	}
+
+	ok, err = store.Persist("key")
+	if err != nil || ok {
+		t.Errorf("Persist on key without TTL: ok=%v err=%v", ok, err)
+	}
+}
+
+// TestTTLReaperDeletes tests that the background reaper removes expired keys
+func TestTTLReaperDeletes(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := OpenWithConfig(Config{DataDir: dir, SyncWrites: true, ExpireInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	store.SetWithTTL("temp", []byte("v"), 20*time.Millisecond)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		store.mu.RLock()
+		_, present := store.data["temp"]
+		store.mu.RUnlock()
+
+		if !present {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("reaper did not delete expired key")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestTTLSurvivesCrash tests that the deadline is recovered from the WAL
+func TestTTLSurvivesCrash(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store1, err := OpenWithConfig(Config{DataDir: dir, SyncWrites: true, ExpireInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	store1.SetWithTTL("short", []byte("v"), 50*time.Millisecond)
+	store1.SetWithTTL("long", []byte("v"), time.Hour)
+	store1.Set("plain", []byte("v"))
+	store1.Expire("plain", time.Hour)
+
+	// DON'T call Close() - simulate crash
+	simulateCrash(store1)
+
+	time.Sleep(60 * time.Millisecond)
+
+	store2, err := OpenWithConfig(Config{DataDir: dir, SyncWrites: true, ExpireInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("Open (after crash) failed: %v", err)
+	}
+	defer store2.Close()
+
+	if _, ok := store2.Get("short"); ok {
+		t.Error("short should have expired across the restart")
+	}
+	if ttl, ok := store2.TTL("long"); !ok || ttl == NoExpiry {
+		t.Errorf("long should keep its TTL, got %v (exists=%v)", ttl, ok)
+	}
+	if ttl, ok := store2.TTL("plain"); !ok || ttl == NoExpiry {
+		t.Errorf("plain should keep the TTL set by Expire, got %v (exists=%v)", ttl, ok)
+	}
+}
+
+// TestTTLSurvivesSnapshot tests that deadlines are kept across a clean shutdown
+func TestTTLSurvivesSnapshot(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store1, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	store1.SetWithTTL("short", []byte("v"), 50*time.Millisecond)
+	store1.SetWithTTL("long", []byte("v"), time.Hour)
+
+	if err := store1.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	store2, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open (second) failed: %v", err)
+	}
+	defer store2.Close()
+
+	if _, ok := store2.Get("short"); ok {
+		t.Error("short should have expired across the restart")
+	}
+	if ttl, ok := store2.TTL("long"); !ok || ttl == NoExpiry {
+		t.Errorf("long should keep its TTL, got %v (exists=%v)", ttl, ok)
+	}
+}
+
+// TestTTLReapedDeleteIsLogged tests that reaper deletions are written to the WAL
+func TestTTLReapedDeleteIsLogged(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := OpenWithConfig(Config{DataDir: dir, SyncWrites: true, ExpireInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	store.SetWithTTL("temp", []byte("v"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	n, err := store.reapExpired()
+	if err != nil {
+		t.Fatalf("reapExpired failed: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("Expected 1 reaped key, got %d", n)
+	}
+
+	deletes := 0
+	err = store.wal.Replay(func(e *Entry) error {
+		if e.Operation != OpBatch {
+			return nil
+		}
+		entries, err := e.BatchEntries()
+		if err != nil {
+			return err
+		}
+		for _, inner := range entries {
+			if inner.Operation == OpDelete && inner.Key == "temp" {
+				deletes++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if deletes != 1 {
+		t.Errorf("Expected 1 logged delete for temp, got %d", deletes)
+	}
+}
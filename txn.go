@@ -0,0 +1,211 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// maxTxnAttempts is how many times Update runs a transaction before
+// giving up with ErrConflict
+const maxTxnAttempts = 10
+
+var (
+	// ErrConflict is returned when a transaction keeps conflicting with
+	// concurrent commits
+	ErrConflict = errors.New("transaction conflict")
+
+	// ErrTxnReadOnly is returned when writing inside a View transaction
+	ErrTxnReadOnly = errors.New("transaction is read-only")
+
+	// ErrTxnDone is returned when using a transaction after it has finished
+	ErrTxnDone = errors.New("transaction already finished")
+)
+
+// Txn is an optimistic transaction
+//
+// Reads record the version of every key they observe and writes are buffered
+// in memory. On commit the recorded versions are checked against the store;
+// if any key changed since it was read the commit fails with ErrConflict,
+// otherwise the buffered writes are appended to the WAL as one batch entry.
+//
+// A Txn is only valid inside the function passed to Update or View and is not
+// safe for concurrent use
+type Txn struct {
+	store    *Store
+	snap     *Snapshot // set for View transactions, which read from a snapshot
+	writable bool
+	done     bool
+	reads    map[string]uint64 // key -> version observed on first read (0 = absent)
+	writes   map[string]*Entry // key -> last buffered operation
+}
+
+func newTxn(store *Store, writable bool) *Txn {
+	return &Txn{
+		store:    store,
+		writable: writable,
+		reads:    make(map[string]uint64),
+		writes:   make(map[string]*Entry),
+	}
+}
+
+// Get returns the value of key as seen by this transaction, including its own
+// buffered writes
+func (tx *Txn) Get(key string) ([]byte, bool) {
+	if entry, ok := tx.writes[key]; ok {
+		switch entry.Operation {
+		case OpDelete:
+			return nil, false
+		case OpSetTTL:
+			_, value, _ := decodeTTLValue(entry.Value)
+			return value, true
+		}
+		return entry.Value, true
+	}
+
+	if tx.snap != nil {
+		return tx.snap.Get(key)
+	}
+
+	tx.store.mu.RLock()
+	value, exists := tx.store.getLocked(key)
+	version := tx.store.versions[key]
+	tx.store.mu.RUnlock()
+
+	// Keep the first observed version so a change between two reads of the
+	// same key is still detected at commit
+	if _, seen := tx.reads[key]; !seen {
+		tx.reads[key] = version
+	}
+
+	if !exists {
+		return nil, false
+	}
+	return value, true
+}
+
+// Set buffers a write of key to value
+func (tx *Txn) Set(key string, value []byte) error {
+	if err := tx.checkWritable(); err != nil {
+		return err
+	}
+	tx.writes[key] = NewSetEntry(key, value)
+	return nil
+}
+
+// SetWithTTL buffers a write of key to value that expires after ttl
+func (tx *Txn) SetWithTTL(key string, value []byte, ttl time.Duration) error {
+	if err := tx.checkWritable(); err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	tx.writes[key] = NewSetWithTTLEntry(key, value, time.Now().Add(ttl).UnixNano())
+	return nil
+}
+
+// Delete buffers a removal of key
+func (tx *Txn) Delete(key string) error {
+	if err := tx.checkWritable(); err != nil {
+		return err
+	}
+	tx.writes[key] = NewDeleteEntry(key)
+	return nil
+}
+
+func (tx *Txn) checkWritable() error {
+	if tx.done {
+		return ErrTxnDone
+	}
+	if !tx.writable {
+		return ErrTxnReadOnly
+	}
+	return nil
+}
+
+// commit validates the read set and, if nothing changed, writes the buffered
+// operations as a single batch entry
+func (tx *Txn) commit() error {
+	tx.done = true
+
+	s := tx.store
+	_, err := s.commit(func() (*Entry, error) {
+		for key, version := range tx.reads {
+			if s.versions[key] != version {
+				return nil, ErrConflict
+			}
+		}
+
+		if len(tx.writes) == 0 {
+			return nil, nil
+		}
+
+		// Sort keys so the WAL record is deterministic
+		keys := make([]string, 0, len(tx.writes))
+		for key := range tx.writes {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		entries := make([]*Entry, 0, len(keys))
+		for _, key := range keys {
+			entries = append(entries, tx.writes[key])
+		}
+
+		entry, err := NewBatchEntry(entries)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build transaction batch: %w", err)
+		}
+		return entry, nil
+	})
+	return err
+}
+
+// Update runs fn in a read-write transaction and commits it
+// If a concurrent commit changed a key read by fn, fn is run again on fresh
+// data; after maxTxnAttempts conflicts ErrConflict is returned. fn may
+// therefore be called more than once and should not have side effects
+// outside the transaction. If fn returns an error nothing is written
+func (s *Store) Update(fn func(tx *Txn) error) error {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+
+	for attempt := 0; attempt < maxTxnAttempts; attempt++ {
+		tx := newTxn(s, true)
+		if err := fn(tx); err != nil {
+			tx.done = true
+			return err
+		}
+
+		err := tx.commit()
+		if errors.Is(err, ErrConflict) {
+			continue
+		}
+		return err
+	}
+
+	return ErrConflict
+}
+
+// View runs fn in a read-only transaction
+// Every read comes from a Snapshot pinned when View starts, so fn sees one
+// consistent state and never has to be retried
+func (s *Store) View(fn func(tx *Txn) error) error {
+	s.mu.Lock()
+	if err := s.checkOpenLocked(); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	snap := s.snapshotLocked()
+	s.mu.Unlock()
+	defer snap.Close()
+
+	tx := newTxn(s, false)
+	tx.snap = snap
+	defer func() { tx.done = true }()
+
+	return fn(tx)
+}
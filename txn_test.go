@@ -0,0 +1,346 @@
+package kvstore
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestTxnUpdateCommits tests that buffered writes are applied on commit
+func TestTxnUpdateCommits(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.Set("gone", []byte("x")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	err = store.Update(func(tx *Txn) error {
+		if err := tx.Set("key1", []byte("value1")); err != nil {
+			return err
+		}
+		if err := tx.Delete("gone"); err != nil {
+			return err
+		}
+
+		// Reads see the transaction's own writes
+		if value, ok := tx.Get("key1"); !ok || string(value) != "value1" {
+			t.Errorf("Expected own write to be visible, got %q (exists=%v)", value, ok)
+		}
+		if _, ok := tx.Get("gone"); ok {
+			t.Error("Expected own delete to be visible")
+		}
+
+		// Store is untouched until commit
+		if _, ok := store.Get("key1"); ok {
+			t.Error("key1 should not be visible before commit")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	if value, ok := store.Get("key1"); !ok || string(value) != "value1" {
+		t.Errorf("key1: got %q (exists=%v), want value1", value, ok)
+	}
+	if _, ok := store.Get("gone"); ok {
+		t.Error("gone should be deleted after commit")
+	}
+}
+
+// TestTxnUpdateError tests that nothing is written when fn fails
+func TestTxnUpdateError(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	errAbort := errors.New("abort")
+	err = store.Update(func(tx *Txn) error {
+		tx.Set("key", []byte("value"))
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("Expected errAbort, got %v", err)
+	}
+
+	if _, ok := store.Get("key"); ok {
+		t.Error("key should not exist after aborted transaction")
+	}
+}
+
+// TestTxnViewReadOnly tests that writes are rejected inside View
+func TestTxnViewReadOnly(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.Set("key", []byte("value")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	err = store.View(func(tx *Txn) error {
+		if value, ok := tx.Get("key"); !ok || string(value) != "value" {
+			t.Errorf("Expected value, got %q (exists=%v)", value, ok)
+		}
+		if err := tx.Set("key", []byte("other")); !errors.Is(err, ErrTxnReadOnly) {
+			t.Errorf("Expected ErrTxnReadOnly from Set, got %v", err)
+		}
+		if err := tx.Delete("key"); !errors.Is(err, ErrTxnReadOnly) {
+			t.Errorf("Expected ErrTxnReadOnly from Delete, got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("View failed: %v", err)
+	}
+}
+
+// TestTxnConflictRetries tests that a conflicting commit reruns fn
+func TestTxnConflictRetries(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.Set("counter", []byte("0")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	attempts := 0
+	err = store.Update(func(tx *Txn) error {
+		attempts++
+		value, _ := tx.Get("counter")
+
+		// Interfere on the first attempt only
+		if attempts == 1 {
+			if err := store.Set("counter", []byte("100")); err != nil {
+				t.Fatalf("Set failed: %v", err)
+			}
+		}
+
+		n, _ := strconv.Atoi(string(value))
+		return tx.Set("counter", []byte(strconv.Itoa(n+1)))
+	})
+	if err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	if attempts != 2 {
+		t.Errorf("Expected 2 attempts, got %d", attempts)
+	}
+	if value, _ := store.Get("counter"); string(value) != "101" {
+		t.Errorf("Expected counter 101, got %q", value)
+	}
+}
+
+// TestTxnConflictOnAbsentKey tests that creating a key read as absent conflicts
+func TestTxnConflictOnAbsentKey(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	tx := newTxn(store, true)
+	if _, ok := tx.Get("lock"); ok {
+		t.Fatal("lock should not exist yet")
+	}
+	tx.Set("lock", []byte("tx"))
+
+	if err := store.Set("lock", []byte("other")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	if err := tx.commit(); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Expected ErrConflict, got %v", err)
+	}
+	if value, _ := store.Get("lock"); string(value) != "other" {
+		t.Errorf("Expected lock held by other, got %q", value)
+	}
+
+	// A finished transaction rejects further writes
+	if err := tx.Set("lock", []byte("again")); !errors.Is(err, ErrTxnDone) {
+		t.Errorf("Expected ErrTxnDone, got %v", err)
+	}
+}
+
+// TestTxnConflictGivesUp tests that ErrConflict is returned after repeated conflicts
+func TestTxnConflictGivesUp(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := OpenWithConfig(Config{DataDir: dir, SyncWrites: false})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	attempts := 0
+	err = store.Update(func(tx *Txn) error {
+		attempts++
+		tx.Get("key")
+		store.Set("key", []byte(strconv.Itoa(attempts)))
+		return tx.Set("key", []byte("tx"))
+	})
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("Expected ErrConflict, got %v", err)
+	}
+	if attempts != maxTxnAttempts {
+		t.Errorf("Expected %d attempts, got %d", maxTxnAttempts, attempts)
+	}
+}
+
+// TestTxnConcurrentTransfers tests that concurrent transfers preserve the total
+func TestTxnConcurrentTransfers(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := OpenWithConfig(Config{DataDir: dir, SyncWrites: false})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	store.Set("a", []byte("1000"))
+	store.Set("b", []byte("1000"))
+
+	transfer := func(from, to string) error {
+		return store.Update(func(tx *Txn) error {
+			fromValue, _ := tx.Get(from)
+			toValue, _ := tx.Get(to)
+			f, _ := strconv.Atoi(string(fromValue))
+			g, _ := strconv.Atoi(string(toValue))
+			if err := tx.Set(from, []byte(strconv.Itoa(f-1))); err != nil {
+				return err
+			}
+			return tx.Set(to, []byte(strconv.Itoa(g+1)))
+		})
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				from, to := "a", "b"
+				if n%2 == 0 {
+					from, to = to, from
+				}
+				if err := transfer(from, to); err != nil && !errors.Is(err, ErrConflict) {
+					t.Errorf("transfer failed: %v", err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var total int
+	err = store.View(func(tx *Txn) error {
+		a, _ := tx.Get("a")
+		b, _ := tx.Get("b")
+		x, _ := strconv.Atoi(string(a))
+		y, _ := strconv.Atoi(string(b))
+		total = x + y
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("View failed: %v", err)
+	}
+	if total != 2000 {
+		t.Errorf("Expected total 2000, got %d", total)
+	}
+}
+
+// TestTxnRecoveryAfterCrash tests that a committed transaction is replayed
+func TestTxnRecoveryAfterCrash(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store1, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	err = store1.Update(func(tx *Txn) error {
+		tx.Set("x", []byte("1"))
+		tx.Set("y", []byte("2"))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	// DON'T call Close() - simulate crash
+	simulateCrash(store1)
+
+	store2, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open (after crash) failed: %v", err)
+	}
+	defer store2.Close()
+
+	if store2.Len() != 2 {
+		t.Errorf("Expected 2 keys after recovery, got %d", store2.Len())
+	}
+}
+
+// TestTxnSetWithTTL tests that TTL writes are visible inside the transaction
+// and expire after commit
+func TestTxnSetWithTTL(t *testing.T) {
+	store, err := OpenWithConfig(Config{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	err = store.Update(func(tx *Txn) error {
+		if err := tx.SetWithTTL("temp", []byte("value"), 0); err != ErrInvalidTTL {
+			t.Errorf("Expected ErrInvalidTTL, got %v", err)
+		}
+		if err := tx.SetWithTTL("temp", []byte("value"), 50*time.Millisecond); err != nil {
+			return err
+		}
+		if value, ok := tx.Get("temp"); !ok || string(value) != "value" {
+			t.Errorf("Expected own TTL write to be visible, got %q (exists=%v)", value, ok)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	if _, ok := store.TTL("temp"); !ok {
+		t.Error("temp should have a TTL after commit")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := store.Get("temp"); ok {
+		t.Error("temp should have expired")
+	}
+}
@@ -0,0 +1,240 @@
+package kvstore
+
+import (
+	"iter"
+	"sort"
+	"time"
+)
+
+// Snapshot is a read-only, point-in-time view of a Store
+//
+// Writers keep running while a snapshot is open. Before a key is modified for
+// the first time after the snapshot was taken, its previous state is copied
+// into the snapshot (copy-on-write), so reads through the snapshot always see
+// the data as of the moment it was pinned. Memory held by a snapshot grows
+// with the number of distinct keys written while it is open; call Close as
+// soon as it is no longer needed
+type Snapshot struct {
+	store     *Store
+	seq       uint64 // LSN the view is pinned at
+	at        int64  // pin time (unix nanoseconds), used for expiry decisions
+	length    int
+	preserved map[string]preservedValue // guarded by store.mu
+	closed    bool                      // guarded by store.mu
+}
+
+// preservedValue is the state of a key at the time a snapshot was pinned
+type preservedValue struct {
+	value     []byte
+	exists    bool
+	expiresAt int64
+}
+
+// record is a key visible in a snapshot with its value and expiry deadline
+type record struct {
+	key       string
+	value     []byte
+	expiresAt int64
+}
+
+// Snapshot pins a consistent read-only view of the store
+// The returned snapshot must be released with Close. Once the store is
+// closed it returns a closed snapshot, which finds nothing
+func (s *Store) Snapshot() *Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state != stateOpen {
+		return &Snapshot{store: s, closed: true}
+	}
+	return s.snapshotLocked()
+}
+
+// snapshotLocked pins a snapshot at the current sequence number
+// Caller must hold s.mu
+func (s *Store) snapshotLocked() *Snapshot {
+	now := time.Now().UnixNano()
+	length := len(s.data)
+	for _, expiresAt := range s.expiries {
+		if isExpired(expiresAt, now) {
+			length--
+		}
+	}
+
+	snap := &Snapshot{
+		store:     s,
+		seq:       s.seq,
+		at:        now,
+		length:    length,
+		preserved: make(map[string]preservedValue),
+	}
+	s.snapshots[snap] = struct{}{}
+
+	return snap
+}
+
+// preserve copies the current state of key into every open snapshot that has
+// not preserved it yet. Called before key is modified
+// Caller must hold s.mu
+func (s *Store) preserve(key string) {
+	if len(s.snapshots) == 0 {
+		return
+	}
+
+	value, exists := s.data[key]
+	state := preservedValue{value: value, exists: exists, expiresAt: s.expiries[key]}
+
+	for snap := range s.snapshots {
+		if _, done := snap.preserved[key]; !done {
+			snap.preserved[key] = state
+		}
+	}
+}
+
+// Seq returns the sequence number the snapshot is pinned at, which is the
+// LSN of the last WAL entry it reflects
+func (snap *Snapshot) Seq() uint64 {
+	return snap.seq
+}
+
+// Len returns the number of keys visible in the snapshot
+func (snap *Snapshot) Len() int {
+	return snap.length
+}
+
+// Get retrieves a value as of the moment the snapshot was taken
+// A closed snapshot returns (nil, false)
+func (snap *Snapshot) Get(key string) ([]byte, bool) {
+	snap.store.mu.RLock()
+	defer snap.store.mu.RUnlock()
+
+	if snap.closed {
+		return nil, false
+	}
+
+	state, visible := snap.resolveLocked(key)
+	if !visible {
+		return nil, false
+	}
+	return state.value, true
+}
+
+// resolveLocked returns the state of key from the preserved copy or, if it was
+// not modified since the snapshot was taken, from the live store, and whether
+// the key is visible in the snapshot
+// Caller must hold snap.store.mu
+func (snap *Snapshot) resolveLocked(key string) (preservedValue, bool) {
+	state, ok := snap.preserved[key]
+	if !ok {
+		value, exists := snap.store.data[key]
+		state = preservedValue{value: value, exists: exists, expiresAt: snap.store.expiries[key]}
+	}
+
+	return state, state.exists && !isExpired(state.expiresAt, snap.at)
+}
+
+// All returns an iterator over every pair in the snapshot in ascending key order
+// Unlike Store.All the result is a consistent point-in-time view
+func (snap *Snapshot) All() iter.Seq2[string, []byte] {
+	return snap.Range("", "")
+}
+
+// Prefix returns an iterator over the pairs in the snapshot whose key starts
+// with prefix
+func (snap *Snapshot) Prefix(prefix string) iter.Seq2[string, []byte] {
+	return snap.Range(PrefixRange(prefix))
+}
+
+// Range returns an iterator over the pairs in the snapshot with lo <= key < hi
+// An empty hi means no upper bound
+func (snap *Snapshot) Range(lo, hi string) iter.Seq2[string, []byte] {
+	return func(yield func(string, []byte) bool) {
+		for rec := range snap.records(lo, hi) {
+			if !yield(rec.key, rec.value) {
+				return
+			}
+		}
+	}
+}
+
+// records iterates the visible keys with lo <= key < hi including their
+// expiry deadline
+func (snap *Snapshot) records(lo, hi string) iter.Seq[record] {
+	return func(yield func(record) bool) {
+		cursor := lo
+		for {
+			recs, next, done := snap.readBatch(cursor, hi)
+
+			for _, rec := range recs {
+				if !yield(rec) {
+					return
+				}
+			}
+
+			if done {
+				return
+			}
+			cursor = next
+		}
+	}
+}
+
+// readBatch reads the visible records in [cursor, bound) where bound is chosen
+// so at most iterBatchSize live keys are visited
+// Returns the records, the next cursor and whether hi was reached
+func (snap *Snapshot) readBatch(cursor, hi string) ([]record, string, bool) {
+	s := snap.store
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if snap.closed {
+		return nil, "", true
+	}
+
+	// Live keys currently in the index
+	var candidates []string
+	node := s.index.seekGE(cursor)
+	for ; node != nil && (hi == "" || node.key < hi) && len(candidates) < iterBatchSize; node = node.next[0] {
+		candidates = append(candidates, node.key)
+	}
+
+	bound, done := hi, true
+	if len(candidates) == iterBatchSize && node != nil && (hi == "" || node.key < hi) {
+		bound, done = candidates[len(candidates)-1]+"\x00", false
+	}
+
+	// Keys deleted since the snapshot are no longer in the index
+	for key, state := range snap.preserved {
+		if !state.exists || key < cursor || (bound != "" && key >= bound) {
+			continue
+		}
+		if _, live := s.data[key]; !live {
+			candidates = append(candidates, key)
+		}
+	}
+	sort.Strings(candidates)
+
+	recs := make([]record, 0, len(candidates))
+	for _, key := range candidates {
+		if state, visible := snap.resolveLocked(key); visible {
+			recs = append(recs, record{key: key, value: state.value, expiresAt: state.expiresAt})
+		}
+	}
+
+	return recs, bound, done
+}
+
+// Close releases the snapshot and the values preserved for it
+// Calling Close more than once is a no-op
+func (snap *Snapshot) Close() {
+	s := snap.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if snap.closed {
+		return
+	}
+	snap.closed = true
+	snap.preserved = nil
+	delete(s.snapshots, snap)
+}
@@ -0,0 +1,188 @@
+package kvstore
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestSnapshotViewIsolation tests that writes after pinning are invisible
+func TestSnapshotViewIsolation(t *testing.T) {
+	store, err := OpenWithConfig(Config{DataDir: t.TempDir(), SyncWrites: false})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	store.Set("changed", []byte("old"))
+	store.Set("deleted", []byte("here"))
+	store.Set("stable", []byte("same"))
+
+	snap := store.Snapshot()
+	defer snap.Close()
+
+	store.Set("changed", []byte("new"))
+	store.Set("changed", []byte("newer"))
+	store.Delete("deleted")
+	store.Set("added", []byte("later"))
+
+	if value, ok := snap.Get("changed"); !ok || string(value) != "old" {
+		t.Errorf("changed: got %q (exists=%v), want old", value, ok)
+	}
+	if value, ok := snap.Get("deleted"); !ok || string(value) != "here" {
+		t.Errorf("deleted: got %q (exists=%v), want here", value, ok)
+	}
+	if value, ok := snap.Get("stable"); !ok || string(value) != "same" {
+		t.Errorf("stable: got %q (exists=%v), want same", value, ok)
+	}
+	if _, ok := snap.Get("added"); ok {
+		t.Error("added should not be visible in the snapshot")
+	}
+	if snap.Len() != 3 {
+		t.Errorf("Expected snapshot Len 3, got %d", snap.Len())
+	}
+
+	// The live store sees the new state
+	if value, _ := store.Get("changed"); string(value) != "newer" {
+		t.Errorf("Live changed: got %q, want newer", value)
+	}
+}
+
+// TestSnapshotViewIterate tests that iteration merges deleted and live keys
+func TestSnapshotViewIterate(t *testing.T) {
+	store, err := OpenWithConfig(Config{DataDir: t.TempDir(), SyncWrites: false})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	const n = iterBatchSize*2 + 10
+	var want []string
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key-%04d", i)
+		store.Set(key, []byte(key))
+		want = append(want, key)
+	}
+
+	snap := store.Snapshot()
+	defer snap.Close()
+
+	// Delete every third key and add new ones in between
+	for i := 0; i < n; i += 3 {
+		store.Delete(fmt.Sprintf("key-%04d", i))
+		store.Set(fmt.Sprintf("key-%04d-new", i), []byte("x"))
+	}
+
+	var got []string
+	for key, value := range snap.All() {
+		if string(value) != key {
+			t.Errorf("Value for %s: got %q", key, value)
+		}
+		got = append(got, key)
+	}
+
+	if !slices.Equal(got, want) {
+		t.Errorf("Snapshot iteration mismatch: got %d keys, want %d", len(got), len(want))
+	}
+
+	var prefixed []string
+	for key := range snap.Prefix("key-000") {
+		prefixed = append(prefixed, key)
+	}
+	if !slices.Equal(prefixed, want[:10]) {
+		t.Errorf("Prefix: got %v, want %v", prefixed, want[:10])
+	}
+}
+
+// TestSnapshotViewExpiry tests that expiry is evaluated at the pin time
+func TestSnapshotViewExpiry(t *testing.T) {
+	store, err := OpenWithConfig(Config{DataDir: t.TempDir(), SyncWrites: false, ExpireInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	store.SetWithTTL("session", []byte("v"), 20*time.Millisecond)
+
+	snap := store.Snapshot()
+	defer snap.Close()
+
+	time.Sleep(30 * time.Millisecond)
+	store.reapExpired()
+
+	if _, ok := store.Get("session"); ok {
+		t.Error("session should be expired in the live store")
+	}
+	if _, ok := snap.Get("session"); !ok {
+		t.Error("session should still be visible in the snapshot")
+	}
+}
+
+// TestSnapshotViewClose tests that closing releases the snapshot
+func TestSnapshotViewClose(t *testing.T) {
+	store, err := OpenWithConfig(Config{DataDir: t.TempDir(), SyncWrites: false})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	store.Set("key", []byte("v"))
+
+	snap := store.Snapshot()
+	seq := snap.Seq()
+	snap.Close()
+	snap.Close() // idempotent
+
+	if len(store.snapshots) != 0 {
+		t.Errorf("Expected no open snapshots, got %d", len(store.snapshots))
+	}
+
+	store.Set("key", []byte("v2"))
+	if _, ok := snap.Get("key"); ok {
+		t.Error("Closed snapshot should not return values")
+	}
+
+	snap2 := store.Snapshot()
+	defer snap2.Close()
+	if snap2.Seq() <= seq {
+		t.Errorf("Expected later snapshot to have a higher seq: %d <= %d", snap2.Seq(), seq)
+	}
+}
+
+// TestViewUsesSnapshot tests that View reads one consistent state
+func TestViewUsesSnapshot(t *testing.T) {
+	store, err := OpenWithConfig(Config{DataDir: t.TempDir(), SyncWrites: false})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	store.Set("a", []byte("1"))
+	store.Set("b", []byte("1"))
+
+	calls := 0
+	err = store.View(func(tx *Txn) error {
+		calls++
+		a, _ := tx.Get("a")
+
+		// A concurrent writer changes both keys mid-transaction
+		store.Batch(func(b *WriteBatch) error {
+			b.Put("a", []byte("2"))
+			b.Put("b", []byte("2"))
+			return nil
+		})
+
+		b, _ := tx.Get("b")
+		if string(a) != string(b) {
+			t.Errorf("View saw inconsistent state: a=%s b=%s", a, b)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("View failed: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("Expected View to run once, got %d", calls)
+	}
+}
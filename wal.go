@@ -1,122 +1,760 @@
 package kvstore
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
+)
+
+// defaultMaxSegmentBytes is the size at which the active WAL segment is sealed
+// and a new one started when no other limit is configured
+const defaultMaxSegmentBytes = 16 << 20
+
+const (
+	segmentPrefix = "wal-"
+	segmentSuffix = ".log"
+
+	// legacyWALFilename is the single log file used before segmentation
+	legacyWALFilename = "wal.log"
 )
 
 // WAL represents a Write-Ahead Log for durability
+//
+// The log is split into segment files named wal-<first LSN>.log. Appends go to
+// the last (active) segment; once it reaches maxSegmentBytes it is sealed and
+// a new segment is started. Every entry gets a log sequence number (LSN) one
+// higher than the previous one, so whole segments can be dropped once a
+// snapshot covers them
+//
+// Appends are group committed: entries from concurrent writers are queued in
+// memory and whichever writer finds no flush in progress writes (and, in sync
+// mode, fsyncs) everything queued so far in one go while the others wait for it
 type WAL struct {
-	file     *os.File
+	file     *os.File // active segment
 	mu       sync.Mutex
 	dataDir  string
 	syncMode bool
+	size     int64 // bytes in all segments
+
+	segments        []segment // ordered by firstLSN, the last one is active
+	lastLSN         uint64    // LSN of the last appended entry
+	maxSegmentBytes int64
+
+	// Group commit
+	flushed  *sync.Cond   // broadcast when a flush finishes, uses mu
+	pending  bytes.Buffer // encoded entries not written to the file yet
+	durable  uint64       // LSN of the last entry written (and synced in sync mode)
+	flushing bool         // a writer is writing pending outside mu
+	err      error        // first write or sync failure, fails all later appends
+
+	// advanced is closed and replaced whenever durable moves, so readers
+	// tailing the log can wait for new entries without holding mu
+	advanced chan struct{}
+
+	// readOnly logs are only read: appends fail with ErrReadOnly, there is no
+	// active segment and recovery leaves the files as they are
+	readOnly bool
+
+	logger  *slog.Logger
+	metrics Metrics
+}
+
+// errEntriesRemoved is returned when tailing the log from an LSN whose
+// entries are no longer (or not yet) in the segments
+var errEntriesRemoved = errors.New("WAL does not hold the requested entries")
+
+// segment is one WAL file holding the entries from firstLSN onwards
+type segment struct {
+	firstLSN uint64
+	path     string
+	size     int64
 }
 
 // NewWAL creates or opens a Write-Ahead Log in the specified directory
 func NewWAL(dataDir string, syncMode bool) (*WAL, error) {
+	return openWAL(dataDir, syncMode, false)
+}
+
+// openWAL opens a WAL, read-only if readOnly: the directory must then exist
+// and no file is created, renamed or removed
+func openWAL(dataDir string, syncMode, readOnly bool) (*WAL, error) {
 	// Create directory if it doesn't exist
-	if err := os.MkdirAll(dataDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	if !readOnly {
+		if err := os.MkdirAll(dataDir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create data directory: %w", err)
+		}
 	}
 
-	// Open or create WAL file
-	walPath := filepath.Join(dataDir, "wal.log")
-	file, err := os.OpenFile(walPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	segments, err := listSegments(dataDir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open WAL file: %w", err)
+		return nil, err
+	}
+
+	// A log from before segmentation becomes the first segment, read in
+	// place when the log is read-only
+	if len(segments) == 0 {
+		legacyPath := filepath.Join(dataDir, legacyWALFilename)
+		if info, err := os.Stat(legacyPath); err == nil {
+			seg := segment{firstLSN: 1, path: segmentPath(dataDir, 1), size: info.Size()}
+			if readOnly {
+				seg.path = legacyPath
+			} else if err := os.Rename(legacyPath, seg.path); err != nil {
+				return nil, fmt.Errorf("failed to migrate legacy WAL: %w", err)
+			}
+			segments = append(segments, seg)
+		}
+	}
+
+	w := &WAL{
+		dataDir:         dataDir,
+		syncMode:        syncMode,
+		segments:        segments,
+		maxSegmentBytes: defaultMaxSegmentBytes,
+		readOnly:        readOnly,
+		logger:          slog.Default(),
+		metrics:         nopMetrics{},
+	}
+	w.flushed = sync.NewCond(&w.mu)
+	w.advanced = make(chan struct{})
+	for _, seg := range segments {
+		w.size += seg.size
+	}
+
+	// Find where the log ends. An empty last segment is reused, otherwise
+	// appends start in a fresh segment so they never land behind a torn tail
+	if len(segments) > 0 {
+		last := segments[len(segments)-1]
+		if last.size == 0 {
+			w.lastLSN = last.firstLSN - 1
+			w.segments = segments[:len(segments)-1]
+		} else {
+			w.lastLSN, _, err = scanSegment(last, nil)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	return &WAL{
-		file:     file,
-		dataDir:  dataDir,
-		syncMode: syncMode,
-	}, nil
+	w.durable = w.lastLSN
+
+	if readOnly {
+		return w, nil
+	}
+	if err := w.openSegmentLocked(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
 }
 
-// Append writes an entry to the WAL
+// segmentPath returns the path of the segment starting at firstLSN
+func segmentPath(dataDir string, firstLSN uint64) string {
+	return filepath.Join(dataDir, fmt.Sprintf("%s%020d%s", segmentPrefix, firstLSN, segmentSuffix))
+}
+
+// listSegments returns the segment files in dataDir ordered by first LSN
+func listSegments(dataDir string) ([]segment, error) {
+	entries, err := os.ReadDir(dataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list WAL segments: %w", err)
+	}
+
+	var segments []segment
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+
+		firstLSN, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix), 10, 64)
+		if err != nil || firstLSN == 0 {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat WAL segment %s: %w", name, err)
+		}
+
+		segments = append(segments, segment{
+			firstLSN: firstLSN,
+			path:     filepath.Join(dataDir, name),
+			size:     info.Size(),
+		})
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].firstLSN < segments[j].firstLSN
+	})
+
+	return segments, nil
+}
+
+// openSegmentLocked creates the segment for the next LSN and makes it active
+// Caller must hold w.mu (or be the only goroutine, as in NewWAL)
+func (w *WAL) openSegmentLocked() error {
+	seg := segment{firstLSN: w.lastLSN + 1, path: segmentPath(w.dataDir, w.lastLSN+1)}
+
+	file, err := os.OpenFile(seg.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open WAL segment: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat WAL segment: %w", err)
+	}
+	seg.size = info.Size()
+
+	w.file = file
+	w.segments = append(w.segments, seg)
+	w.size += seg.size
+
+	return nil
+}
+
+// active returns the segment appends currently go to
+func (w *WAL) active() *segment {
+	return &w.segments[len(w.segments)-1]
+}
+
+// Append writes an entry to the WAL and returns once it is durable
+// An entry without an LSN is assigned the next one; an entry that already
+// carries an LSN (e.g. received from a leader) must be the next one in order
 func (w *WAL) Append(entry *Entry) error {
+	if err := w.enqueue(entry); err != nil {
+		return err
+	}
+	return w.WaitDurable(entry.LSN)
+}
+
+// enqueue assigns the entry its LSN and queues it for the next flush
+// The entry is not on disk until WaitDurable(entry.LSN) returns
+func (w *WAL) enqueue(entry *Entry) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	// Encode entry to in-memory buffer first (atomic write preparation)
-	var buf bytes.Buffer
-	if err := entry.Encode(&buf); err != nil {
+	if w.readOnly {
+		return ErrReadOnly
+	}
+	if w.err != nil {
+		return w.err
+	}
+
+	assigned := entry.LSN == 0
+	if assigned {
+		entry.LSN = w.lastLSN + 1
+	} else if entry.LSN != w.lastLSN+1 {
+		return fmt.Errorf("%w: expected %d, got %d", ErrUnexpectedLSN, w.lastLSN+1, entry.LSN)
+	}
+
+	// Encode straight into the queue; a failed encode must not leave a
+	// partial entry behind
+	mark := w.pending.Len()
+	if err := entry.Encode(&w.pending); err != nil {
+		w.pending.Truncate(mark)
+		if assigned {
+			entry.LSN = 0
+		}
 		return fmt.Errorf("failed to encode entry: %w", err)
 	}
+	w.lastLSN = entry.LSN
 
-	// Write buffer to file atomically
-	if _, err := w.file.Write(buf.Bytes()); err != nil {
-		return fmt.Errorf("failed to write to WAL: %w", err)
+	return nil
+}
+
+// WaitDurable blocks until every entry up to lsn has been written to the
+// active segment and, in sync mode, fsynced
+// If no flush is in progress the caller performs one for everything queued
+func (w *WAL) WaitDurable(lsn uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if lsn > w.lastLSN {
+		return fmt.Errorf("LSN %d has not been appended (last is %d)", lsn, w.lastLSN)
 	}
 
-	// Sync to disk if configured
-	if w.syncMode {
-		if err := w.file.Sync(); err != nil {
-			return fmt.Errorf("failed to sync WAL: %w", err)
+	for w.durable < lsn {
+		if w.err != nil {
+			return w.err
+		}
+		if w.flushing {
+			w.flushed.Wait()
+			continue
 		}
+		w.flushLocked()
 	}
 
 	return nil
 }
 
+// flushLocked writes the queued entries to the active segment
+// w.mu is released during the write and sync so other writers can queue
+// the next group meanwhile
+// Caller must hold w.mu and no flush may be in progress
+func (w *WAL) flushLocked() {
+	if w.pending.Len() == 0 {
+		return
+	}
+
+	// Let writers that are about to queue join this group; with a sync
+	// in flight they wait for the next one otherwise
+	w.flushing = true
+	w.mu.Unlock()
+	if w.syncMode {
+		runtime.Gosched()
+	}
+	w.mu.Lock()
+
+	data := w.pending.Bytes()
+	w.pending = bytes.Buffer{}
+	upto := w.lastLSN
+	file := w.file
+	w.mu.Unlock()
+
+	// Write buffer to file atomically
+	n, err := file.Write(data)
+	if err != nil {
+		err = fmt.Errorf("failed to write to WAL: %w", err)
+	} else if w.syncMode {
+		// Sync to disk if configured
+		started := time.Now()
+		if syncErr := file.Sync(); syncErr != nil {
+			err = fmt.Errorf("failed to sync WAL: %w", syncErr)
+		}
+		w.metrics.Observe(MetricFsyncSeconds, time.Since(started).Seconds())
+	}
+
+	w.mu.Lock()
+	w.flushing = false
+	defer w.flushed.Broadcast()
+
+	w.active().size += int64(n)
+	w.size += int64(n)
+	w.metrics.Count(MetricWALWrittenBytes, int64(n))
+	w.metrics.Gauge(MetricWALBytes, float64(w.size))
+	if err != nil {
+		w.err = err
+		w.advanceLocked()
+		return
+	}
+	w.durable = upto
+	w.advanceLocked()
+
+	if w.active().size >= w.maxSegmentBytes {
+		if err := w.rotateLocked(); err != nil {
+			w.err = fmt.Errorf("failed to rotate WAL: %w", err)
+		}
+	}
+}
+
+// drainLocked waits for a flush in progress and writes whatever is queued,
+// so the files hold every appended entry
+// Caller must hold w.mu
+func (w *WAL) drainLocked() error {
+	for w.flushing || w.pending.Len() > 0 {
+		if w.err != nil {
+			return w.err
+		}
+		if w.flushing {
+			w.flushed.Wait()
+			continue
+		}
+		w.flushLocked()
+	}
+
+	return w.err
+}
+
+// Rotate seals the active segment and starts a new one, so every entry
+// appended so far is in a sealed segment. It is a no-op if the active
+// segment is empty
+func (w *WAL) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.readOnly {
+		return ErrReadOnly
+	}
+	if err := w.drainLocked(); err != nil {
+		return err
+	}
+	return w.rotateLocked()
+}
+
+// rotateLocked implements Rotate
+// Caller must hold w.mu and nothing may be queued
+func (w *WAL) rotateLocked() error {
+	if w.active().size == 0 {
+		return nil
+	}
+
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync WAL segment: %w", err)
+	}
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("failed to close WAL segment: %w", err)
+	}
+
+	return w.openSegmentLocked()
+}
+
 // Replay reads all entries from the WAL and calls the callback for each valid entry
 // Stops at first corrupted entry (partial recovery)
 // Skips unknown operation codes (forward compatibility)
 func (w *WAL) Replay(callback func(*Entry) error) error {
+	return w.ReplayFrom(0, callback)
+}
+
+// ReplayFrom is like Replay but only calls callback for entries with
+// LSN >= from. Segments holding only older entries are not read
+//
+// from > 0 means everything before it is covered by a snapshot: a log that
+// starts after from is missing entries, and a log that ends before it is
+// replaced by an empty one so appends continue after the snapshot
+//
+// When entries are lost to corruption, the segments after the damage are
+// renamed to *.corrupt and appends continue after the last valid entry, so
+// the log stays contiguous
+func (w *WAL) ReplayFrom(from uint64, callback func(*Entry) error) error {
+	return w.replay(from, callback, &RecoveryReport{})
+}
+
+// replay implements ReplayFrom, counting what it does in report
+func (w *WAL) replay(from uint64, callback func(*Entry) error, report *RecoveryReport) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	// Seek to beginning of file
-	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
-		return fmt.Errorf("failed to seek to start of WAL: %w", err)
+	if err := w.drainLocked(); err != nil {
+		return err
 	}
 
+	fn := func(entry *Entry) error {
+		if entry.LSN < from {
+			return nil
+		}
+
+		// Skip unknown operations (forward compatibility)
+		if !isKnownOperation(entry.Operation) {
+			w.logger.Warn("WAL replay: skipping entry with unknown operation", "lsn", entry.LSN, "op", entry.Operation)
+			report.Skipped++
+			return nil
+		}
+
+		// Call callback with entry
+		if err := callback(entry); err != nil {
+			return fmt.Errorf("callback failed during replay: %w", err)
+		}
+		report.Replayed++
+		return nil
+	}
+
+	var last uint64
+	started := false
+	for i, seg := range w.segments {
+		// Every entry of this segment is older than from
+		if i+1 < len(w.segments) && w.segments[i+1].firstLSN <= from {
+			continue
+		}
+
+		if (started && seg.firstLSN != last+1) || (!started && from > 0 && seg.firstLSN > from) {
+			expected := last + 1
+			if !started {
+				expected = from
+			}
+			for _, seg := range w.segments[i:] {
+				if seg.size > 0 && !w.readOnly {
+					report.SetAside = append(report.SetAside, filepath.Base(seg.path)+".corrupt")
+					report.DiscardedBytes += seg.size
+				}
+			}
+			w.logger.Error("WAL replay: entries missing, setting aside the rest of the log",
+				"from_lsn", expected, "next_segment_lsn", seg.firstLSN, "segments", len(w.segments)-i)
+			return w.discardFromLocked(i, expected-1)
+		}
+
+		segLast, stop, err := scanSegment(seg, fn)
+		if err != nil {
+			return err
+		}
+		if stop != nil {
+			// A torn tail is harmless if the next segment continues after it
+			attrs := []any{"file", filepath.Base(seg.path), "last_lsn", segLast, "err", stop}
+			var cerr *CorruptionError
+			if errors.As(stop, &cerr) {
+				discarded := seg.size - cerr.Offset
+				report.DiscardedBytes += discarded
+				attrs = append(attrs, "offset", cerr.Offset, "discarded_bytes", discarded)
+			}
+			report.Corruption = append(report.Corruption, stop)
+			w.logger.Warn("WAL replay: corruption detected, skipping the rest of the segment", attrs...)
+		}
+		last, started = segLast, true
+	}
+
+	// The whole log is covered by the snapshot
+	if from > 0 && w.lastLSN < from-1 {
+		return w.resetLocked(from - 1)
+	}
+
+	return nil
+}
+
+// scanSegment decodes the entries of a segment in order and calls fn (if not
+// nil) for each. Entries from a v1 log have no LSN and are numbered in order
+// Returns the LSN of the last valid entry, the reason decoding stopped early
+// (nil at a clean end of file, a *CorruptionError for damaged data) and any
+// error from opening the file or fn
+func scanSegment(seg segment, fn func(*Entry) error) (uint64, error, error) {
+	file, err := os.Open(seg.path)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to open WAL segment: %w", err)
+	}
+	defer file.Close()
+
+	br := bufio.NewReader(file)
+	r := &countingReader{r: br}
+	last := seg.firstLSN - 1
+
 	for {
-		entry, err := DecodeEntry(w.file)
+		// EOF before an entry starts is the normal end of the segment
+		if _, err := br.Peek(1); err == io.EOF {
+			return last, nil, nil
+		}
+
+		start := r.n
+		entry, err := DecodeEntry(r)
+		if err == nil && entry.LSN == 0 {
+			entry.LSN = last + 1
+		} else if err == nil && entry.LSN != last+1 {
+			err = fmt.Errorf("%w: expected %d, got %d", ErrUnexpectedLSN, last+1, entry.LSN)
+		}
 		if err != nil {
-			// EOF is normal - end of valid entries
-			if err == io.EOF {
-				break
+			if isCorruption(err) {
+				err = &CorruptionError{File: filepath.Base(seg.path), Offset: start, Index: -1, LSN: last + 1, Err: err}
 			}
+			return last, err, nil
+		}
+		last = entry.LSN
 
-			// Checksum mismatch means corruption - stop replay (partial recovery)
-			if strings.Contains(err.Error(), "checksum mismatch") {
-				// Log warning but don't return error - allow partial recovery
-				fmt.Fprintf(os.Stderr, "WAL replay: corruption detected, stopping at corrupted entry: %v\n", err)
-				break
+		if fn != nil {
+			if err := fn(entry); err != nil {
+				return last, nil, err
 			}
+		}
+	}
+}
+
+// walTail reads durable entries from the segment files in LSN order while
+// the log keeps growing, following rotations. It is used to ship the log to
+// followers
+type walTail struct {
+	wal  *WAL
+	next uint64 // LSN of the next entry to return
+
+	file *os.File
+	r    *bufio.Reader
+	last uint64 // LSN of the last entry decoded from file
+}
+
+// tail returns a reader starting at LSN from. It fails with errEntriesRemoved
+// if a checkpoint already removed that entry or from is past the end of the
+// log by more than one
+func (w *WAL) tail(from uint64) (*walTail, error) {
+	if from == 0 {
+		from = 1
+	}
+
+	t := &walTail{wal: w, next: from}
+	if err := t.open(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
 
-			// Other errors (like truncated entry) also stop replay
-			if strings.Contains(err.Error(), "failed to read") {
-				fmt.Fprintf(os.Stderr, "WAL replay: incomplete entry detected, stopping: %v\n", err)
-				break
+// open opens the segment holding t.next
+func (t *walTail) open() error {
+	w := t.wal
+	w.mu.Lock()
+	if len(w.segments) == 0 || t.next > w.lastLSN+1 || t.next < w.segments[0].firstLSN {
+		w.mu.Unlock()
+		return errEntriesRemoved
+	}
+	i := sort.Search(len(w.segments), func(i int) bool {
+		return w.segments[i].firstLSN > t.next
+	}) - 1
+	seg := w.segments[i]
+	w.mu.Unlock()
+
+	// A checkpoint may remove the segment right after it was looked up
+	file, err := os.Open(seg.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return errEntriesRemoved
+	} else if err != nil {
+		return fmt.Errorf("failed to open WAL segment: %w", err)
+	}
+
+	t.close()
+	t.file = file
+	t.r = bufio.NewReader(file)
+	t.last = seg.firstLSN - 1
+
+	return nil
+}
+
+// read calls fn for every entry from t.next up to and including upto, which
+// must not be past the durable LSN
+func (t *walTail) read(upto uint64, fn func(*Entry) error) error {
+	for t.next <= upto {
+		// The segment is complete, the next entry starts a new one
+		if _, err := t.r.Peek(1); err == io.EOF {
+			if err := t.open(); err != nil {
+				return err
+			}
+			if t.last+1 != t.next {
+				return fmt.Errorf("%w: WAL segment starts at %d, expected %d", ErrUnexpectedLSN, t.last+1, t.next)
 			}
+			continue
+		}
 
-			// Unexpected error
-			return fmt.Errorf("failed to decode WAL entry: %w", err)
+		entry, err := DecodeEntry(t.r)
+		if err != nil {
+			return fmt.Errorf("failed to read WAL entry %d: %w", t.last+1, err)
 		}
 
-		// Skip unknown operations (forward compatibility)
-		if entry.Operation != OpSet && entry.Operation != OpDelete {
-			fmt.Fprintf(os.Stderr, "WAL replay: unknown operation code 0x%X, skipping entry\n", entry.Operation)
+		if entry.LSN == 0 {
+			entry.LSN = t.last + 1
+		} else if entry.LSN != t.last+1 {
+			return fmt.Errorf("%w: expected %d, got %d", ErrUnexpectedLSN, t.last+1, entry.LSN)
+		}
+		t.last = entry.LSN
+
+		// Entries before the starting point in its segment
+		if entry.LSN < t.next {
 			continue
 		}
 
-		// Call callback with entry
-		if err := callback(entry); err != nil {
-			return fmt.Errorf("callback failed during replay: %w", err)
+		t.next++
+		if err := fn(entry); err != nil {
+			return err
 		}
 	}
 
-	// Seek to end of file for new appends
-	if _, err := w.file.Seek(0, io.SeekEnd); err != nil {
-		return fmt.Errorf("failed to seek to end of WAL: %w", err)
+	return nil
+}
+
+// close releases the open segment
+func (t *walTail) close() {
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+}
+
+// discardFromLocked sets aside the segments from index i on, which can no
+// longer be replayed in order, and continues the log after lastLSN
+// Caller must hold w.mu
+func (w *WAL) discardFromLocked(i int, lastLSN uint64) error {
+	if !w.readOnly {
+		if err := w.file.Close(); err != nil {
+			return fmt.Errorf("failed to close WAL segment: %w", err)
+		}
+	}
+
+	for _, seg := range w.segments[i:] {
+		w.size -= seg.size
+		if w.readOnly {
+			continue
+		}
+		if seg.size == 0 {
+			os.Remove(seg.path)
+			continue
+		}
+		if err := os.Rename(seg.path, seg.path+".corrupt"); err != nil {
+			return fmt.Errorf("failed to set aside WAL segment: %w", err)
+		}
+	}
+	w.segments = w.segments[:i]
+	w.lastLSN = lastLSN
+	w.durable = lastLSN
+	w.advanceLocked()
+
+	if w.readOnly {
+		return nil
+	}
+	return w.openSegmentLocked()
+}
+
+// resetLocked removes every segment and starts an empty log after lastLSN
+// Caller must hold w.mu
+func (w *WAL) resetLocked(lastLSN uint64) error {
+	if !w.readOnly {
+		if err := w.file.Close(); err != nil {
+			return fmt.Errorf("failed to close WAL segment: %w", err)
+		}
+
+		for _, seg := range w.segments {
+			if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove WAL segment: %w", err)
+			}
+		}
+	}
+	w.segments = nil
+	w.size = 0
+	w.lastLSN = lastLSN
+	w.durable = lastLSN
+	w.advanceLocked()
+
+	if w.readOnly {
+		return nil
+	}
+	return w.openSegmentLocked()
+}
+
+// advanceLocked wakes the goroutines waiting in durableLSN
+// Caller must hold w.mu
+func (w *WAL) advanceLocked() {
+	close(w.advanced)
+	w.advanced = make(chan struct{})
+}
+
+// durableLSN returns the LSN of the last durable entry and a channel that is
+// closed once that changes (or the WAL fails)
+func (w *WAL) durableLSN() (uint64, <-chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.durable, w.advanced
+}
+
+// reset discards every entry and continues the log after lastLSN, which may
+// be lower or higher than the current last LSN. Used when a follower installs
+// a snapshot from its leader
+func (w *WAL) reset(lastLSN uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.readOnly {
+		return ErrReadOnly
+	}
+	if err := w.drainLocked(); err != nil {
+		return err
+	}
+
+	if err := w.resetLocked(lastLSN); err != nil {
+		return fmt.Errorf("failed to reset WAL: %w", err)
 	}
 
 	return nil
@@ -127,6 +765,15 @@ func (w *WAL) Close() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
+	// A read-only log has no open file
+	if w.readOnly {
+		return nil
+	}
+
+	// Write entries still queued (ignoring a sticky failure, the file is
+	// closed either way)
+	w.drainLocked()
+
 	// Sync any remaining data to disk
 	if err := w.file.Sync(); err != nil {
 		return fmt.Errorf("failed to sync WAL on close: %w", err)
@@ -140,20 +787,72 @@ func (w *WAL) Close() error {
 	return nil
 }
 
-// Truncate clears the WAL file (called after successful snapshot)
+// Truncate clears the WAL (called after successful snapshot)
+// LSNs keep counting from where they were
 func (w *WAL) Truncate() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	// Truncate file to 0 bytes
-	if err := w.file.Truncate(0); err != nil {
+	if w.readOnly {
+		return ErrReadOnly
+	}
+	if err := w.drainLocked(); err != nil {
+		return err
+	}
+
+	if err := w.resetLocked(w.lastLSN); err != nil {
 		return fmt.Errorf("failed to truncate WAL: %w", err)
 	}
 
-	// Seek to beginning
-	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
-		return fmt.Errorf("failed to seek after truncate: %w", err)
+	return nil
+}
+
+// Size returns the number of bytes in the WAL
+func (w *WAL) Size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.size
+}
+
+// failure returns the write or sync error that stopped the WAL, if any
+func (w *WAL) failure() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.err
+}
+
+// LastLSN returns the LSN of the last entry appended to the WAL
+func (w *WAL) LastLSN() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.lastLSN
+}
+
+// RemoveBefore deletes the sealed segments whose entries all have an LSN
+// below lsn (called after a checkpoint covering them)
+// The active segment is never removed
+func (w *WAL) RemoveBefore(lsn uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.readOnly {
+		return ErrReadOnly
+	}
+
+	removed := 0
+	for removed+1 < len(w.segments) && w.segments[removed+1].firstLSN <= lsn {
+		seg := w.segments[removed]
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			w.segments = w.segments[removed:]
+			return fmt.Errorf("failed to remove WAL segment: %w", err)
+		}
+		w.size -= seg.size
+		removed++
 	}
+	w.segments = w.segments[removed:]
 
 	return nil
 }
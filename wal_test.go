@@ -2,6 +2,9 @@ package kvstore
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"os"
 	"path/filepath"
 	"sync"
@@ -26,6 +29,16 @@ func cleanupDir(t *testing.T, dir string) {
 	}
 }
 
+// walSegments returns the WAL segment files in dir ordered by first LSN
+func walSegments(t *testing.T, dir string) []segment {
+	t.Helper()
+	segments, err := listSegments(dir)
+	if err != nil {
+		t.Fatalf("Failed to list WAL segments: %v", err)
+	}
+	return segments
+}
+
 // TestWALCreate tests WAL file creation
 func TestWALCreate(t *testing.T) {
 	dir := createTempDir(t)
@@ -37,16 +50,15 @@ func TestWALCreate(t *testing.T) {
 	}
 	defer wal.Close()
 
-	// Verify WAL file exists
-	walPath := filepath.Join(dir, "wal.log")
-	info, err := os.Stat(walPath)
-	if err != nil {
-		t.Fatalf("WAL file does not exist: %v", err)
+	// Verify the first segment exists
+	segments := walSegments(t, dir)
+	if len(segments) != 1 || segments[0].firstLSN != 1 {
+		t.Fatalf("Expected a single segment starting at LSN 1, got %v", segments)
 	}
 
 	// Verify file is empty initially
-	if info.Size() != 0 {
-		t.Errorf("Expected empty WAL file, got size: %d", info.Size())
+	if segments[0].size != 0 {
+		t.Errorf("Expected empty WAL file, got size: %d", segments[0].size)
 	}
 }
 
@@ -67,8 +79,7 @@ func TestWALAppendSingle(t *testing.T) {
 	}
 
 	// Verify file size increased
-	walPath := filepath.Join(dir, "wal.log")
-	info, err := os.Stat(walPath)
+	info, err := os.Stat(segmentPath(dir, 1))
 	if err != nil {
 		t.Fatalf("Failed to stat WAL file: %v", err)
 	}
@@ -214,7 +225,7 @@ func TestWALCorruptionDetection(t *testing.T) {
 	}
 
 	// Manually corrupt the file (flip some bits in the middle)
-	walPath := filepath.Join(dir, "wal.log")
+	walPath := segmentPath(dir, 1)
 	data, err := os.ReadFile(walPath)
 	if err != nil {
 		t.Fatalf("Failed to read WAL file: %v", err)
@@ -277,14 +288,13 @@ func TestWALTruncate(t *testing.T) {
 		t.Fatalf("Truncate failed: %v", err)
 	}
 
-	// Verify file size is 0
-	walPath := filepath.Join(dir, "wal.log")
-	info, err := os.Stat(walPath)
-	if err != nil {
-		t.Fatalf("Failed to stat WAL file: %v", err)
+	// Verify a single empty segment remains, continuing the LSNs
+	segments := walSegments(t, dir)
+	if len(segments) != 1 || segments[0].size != 0 || segments[0].firstLSN != 11 {
+		t.Errorf("Expected one empty segment starting at LSN 11 after truncate, got %v", segments)
 	}
-	if info.Size() != 0 {
-		t.Errorf("Expected empty WAL after truncate, got size: %d", info.Size())
+	if wal.Size() != 0 {
+		t.Errorf("Expected empty WAL after truncate, got size: %d", wal.Size())
 	}
 
 	// Verify replay returns no entries
@@ -451,3 +461,464 @@ func TestWALRecoveryAfterCrash(t *testing.T) {
 		t.Errorf("Expected %d entries after crash recovery, got %d", len(entries), count)
 	}
 }
+
+// TestWALAssignsLSN tests that appended entries get consecutive LSNs that
+// survive a reopen
+func TestWALAssignsLSN(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	wal, err := NewWAL(dir, true)
+	if err != nil {
+		t.Fatalf("NewWAL failed: %v", err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		entry := NewSetEntry("key", []byte("value"))
+		if err := wal.Append(entry); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+		if entry.LSN != uint64(i) {
+			t.Errorf("Expected LSN %d, got %d", i, entry.LSN)
+		}
+	}
+
+	// An explicit LSN must be the next one
+	if err := wal.Append(&Entry{LSN: 10, Operation: OpDelete, Key: "key"}); err == nil {
+		t.Error("Expected error for out of order LSN")
+	}
+	if err := wal.Append(&Entry{LSN: 4, Operation: OpDelete, Key: "key"}); err != nil {
+		t.Fatalf("Append with next LSN failed: %v", err)
+	}
+	wal.Close()
+
+	wal2, err := NewWAL(dir, true)
+	if err != nil {
+		t.Fatalf("NewWAL (reopen) failed: %v", err)
+	}
+	defer wal2.Close()
+
+	if wal2.LastLSN() != 4 {
+		t.Errorf("Expected last LSN 4 after reopen, got %d", wal2.LastLSN())
+	}
+
+	var lsns []uint64
+	err = wal2.Replay(func(e *Entry) error {
+		lsns = append(lsns, e.LSN)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if len(lsns) != 4 || lsns[0] != 1 || lsns[3] != 4 {
+		t.Errorf("Expected LSNs 1..4, got %v", lsns)
+	}
+
+	entry := NewSetEntry("next", []byte("value"))
+	if err := wal2.Append(entry); err != nil {
+		t.Fatalf("Append after reopen failed: %v", err)
+	}
+	if entry.LSN != 5 {
+		t.Errorf("Expected LSN 5 after reopen, got %d", entry.LSN)
+	}
+}
+
+// TestWALRotation tests that segments are sealed at the size limit and that
+// replay reads across them
+func TestWALRotation(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	wal, err := NewWAL(dir, false)
+	if err != nil {
+		t.Fatalf("NewWAL failed: %v", err)
+	}
+	defer wal.Close()
+	wal.maxSegmentBytes = 256
+
+	for i := 0; i < 50; i++ {
+		if err := wal.Append(NewSetEntry(fmt.Sprintf("key-%d", i), []byte("value"))); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+
+	segments := walSegments(t, dir)
+	if len(segments) < 3 {
+		t.Fatalf("Expected several segments, got %d", len(segments))
+	}
+
+	var total int64
+	for i, seg := range segments {
+		total += seg.size
+		if i > 0 && seg.firstLSN <= segments[i-1].firstLSN {
+			t.Errorf("Segments out of order: %v", segments)
+		}
+	}
+	if total != wal.Size() {
+		t.Errorf("Size mismatch: files %d, tracked %d", total, wal.Size())
+	}
+
+	count := 0
+	err = wal.ReplayFrom(21, func(e *Entry) error {
+		if e.LSN != uint64(21+count) {
+			t.Errorf("Expected LSN %d, got %d", 21+count, e.LSN)
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ReplayFrom failed: %v", err)
+	}
+	if count != 30 {
+		t.Errorf("Expected 30 entries from LSN 21, got %d", count)
+	}
+}
+
+// TestWALRemoveBefore tests discarding segments covered by a checkpoint
+func TestWALRemoveBefore(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	wal, err := NewWAL(dir, true)
+	if err != nil {
+		t.Fatalf("NewWAL failed: %v", err)
+	}
+	defer wal.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := wal.Append(NewSetEntry("old", []byte("value"))); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	if err := wal.Rotate(); err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	if err := wal.Append(NewSetEntry("new", []byte("value"))); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+
+	// LSN 3 is not covered, so nothing can go yet
+	if err := wal.RemoveBefore(3); err != nil {
+		t.Fatalf("RemoveBefore failed: %v", err)
+	}
+	if n := len(walSegments(t, dir)); n != 2 {
+		t.Fatalf("Expected 2 segments, got %d", n)
+	}
+
+	if err := wal.RemoveBefore(4); err != nil {
+		t.Fatalf("RemoveBefore failed: %v", err)
+	}
+
+	// The active segment stays even when fully covered
+	if err := wal.RemoveBefore(100); err != nil {
+		t.Fatalf("RemoveBefore failed: %v", err)
+	}
+
+	segments := walSegments(t, dir)
+	if len(segments) != 1 || segments[0].firstLSN != 4 {
+		t.Fatalf("Expected only the segment starting at LSN 4, got %v", segments)
+	}
+	if segments[0].size != wal.Size() {
+		t.Errorf("Size mismatch: file %d, tracked %d", segments[0].size, wal.Size())
+	}
+
+	var keys []string
+	err = wal.Replay(func(e *Entry) error {
+		keys = append(keys, e.Key)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if len(keys) != 1 || keys[0] != "new" {
+		t.Errorf("Expected only entries after LSN 3, got %v", keys)
+	}
+}
+
+// TestWALTornTailContinues tests that entries appended after a torn write
+// are replayed once the log is reopened
+func TestWALTornTailContinues(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	wal, err := NewWAL(dir, true)
+	if err != nil {
+		t.Fatalf("NewWAL failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		wal.Append(NewSetEntry(fmt.Sprintf("key-%d", i), []byte("value")))
+	}
+	wal.Close()
+
+	// Cut the last entry in half
+	path := segmentPath(dir, 1)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read segment: %v", err)
+	}
+	if err := os.WriteFile(path, data[:len(data)-5], 0644); err != nil {
+		t.Fatalf("Failed to write torn segment: %v", err)
+	}
+
+	wal2, err := NewWAL(dir, true)
+	if err != nil {
+		t.Fatalf("NewWAL (reopen) failed: %v", err)
+	}
+	entry := NewSetEntry("after", []byte("value"))
+	if err := wal2.Append(entry); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if entry.LSN != 3 {
+		t.Errorf("Expected the torn entry's LSN to be reused, got %d", entry.LSN)
+	}
+	wal2.Close()
+
+	wal3, err := NewWAL(dir, true)
+	if err != nil {
+		t.Fatalf("NewWAL (reopen) failed: %v", err)
+	}
+	defer wal3.Close()
+
+	var keys []string
+	err = wal3.Replay(func(e *Entry) error {
+		keys = append(keys, e.Key)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if len(keys) != 3 || keys[2] != "after" {
+		t.Errorf("Expected key-0, key-1, after; got %v", keys)
+	}
+}
+
+// TestWALReplayGap tests that replay stops at missing entries and that the
+// unreachable segments are set aside
+func TestWALReplayGap(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	wal, err := NewWAL(dir, true)
+	if err != nil {
+		t.Fatalf("NewWAL failed: %v", err)
+	}
+	for i := 0; i < 6; i++ {
+		wal.Append(NewSetEntry("key", []byte("value")))
+		if i%2 == 1 {
+			wal.Rotate()
+		}
+	}
+	wal.Close()
+
+	// Lose the middle segment (LSN 3-4)
+	if err := os.Remove(segmentPath(dir, 3)); err != nil {
+		t.Fatalf("Failed to remove segment: %v", err)
+	}
+
+	wal2, err := NewWAL(dir, true)
+	if err != nil {
+		t.Fatalf("NewWAL (reopen) failed: %v", err)
+	}
+
+	count := 0
+	err = wal2.Replay(func(e *Entry) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 entries before the gap, got %d", count)
+	}
+
+	entry := NewSetEntry("next", []byte("value"))
+	if err := wal2.Append(entry); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if entry.LSN != 3 {
+		t.Errorf("Expected appends to continue at LSN 3, got %d", entry.LSN)
+	}
+	wal2.Close()
+
+	if _, err := os.Stat(segmentPath(dir, 5) + ".corrupt"); err != nil {
+		t.Errorf("Expected unreachable segment to be set aside: %v", err)
+	}
+}
+
+// TestWALLegacyMigration tests that a single-file WAL from before segments
+// and LSNs is replayed and numbered
+func TestWALLegacyMigration(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	// Write v1 entries (no LSN) by hand
+	var buf bytes.Buffer
+	for _, key := range []string{"a", "b"} {
+		var data bytes.Buffer
+		binary.Write(&data, binary.BigEndian, entryMagicV1)
+		binary.Write(&data, binary.BigEndian, OpSet)
+		binary.Write(&data, binary.BigEndian, int64(0))
+		binary.Write(&data, binary.BigEndian, uint32(len(key)))
+		data.WriteString(key)
+		binary.Write(&data, binary.BigEndian, uint32(1))
+		data.WriteString("v")
+		buf.Write(data.Bytes())
+		binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(data.Bytes()))
+	}
+	if err := os.WriteFile(filepath.Join(dir, legacyWALFilename), buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write legacy WAL: %v", err)
+	}
+
+	wal, err := NewWAL(dir, true)
+	if err != nil {
+		t.Fatalf("NewWAL failed: %v", err)
+	}
+	defer wal.Close()
+
+	if _, err := os.Stat(filepath.Join(dir, legacyWALFilename)); !os.IsNotExist(err) {
+		t.Error("Expected legacy WAL to be migrated")
+	}
+
+	var lsns []uint64
+	err = wal.Replay(func(e *Entry) error {
+		lsns = append(lsns, e.LSN)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if len(lsns) != 2 || lsns[0] != 1 || lsns[1] != 2 {
+		t.Errorf("Expected LSNs [1 2], got %v", lsns)
+	}
+
+	entry := NewSetEntry("c", []byte("v"))
+	if err := wal.Append(entry); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if entry.LSN != 3 {
+		t.Errorf("Expected LSN 3, got %d", entry.LSN)
+	}
+}
+
+// TestWALGroupCommit tests that concurrent appends are all durable and
+// numbered without gaps
+func TestWALGroupCommit(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	wal, err := NewWAL(dir, true)
+	if err != nil {
+		t.Fatalf("NewWAL failed: %v", err)
+	}
+
+	const writers = 16
+	const perWriter = 50
+
+	var wg sync.WaitGroup
+	for g := 0; g < writers; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				entry := NewSetEntry("key", []byte("value"))
+				if err := wal.Append(entry); err != nil {
+					t.Errorf("Append failed: %v", err)
+					return
+				}
+				wal.mu.Lock()
+				durable := wal.durable
+				wal.mu.Unlock()
+				if durable < entry.LSN {
+					t.Errorf("Append returned before LSN %d was durable", entry.LSN)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	wal.Close()
+
+	wal2, err := NewWAL(dir, true)
+	if err != nil {
+		t.Fatalf("NewWAL (reopen) failed: %v", err)
+	}
+	defer wal2.Close()
+
+	var next uint64 = 1
+	err = wal2.Replay(func(e *Entry) error {
+		if e.LSN != next {
+			t.Errorf("Expected LSN %d, got %d", next, e.LSN)
+		}
+		next++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if next-1 != writers*perWriter {
+		t.Errorf("Expected %d entries, got %d", writers*perWriter, next-1)
+	}
+}
+
+// TestWALFailureIsSticky tests that a failed write fails every later append
+func TestWALFailureIsSticky(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	wal, err := NewWAL(dir, true)
+	if err != nil {
+		t.Fatalf("NewWAL failed: %v", err)
+	}
+
+	// Closing the file underneath the WAL makes the next write fail
+	wal.file.Close()
+
+	if err := wal.Append(NewSetEntry("key", []byte("value"))); err == nil {
+		t.Fatal("Expected error writing to a closed file")
+	}
+	if err := wal.Append(NewSetEntry("key", []byte("value"))); err == nil {
+		t.Error("Expected later appends to fail too")
+	}
+}
+
+// BenchmarkWALAppend compares concurrent synchronous appends that each pay
+// for their own fsync (as when appends are serialized by a lock) with group
+// commit, where concurrent appends share one
+func BenchmarkWALAppend(b *testing.B) {
+	value := bytes.Repeat([]byte("v"), 100)
+
+	run := func(b *testing.B, append func(w *WAL) error) {
+		dir := b.TempDir()
+		wal, err := NewWAL(dir, true)
+		if err != nil {
+			b.Fatalf("NewWAL failed: %v", err)
+		}
+		defer wal.Close()
+
+		b.SetParallelism(8)
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if err := append(wal); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	}
+
+	b.Run("serialized", func(b *testing.B) {
+		var mu sync.Mutex
+		run(b, func(w *WAL) error {
+			mu.Lock()
+			defer mu.Unlock()
+			return w.Append(NewSetEntry("key", value))
+		})
+	})
+
+	b.Run("group", func(b *testing.B) {
+		run(b, func(w *WAL) error {
+			return w.Append(NewSetEntry("key", value))
+		})
+	})
+}
@@ -0,0 +1,353 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// defaultWatchBuffer is the number of events held for a watcher that falls
+// behind when WatchOptions.Buffer is not set
+const defaultWatchBuffer = 256
+
+// ErrCompacted is returned when a watch needs changes that a checkpoint
+// already removed from the WAL, or that were replaced by a snapshot received
+// from a leader
+var ErrCompacted = errors.New("changes are no longer in the WAL")
+
+// Event is one change to a key
+type Event struct {
+	Op        byte // OpSet, OpSetTTL, OpExpire or OpDelete
+	Key       string
+	Value     []byte // new value for OpSet and OpSetTTL, must not be modified
+	ExpiresAt int64  // expiry set by OpSetTTL or OpExpire (unix nanoseconds, 0 for none)
+	Seq       uint64 // LSN of the write; the operations of a batch share it
+	Timestamp int64  // when the write was made (unix nanoseconds)
+}
+
+// WatchOptions controls where a watch starts and how far it may fall behind
+type WatchOptions struct {
+	// From is the sequence number of the first write to report. Writes
+	// already applied are read back from the WAL, which must still hold
+	// them. 0 starts with the next write
+	From uint64
+
+	// Buffer is the number of events held while the consumer is busy
+	// (default: 256). A watcher that falls further behind stops buffering
+	// and continues from the WAL instead, so writers never wait for it
+	Buffer int
+}
+
+// Watcher delivers the changes to keys under a prefix, in the order they
+// were applied
+type Watcher struct {
+	s      *Store
+	prefix string
+	buffer int
+	events chan Event
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	tail   *walTail // open while catching up from the WAL
+
+	mu      sync.Mutex
+	pending []Event       // buffered live events
+	notify  chan struct{} // buffered, wakes the watcher when pending grows
+	lagged  bool          // events from resume on must come from the WAL
+	resume  uint64
+	reset   error // set when the changes cannot be followed any more
+	err     error // why the watch ended
+}
+
+// Watch reports every change to keys starting with prefix once it is durable
+// and visible, until ctx is done, Close is called or the store closes
+// Resuming after the last Seq received (From = Seq+1) continues without gaps
+// or repeats, as long as the WAL still holds the writes in between
+func (s *Store) Watch(ctx context.Context, prefix string, opts WatchOptions) (*Watcher, error) {
+	buffer := opts.Buffer
+	if buffer <= 0 {
+		buffer = defaultWatchBuffer
+	}
+
+	w := &Watcher{
+		s:      s,
+		prefix: prefix,
+		buffer: buffer,
+		events: make(chan Event),
+		done:   make(chan struct{}),
+		notify: make(chan struct{}, 1),
+	}
+	w.ctx, w.cancel = context.WithCancel(ctx)
+
+	s.mu.Lock()
+	if s.stopped() {
+		s.mu.Unlock()
+		w.cancel()
+		return nil, ErrClosed
+	}
+	if opts.From > s.seq+1 {
+		s.mu.Unlock()
+		w.cancel()
+		return nil, fmt.Errorf("cannot watch from sequence %d, the last one is %d", opts.From, s.seq)
+	}
+	if opts.From > 0 && opts.From <= s.seq {
+		tail, err := s.wal.tail(opts.From)
+		if err != nil {
+			s.mu.Unlock()
+			w.cancel()
+			return nil, walError(err)
+		}
+		w.tail = tail
+		w.lagged, w.resume = true, opts.From
+	}
+	s.watchers[w] = struct{}{}
+	s.mu.Unlock()
+
+	if !s.goTask(w.run) {
+		w.finish(ErrClosed)
+		return nil, ErrClosed
+	}
+	return w, nil
+}
+
+// Events returns the channel of changes. It is closed when the watch ends
+func (w *Watcher) Events() <-chan Event {
+	return w.events
+}
+
+// Err returns why the watch ended: the context's error, ErrClosed when the
+// store closed, ErrCompacted when the changes could not be followed. It is
+// nil while the watch runs
+func (w *Watcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.err
+}
+
+// Close ends the watch and waits until the events channel is closed
+func (w *Watcher) Close() {
+	w.cancel()
+	<-w.done
+}
+
+// run delivers events, switching between buffered live events and the WAL
+// whenever the consumer falls behind
+func (w *Watcher) run() {
+	for {
+		resume, err := w.live()
+		if err == nil {
+			err = w.catchUp(resume)
+		}
+		if err != nil {
+			w.finish(err)
+			return
+		}
+	}
+}
+
+// live delivers buffered events until the watcher lags behind. Returns the
+// sequence number to continue from in the WAL
+func (w *Watcher) live() (uint64, error) {
+	for {
+		w.mu.Lock()
+		events := w.pending
+		w.pending = nil
+		lagged, resume, reset := w.lagged, w.resume, w.reset
+		w.mu.Unlock()
+
+		for _, event := range events {
+			if err := w.send(event); err != nil {
+				return 0, err
+			}
+		}
+		if reset != nil {
+			return 0, reset
+		}
+		if lagged {
+			return resume, nil
+		}
+		if len(events) > 0 {
+			continue
+		}
+
+		select {
+		case <-w.notify:
+		case <-w.ctx.Done():
+			return 0, w.ctx.Err()
+		case <-w.s.stop:
+			return 0, ErrClosed
+		}
+	}
+}
+
+// catchUp delivers the changes from the WAL starting at next, until it
+// reaches the last applied write and live events take over
+func (w *Watcher) catchUp(next uint64) error {
+	if w.tail == nil {
+		tail, err := w.s.wal.tail(next)
+		if err != nil {
+			return walError(err)
+		}
+		w.tail = tail
+	}
+	defer func() {
+		w.tail.close()
+		w.tail = nil
+	}()
+
+	for {
+		// Writes are applied (and published) under s.mu, so none is missed
+		// or repeated when the watcher switches back
+		w.s.mu.Lock()
+		upto := w.s.seq
+		if w.tail.next > upto {
+			w.mu.Lock()
+			w.lagged = false
+			reset := w.reset
+			w.mu.Unlock()
+			w.s.mu.Unlock()
+			return reset
+		}
+		w.s.mu.Unlock()
+
+		err := w.tail.read(upto, func(entry *Entry) error {
+			ops := []*Entry{entry}
+			if entry.Operation == OpBatch {
+				var err error
+				if ops, err = entry.BatchEntries(); err != nil {
+					return fmt.Errorf("failed to decode batch: %w", err)
+				}
+			}
+			for _, event := range entryEvents(entry, ops, w.prefix) {
+				if err := w.send(event); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return walError(err)
+		}
+	}
+}
+
+// send hands an event to the consumer
+func (w *Watcher) send(event Event) error {
+	select {
+	case w.events <- event:
+		return nil
+	case <-w.ctx.Done():
+		return w.ctx.Err()
+	case <-w.s.stop:
+		return ErrClosed
+	}
+}
+
+// finish unregisters the watcher and closes its channel
+func (w *Watcher) finish(err error) {
+	w.s.mu.Lock()
+	delete(w.s.watchers, w)
+	w.s.mu.Unlock()
+
+	if w.tail != nil {
+		w.tail.close()
+	}
+
+	w.mu.Lock()
+	w.err = err
+	w.mu.Unlock()
+
+	w.cancel()
+	close(w.events)
+	close(w.done)
+}
+
+// publish buffers the events of an applied entry. A watcher that would
+// exceed its buffer switches to reading the WAL from this entry on
+// Caller must hold s.mu
+func (w *Watcher) publish(entry *Entry, ops []*Entry) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.lagged || w.reset != nil {
+		return
+	}
+
+	events := entryEvents(entry, ops, w.prefix)
+	if len(events) == 0 {
+		return
+	}
+	if len(w.pending)+len(events) > w.buffer {
+		w.lagged, w.resume = true, entry.LSN
+	} else {
+		w.pending = append(w.pending, events...)
+	}
+
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// publishLocked passes an applied entry to every watcher
+// Caller must hold s.mu
+func (s *Store) publishLocked(entry *Entry, ops []*Entry) {
+	for w := range s.watchers {
+		w.publish(entry, ops)
+	}
+}
+
+// resetWatchersLocked ends every watch after the state was replaced without
+// going through the WAL (a snapshot received from a leader)
+// Caller must hold s.mu
+func (s *Store) resetWatchersLocked() {
+	for w := range s.watchers {
+		w.mu.Lock()
+		w.reset = ErrCompacted
+		w.mu.Unlock()
+
+		select {
+		case w.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// entryEvents returns the events for the operations of an entry on keys
+// under prefix
+func entryEvents(entry *Entry, ops []*Entry, prefix string) []Event {
+	var events []Event
+	for _, op := range ops {
+		if !strings.HasPrefix(op.Key, prefix) {
+			continue
+		}
+
+		event := Event{
+			Op:        op.Operation,
+			Key:       op.Key,
+			Seq:       entry.LSN,
+			Timestamp: entry.Timestamp,
+		}
+		switch op.Operation {
+		case OpSet:
+			event.Value = op.Value
+		case OpSetTTL:
+			event.ExpiresAt, event.Value, _ = decodeTTLValue(op.Value)
+		case OpExpire:
+			event.ExpiresAt, _, _ = decodeTTLValue(op.Value)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// walError maps a failure to read the WAL to the error reported to watchers
+func walError(err error) error {
+	if errors.Is(err, errEntriesRemoved) {
+		return ErrCompacted
+	}
+	return err
+}
@@ -0,0 +1,246 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// nextEvent receives one event or fails after a second
+func nextEvent(t *testing.T, w *Watcher) Event {
+	t.Helper()
+
+	select {
+	case event, ok := <-w.Events():
+		if !ok {
+			t.Fatalf("Watch ended early: %v", w.Err())
+		}
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for an event")
+		return Event{}
+	}
+}
+
+// waitEnded waits for the events channel to close and returns Err
+func waitEnded(t *testing.T, w *Watcher) error {
+	t.Helper()
+
+	for {
+		select {
+		case _, ok := <-w.Events():
+			if !ok {
+				return w.Err()
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for the watch to end")
+		}
+	}
+}
+
+// TestWatchEvents tests that changes under the prefix are reported in order
+func TestWatchEvents(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := OpenWithConfig(Config{DataDir: dir, SyncWrites: true, ExpireInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	w, err := store.Watch(context.Background(), "user:", WatchOptions{})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	defer w.Close()
+
+	store.Set("user:1", []byte("alice"))
+	store.Set("order:1", []byte("ignored"))
+	store.SetWithTTL("user:2", []byte("bob"), time.Hour)
+	store.Delete("user:1")
+	store.Batch(func(b *WriteBatch) error {
+		b.Put("user:3", []byte("carol"))
+		b.Put("order:2", []byte("ignored"))
+		b.Delete("user:2")
+		return nil
+	})
+
+	want := []struct {
+		op    byte
+		key   string
+		value string
+	}{
+		{OpSet, "user:1", "alice"},
+		{OpSetTTL, "user:2", "bob"},
+		{OpDelete, "user:1", ""},
+		{OpSet, "user:3", "carol"},
+		{OpDelete, "user:2", ""},
+	}
+
+	var events []Event
+	for i, expected := range want {
+		event := nextEvent(t, w)
+		events = append(events, event)
+		if event.Op != expected.op || event.Key != expected.key || string(event.Value) != expected.value {
+			t.Errorf("Event %d: expected %v, got op %d key %s value %q", i, expected, event.Op, event.Key, event.Value)
+		}
+		if event.Timestamp == 0 {
+			t.Errorf("Event %d has no timestamp", i)
+		}
+	}
+
+	if events[1].ExpiresAt == 0 {
+		t.Error("SetWithTTL event should carry the expiry")
+	}
+	if events[0].Seq >= events[1].Seq || events[1].Seq >= events[2].Seq {
+		t.Errorf("Sequence numbers should increase, got %d %d %d", events[0].Seq, events[1].Seq, events[2].Seq)
+	}
+	if events[3].Seq != events[4].Seq {
+		t.Errorf("Batch operations should share a sequence number, got %d and %d", events[3].Seq, events[4].Seq)
+	}
+}
+
+// TestWatchResume tests starting a watch from a sequence number in the WAL
+func TestWatchResume(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	for i := 1; i <= 5; i++ {
+		store.Set(fmt.Sprintf("key%d", i), []byte("v"))
+	}
+
+	w, err := store.Watch(context.Background(), "", WatchOptions{From: 3})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	defer w.Close()
+
+	store.Set("key6", []byte("v"))
+	for i := 3; i <= 6; i++ {
+		event := nextEvent(t, w)
+		if event.Seq != uint64(i) || event.Key != fmt.Sprintf("key%d", i) {
+			t.Errorf("Expected key%d at %d, got %s at %d", i, i, event.Key, event.Seq)
+		}
+	}
+
+	if _, err := store.Watch(context.Background(), "", WatchOptions{From: 10}); err == nil {
+		t.Error("Watching from a future sequence number should fail")
+	}
+}
+
+// TestWatchSlowConsumer tests that writers do not wait for a watcher that
+// fell behind, and that it still sees every change
+func TestWatchSlowConsumer(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	w, err := store.Watch(context.Background(), "", WatchOptions{Buffer: 4})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	defer w.Close()
+
+	// Nothing is read while these are written
+	for i := 0; i < 100; i++ {
+		if err := store.Set(fmt.Sprintf("key%03d", i), []byte("v")); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		event := nextEvent(t, w)
+		if event.Key != fmt.Sprintf("key%03d", i) || event.Seq != uint64(i+1) {
+			t.Fatalf("Expected key%03d at %d, got %s at %d", i, i+1, event.Key, event.Seq)
+		}
+	}
+
+	// Back to live events
+	store.Set("live", []byte("v"))
+	if event := nextEvent(t, w); event.Key != "live" {
+		t.Errorf("Expected the live event, got %s", event.Key)
+	}
+}
+
+// TestWatchCompacted tests resuming from writes a checkpoint removed
+func TestWatchCompacted(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	store.Set("a", []byte("1"))
+	store.Set("b", []byte("2"))
+	if err := store.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+
+	if _, err := store.Watch(context.Background(), "", WatchOptions{From: 1}); !errors.Is(err, ErrCompacted) {
+		t.Errorf("Expected ErrCompacted, got %v", err)
+	}
+
+	// Starting after the checkpoint works
+	w, err := store.Watch(context.Background(), "", WatchOptions{From: 3})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	defer w.Close()
+	store.Set("c", []byte("3"))
+	if event := nextEvent(t, w); event.Key != "c" || event.Seq != 3 {
+		t.Errorf("Expected c at 3, got %s at %d", event.Key, event.Seq)
+	}
+}
+
+// TestWatchEnds tests the ways a watch ends
+func TestWatchEnds(t *testing.T) {
+	dir := createTempDir(t)
+	defer cleanupDir(t, dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled, err := store.Watch(ctx, "", WatchOptions{})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	cancel()
+	if err := waitEnded(t, cancelled); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	open, err := store.Watch(context.Background(), "", WatchOptions{})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := waitEnded(t, open); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+
+	if _, err := store.Watch(context.Background(), "", WatchOptions{}); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed after Close, got %v", err)
+	}
+}